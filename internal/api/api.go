@@ -0,0 +1,214 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// shutdownTimeout specifies how long to wait for active requests on shutdown
+const shutdownTimeout = 5 * time.Second
+
+// Server serves HTTP endpoints of the scheduler
+type Server struct {
+	// ClientName is the effective client name of the scheduler instance
+	ClientName string
+	// OnlyTags and ExcludeTags are the tag filters of chain configurations handled by the scheduler
+	OnlyTags, ExcludeTags []string
+	// StartedAt is the process start time
+	StartedAt time.Time
+	// LastTick returns the time of the latest scheduler main loop iteration
+	LastTick func() time.Time
+	// LastRefresh returns the time chains were re-read from the database last time, may be nil
+	LastRefresh func() time.Time
+	// RunningTasks returns the number of tasks being executed right now, may be nil
+	RunningTasks func() int
+	// StartedRuns returns the number of chain runs started since the process start, may be nil
+	StartedRuns func() int64
+	// SkippedRuns returns the number of chain runs not started when due by skip reason, may be nil
+	SkippedRuns func() map[string]int64
+	// NextRunTimes returns the next scheduled start by chain configuration ID of time based chains, may be nil
+	NextRunTimes func() (map[int]time.Time, error)
+	// DroppedLogs returns the number of log entries not written to the database since the process start, may be nil
+	DroppedLogs func() int64
+	// LoopRestarts returns the number of main loop restarts after failures since the process start, may be nil
+	LoopRestarts func() int64
+	// MaxTickAge specifies how old the latest tick may be for the scheduler to be healthy
+	MaxTickAge time.Duration
+	// SchemaExists returns error if the configuration schema is not available
+	SchemaExists func() error
+	// RunChain starts the chain configuration immediately and returns run status ID
+	RunChain func(chainConfigID int) (int, error)
+	// PauseChain pauses or resumes the chain configuration, may be nil
+	PauseChain func(chainConfigID int, paused bool) error
+	// CancelRun cancels the chain run executed by the scheduler, may be nil
+	CancelRun func(runStatusID int) error
+	// Paused returns true if starting of new chains is suppressed, may be nil
+	Paused func() bool
+	// SetPaused suppresses or resumes starting of new chains, may be nil
+	SetPaused func(paused bool)
+	// ChainStates returns chain configurations handled by the scheduler, nil disables the read-only API
+	ChainStates func() ([]pgengine.ChainState, error)
+	// ActiveRuns returns the chain runs executed by the scheduler, may be nil
+	ActiveRuns func() []pgengine.RunningChain
+	// RunHistory returns runs of the chain configuration started within the duration, newest first, may be nil
+	RunHistory func(chainConfigID int, since time.Duration) ([]pgengine.RunRecord, error)
+	// Token is the bearer token required by endpoints changing the scheduler state, empty value disables them
+	Token string
+	// ReadToken is the bearer token allowed to use the read-only API only, Token is accepted there as well.
+	// The read-only API is disabled if both are empty
+	ReadToken string
+}
+
+type status struct {
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	ClientName  string    `json:"client_name"`
+	StartedAt   time.Time `json:"started_at"`
+	Uptime      string    `json:"uptime"`
+	LastTick    time.Time `json:"last_tick"`
+	LastRefresh time.Time `json:"last_refresh"`
+	Paused      bool      `json:"paused"`
+	OnlyTags    []string  `json:"only_tags"`
+	ExcludeTags []string  `json:"exclude_tags"`
+	NextRun     *nextRun  `json:"next_run"`
+}
+
+// Handler returns HTTP handler with all endpoints registered
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.HandleFunc("/metrics", s.metrics)
+	if s.Token != "" && (s.RunChain != nil || s.PauseChain != nil) {
+		mux.HandleFunc("/chains/", s.authorized(s.chains))
+	}
+	if s.Token != "" && s.CancelRun != nil {
+		mux.HandleFunc("/runs/", s.authorized(s.cancelRun))
+	}
+	if s.Token != "" && s.SetPaused != nil {
+		mux.HandleFunc("/pause", s.authorized(s.setPaused(true)))
+		mux.HandleFunc("/resume", s.authorized(s.setPaused(false)))
+	}
+	if (s.Token != "" || s.ReadToken != "") && s.ChainStates != nil {
+		mux.HandleFunc("/api/chains", s.readAuthorized(s.state))
+		mux.HandleFunc("/api/chains/", s.readAuthorized(s.state))
+	}
+	return mux
+}
+
+// ListenAndServe serves HTTP endpoints on addr until ctx is cancelled, active requests are finished before return
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s.Handler()}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	pgengine.LogToDB("LOG", "Serving health checks and metrics on ", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
+}
+
+// checkHealth returns error if the configuration database is not reachable or the scheduler is stuck
+func (s *Server) checkHealth() error {
+	if pgengine.ConfigDb() == nil {
+		return errors.New("Configuration database is not connected")
+	}
+	if err := pgengine.ConfigDb().Ping(); err != nil {
+		return err
+	}
+	if age := time.Since(s.LastTick()); age > s.MaxTickAge {
+		return fmt.Errorf("Scheduler loop has not ticked for %s", age.Truncate(time.Second))
+	}
+	return nil
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	s.writeStatus(w, s.checkHealth())
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	err := s.checkHealth()
+	if err == nil {
+		err = s.SchemaExists()
+	}
+	s.writeStatus(w, err)
+}
+
+func (s *Server) lastRefresh() time.Time {
+	if s.LastRefresh == nil {
+		return time.Unix(0, 0)
+	}
+	return s.LastRefresh()
+}
+
+func (s *Server) paused() bool {
+	return s.Paused != nil && s.Paused()
+}
+
+// nextRun is the earliest scheduled start of all time based chains handled by the scheduler
+type nextRun struct {
+	ChainConfig int       `json:"chain_execution_config"`
+	Time        time.Time `json:"time"`
+}
+
+// nextRuns returns the next scheduled starts sorted by time, nil if they are not available
+func (s *Server) nextRuns() []nextRun {
+	if s.NextRunTimes == nil {
+		return nil
+	}
+	next, err := s.NextRunTimes()
+	if err != nil {
+		return nil
+	}
+	runs := make([]nextRun, 0, len(next))
+	for id, t := range next {
+		runs = append(runs, nextRun{id, t})
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].Time.Equal(runs[j].Time) {
+			return runs[i].ChainConfig < runs[j].ChainConfig
+		}
+		return runs[i].Time.Before(runs[j].Time)
+	})
+	return runs
+}
+
+func (s *Server) writeStatus(w http.ResponseWriter, err error) {
+	st := status{
+		Status:      "ok",
+		ClientName:  s.ClientName,
+		StartedAt:   s.StartedAt,
+		Uptime:      time.Since(s.StartedAt).Truncate(time.Second).String(),
+		LastTick:    s.LastTick(),
+		LastRefresh: s.lastRefresh(),
+		Paused:      s.paused(),
+		OnlyTags:    s.OnlyTags,
+		ExcludeTags: s.ExcludeTags,
+	}
+	if runs := s.nextRuns(); len(runs) > 0 {
+		st.NextRun = &runs[0]
+	}
+	code := http.StatusOK
+	if err != nil {
+		st.Status = "unavailable"
+		st.Error = err.Error()
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,325 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthChecks(t *testing.T) {
+	s := &Server{
+		ClientName:   "worker01",
+		OnlyTags:     []string{"etl", "reporting"},
+		ExcludeTags:  []string{"heavy"},
+		StartedAt:    time.Now().Add(-time.Hour),
+		LastTick:     time.Now,
+		LastRefresh:  time.Now,
+		MaxTickAge:   time.Minute,
+		SchemaExists: func() error { return nil },
+		NextRunTimes: func() (map[int]time.Time, error) {
+			return map[int]time.Time{3: time.Unix(1700000600, 0), 1: time.Unix(1700000060, 0)}, nil
+		},
+	}
+	h := s.Handler()
+	for _, endpoint := range []string{"/healthz", "/readyz"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", endpoint, nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "Should fail without database connection")
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		var st status
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &st), "Response should be valid JSON")
+		assert.Equal(t, "unavailable", st.Status)
+		assert.NotEmpty(t, st.Error, "Error should be reported")
+		assert.Equal(t, "worker01", st.ClientName, "Client name should be reported")
+		assert.Equal(t, "1h0m0s", st.Uptime, "Uptime should be reported")
+		assert.False(t, st.LastTick.IsZero(), "Last tick should be reported")
+		assert.False(t, st.LastRefresh.IsZero(), "Last refresh should be reported")
+		assert.Equal(t, []string{"etl", "reporting"}, st.OnlyTags, "Tag filter should be reported")
+		assert.Equal(t, []string{"heavy"}, st.ExcludeTags, "Excluded tags should be reported")
+		if assert.NotNil(t, st.NextRun, "Next run should be reported") {
+			assert.Equal(t, 1, st.NextRun.ChainConfig, "The earliest next run should be reported")
+			assert.True(t, st.NextRun.Time.Equal(time.Unix(1700000060, 0)))
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := &Server{ClientName: "worker01", StartedAt: time.Now().Add(-time.Minute), LastTick: time.Now,
+		RunningTasks: func() int { return 3 }, StartedRuns: func() int64 { return 7 },
+		SkippedRuns: func() map[string]int64 { return map[string]int64{"throttled": 2, "capacity": 0} },
+		DroppedLogs: func() int64 { return 5 }, LoopRestarts: func() int64 { return 2 },
+		NextRunTimes: func() (map[int]time.Time, error) {
+			return map[int]time.Time{3: time.Unix(1700000060, 0), 1: time.Unix(1700000600, 0)}, nil
+		}}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.True(t, strings.Contains(body, "pg_timetable_info{client_name=\"worker01\"} 1\n"), "Client name should be exposed")
+	assert.True(t, strings.Contains(body, "pg_timetable_uptime_seconds 60\n"), "Uptime should be exposed")
+	assert.True(t, strings.Contains(body, "pg_timetable_last_refresh_timestamp_seconds 0\n"),
+		"Last refresh should be exposed even if unknown")
+	assert.True(t, strings.Contains(body, "pg_timetable_running_tasks 3\n"), "Running tasks should be exposed")
+	assert.True(t, strings.Contains(body, "# TYPE pg_timetable_remote_db_open_connections gauge\n"),
+		"Remote pool metrics should be declared even if pool is empty")
+	assert.True(t, strings.Contains(body, "pg_timetable_chain_runs_started_total 7\n"), "Started runs should be exposed")
+	assert.True(t, strings.Contains(body, "pg_timetable_chain_runs_skipped_total{reason=\"capacity\"} 0\n"+
+		"pg_timetable_chain_runs_skipped_total{reason=\"throttled\"} 2\n"), "Skipped runs should be exposed by reason")
+	assert.True(t, strings.Contains(body, "pg_timetable_log_entries_dropped_total 5\n"), "Dropped log entries should be exposed")
+	assert.True(t, strings.Contains(body, "pg_timetable_scheduler_restarts_total 2\n"), "Loop restarts should be exposed")
+	assert.True(t, strings.Contains(body, "pg_timetable_chain_next_run_timestamp_seconds{chain_execution_config=\"1\"} 1700000600\n"+
+		"pg_timetable_chain_next_run_timestamp_seconds{chain_execution_config=\"3\"} 1700000060\n"),
+		"Next runs should be exposed by chain configuration")
+}
+
+func TestListenAndServeShutdown(t *testing.T) {
+	s := &Server{StartedAt: time.Now(), LastTick: time.Now}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() { errCh <- s.ListenAndServe(ctx, "127.0.0.1:0") }()
+	cancel()
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err, "Server should stop without error on context cancel")
+	case <-time.After(shutdownTimeout + time.Second):
+		t.Fatal("Server should stop on context cancel")
+	}
+}
+
+func TestRunChain(t *testing.T) {
+	s := &Server{StartedAt: time.Now(), LastTick: time.Now, Token: "secret",
+		RunChain: func(id int) (int, error) {
+			switch id {
+			case 1:
+				return 42, nil
+			case 2:
+				return 0, pgengine.ErrChainRunning
+			case 3:
+				return 0, context.Canceled
+			case 5:
+				return 0, pgengine.ErrChainPaused
+			}
+			return 0, pgengine.ErrChainNotFound
+		}}
+	h := s.Handler()
+	request := func(method, path, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("POST", "/chains/1/run", "Bearer secret")
+	assert.Equal(t, http.StatusAccepted, rec.Code, "Chain run should be accepted")
+	var res runResult
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res), "Response should be valid JSON")
+	assert.Equal(t, 42, res.RunStatus, "Run status ID should be returned")
+
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/chains/1/run", "").Code, "Missing token should be rejected")
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/chains/1/run", "Bearer wrong").Code, "Wrong token should be rejected")
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/chains/1/run", "secret").Code, "Token without scheme should be rejected")
+	assert.Equal(t, http.StatusMethodNotAllowed, request("GET", "/chains/1/run", "Bearer secret").Code, "Only POST should be allowed")
+	assert.Equal(t, http.StatusConflict, request("POST", "/chains/2/run", "Bearer secret").Code, "Running chain should conflict")
+	assert.Equal(t, http.StatusConflict, request("POST", "/chains/5/run", "Bearer secret").Code, "Paused chain should conflict")
+	assert.Equal(t, http.StatusNotFound, request("POST", "/chains/1/pause", "Bearer secret").Code,
+		"Pause endpoint should be disabled without PauseChain")
+	assert.Equal(t, http.StatusServiceUnavailable, request("POST", "/chains/3/run", "Bearer secret").Code, "Shutdown should be reported")
+	assert.Equal(t, http.StatusNotFound, request("POST", "/chains/4/run", "Bearer secret").Code, "Unknown chain should not be found")
+	assert.Equal(t, http.StatusNotFound, request("POST", "/chains/foo/run", "Bearer secret").Code, "Invalid ID should not be found")
+	assert.Equal(t, http.StatusNotFound, request("POST", "/chains/1", "Bearer secret").Code, "Unknown endpoint should not be found")
+
+	s.Token = ""
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("POST", "/chains/1/run", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "Endpoint should be disabled without token")
+}
+
+func TestCancelRun(t *testing.T) {
+	s := &Server{StartedAt: time.Now(), LastTick: time.Now, Token: "secret",
+		CancelRun: func(id int) error {
+			if id == 42 {
+				return nil
+			}
+			return pgengine.ErrRunNotActive
+		}}
+	h := s.Handler()
+	request := func(method, path, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("POST", "/runs/42/cancel", "Bearer secret")
+	assert.Equal(t, http.StatusAccepted, rec.Code, "Cancel of active run should be accepted")
+	assert.JSONEq(t, `{"run_status": 42}`, rec.Body.String(), "Run status ID should be returned")
+	rec = request("POST", "/runs/43/cancel", "Bearer secret")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "Finished run should not be found")
+	assert.JSONEq(t, `{"run_status": 43, "error": "Run not found or already finished"}`, rec.Body.String(),
+		"Reason should be returned")
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/runs/42/cancel", "Bearer wrong").Code, "Wrong token should be rejected")
+	assert.Equal(t, http.StatusMethodNotAllowed, request("GET", "/runs/42/cancel", "Bearer secret").Code, "Only POST should be allowed")
+	assert.Equal(t, http.StatusNotFound, request("POST", "/runs/foo/cancel", "Bearer secret").Code, "Invalid ID should not be found")
+	assert.Equal(t, http.StatusNotFound, request("POST", "/runs/42", "Bearer secret").Code, "Unknown endpoint should not be found")
+}
+
+func TestPause(t *testing.T) {
+	var paused bool
+	s := &Server{StartedAt: time.Now(), LastTick: time.Now, Token: "secret",
+		Paused: func() bool { return paused }, SetPaused: func(p bool) { paused = p }}
+	h := s.Handler()
+	request := func(method, path, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/pause", "Bearer wrong").Code, "Wrong token should be rejected")
+	assert.Equal(t, http.StatusMethodNotAllowed, request("GET", "/pause", "Bearer secret").Code, "Only POST should be allowed")
+	assert.False(t, paused, "Rejected request should not pause")
+	rec := request("POST", "/pause", "Bearer secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"paused": true}`, rec.Body.String(), "Paused state should be returned")
+	assert.True(t, paused, "Scheduler should be paused")
+
+	rec = request("GET", "/healthz", "")
+	var st status
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &st), "Response should be valid JSON")
+	assert.True(t, st.Paused, "Paused state should be reported by health check")
+	assert.True(t, strings.Contains(request("GET", "/metrics", "").Body.String(), "pg_timetable_paused 1\n"),
+		"Paused state should be exposed")
+
+	rec = request("POST", "/resume", "Bearer secret")
+	assert.JSONEq(t, `{"paused": false}`, rec.Body.String(), "Resumed state should be returned")
+	assert.False(t, paused, "Scheduler should be resumed")
+}
+
+func TestPauseChain(t *testing.T) {
+	paused := map[int]bool{}
+	s := &Server{StartedAt: time.Now(), LastTick: time.Now, Token: "secret",
+		PauseChain: func(id int, p bool) error {
+			if id != 1 {
+				return pgengine.ErrChainNotFound
+			}
+			paused[id] = p
+			return nil
+		}}
+	h := s.Handler()
+	request := func(method, path, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/chains/1/pause", "Bearer wrong").Code, "Wrong token should be rejected")
+	assert.Equal(t, http.StatusMethodNotAllowed, request("GET", "/chains/1/pause", "Bearer secret").Code, "Only POST should be allowed")
+	assert.False(t, paused[1], "Rejected request should not pause")
+	rec := request("POST", "/chains/1/pause", "Bearer secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"chain_execution_config": 1, "paused": true}`, rec.Body.String(), "Paused state should be returned")
+	assert.True(t, paused[1], "Chain should be paused")
+	rec = request("POST", "/chains/1/resume", "Bearer secret")
+	assert.JSONEq(t, `{"chain_execution_config": 1, "paused": false}`, rec.Body.String(), "Resumed state should be returned")
+	assert.False(t, paused[1], "Chain should be resumed")
+	assert.Equal(t, http.StatusNotFound, request("POST", "/chains/2/pause", "Bearer secret").Code, "Unknown chain should not be found")
+	assert.Equal(t, http.StatusNotFound, request("POST", "/chains/1/run", "Bearer secret").Code,
+		"Run endpoint should be disabled without RunChain")
+}
+
+func TestChainStates(t *testing.T) {
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	var since time.Duration
+	s := &Server{StartedAt: time.Now(), LastTick: time.Now, ClientName: "worker001", ReadToken: "reader",
+		ChainStates: func() ([]pgengine.ChainState, error) {
+			runAt := "@every 1 hour"
+			return []pgengine.ChainState{
+				{ChainExecutionConfigID: 1, ChainName: "nightly", Live: true, Tags: []string{}},
+				{ChainExecutionConfigID: 2, ChainName: "hourly", RunAt: &runAt, Tags: []string{"etl"}}}, nil
+		},
+		ActiveRuns: func() []pgengine.RunningChain {
+			return []pgengine.RunningChain{{RunStatus: 42, ChainExecutionConfigID: 1, ChainName: "nightly", Started: started}}
+		},
+		RunHistory: func(id int, d time.Duration) ([]pgengine.RunRecord, error) {
+			if id != 1 {
+				return nil, pgengine.ErrChainNotFound
+			}
+			since = d
+			return []pgengine.RunRecord{{RunStatus: 42, Status: "STARTED", Started: started, ClientName: "worker001",
+				Elements: []pgengine.TaskOutcome{}}}, nil
+		}}
+	h := s.Handler()
+	request := func(method, path, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("GET", "/api/chains", "Bearer reader")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var chains map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &chains), "Response should be valid JSON")
+	assert.NotEmpty(t, chains["generated_at"])
+	delete(chains, "generated_at")
+	body, _ := json.Marshal(chains)
+	assert.JSONEq(t, `{"api_version": 1, "client_name": "worker001", "chains": [
+		{"chain_execution_config": 1, "chain_name": "nightly", "run_at": null, "live": true, "paused": false, "tags": [],
+			"last_run": null, "next_run": null,
+			"running": [{"run_status": 42, "chain_execution_config": 1, "chain_name": "nightly", "started": "2024-01-02T03:04:05Z"}]},
+		{"chain_execution_config": 2, "chain_name": "hourly", "run_at": "@every 1 hour", "live": false, "paused": false,
+			"tags": ["etl"], "last_run": null, "next_run": null, "running": []}]}`, string(body), "Chains should be returned")
+
+	rec = request("GET", "/api/chains/1/runs?hours=2", "Bearer reader")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 2*time.Hour, since, "History should be limited by hours parameter")
+	var runs runsResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &runs), "Response should be valid JSON")
+	assert.Equal(t, 1, runs.APIVersion)
+	assert.Equal(t, 1, runs.ChainConfig)
+	assert.Len(t, runs.Running, 1, "Running executions should be returned")
+	assert.Len(t, runs.Runs, 1, "Recent runs should be returned")
+	_ = request("GET", "/api/chains/1/runs", "Bearer reader")
+	assert.Equal(t, 24*time.Hour, since, "Last 24 hours should be returned by default")
+
+	assert.Equal(t, http.StatusBadRequest, request("GET", "/api/chains/1/runs?hours=0", "Bearer reader").Code,
+		"Invalid hours should be rejected")
+	assert.Equal(t, http.StatusBadRequest, request("GET", "/api/chains/1/runs?hours=9223372036854775807", "Bearer reader").Code,
+		"Hours overflowing the period should be rejected")
+	assert.Equal(t, http.StatusOK, request("GET", "/api/chains/1/runs?hours=8760", "Bearer reader").Code,
+		"Maximum hours should be accepted")
+	assert.Equal(t, 8760*time.Hour, since)
+	rec = request("GET", "/api/chains/2/runs", "Bearer reader")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "Unknown chain should not be found")
+	assert.JSONEq(t, `{"api_version": 1, "error": "Chain configuration not found"}`, rec.Body.String(), "Errors should be versioned")
+	assert.Equal(t, http.StatusNotFound, request("GET", "/api/chains/1", "Bearer reader").Code, "Unknown endpoint should not be found")
+	assert.Equal(t, http.StatusMethodNotAllowed, request("POST", "/api/chains", "Bearer reader").Code, "Only GET should be allowed")
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/api/chains", "Bearer wrong").Code, "Wrong token should be rejected")
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/api/chains", "").Code, "Missing token should be rejected")
+
+	s.Token = "secret"
+	s.RunChain = func(id int) (int, error) { return 43, nil }
+	h = s.Handler()
+	assert.Equal(t, http.StatusOK, request("GET", "/api/chains", "Bearer secret").Code, "Token should be accepted as well")
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/chains/1/run", "Bearer reader").Code,
+		"Read-only token should not change the scheduler state")
+	s.Token, s.ReadToken = "", ""
+	h = s.Handler()
+	assert.Equal(t, http.StatusNotFound, request("GET", "/api/chains", "").Code, "API should be disabled without tokens")
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+type runResult struct {
+	RunStatus int    `json:"run_status,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type pauseResult struct {
+	Paused bool `json:"paused"`
+}
+
+type chainPauseResult struct {
+	ChainConfig int  `json:"chain_execution_config"`
+	Paused      bool `json:"paused"`
+}
+
+// authorized passes requests with the valid bearer token to the handler
+func (s *Server) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return bearerAuthorized(h, s.Token)
+}
+
+// readAuthorized passes requests with either the bearer token or the read-only token to the handler
+func (s *Server) readAuthorized(h http.HandlerFunc) http.HandlerFunc {
+	return bearerAuthorized(h, s.Token, s.ReadToken)
+}
+
+// bearerAuthorized passes requests with any of non-empty tokens as bearer token to the handler
+func bearerAuthorized(h http.HandlerFunc, tokens ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		valid := false
+		for _, t := range tokens {
+			if t != "" && token != auth && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				valid = true
+			}
+		}
+		if !valid {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pg_timetable"`)
+			writeJSON(w, http.StatusUnauthorized, runResult{Error: "Invalid or missing bearer token"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// chains serves POST /chains/{id}/run, POST /chains/{id}/pause and POST /chains/{id}/resume
+func (s *Server) chains(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/chains/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	var action string
+	if len(parts) == 2 && err == nil {
+		action = parts[1]
+	}
+	if !(action == "run" && s.RunChain != nil || (action == "pause" || action == "resume") && s.PauseChain != nil) {
+		writeJSON(w, http.StatusNotFound, runResult{Error: "Unknown endpoint"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, runResult{Error: "Only POST method is allowed"})
+		return
+	}
+	if action == "run" {
+		s.runChain(w, r, id)
+	} else {
+		s.setChainPaused(w, r, id, action == "pause")
+	}
+}
+
+// runChain starts the chain configuration immediately
+func (s *Server) runChain(w http.ResponseWriter, r *http.Request, id int) {
+	runStatusID, err := s.RunChain(id)
+	switch {
+	case err == nil:
+		pgengine.LogToDB("LOG", "Chain configuration ID: ", id, " run requested from ", r.RemoteAddr)
+		writeJSON(w, http.StatusAccepted, runResult{RunStatus: runStatusID})
+	case errors.Is(err, pgengine.ErrChainNotFound):
+		writeJSON(w, http.StatusNotFound, runResult{Error: err.Error()})
+	case errors.Is(err, pgengine.ErrChainRunning), errors.Is(err, pgengine.ErrChainPaused):
+		writeJSON(w, http.StatusConflict, runResult{Error: err.Error()})
+	case errors.Is(err, pgengine.ErrSchedulerPaused):
+		writeJSON(w, http.StatusServiceUnavailable, runResult{Error: err.Error()})
+	case errors.Is(err, context.Canceled):
+		writeJSON(w, http.StatusServiceUnavailable, runResult{Error: "Scheduler is shutting down"})
+	default:
+		writeJSON(w, http.StatusInternalServerError, runResult{Error: err.Error()})
+	}
+}
+
+// setChainPaused pauses or resumes the chain configuration
+func (s *Server) setChainPaused(w http.ResponseWriter, r *http.Request, id int, paused bool) {
+	switch err := s.PauseChain(id, paused); {
+	case err == nil:
+		pgengine.LogToDB("LOG", r.URL.Path, " requested from ", r.RemoteAddr)
+		writeJSON(w, http.StatusOK, chainPauseResult{ChainConfig: id, Paused: paused})
+	case errors.Is(err, pgengine.ErrChainNotFound):
+		writeJSON(w, http.StatusNotFound, runResult{Error: err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, runResult{Error: err.Error()})
+	}
+}
+
+// cancelRun serves POST /runs/{run_status}/cancel interrupting the chain run executed by the scheduler
+func (s *Server) cancelRun(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/runs/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if len(parts) != 2 || parts[1] != "cancel" || err != nil {
+		writeJSON(w, http.StatusNotFound, runResult{Error: "Unknown endpoint"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, runResult{Error: "Only POST method is allowed"})
+		return
+	}
+	switch err = s.CancelRun(id); {
+	case err == nil:
+		pgengine.LogToDB("LOG", "Run status ID: ", id, " cancel requested from ", r.RemoteAddr)
+		writeJSON(w, http.StatusAccepted, runResult{RunStatus: id})
+	case errors.Is(err, pgengine.ErrRunNotActive):
+		writeJSON(w, http.StatusNotFound, runResult{RunStatus: id, Error: err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, runResult{RunStatus: id, Error: err.Error()})
+	}
+}
+
+// setPaused returns handler of POST /pause and POST /resume, the result reflects the pause file as well
+func (s *Server) setPaused(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, runResult{Error: "Only POST method is allowed"})
+			return
+		}
+		pgengine.LogToDB("LOG", r.URL.Path, " requested from ", r.RemoteAddr)
+		s.SetPaused(paused)
+		writeJSON(w, http.StatusOK, pauseResult{Paused: s.paused()})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
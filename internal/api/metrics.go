@@ -0,0 +1,106 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// writeMetric writes metric samples in Prometheus text exposition format
+func writeMetric(w io.Writer, name, help, kind string, samples ...sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %v\n", name, s.labels, s.value)
+	}
+}
+
+type sample struct {
+	labels string
+	value  interface{}
+}
+
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "pg_timetable_info", "Scheduler instance information, the value is always 1.", "gauge",
+		sample{fmt.Sprintf(`{client_name=%q}`, s.ClientName), 1})
+	writeMetric(w, "pg_timetable_uptime_seconds", "Seconds since the scheduler process started.", "gauge",
+		sample{"", int64(time.Since(s.StartedAt).Seconds())})
+	writeMetric(w, "pg_timetable_last_tick_timestamp_seconds", "Unix time of the latest scheduler main loop iteration.", "gauge",
+		sample{"", s.LastTick().Unix()})
+	writeMetric(w, "pg_timetable_last_refresh_timestamp_seconds", "Unix time chains were re-read from the database last time.", "gauge",
+		sample{"", s.lastRefresh().Unix()})
+	paused := 0
+	if s.paused() {
+		paused = 1
+	}
+	writeMetric(w, "pg_timetable_paused", "1 if starting of new chains is suppressed, 0 otherwise.", "gauge",
+		sample{"", paused})
+
+	if s.RunningTasks != nil {
+		writeMetric(w, "pg_timetable_running_tasks", "Tasks being executed right now by all chains.", "gauge",
+			sample{"", s.RunningTasks()})
+		writeMetric(w, "pg_timetable_max_running_tasks", "Maximum number of tasks executed at once, 0 means unlimited.", "gauge",
+			sample{"", pgengine.MaxRunningTasks.Get()})
+	}
+
+	if s.StartedRuns != nil {
+		writeMetric(w, "pg_timetable_chain_runs_started_total", "Chain runs started since the process start.", "counter",
+			sample{"", s.StartedRuns()})
+	}
+	if s.SkippedRuns != nil {
+		skipped := s.SkippedRuns()
+		reasons := make([]string, 0, len(skipped))
+		for reason := range skipped {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		samples := make([]sample, len(reasons))
+		for i, reason := range reasons {
+			samples[i] = sample{fmt.Sprintf(`{reason=%q}`, reason), skipped[reason]}
+		}
+		writeMetric(w, "pg_timetable_chain_runs_skipped_total", "Chain runs not started when due since the process start by reason.",
+			"counter", samples...)
+	}
+
+	if s.NextRunTimes != nil {
+		runs := s.nextRuns()
+		sort.Slice(runs, func(i, j int) bool { return runs[i].ChainConfig < runs[j].ChainConfig })
+		samples := make([]sample, len(runs))
+		for i, run := range runs {
+			samples[i] = sample{fmt.Sprintf(`{chain_execution_config="%d"}`, run.ChainConfig), run.Time.Unix()}
+		}
+		writeMetric(w, "pg_timetable_chain_next_run_timestamp_seconds", "Unix time of the next scheduled start of time based chains.",
+			"gauge", samples...)
+	}
+
+	if s.DroppedLogs != nil {
+		writeMetric(w, "pg_timetable_log_entries_dropped_total", "Log entries not written to the database because the log buffer was full.",
+			"counter", sample{"", s.DroppedLogs()})
+	}
+
+	if s.LoopRestarts != nil {
+		writeMetric(w, "pg_timetable_scheduler_restarts_total", "Restarts of the main scheduler loop after failures.",
+			"counter", sample{"", s.LoopRestarts()})
+	}
+
+	stats := pgengine.GetRemoteDBStats()
+	open := make([]sample, len(stats))
+	inUse := make([]sample, len(stats))
+	idle := make([]sample, len(stats))
+	waits := make([]sample, len(stats))
+	for i, st := range stats {
+		labels := fmt.Sprintf(`{database_connection="%d"}`, st.DatabaseConnection)
+		open[i] = sample{labels, st.OpenConnections}
+		inUse[i] = sample{labels, st.InUse}
+		idle[i] = sample{labels, st.Idle}
+		waits[i] = sample{labels, st.WaitCount}
+	}
+	writeMetric(w, "pg_timetable_remote_db_open_connections", "Open connections to the remote database.", "gauge", open...)
+	writeMetric(w, "pg_timetable_remote_db_in_use_connections", "Remote database connections currently in use.", "gauge", inUse...)
+	writeMetric(w, "pg_timetable_remote_db_idle_connections", "Idle remote database connections.", "gauge", idle...)
+	writeMetric(w, "pg_timetable_remote_db_wait_count_total", "Total number of waits for a remote database connection.", "counter", waits...)
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// apiVersion is the version of the read-only JSON API responses, it's increased on incompatible changes only
+const apiVersion = 1
+
+// defaultHistoryHours specifies how many hours of runs are returned if the hours parameter is omitted
+const defaultHistoryHours = 24
+
+// maxHistoryHours limits the hours parameter to a year, so the requested period never overflows time.Duration
+const maxHistoryHours = 24 * 365
+
+type apiError struct {
+	APIVersion int    `json:"api_version"`
+	Error      string `json:"error"`
+}
+
+// chainState is the chain configuration with its runs being executed by the scheduler
+type chainState struct {
+	pgengine.ChainState
+	Running []pgengine.RunningChain `json:"running"`
+}
+
+type chainsResponse struct {
+	APIVersion  int          `json:"api_version"`
+	GeneratedAt time.Time    `json:"generated_at"`
+	ClientName  string       `json:"client_name"`
+	Chains      []chainState `json:"chains"`
+}
+
+type runsResponse struct {
+	APIVersion  int                     `json:"api_version"`
+	GeneratedAt time.Time               `json:"generated_at"`
+	ChainConfig int                     `json:"chain_execution_config"`
+	Running     []pgengine.RunningChain `json:"running"`
+	Runs        []pgengine.RunRecord    `json:"runs"`
+}
+
+// state serves GET /api/chains and GET /api/chains/{id}/runs
+func (s *Server) state(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/chains")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	runs := len(parts) == 2 && parts[1] == "runs" && err == nil && s.RunHistory != nil
+	if !(runs || strings.Trim(path, "/") == "") {
+		writeJSON(w, http.StatusNotFound, apiError{APIVersion: apiVersion, Error: "Unknown endpoint"})
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{APIVersion: apiVersion, Error: "Only GET method is allowed"})
+		return
+	}
+	if runs {
+		s.chainRuns(w, r, id)
+	} else {
+		s.chainStates(w)
+	}
+}
+
+// chainStates returns chain configurations handled by the scheduler with their last, running and next runs
+func (s *Server) chainStates(w http.ResponseWriter) {
+	states, err := s.ChainStates()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{APIVersion: apiVersion, Error: err.Error()})
+		return
+	}
+	running := s.runningChains()
+	res := chainsResponse{APIVersion: apiVersion, GeneratedAt: time.Now(), ClientName: s.ClientName,
+		Chains: make([]chainState, 0, len(states))}
+	for _, st := range states {
+		res.Chains = append(res.Chains, chainState{ChainState: st, Running: runningOf(running, st.ChainExecutionConfigID)})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// chainRuns returns runs of the chain configuration started within the last hours given by the parameter
+func (s *Server) chainRuns(w http.ResponseWriter, r *http.Request, id int) {
+	hours := defaultHistoryHours
+	if v := r.URL.Query().Get("hours"); v != "" {
+		var err error
+		if hours, err = strconv.Atoi(v); err != nil || hours <= 0 || hours > maxHistoryHours {
+			writeJSON(w, http.StatusBadRequest, apiError{APIVersion: apiVersion,
+				Error: fmt.Sprintf("Parameter hours must be a positive integer up to %d", maxHistoryHours)})
+			return
+		}
+	}
+	history, err := s.RunHistory(id, time.Duration(hours)*time.Hour)
+	switch {
+	case errors.Is(err, pgengine.ErrChainNotFound):
+		writeJSON(w, http.StatusNotFound, apiError{APIVersion: apiVersion, Error: err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, apiError{APIVersion: apiVersion, Error: err.Error()})
+	default:
+		writeJSON(w, http.StatusOK, runsResponse{APIVersion: apiVersion, GeneratedAt: time.Now(), ChainConfig: id,
+			Running: runningOf(s.runningChains(), id), Runs: history})
+	}
+}
+
+func (s *Server) runningChains() []pgengine.RunningChain {
+	if s.ActiveRuns == nil {
+		return nil
+	}
+	return s.ActiveRuns()
+}
+
+// runningOf returns the runs of the chain configuration, never nil so the list is encoded as JSON array
+func runningOf(running []pgengine.RunningChain, chainConfigID int) []pgengine.RunningChain {
+	res := []pgengine.RunningChain{}
+	for _, run := range running {
+		if run.ChainExecutionConfigID == chainConfigID {
+			res = append(res, run)
+		}
+	}
+	return res
+}
@@ -1,29 +1,98 @@
 package cmdparser
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
 	flags "github.com/jessevdk/go-flags"
 )
 
 type cmdOptions struct {
-	ClientName   string `short:"c" long:"clientname" description:"Unique name for application instance" required:"True"`
-	Verbose      bool   `short:"v" long:"verbose" description:"Show verbose debug information" env:"PGTT_VERBOSE"`
-	Host         string `short:"h" long:"host" description:"PG config DB host" default:"localhost" env:"PGTT_PGHOST"`
-	Port         string `short:"p" long:"port" description:"PG config DB port" default:"5432" env:"PGTT_PGPORT"`
-	Dbname       string `short:"d" long:"dbname" description:"PG config DB dbname" default:"timetable" env:"PGTT_PGDATABASE"`
-	User         string `short:"u" long:"user" description:"PG config DB user" default:"scheduler" env:"PGTT_PGUSER"`
-	File         string `short:"f" long:"file" description:"Config file only mode" hidden:"TODO"`
-	Password     string `long:"password" description:"PG config DB password" env:"PGTT_PGPASSWORD"`
-	SSLMode      string `long:"sslmode" default:"disable" description:"What SSL priority use for connection" choice:"disable" choice:"require"`
-	PostgresURL  DbURL  `long:"pgurl" description:"PG config DB url" env:"PGTT_URL"`
-	Upgrade      bool   `long:"upgrade" description:"Upgrade database to the latest version"`
-	NoShellTasks bool   `long:"no-shell-tasks" description:"Disable executing of shell tasks" env:"PGTT_NOSHELLTASKS"`
+	ClientName   string   `short:"c" long:"clientname" description:"Unique name for application instance, generated from host name and PID if omitted" env:"PGTT_CLIENTNAME"`
+	Verbose      bool     `short:"v" long:"verbose" description:"Show verbose debug information" env:"PGTT_VERBOSE"`
+	Host         string   `short:"h" long:"host" description:"PG config DB host" default:"localhost" env:"PGTT_PGHOST"`
+	Port         string   `short:"p" long:"port" description:"PG config DB port" default:"5432" env:"PGTT_PGPORT"`
+	Dbname       string   `short:"d" long:"dbname" description:"PG config DB dbname" default:"timetable" env:"PGTT_PGDATABASE"`
+	User         string   `short:"u" long:"user" description:"PG config DB user" default:"scheduler" env:"PGTT_PGUSER"`
+	File         string   `short:"f" long:"file" description:"Config file only mode" hidden:"TODO"`
+	Config       string   `long:"config" description:"INI file with options, re-read on SIGHUP" env:"PGTT_CONFIG" no-ini:"true"`
+	Password     string   `long:"password" description:"PG config DB password" env:"PGTT_PGPASSWORD"`
+	SSLMode      string   `long:"sslmode" default:"disable" description:"What SSL priority use for connection" choice:"disable" choice:"require" choice:"verify-ca" choice:"verify-full"`
+	SSLRootCert  string   `long:"sslrootcert" description:"SSL certificate authority (CA) file" env:"PGTT_SSLROOTCERT"`
+	SSLCert      string   `long:"sslcert" description:"SSL client certificate file" env:"PGTT_SSLCERT"`
+	SSLKey       string   `long:"sslkey" description:"SSL client certificate secret key file" env:"PGTT_SSLKEY"`
+	PostgresURL  DbURL    `long:"pgurl" description:"PG config DB url" env:"PGTT_URL"`
+	WaitForDB    int      `long:"wait-for-db" default:"0" description:"Seconds to retry the initial connection to PG config DB, 0 fails immediately" env:"PGTT_WAITFORDB"`
+	Upgrade      bool     `long:"upgrade" description:"Upgrade database to the latest version"`
+	InitOnly     bool     `long:"init-only" description:"Create or upgrade configuration schema and exit"`
+	ListChains   bool     `long:"list-chains" description:"Print configured chains as JSON and exit"`
+	RunChain     int      `long:"run-chain" description:"Execute the chain configuration with the given ID once and exit with non-zero code if it fails"`
+	RunChains    []string `long:"run-chains" description:"Execute the chain configurations with the comma separated IDs at once, print their outcomes and exit with non-zero code if any fails, can be repeated"`
+	RunTimeout   int      `long:"run-chains-timeout" default:"0" description:"Seconds to wait for --run-chains before cancelling unfinished runs, 0 waits forever"`
+	TestTask     string   `long:"test-task" description:"Execute the base task with the given name or ID once outside of any chain, print its output and exit with its exit code" no-ini:"true"`
+	TestParams   []string `long:"test-params" description:"JSON value of the positional parameter passed to --test-task, can be repeated" no-ini:"true"`
+	RunHistory   int      `long:"run-history" description:"Print recent runs of the chain configuration with the given ID and exit"`
+	HistoryHours int      `long:"history-hours" default:"24" description:"Number of hours of --run-history to print"`
+	HistoryJSON  bool     `long:"history-json" description:"Print --run-history as JSON instead of a table"`
+	CheckConn    bool     `long:"check-connection" description:"Check the connection and the configuration schema, print diagnostics and exit" no-ini:"true"`
+	JSON         bool     `long:"json" description:"Print --check-connection diagnostics as JSON" no-ini:"true"`
+	EnableChain  []int    `long:"enable-chain" description:"Enable chain configuration with the given ID and exit, can be repeated"`
+	DisableChain []int    `long:"disable-chain" description:"Disable chain configuration with the given ID and exit, can be repeated"`
+	PruneLogs    bool     `long:"prune-logs" description:"Delete log rows older than log-retention and error-log-retention days and finished runs older than run-retention days and exit"`
+	LogRetain    int      `long:"log-retention" default:"0" description:"Days to keep log entries and successful task executions, 0 keeps forever" env:"PGTT_LOGRETENTION"`
+	ErrorRetain  int      `long:"error-log-retention" default:"0" description:"Days to keep error log entries and failed task executions, 0 keeps forever" env:"PGTT_ERRORLOGRETENTION"`
+	RunRetain    int      `long:"run-retention" default:"0" description:"Days to keep finished runs in run_status, 0 keeps forever" env:"PGTT_RUNRETENTION"`
+	ArchiveRuns  bool     `long:"archive-runs" description:"Move finished runs older than run-retention days with their task executions to archive tables instead of deleting them" env:"PGTT_ARCHIVERUNS"`
+	DryRun       bool     `long:"dry-run" description:"Roll back SQL tasks of every chain instead of committing, shell tasks are still executed" no-ini:"true"`
+	NoShellTasks bool     `long:"no-shell-tasks" description:"Disable executing of shell tasks" env:"PGTT_NOSHELLTASKS"`
+	Refresh      int      `long:"refresh-interval" default:"60" description:"Seconds between re-reading interval chains from the database" env:"PGTT_REFRESHINTERVAL"`
+	MaxTasks     int      `long:"max-running-tasks" default:"0" description:"Maximum number of tasks executed at once by all chains, 0 for unlimited" env:"PGTT_MAXRUNNINGTASKS"`
+	TaskWait     int      `long:"task-wait-timeout" default:"300" description:"Seconds a task waits for a free slot if max-running-tasks is reached, 0 for unlimited" env:"PGTT_TASKWAITTIMEOUT"`
+	Schema       string   `long:"schema" default:"timetable" description:"Name of the configuration schema in PG config DB" env:"PGTT_SCHEMA"`
+	SchemaFile   []string `long:"schema-file" description:"SQL file executed after the built-in scripts when the configuration schema is created, can be repeated"`
+	InstanceLock string   `long:"instance-lock" default:"refuse" choice:"refuse" choice:"wait" choice:"off" description:"Refuse to start or wait while another instance with the same schema and client name is running, off disables the check" env:"PGTT_INSTANCELOCK"`
+	SchemaDrift  string   `long:"schema-drift" default:"fail" choice:"fail" choice:"repair" description:"Fail or repair if objects of the configuration schema are missing at startup" env:"PGTT_SCHEMADRIFT"`
+	EmptyChain   string   `long:"empty-chain" default:"skip" choice:"skip" choice:"fail" description:"Mark runs of chain configurations without chain as skipped or failed" env:"PGTT_EMPTYCHAIN"`
+	OnFailure    int      `long:"on-failure-chain" description:"Chain configuration ID started when a run of a chain without its own on_failure_chain_id fails or times out" env:"PGTT_ONFAILURECHAIN"`
+	Watchdog     int      `long:"watchdog-interval" default:"60" description:"Seconds between checks for runs exceeding their timeout, 0 disables the watchdog" env:"PGTT_WATCHDOGINTERVAL"`
+	DrainTimeout int      `long:"drain-timeout" default:"300" description:"Seconds running chains are waited for on shutdown before they are interrupted, 0 waits forever" env:"PGTT_DRAINTIMEOUT"`
+	CatchUpLimit int      `long:"catch-up-limit" default:"10" description:"Maximum number of missed runs caught up by chains with catch_up_all missed_ticks" env:"PGTT_CATCHUPLIMIT"`
+	LoopRestarts int      `long:"loop-restarts" default:"5" description:"Times in a row the failed main scheduler loop is restarted before the scheduler exits, 0 exits on the first failure" env:"PGTT_LOOPRESTARTS"`
+	LoopBackoff  int      `long:"loop-backoff" default:"5" description:"Seconds before the first restart of the failed main scheduler loop, doubled on every next restart" env:"PGTT_LOOPBACKOFF"`
+	StuckGrace   int      `long:"watchdog-grace" default:"60" description:"Seconds a run may exceed its timeout before the watchdog marks it as failed" env:"PGTT_WATCHDOGGRACE"`
+	StuckKill    bool     `long:"watchdog-kill" description:"Kill process groups of shell tasks of runs marked as failed by the watchdog" env:"PGTT_WATCHDOGKILL"`
+	CondTimeout  int      `long:"precondition-timeout" default:"10" description:"Seconds a precondition query of a chain may run, 0 for unlimited" env:"PGTT_PRECONDITIONTIMEOUT"`
+	MaxJitter    int      `long:"max-jitter" default:"0" description:"Maximum random delay in seconds before cron chains start, 0 disables jitter" env:"PGTT_MAXJITTER"`
+	LogBuffer    int      `long:"log-buffer" default:"0" description:"Number of log entries buffered to be written in batches, 0 writes every entry at once" env:"PGTT_LOGBUFFER"`
+	LogOverflow  string   `long:"log-overflow" default:"block" choice:"block" choice:"drop" description:"Block logging or drop log entries while the log buffer is full" env:"PGTT_LOGOVERFLOW"`
+	LogFlush     int      `long:"log-flush-interval" default:"1000" description:"Milliseconds between writes of buffered log entries" env:"PGTT_LOGFLUSHINTERVAL"`
+	Redact       []string `long:"redact" description:"Regular expression matching sensitive text to be masked in logs, can be repeated"`
+	SecretsDir   string   `long:"secrets-dir" description:"Directory with files holding secrets for task parameters" env:"PGTT_SECRETSDIR"`
+	VaultAddr    string   `long:"vault-addr" description:"Address of HashiCorp Vault server to resolve secrets from, e.g. https://vault:8200" env:"PGTT_VAULTADDR"`
+	VaultToken   string   `long:"vault-token" description:"Token to read secrets from Vault" env:"PGTT_VAULTTOKEN"`
+	VaultPath    string   `long:"vault-path" default:"secret/data/pg_timetable" description:"Path of Vault key/value secret holding secrets as its keys" env:"PGTT_VAULTPATH"`
+	AWSRegion    string   `long:"aws-secrets-region" description:"Region of AWS Secrets Manager to resolve secrets from, e.g. eu-central-1" env:"PGTT_AWSSECRETSREGION"`
+	AWSPrefix    string   `long:"aws-secrets-prefix" description:"Prefix prepended to secret names to get AWS Secrets Manager secret IDs" env:"PGTT_AWSSECRETSPREFIX"`
+	SecretsTTL   int      `long:"secrets-cache-ttl" default:"60" description:"Seconds secrets of Vault and AWS Secrets Manager are cached, 0 disables the cache" env:"PGTT_SECRETSCACHETTL"`
+	HTTPListen   string   `long:"http-listen" description:"Address to serve health check endpoints on, e.g. :8008" env:"PGTT_HTTPLISTEN"`
+	OnlyTags     []string `long:"only-tags" description:"Handle only chain configurations with any of the comma separated tags, can be repeated" env:"PGTT_ONLYTAGS" env-delim:","`
+	ExcludeTags  []string `long:"exclude-tags" description:"Ignore chain configurations with any of the comma separated tags, can be repeated" env:"PGTT_EXCLUDETAGS" env-delim:","`
+	PauseFile    string   `long:"pause-file" description:"Do not start new chains while this file exists" env:"PGTT_PAUSEFILE"`
+	OTLPEndpoint string   `long:"otlp-endpoint" description:"Base URL of OTLP/HTTP endpoint to export traces of chain runs to, e.g. http://localhost:4318, tracing is disabled if not set" env:"PGTT_OTLPENDPOINT"`
+	OTLPService  string   `long:"otlp-service-name" default:"pg_timetable" description:"Service name of exported traces" env:"PGTT_OTLPSERVICENAME"`
+	APIToken     string   `long:"api-token" description:"Bearer token enabling HTTP endpoints to run chains on demand" env:"PGTT_APITOKEN"`
+	APIReadToken string   `long:"api-read-token" description:"Bearer token enabling read-only JSON API only, API is enabled by api-token as well" env:"PGTT_APIREADTOKEN"`
+	MaxOutput    int      `long:"max-output-size" default:"1048576" description:"Maximum size in bytes of shell task output to capture, 0 for unlimited" env:"PGTT_MAXOUTPUTSIZE"`
+	RemoteOpen   int      `long:"remote-max-open-conns" default:"2" description:"Maximum number of open connections per remote database, 0 for unlimited" env:"PGTT_REMOTEMAXOPENCONNS"`
+	RemoteIdle   int      `long:"remote-max-idle-conns" default:"1" description:"Maximum number of idle connections kept per remote database" env:"PGTT_REMOTEMAXIDLECONNS"`
+	RemoteTTL    int      `long:"remote-idle-timeout" default:"300" description:"Seconds an unused remote database is kept in the connection pool" env:"PGTT_REMOTEIDLETIMEOUT"`
 }
 
 func (c cmdOptions) String() string {
@@ -42,6 +111,9 @@ type DbURL struct {
 
 var nonOptionArgs []string
 
+// redactPatterns keeps redaction patterns set, so reload applies them only if changed
+var redactPatterns []string
+
 //UnmarshalFlag parses commandline string in to url
 func (d *DbURL) UnmarshalFlag(s string) error {
 	var err error
@@ -78,6 +150,26 @@ func (c *cmdOptions) ParseCurl(cmdURL *url.URL) error {
 	if len(a["sslmode"]) > 0 {
 		c.SSLMode = a["sslmode"][0]
 	}
+	if len(a["sslrootcert"]) > 0 {
+		c.SSLRootCert = a["sslrootcert"][0]
+	}
+	if len(a["sslcert"]) > 0 {
+		c.SSLCert = a["sslcert"][0]
+	}
+	if len(a["sslkey"]) > 0 {
+		c.SSLKey = a["sslkey"][0]
+	}
+	return nil
+}
+
+//VerifySSL checks that SSL related options are consistent
+func (c *cmdOptions) VerifySSL() error {
+	if (c.SSLMode == "verify-ca" || c.SSLMode == "verify-full") && c.SSLRootCert == "" {
+		return fmt.Errorf("SSL mode %s requires certificate authority file specified with --sslrootcert", c.SSLMode)
+	}
+	if (c.SSLCert == "") != (c.SSLKey == "") {
+		return errors.New("Both --sslcert and --sslkey should be specified for client certificate authentication")
+	}
 	return nil
 }
 
@@ -85,15 +177,25 @@ func isPostgresURI(s string) bool {
 	return strings.HasPrefix(s, "postgres://") || strings.HasPrefix(s, "postgresql://")
 }
 
-// Parse will parse command line arguments and initialize pgengine
-func Parse() error {
+// parseOptions parses command line arguments and configuration file, command line takes precedence
+func parseOptions(writeHelp bool) (*cmdOptions, error) {
 	cmdOpts := new(cmdOptions)
 	parser := flags.NewParser(cmdOpts, flags.PrintErrors)
 	var err error
 	if nonOptionArgs, err = parser.Parse(); err != nil {
 		if !flags.WroteHelp(err) {
-			parser.WriteHelp(os.Stdout)
-			return err
+			if writeHelp {
+				parser.WriteHelp(os.Stdout)
+			}
+			return nil, err
+		}
+	}
+	//--config option
+	if cmdOpts.Config != "" {
+		ini := flags.NewIniParser(parser)
+		ini.ParseAsDefaults = true
+		if err = ini.ParseFile(cmdOpts.Config); err != nil {
+			return nil, err
 		}
 	}
 	//--pgurl option
@@ -105,7 +207,7 @@ func Parse() error {
 	if len(nonOptionArgs) > 0 && cmdOpts.PostgresURL.pgurl == nil {
 		cmdOpts.PostgresURL.pgurl, err = url.Parse(strings.Join(nonOptionArgs, ""))
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 	}
@@ -113,24 +215,295 @@ func Parse() error {
 	if isPostgresURI(cmdOpts.Dbname) && cmdOpts.PostgresURL.pgurl == nil {
 		cmdOpts.PostgresURL.pgurl, err = url.Parse(cmdOpts.Dbname)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	err = cmdOpts.ParseCurl(cmdOpts.PostgresURL.pgurl)
 	if err != nil {
+		return nil, err
+	}
+	if err = cmdOpts.VerifySSL(); err != nil {
+		return nil, err
+	}
+	if err = pgengine.ValidateSchemaName(cmdOpts.Schema); err != nil {
+		return nil, err
+	}
+	return cmdOpts, nil
+}
+
+// Parse will parse command line arguments and initialize pgengine
+func Parse() error {
+	cmdOpts, err := parseOptions(true)
+	if err != nil {
+		fmt.Printf(pgengine.GetLogPrefixLn("PANIC"), err)
 		return err
 	}
 	pgengine.ClientName = cmdOpts.ClientName
-	pgengine.VerboseLogLevel = cmdOpts.Verbose
+	pgengine.ClientNameGenerated = cmdOpts.ClientName == ""
+	if pgengine.ClientNameGenerated {
+		pgengine.ClientName = pgengine.GenerateClientName()
+	}
+	pgengine.VerboseLogLevel.Set(cmdOpts.Verbose)
 	pgengine.Host = cmdOpts.Host
 	pgengine.Port = cmdOpts.Port
 	pgengine.DbName = cmdOpts.Dbname
 	pgengine.User = cmdOpts.User
 	pgengine.Password = cmdOpts.Password
 	pgengine.SSLMode = cmdOpts.SSLMode
+	pgengine.SSLRootCert = cmdOpts.SSLRootCert
+	pgengine.SSLCert = cmdOpts.SSLCert
+	pgengine.SSLKey = cmdOpts.SSLKey
+	pgengine.WaitForDB = cmdOpts.WaitForDB
 	pgengine.Upgrade = cmdOpts.Upgrade
-	pgengine.NoShellTasks = cmdOpts.NoShellTasks
+	pgengine.InitOnly = cmdOpts.InitOnly
+	pgengine.ListChains = cmdOpts.ListChains
+	pgengine.RunChainID = cmdOpts.RunChain
+	if pgengine.RunChainIDs, err = parseChainIDs(cmdOpts.RunChains); err != nil {
+		fmt.Printf(pgengine.GetLogPrefixLn("PANIC"), err)
+		return err
+	}
+	pgengine.RunChainsTimeout = cmdOpts.RunTimeout
+	pgengine.TestTask = cmdOpts.TestTask
+	pgengine.TestParams = cmdOpts.TestParams
+	pgengine.RunHistory = cmdOpts.RunHistory
+	pgengine.HistorySince = time.Duration(cmdOpts.HistoryHours) * time.Hour
+	pgengine.HistoryJSON = cmdOpts.HistoryJSON
+	pgengine.CheckConnection = cmdOpts.CheckConn
+	pgengine.CheckJSON = cmdOpts.JSON
+	pgengine.EnableChains = cmdOpts.EnableChain
+	pgengine.DisableChains = cmdOpts.DisableChain
+	pgengine.PruneLogs = cmdOpts.PruneLogs
+	pgengine.LogRetention.Set(cmdOpts.LogRetain)
+	pgengine.ErrorLogRetention.Set(cmdOpts.ErrorRetain)
+	pgengine.RunRetention.Set(cmdOpts.RunRetain)
+	pgengine.ArchiveRuns.Set(cmdOpts.ArchiveRuns)
+	pgengine.NoShellTasks.Set(cmdOpts.NoShellTasks)
+	pgengine.DryRun = cmdOpts.DryRun
+	pgengine.MaxOutputSize.Set(cmdOpts.MaxOutput)
+	pgengine.HTTPListen = cmdOpts.HTTPListen
+	pgengine.APIToken = cmdOpts.APIToken
+	pgengine.APIReadToken = cmdOpts.APIReadToken
+	pgengine.OTLPEndpoint = cmdOpts.OTLPEndpoint
+	pgengine.OTLPService = cmdOpts.OTLPService
+	pgengine.PauseFile.Set(cmdOpts.PauseFile)
+	pgengine.MaxJitter.Set(cmdOpts.MaxJitter)
+	pgengine.EmptyChain.Set(cmdOpts.EmptyChain)
+	pgengine.OnFailureChain.Set(cmdOpts.OnFailure)
+	pgengine.Schema = cmdOpts.Schema
+	if err = pgengine.LoadSchemaFiles(cmdOpts.SchemaFile); err != nil {
+		fmt.Printf(pgengine.GetLogPrefixLn("PANIC"), err)
+		return err
+	}
+	pgengine.LogBufferSize = cmdOpts.LogBuffer
+	pgengine.LogOverflow.Set(cmdOpts.LogOverflow)
+	pgengine.LogFlushInterval = cmdOpts.LogFlush
+	pgengine.SchemaDrift = cmdOpts.SchemaDrift
+	pgengine.InstanceLock = cmdOpts.InstanceLock
+	pgengine.PreconditionTimeout.Set(cmdOpts.CondTimeout)
+	pgengine.WatchdogInterval.Set(cmdOpts.Watchdog)
+	pgengine.WatchdogGrace.Set(cmdOpts.StuckGrace)
+	pgengine.WatchdogKill.Set(cmdOpts.StuckKill)
+	pgengine.DrainTimeout.Set(cmdOpts.DrainTimeout)
+	pgengine.CatchUpLimit.Set(cmdOpts.CatchUpLimit)
+	pgengine.LoopRestarts.Set(cmdOpts.LoopRestarts)
+	pgengine.LoopBackoff.Set(cmdOpts.LoopBackoff)
+	pgengine.RefreshInterval.Set(cmdOpts.Refresh)
+	pgengine.MaxRunningTasks.Set(cmdOpts.MaxTasks)
+	pgengine.TaskWaitTimeout.Set(cmdOpts.TaskWait)
+	pgengine.SecretsDir.Set(cmdOpts.SecretsDir)
+	pgengine.VaultAddr = cmdOpts.VaultAddr
+	pgengine.VaultToken = cmdOpts.VaultToken
+	pgengine.VaultPath = cmdOpts.VaultPath
+	pgengine.AWSSecretsRegion = cmdOpts.AWSRegion
+	pgengine.AWSSecretsPrefix = cmdOpts.AWSPrefix
+	pgengine.SecretsCacheTTL = cmdOpts.SecretsTTL
+	if pgengine.OnlyTags, err = pgengine.ParseTags(cmdOpts.OnlyTags); err != nil {
+		fmt.Printf(pgengine.GetLogPrefixLn("PANIC"), err)
+		return err
+	}
+	if pgengine.ExcludeTags, err = pgengine.ParseTags(cmdOpts.ExcludeTags); err != nil {
+		fmt.Printf(pgengine.GetLogPrefixLn("PANIC"), err)
+		return err
+	}
+	if err = pgengine.SetRedactPatterns(cmdOpts.Redact); err != nil {
+		fmt.Printf(pgengine.GetLogPrefixLn("PANIC"), err)
+		return err
+	}
+	redactPatterns = cmdOpts.Redact
+	pgengine.RemoteMaxOpenConns.Set(cmdOpts.RemoteOpen)
+	pgengine.RemoteMaxIdleConns.Set(cmdOpts.RemoteIdle)
+	pgengine.RemoteIdleTimeout.Set(cmdOpts.RemoteTTL)
 	pgengine.LogToDB("DEBUG", fmt.Sprintf("Starting new session... %s", cmdOpts))
 	return nil
 }
+
+// parseChainIDs returns chain configuration IDs given as comma separated lists, every ID may be listed once
+func parseChainIDs(lists []string) ([]int, error) {
+	var ids []int
+	seen := make(map[int]bool)
+	for _, list := range lists {
+		for _, s := range strings.Split(list, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || id <= 0 {
+				return nil, fmt.Errorf("Invalid chain configuration ID '%s'", s)
+			}
+			if seen[id] {
+				return nil, fmt.Errorf("Chain configuration ID %d is listed more than once", id)
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// reloadOption updates the option value if it differs from the new one, secret values are not logged
+func reloadOption(name string, dst *string, value string, secret bool) bool {
+	if *dst == value {
+		return false
+	}
+	if secret {
+		pgengine.LogToDB("LOG", fmt.Sprintf("Reloaded option %s", name))
+	} else {
+		pgengine.LogToDB("LOG", fmt.Sprintf("Reloaded option %s: '%s' -> '%s'", name, *dst, value))
+	}
+	*dst = value
+	return true
+}
+
+// reloadString updates the option changeable at runtime if it differs from the new value
+func reloadString(name string, dst *pgengine.StringSetting, value string) {
+	if old := dst.Get(); old != value {
+		pgengine.LogToDB("LOG", fmt.Sprintf("Reloaded option %s: '%s' -> '%s'", name, old, value))
+		dst.Set(value)
+	}
+}
+
+func reloadInt(name string, dst *pgengine.IntSetting, value int) {
+	if old := dst.Get(); old != value {
+		pgengine.LogToDB("LOG", fmt.Sprintf("Reloaded option %s: %d -> %d", name, old, value))
+		dst.Set(value)
+	}
+}
+
+func reloadBool(name string, dst *pgengine.BoolSetting, value bool) {
+	if old := dst.Get(); old != value {
+		pgengine.LogToDB("LOG", fmt.Sprintf("Reloaded option %s: %t -> %t", name, old, value))
+		dst.Set(value)
+	}
+}
+
+// Reload parses command line arguments and configuration file again and applies options changeable at runtime.
+// Changed connection parameters make the configuration database to be reconnected, options which cannot be
+// changed without restart are reported
+func Reload() error {
+	cmdOpts, err := parseOptions(false)
+	if err != nil {
+		return err
+	}
+	if cmdOpts.ClientName != pgengine.ClientName && !(pgengine.ClientNameGenerated && cmdOpts.ClientName == "") {
+		pgengine.LogToDB("ERROR", "Option clientname cannot be changed at runtime, restart required")
+	}
+	if cmdOpts.HTTPListen != pgengine.HTTPListen {
+		pgengine.LogToDB("ERROR", "Option http-listen cannot be changed at runtime, restart required")
+	}
+	if cmdOpts.APIToken != pgengine.APIToken || cmdOpts.APIReadToken != pgengine.APIReadToken {
+		pgengine.LogToDB("ERROR", "Options api-token and api-read-token cannot be changed at runtime, restart required")
+	}
+	if cmdOpts.OTLPEndpoint != pgengine.OTLPEndpoint || cmdOpts.OTLPService != pgengine.OTLPService {
+		pgengine.LogToDB("ERROR", "Options otlp-* cannot be changed at runtime, restart required")
+	}
+	if cmdOpts.VaultAddr != pgengine.VaultAddr || cmdOpts.VaultToken != pgengine.VaultToken ||
+		cmdOpts.VaultPath != pgengine.VaultPath || cmdOpts.AWSRegion != pgengine.AWSSecretsRegion ||
+		cmdOpts.AWSPrefix != pgengine.AWSSecretsPrefix || cmdOpts.SecretsTTL != pgengine.SecretsCacheTTL {
+		pgengine.LogToDB("ERROR", "Options vault-*, aws-secrets-* and secrets-cache-ttl cannot be changed at runtime, restart required")
+	}
+	if cmdOpts.InstanceLock != pgengine.InstanceLock {
+		pgengine.LogToDB("ERROR", "Option instance-lock cannot be changed at runtime, restart required")
+	}
+	if cmdOpts.Schema != pgengine.Schema {
+		pgengine.LogToDB("ERROR", "Option schema cannot be changed at runtime, restart required")
+	}
+	onlyTags, _ := pgengine.ParseTags(cmdOpts.OnlyTags)
+	excludeTags, _ := pgengine.ParseTags(cmdOpts.ExcludeTags)
+	if strings.Join(onlyTags, ",") != strings.Join(pgengine.OnlyTags, ",") ||
+		strings.Join(excludeTags, ",") != strings.Join(pgengine.ExcludeTags, ",") {
+		pgengine.LogToDB("ERROR", "Options only-tags and exclude-tags cannot be changed at runtime, restart required")
+	}
+	if cmdOpts.LogBuffer != pgengine.LogBufferSize {
+		pgengine.LogToDB("ERROR", "Option log-buffer cannot be changed at runtime, restart required")
+	}
+	if cmdOpts.LogFlush != pgengine.LogFlushInterval {
+		pgengine.LogToDB("ERROR", "Option log-flush-interval cannot be changed at runtime, restart required")
+	}
+	reloadBool("verbose", &pgengine.VerboseLogLevel, cmdOpts.Verbose)
+	reloadBool("no-shell-tasks", &pgengine.NoShellTasks, cmdOpts.NoShellTasks)
+	reloadInt("max-output-size", &pgengine.MaxOutputSize, cmdOpts.MaxOutput)
+	reloadInt("max-jitter", &pgengine.MaxJitter, cmdOpts.MaxJitter)
+	reloadInt("precondition-timeout", &pgengine.PreconditionTimeout, cmdOpts.CondTimeout)
+	reloadInt("on-failure-chain", &pgengine.OnFailureChain, cmdOpts.OnFailure)
+	reloadInt("watchdog-interval", &pgengine.WatchdogInterval, cmdOpts.Watchdog)
+	reloadInt("watchdog-grace", &pgengine.WatchdogGrace, cmdOpts.StuckGrace)
+	reloadBool("watchdog-kill", &pgengine.WatchdogKill, cmdOpts.StuckKill)
+	reloadInt("drain-timeout", &pgengine.DrainTimeout, cmdOpts.DrainTimeout)
+	reloadInt("catch-up-limit", &pgengine.CatchUpLimit, cmdOpts.CatchUpLimit)
+	reloadInt("loop-restarts", &pgengine.LoopRestarts, cmdOpts.LoopRestarts)
+	reloadInt("loop-backoff", &pgengine.LoopBackoff, cmdOpts.LoopBackoff)
+	reloadInt("refresh-interval", &pgengine.RefreshInterval, cmdOpts.Refresh)
+	reloadInt("max-running-tasks", &pgengine.MaxRunningTasks, cmdOpts.MaxTasks)
+	reloadInt("task-wait-timeout", &pgengine.TaskWaitTimeout, cmdOpts.TaskWait)
+	reloadInt("log-retention", &pgengine.LogRetention, cmdOpts.LogRetain)
+	reloadInt("error-log-retention", &pgengine.ErrorLogRetention, cmdOpts.ErrorRetain)
+	reloadInt("run-retention", &pgengine.RunRetention, cmdOpts.RunRetain)
+	reloadBool("archive-runs", &pgengine.ArchiveRuns, cmdOpts.ArchiveRuns)
+	reloadInt("remote-max-open-conns", &pgengine.RemoteMaxOpenConns, cmdOpts.RemoteOpen)
+	reloadInt("remote-max-idle-conns", &pgengine.RemoteMaxIdleConns, cmdOpts.RemoteIdle)
+	reloadInt("remote-idle-timeout", &pgengine.RemoteIdleTimeout, cmdOpts.RemoteTTL)
+	reloadString("secrets-dir", &pgengine.SecretsDir, cmdOpts.SecretsDir)
+	reloadString("pause-file", &pgengine.PauseFile, cmdOpts.PauseFile)
+	reloadString("empty-chain", &pgengine.EmptyChain, cmdOpts.EmptyChain)
+	reloadString("log-overflow", &pgengine.LogOverflow, cmdOpts.LogOverflow)
+	if strings.Join(cmdOpts.Redact, "\n") != strings.Join(redactPatterns, "\n") {
+		if err = pgengine.SetRedactPatterns(cmdOpts.Redact); err != nil {
+			pgengine.LogToDB("ERROR", err, ", previous redaction patterns are kept")
+		} else {
+			redactPatterns = cmdOpts.Redact
+			pgengine.LogToDB("LOG", "Reloaded option redact")
+		}
+	}
+
+	connOpts := []struct {
+		name   string
+		dst    *string
+		value  string
+		secret bool
+	}{
+		{"host", &pgengine.Host, cmdOpts.Host, false},
+		{"port", &pgengine.Port, cmdOpts.Port, false},
+		{"dbname", &pgengine.DbName, cmdOpts.Dbname, false},
+		{"user", &pgengine.User, cmdOpts.User, false},
+		{"password", &pgengine.Password, cmdOpts.Password, true},
+		{"sslmode", &pgengine.SSLMode, cmdOpts.SSLMode, false},
+		{"sslrootcert", &pgengine.SSLRootCert, cmdOpts.SSLRootCert, false},
+		{"sslcert", &pgengine.SSLCert, cmdOpts.SSLCert, false},
+		{"sslkey", &pgengine.SSLKey, cmdOpts.SSLKey, false},
+	}
+	prevValues := make([]string, len(connOpts))
+	changed := false
+	for i, o := range connOpts {
+		prevValues[i] = *o.dst
+		changed = reloadOption(o.name, o.dst, o.value, o.secret) || changed
+	}
+	if !changed {
+		return nil
+	}
+	if err = pgengine.ReconnectConfigDB(); err != nil {
+		// keep previous parameters, so the next reload tries to reconnect again
+		for i, o := range connOpts {
+			*o.dst = prevValues[i]
+		}
+		return fmt.Errorf("Cannot reconnect with new connection parameters, previous connection is kept: %v", err)
+	}
+	return nil
+}
@@ -115,6 +115,10 @@ func (m *Migrator) Pending(db *sql.DB) ([]interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	if count > len(m.migrations) {
+		return nil, fmt.Errorf("Database has %d migrations applied, but only %d migrations are known. "+
+			"Database is newer than the application, no migration path available", count, len(m.migrations))
+	}
 	return m.migrations[count:len(m.migrations)], nil
 }
 
@@ -51,8 +51,8 @@ func migrateTest() error {
 
 	// Migrate up
 	pgengine.InitAndTestConfigDBConnection()
-	pgengine.ConfigDb.MustExec("DROP TABLE IF EXISTS foo, bar, baz")
-	if err := migrator.Migrate(pgengine.ConfigDb.DB); err != nil {
+	pgengine.ConfigDb().MustExec("DROP TABLE IF EXISTS foo, bar, baz")
+	if err := migrator.Migrate(pgengine.ConfigDb().DB); err != nil {
 		return err
 	}
 
@@ -85,7 +85,7 @@ func TestDatabaseNotFound(t *testing.T) {
 
 func TestBadMigrations(t *testing.T) {
 	pgengine.InitAndTestConfigDBConnection()
-	db := pgengine.ConfigDb.DB
+	db := pgengine.ConfigDb().DB
 
 	var migrators = []struct {
 		name  string
@@ -134,7 +134,7 @@ func TestBadMigrations(t *testing.T) {
 
 func TestBadMigrationNumber(t *testing.T) {
 	pgengine.InitAndTestConfigDBConnection()
-	db := pgengine.ConfigDb.DB
+	db := pgengine.ConfigDb().DB
 	migrator := mustMigrator(migrator.New(migrator.Migrations(
 		&migrator.Migration{
 			Name: "bad migration number",
@@ -153,7 +153,7 @@ func TestBadMigrationNumber(t *testing.T) {
 
 func TestPending(t *testing.T) {
 	pgengine.InitAndTestConfigDBConnection()
-	db := pgengine.ConfigDb.DB
+	db := pgengine.ConfigDb().DB
 	migrator := mustMigrator(migrator.New(migrator.Migrations(
 		&migrator.Migration{
 			Name: "Using tx, create baz table",
@@ -173,3 +173,31 @@ func TestPending(t *testing.T) {
 		t.Fatalf("pending migrations should be 1, got %d", len(pending))
 	}
 }
+
+func TestPendingNewerDatabase(t *testing.T) {
+	pgengine.InitAndTestConfigDBConnection()
+	db := pgengine.ConfigDb().DB
+	migrator := mustMigrator(migrator.New(migrator.Migrations(
+		&migrator.Migration{
+			Name: "the only known migration",
+			Func: func(tx *sql.Tx) error {
+				return nil
+			},
+		},
+	)))
+	if _, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", migrator.TableName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO migrations (id, version) VALUES (1000, 'unknown migration')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Pending(db); err == nil {
+		t.Fatal("Pending should fail for database newer than migrations list")
+	}
+	if _, err := migrator.NeedUpgrade(db); err == nil {
+		t.Fatal("NeedUpgrade should fail for database newer than migrations list")
+	}
+}
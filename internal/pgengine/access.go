@@ -1,12 +1,19 @@
 package pgengine
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"hash/adler32"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 // InvalidOid specifies value for non-existent objects
@@ -15,102 +22,789 @@ const InvalidOid = 0
 // AppID used as a key for obtaining locks on the server, it's Adler32 hash of 'pg_timetable' string
 const AppID = 0x204F04EE
 
+// HeartbeatInterval specifies how often the scheduler session updates its heartbeat
+const HeartbeatInterval = 10 * time.Second
+
+// StaleSessionTimeout specifies how long the session may stay without heartbeat before considered dead
+var StaleSessionTimeout = 6 * HeartbeatInterval
+
+// shutdownCtx is cancelled when the process is going to be stopped
+var shutdownCtx, shutdown = context.WithCancel(context.Background())
+
+// ShutdownContext returns context cancelled on graceful shutdown, goroutines serving the process should stop on it
+func ShutdownContext() context.Context {
+	return shutdownCtx
+}
+
+// shutdownWaiters counts goroutines the process waits for on graceful shutdown
+var shutdownWaiters sync.WaitGroup
+
+// AddShutdownWaiter registers goroutine to be waited for on graceful shutdown, the returned function
+// must be called when the goroutine is stopped
+func AddShutdownWaiter() (done func()) {
+	shutdownWaiters.Add(1)
+	return shutdownWaiters.Done
+}
+
+// sessionStartedAt holds the start time of the current scheduler session registered in timetable.active_session
+var sessionStartedAt time.Time
+
 /*FixSchedulerCrash make sure that task chains which are not complete due to a scheduler crash are "fixed"
-and marked as stopped at a certain point */
+and marked as stopped at a certain point. Only chains of the current client started before the current session
+are fixed, and only if there is no other alive session with the same client name */
 func FixSchedulerCrash() {
-	_, err := ConfigDb.Exec(`
+	_, err := ConfigDb().Exec(SchemaSQL(`
 		INSERT INTO timetable.run_status (execution_status, started, last_status_update, start_status, chain_execution_config, client_name)
 		  SELECT 'DEAD', now(), now(), start_status, 0, $1 FROM (
 		   SELECT   start_status
 		     FROM   timetable.run_status
-		     WHERE   execution_status IN ('STARTED', 'CHAIN_FAILED', 'CHAIN_DONE', 'DEAD') AND client_name = $1
+		     WHERE   execution_status IN ('STARTED', 'CHAIN_FAILED', 'CHAIN_DONE', 'DEAD', 'CHAIN_TIMEOUT', 'CHAIN_SKIPPED', 'CHAIN_CANCELLED', 'CHAIN_INTERRUPTED') AND client_name = $1
 		     GROUP BY 1
-		     HAVING count(*) < 2 ) AS abc`, ClientName)
+		     HAVING count(*) < 2 AND max(started) < COALESCE(
+				(SELECT started_at FROM timetable.active_session WHERE client_pid = $2 AND client_name = $1), now())
+		  ) AS abc
+		  WHERE NOT EXISTS (
+			SELECT 1 FROM timetable.active_session 
+			WHERE client_name = $1 AND client_pid <> $2 AND last_seen > now() - $3 * interval '1 second')`),
+		ClientName, os.Getpid(), StaleSessionTimeout.Seconds())
 	if err != nil {
 		LogToDB("ERROR", "Error occurred during reverting from the scheduler crash: ", err)
 	}
 }
 
+// RegisterSession creates heartbeat row for the current scheduler session and removes stale sessions
+func RegisterSession() {
+	removeStaleSessions()
+	err := ConfigDb().Get(&sessionStartedAt, SchemaSQL(`INSERT INTO timetable.active_session (client_pid, client_name) VALUES ($1, $2)
+		ON CONFLICT (client_pid, client_name) DO UPDATE SET started_at = now(), last_seen = now()
+		RETURNING started_at`), os.Getpid(), ClientName)
+	if err != nil {
+		LogToDB("ERROR", "Cannot register scheduler session: ", err)
+	}
+}
+
+// UpdateSessionHeartbeat updates last seen timestamp of the current scheduler session. If session row was removed
+// by another instance considering it stale, it's inserted back with the original session start time
+func UpdateSessionHeartbeat() {
+	if sessionStartedAt.IsZero() {
+		return
+	}
+	removeStaleSessions()
+	_, err := ConfigDb().Exec(SchemaSQL(`INSERT INTO timetable.active_session (client_pid, client_name, started_at) VALUES ($1, $2, $3)
+		ON CONFLICT (client_pid, client_name) DO UPDATE SET last_seen = now()`),
+		os.Getpid(), ClientName, sessionStartedAt)
+	if err != nil {
+		LogToDB("ERROR", "Cannot update scheduler session heartbeat: ", err)
+	}
+}
+
+// UpdateSessionTick stores the time of the latest scheduling tick of the current scheduler session
+func UpdateSessionTick(lastTick time.Time) {
+	if sessionStartedAt.IsZero() {
+		return
+	}
+	_, err := ConfigDb().Exec(SchemaSQL("UPDATE timetable.active_session SET last_tick = $3 WHERE client_pid = $1 AND client_name = $2"),
+		os.Getpid(), ClientName, lastTick)
+	if err != nil {
+		LogToDB("ERROR", "Cannot update scheduler session tick: ", err)
+	}
+}
+
+func removeStaleSessions() {
+	res, err := ConfigDb().Exec(SchemaSQL("DELETE FROM timetable.active_session WHERE last_seen < now() - $1 * interval '1 second'"),
+		StaleSessionTimeout.Seconds())
+	if err != nil {
+		LogToDB("ERROR", "Cannot remove stale scheduler sessions: ", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		LogToDB("LOG", fmt.Sprintf("Removed %d stale scheduler session(s)", n))
+	}
+}
+
+// ErrClientNameInUse is returned if another alive scheduler session has the same client name
+var ErrClientNameInUse = errors.New("Client name is already used by another alive session")
+
+// CheckClientNameUnique returns ErrClientNameInUse if a session with the same client name of another process
+// has sent its heartbeat within StaleSessionTimeout
+func CheckClientNameUnique() error {
+	var pids []int64
+	err := ConfigDb().Select(&pids, SchemaSQL(`SELECT client_pid FROM timetable.active_session 
+		WHERE client_name = $1 AND client_pid <> $2 AND last_seen > now() - $3 * interval '1 second'`),
+		ClientName, os.Getpid(), StaleSessionTimeout.Seconds())
+	if err != nil {
+		return err
+	}
+	if len(pids) > 0 {
+		return fmt.Errorf("%w: '%s' is used by client PID %v", ErrClientNameInUse, ClientName, pids)
+	}
+	return nil
+}
+
+// UnregisterSession removes heartbeat row of the current scheduler session
+func UnregisterSession() {
+	if sessionStartedAt.IsZero() {
+		return
+	}
+	_, err := ConfigDb().Exec(SchemaSQL("DELETE FROM timetable.active_session WHERE client_pid = $1 AND client_name = $2"),
+		os.Getpid(), ClientName)
+	if err != nil {
+		fmt.Printf(GetLogPrefixLn("ERROR"), fmt.Sprintf("Error occurred during session unregistering: %v", err))
+	}
+	sessionStartedAt = time.Time{}
+}
+
+// ClaimChainExecution makes sure the chain is executed by exactly one scheduler session per schedule tick.
+// The chain configuration row is locked and the run status is inserted only if no other alive session started
+// the chain within the claim window. The window of 0 seconds stands for the current minute, used by cron chains,
+// negative window disables the check, used by notification chains started on every notification.
+// Returns run status ID or 0 if the chain execution was claimed by another session or the chain was disabled.
+func ClaimChainExecution(chainConfigID int, chainID int, windowSeconds int) int {
+	id, err := ClaimChainExecutionE(chainConfigID, chainID, windowSeconds)
+	if err != nil {
+		LogToDB("ERROR", "Cannot claim chain execution: ", err)
+	}
+	return id
+}
+
+// ClaimChainExecutionE is ClaimChainExecution returning the error instead of logging it, the error is QueryError
+// or matches ErrConnectionLost if the claim failed because of the database. Run status ID of 0 and no error are
+// returned if the chain execution was claimed by another session or the chain was disabled
+func ClaimChainExecutionE(chainConfigID int, chainID int, windowSeconds int) (int, error) {
+	const sqlLockChainConfig = `SELECT chain_execution_config FROM timetable.chain_execution_config 
+WHERE chain_execution_config = $1 AND live FOR UPDATE SKIP LOCKED`
+	const sqlCheckChainConfig = `SELECT chain_execution_config FROM timetable.chain_execution_config 
+WHERE chain_execution_config = $1 AND live`
+	const sqlClaimedByOthers = `
+SELECT EXISTS(
+	SELECT 1 FROM timetable.run_status rs JOIN timetable.active_session s USING (client_name) 
+	WHERE $3 >= 0 AND rs.chain_execution_config = $1 AND rs.start_status IS NULL AND rs.execution_status = 'STARTED' 
+		AND rs.client_name <> $2 AND rs.started >= CASE WHEN $3 = 0 THEN date_trunc('minute', now()) 
+		ELSE now() - $3 * interval '1 second' END 
+		AND s.last_seen > now() - $4 * interval '1 second')`
+	const sqlInsertRunStatus = `
+INSERT INTO timetable.run_status 
+(chain_id, execution_status, started, chain_execution_config, client_name) 
+VALUES 
+($1, 'STARTED', now(), $2, $3) 
+RETURNING run_status`
+	var id int
+	var claimed bool
+	sqlLock := SchemaSQL(sqlLockChainConfig)
+	if windowSeconds < 0 {
+		// concurrent runs are not serialized, a locked row must not skip the run
+		sqlLock = SchemaSQL(sqlCheckChainConfig)
+	}
+	err := RetryTransient(ShutdownContext(), "chain claim", func() error {
+		claimed = false
+		tx, err := ConfigDb().Beginx()
+		if err != nil {
+			return err
+		}
+		err = tx.Get(&id, sqlLock, chainConfigID)
+		if err == nil {
+			err = tx.Get(&claimed, SchemaSQL(sqlClaimedByOthers), chainConfigID, ClientName, windowSeconds, StaleSessionTimeout.Seconds())
+		}
+		if err == nil && !claimed {
+			err = tx.Get(&id, SchemaSQL(sqlInsertRunStatus), chainID, chainConfigID, ClientName)
+		}
+		if err != nil || claimed {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+	switch {
+	case err == sql.ErrNoRows || err == nil && claimed:
+		LogToDB("LOG", fmt.Sprintf("Chain configuration ID: %d is claimed by another session or disabled, skipping", chainConfigID))
+		return 0, nil
+	case err != nil:
+		return 0, queryError("chain claim", err)
+	}
+	return id, nil
+}
+
+// ErrChainNotFound is returned if the chain configuration requested to run doesn't exist, is disabled
+// or belongs to another client, errors of updating or deleting unknown configurations match it too
+var ErrChainNotFound = errors.New("Chain configuration not found")
+
+// ErrChainRunning is returned if the chain configuration requested to run has an active run
+var ErrChainRunning = errors.New("Chain configuration is already running")
+
+// ErrRunNotActive is returned if the run requested to cancel doesn't exist, has already finished or is executed
+// by another scheduler process
+var ErrRunNotActive = errors.New("Run not found or already finished")
+
+// ErrSchedulerPaused is returned if the chain configuration is requested to run while the scheduler is paused
+var ErrSchedulerPaused = errors.New("Scheduler is paused")
+
+// ErrChainPaused is returned if the chain configuration requested to run is paused with PauseChain
+var ErrChainPaused = errors.New("Chain configuration is paused")
+
+// ClaimChainRun inserts run status for immediate on demand execution of the chain configuration. The run is not
+// claimed if the configuration has an active run in any alive session. Returns run status ID
+func ClaimChainRun(chainConfigID int, chainID int) (int, error) {
+	const sqlLockChainConfig = `SELECT chain_execution_config FROM timetable.chain_execution_config 
+WHERE chain_execution_config = $1 AND live AND (client_name = $2 OR client_name IS NULL) FOR UPDATE`
+	const sqlRunningCount = `SELECT count(*) FROM timetable.get_running_jobs($1, $2 * interval '1 second') 
+	AS (id BIGINT, status BIGINT)`
+	const sqlInsertRunStatus = `
+INSERT INTO timetable.run_status 
+(chain_id, execution_status, started, chain_execution_config, client_name) 
+VALUES 
+($1, 'STARTED', now(), $2, $3) 
+RETURNING run_status`
+	var id, running int
+	err := RetryTransient(ShutdownContext(), "chain run", func() error {
+		running = 0
+		tx, err := ConfigDb().Beginx()
+		if err != nil {
+			return err
+		}
+		err = tx.Get(&id, SchemaSQL(sqlLockChainConfig), chainConfigID, ClientName)
+		if err == nil {
+			err = tx.Get(&running, SchemaSQL(sqlRunningCount), chainConfigID, StaleSessionTimeout.Seconds())
+		}
+		if err == nil && running == 0 {
+			err = tx.Get(&id, SchemaSQL(sqlInsertRunStatus), chainID, chainConfigID, ClientName)
+		}
+		if err != nil || running > 0 {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, ErrChainNotFound
+	case err != nil:
+		err = queryError("chain run", err)
+		LogToDB("ERROR", "Cannot claim chain execution: ", err)
+		return 0, err
+	case running > 0:
+		return 0, ErrChainRunning
+	}
+	LogToDB("LOG", fmt.Sprintf("Chain configuration ID: %d claimed for on demand execution", chainConfigID))
+	return id, nil
+}
+
+// StuckRun is the chain run of the current client running longer than its timeout
+type StuckRun struct {
+	RunStatusID   int       `db:"run_status"`
+	ChainConfigID int       `db:"chain_execution_config"`
+	ChainID       int       `db:"chain_id"`
+	Started       time.Time `db:"started"`
+	Timeout       int       `db:"timeout"`
+}
+
+// GetStuckRuns returns runs of the current client started more than the chain timeout plus graceSeconds ago
+// which are not finished yet. Chains without timeout are never considered stuck
+func GetStuckRuns(graceSeconds int) ([]StuckRun, error) {
+	const sqlSelectStuckRuns = `
+SELECT rs.run_status, rs.chain_execution_config, COALESCE(rs.chain_id, 0) AS chain_id, rs.started, c.timeout
+FROM timetable.run_status rs JOIN timetable.chain_execution_config c USING (chain_execution_config)
+WHERE rs.start_status IS NULL AND rs.execution_status = 'STARTED' AND rs.client_name = $1
+	AND COALESCE(c.timeout, 0) > 0 AND rs.started < now() - (c.timeout + $2) * interval '1 second'
+	AND NOT EXISTS (
+		SELECT 1 FROM timetable.run_status f
+		WHERE f.start_status = rs.run_status AND f.fan_out_item IS NULL AND (f.execution_status IN ('CHAIN_FAILED', 'CHAIN_TIMEOUT', 'CHAIN_SKIPPED', 'CHAIN_CANCELLED', 'CHAIN_INTERRUPTED', 'DEAD')
+			OR f.execution_status = 'CHAIN_DONE' AND COALESCE(f.current_execution_element, 0) = 0))
+ORDER BY rs.run_status`
+	runs := []StuckRun{}
+	err := ConfigDb().Select(&runs, SchemaSQL(sqlSelectStuckRuns), ClientName, graceSeconds)
+	return runs, err
+}
+
+// CheckPrecondition evaluates the precondition query of the chain configuration in a read-only transaction limited
+// by PreconditionTimeout seconds. The precondition is met only if the query returns true, NULL or no rows are not
+func CheckPrecondition(ctx context.Context, query string) (bool, error) {
+	if PreconditionTimeout.Get() > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(PreconditionTimeout.Get())*time.Second)
+		defer cancel()
+	}
+	tx, err := ConfigDb().BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var met sql.NullBool
+	switch err = tx.GetContext(ctx, &met, query); {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case ctx.Err() == context.DeadlineExceeded:
+		return false, fmt.Errorf("Precondition timed out after %d seconds", PreconditionTimeout.Get())
+	case err != nil:
+		return false, err
+	}
+	return met.Valid && met.Bool, nil
+}
+
 // CanProceedChainExecution checks if particular chain can be exeuted in parallel
 func CanProceedChainExecution(chainConfigID int, maxInstances int) bool {
-	const sqlProcCount = "SELECT count(*) FROM timetable.get_running_jobs($1) AS (id BIGINT, status BIGINT) GROUP BY id"
+	ok, err := CanProceedChainExecutionE(chainConfigID, maxInstances)
+	if err != nil {
+		LogToDB("ERROR", "Cannot read information about concurrent running jobs: ", err)
+	}
+	return ok
+}
+
+// CanProceedChainExecutionE is CanProceedChainExecution returning the error instead of logging it, the chain
+// cannot proceed if the error is not nil
+func CanProceedChainExecutionE(chainConfigID int, maxInstances int) (bool, error) {
+	const sqlProcCount = `SELECT count(*) FROM timetable.get_running_jobs($1, $2 * interval '1 second') 
+	AS (id BIGINT, status BIGINT) GROUP BY id`
 	var procCount int
 	LogToDB("DEBUG", fmt.Sprintf("Checking if can proceed with chaing config ID: %d", chainConfigID))
-	err := ConfigDb.Get(&procCount, sqlProcCount, chainConfigID)
+	err := ConfigDb().Get(&procCount, SchemaSQL(sqlProcCount), chainConfigID, StaleSessionTimeout.Seconds())
 	switch {
 	case err == sql.ErrNoRows:
-		return true
+		return true, nil
 	case err == nil:
-		return procCount < maxInstances
+		return procCount < maxInstances, nil
 	default:
-		LogToDB("ERROR", "Cannot read information about concurrent running jobs: ", err)
-		return false
+		return false, queryError("running jobs check", err)
+	}
+}
+
+// ChainConfig structure mirrors timetable.chain_execution_config table, ChainID of 0 stands for NULL
+type ChainConfig struct {
+	ChainExecutionConfigID   int            `db:"chain_execution_config" json:"chain_execution_config"`
+	ChainID                  int            `db:"chain_id" json:"chain_id"`
+	ChainName                string         `db:"chain_name" json:"chain_name"`
+	RunAt                    sql.NullString `db:"run_at" json:"-"`
+	MaxInstances             sql.NullInt64  `db:"max_instances" json:"-"`
+	Live                     bool           `db:"live" json:"live"`
+	SelfDestruct             bool           `db:"self_destruct" json:"self_destruct"`
+	ExclusiveExecution       bool           `db:"exclusive_execution" json:"exclusive_execution"`
+	ExcludedExecutionConfigs pq.Int64Array  `db:"excluded_execution_configs" json:"excluded_execution_configs"`
+	ClientName               sql.NullString `db:"client_name" json:"-"`
+	MaxJitter                sql.NullInt64  `db:"max_jitter" json:"-"`
+	Timeout                  sql.NullInt64  `db:"timeout" json:"-"`
+	NotifyChannel            sql.NullString `db:"notify_channel" json:"-"`
+	Priority                 int            `db:"priority" json:"priority"`
+	Precondition             sql.NullString `db:"precondition" json:"-"`
+	Tags                     pq.StringArray `db:"tags" json:"tags"`
+	WindowStart              sql.NullString `db:"window_start" json:"-"`
+	WindowEnd                sql.NullString `db:"window_end" json:"-"`
+	WindowTimezone           sql.NullString `db:"window_timezone" json:"-"`
+	WindowAction             string         `db:"window_action" json:"window_action"`
+	OnFailureChainID         sql.NullInt64  `db:"on_failure_chain_id" json:"-"`
+	Paused                   bool           `db:"paused" json:"paused"`
+	MissedTicks              string         `db:"missed_ticks" json:"missed_ticks"`
+}
+
+// sqlSelectChainConfigColumns lists timetable.chain_execution_config columns scanned into ChainConfig
+const sqlSelectChainConfigColumns = `chain_execution_config, COALESCE(chain_id, 0) AS chain_id, chain_name, run_at, 
+	max_instances, COALESCE(live, false) AS live, COALESCE(self_destruct, false) AS self_destruct, 
+	COALESCE(exclusive_execution, false) AS exclusive_execution, excluded_execution_configs, client_name, max_jitter, timeout, 
+	notify_channel, priority, precondition, tags, window_start :: text AS window_start, window_end :: text AS window_end, 
+	window_timezone, window_action, on_failure_chain_id, paused, missed_ticks`
+
+// chainConfigNullables holds nullable columns of ChainConfig as pointers, so they are encoded as JSON null
+type chainConfigNullables struct {
+	RunAt         *string `json:"run_at"`
+	MaxInstances  *int64  `json:"max_instances"`
+	ClientName    *string `json:"client_name"`
+	MaxJitter     *int64  `json:"max_jitter"`
+	Timeout       *int64  `json:"timeout"`
+	NotifyChannel *string `json:"notify_channel"`
+	Precondition  *string `json:"precondition"`
+	WindowStart   *string `json:"window_start"`
+	WindowEnd     *string `json:"window_end"`
+	WindowTZ      *string `json:"window_timezone"`
+	OnFailure     *int64  `json:"on_failure_chain_id"`
+}
+
+// MarshalJSON encodes NULL columns of the chain configuration as JSON null
+func (cfg ChainConfig) MarshalJSON() ([]byte, error) {
+	type config ChainConfig
+	n := chainConfigNullables{RunAt: nullString(cfg.RunAt), ClientName: nullString(cfg.ClientName),
+		NotifyChannel: nullString(cfg.NotifyChannel), Precondition: nullString(cfg.Precondition),
+		WindowStart: nullString(cfg.WindowStart), WindowEnd: nullString(cfg.WindowEnd), WindowTZ: nullString(cfg.WindowTimezone)}
+	if cfg.MaxInstances.Valid {
+		n.MaxInstances = &cfg.MaxInstances.Int64
+	}
+	if cfg.MaxJitter.Valid {
+		n.MaxJitter = &cfg.MaxJitter.Int64
+	}
+	if cfg.Timeout.Valid {
+		n.Timeout = &cfg.Timeout.Int64
+	}
+	if cfg.OnFailureChainID.Valid {
+		n.OnFailure = &cfg.OnFailureChainID.Int64
+	}
+	return json.Marshal(struct {
+		config
+		chainConfigNullables
+	}{config(cfg), n})
+}
+
+// UnmarshalJSON decodes chain configuration encoded by MarshalJSON
+func (cfg *ChainConfig) UnmarshalJSON(data []byte) error {
+	type config ChainConfig
+	var v struct {
+		*config
+		chainConfigNullables
+	}
+	v.config = (*config)(cfg)
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	n := v.chainConfigNullables
+	if n.RunAt != nil {
+		cfg.RunAt = sql.NullString{String: *n.RunAt, Valid: true}
+	}
+	if n.MaxInstances != nil {
+		cfg.MaxInstances = sql.NullInt64{Int64: *n.MaxInstances, Valid: true}
+	}
+	if n.ClientName != nil {
+		cfg.ClientName = sql.NullString{String: *n.ClientName, Valid: true}
+	}
+	if n.MaxJitter != nil {
+		cfg.MaxJitter = sql.NullInt64{Int64: *n.MaxJitter, Valid: true}
+	}
+	if n.Timeout != nil {
+		cfg.Timeout = sql.NullInt64{Int64: *n.Timeout, Valid: true}
+	}
+	if n.NotifyChannel != nil {
+		cfg.NotifyChannel = sql.NullString{String: *n.NotifyChannel, Valid: true}
+	}
+	if n.Precondition != nil {
+		cfg.Precondition = sql.NullString{String: *n.Precondition, Valid: true}
+	}
+	if n.WindowStart != nil {
+		cfg.WindowStart = sql.NullString{String: *n.WindowStart, Valid: true}
+	}
+	if n.WindowEnd != nil {
+		cfg.WindowEnd = sql.NullString{String: *n.WindowEnd, Valid: true}
+	}
+	if n.WindowTZ != nil {
+		cfg.WindowTimezone = sql.NullString{String: *n.WindowTZ, Valid: true}
+	}
+	if n.OnFailure != nil {
+		cfg.OnFailureChainID = sql.NullInt64{Int64: *n.OnFailure, Valid: true}
+	}
+	return nil
+}
+
+// AddChainConfig inserts new chain configuration and returns its ID
+func AddChainConfig(cfg ChainConfig) (int, error) {
+	const sqlInsertChainConfig = `
+INSERT INTO timetable.chain_execution_config 
+(chain_id, chain_name, run_at, max_instances, live, self_destruct, exclusive_execution, excluded_execution_configs, client_name, max_jitter, timeout, 
+	notify_channel, priority, precondition, tags, window_start, window_end, window_timezone, window_action, on_failure_chain_id, missed_ticks) 
+VALUES 
+(:chain_id, :chain_name, :run_at, :max_instances, :live, :self_destruct, :exclusive_execution, :excluded_execution_configs, :client_name, :max_jitter, :timeout, 
+	:notify_channel, :priority, :precondition, :tags, :window_start, :window_end, :window_timezone, COALESCE(NULLIF(:window_action, ''), 'skip'), 
+	:on_failure_chain_id, COALESCE(NULLIF(:missed_ticks, ''), 'skip')) 
+RETURNING chain_execution_config`
+	if err := ValidateRunAt(cfg.RunAt.String); err != nil {
+		LogToDB("ERROR", "Cannot add chain configuration: ", err)
+		return 0, err
+	}
+	var id int
+	tx := StartTransaction()
+	var rows *sqlx.Rows
+	err := setChangeClientName(tx)
+	if err == nil {
+		rows, err = tx.NamedQuery(SchemaSQL(sqlInsertChainConfig), cfg)
+	}
+	if err == nil {
+		if rows.Next() {
+			err = rows.Scan(&id)
+		} else if err = rows.Err(); err == nil {
+			err = errors.New("No chain configuration ID returned")
+		}
+		rows.Close()
+	}
+	if err != nil {
+		LogToDB("ERROR", "Cannot add chain configuration: ", err)
+		MustRollbackTransaction(tx)
+		return 0, err
+	}
+	MustCommitTransaction(tx)
+	LogToDB("LOG", "Added chain configuration ID: ", id)
+	return id, nil
+}
+
+// UpdateChainConfig updates existing chain configuration identified by cfg.ChainExecutionConfigID
+func UpdateChainConfig(cfg ChainConfig) error {
+	const sqlUpdateChainConfig = `
+UPDATE timetable.chain_execution_config SET 
+	chain_id = :chain_id, 
+	chain_name = :chain_name, 
+	run_at = :run_at, 
+	max_instances = :max_instances, 
+	live = :live, 
+	self_destruct = :self_destruct, 
+	exclusive_execution = :exclusive_execution, 
+	excluded_execution_configs = :excluded_execution_configs, 
+	client_name = :client_name, 
+	max_jitter = :max_jitter, 
+	timeout = :timeout, 
+	notify_channel = :notify_channel, 
+	priority = :priority, 
+	precondition = :precondition, 
+	tags = :tags 
+WHERE chain_execution_config = :chain_execution_config`
+	if err := ValidateRunAt(cfg.RunAt.String); err != nil {
+		LogToDB("ERROR", "Cannot update chain configuration: ", err)
+		return err
+	}
+	tx := StartTransaction()
+	var res sql.Result
+	err := setChangeClientName(tx)
+	if err == nil {
+		res, err = tx.NamedExec(SchemaSQL(sqlUpdateChainConfig), cfg)
+	}
+	if err == nil {
+		var rowsUpdated int64
+		if rowsUpdated, err = res.RowsAffected(); err == nil && rowsUpdated != 1 {
+			err = fmt.Errorf("%w: ID %d", ErrChainNotFound, cfg.ChainExecutionConfigID)
+		}
+	}
+	if err != nil {
+		LogToDB("ERROR", "Cannot update chain configuration: ", err)
+		MustRollbackTransaction(tx)
+		return err
+	}
+	MustCommitTransaction(tx)
+	LogToDB("LOG", "Updated chain configuration ID: ", cfg.ChainExecutionConfigID)
+	return nil
+}
+
+// SetChainEnabled pauses or resumes chain configuration without deleting it. Disabled chains are not started anymore,
+// but running executions are allowed to finish
+func SetChainEnabled(tx *sqlx.Tx, chainConfigID int, enabled bool) error {
+	if err := setChangeClientName(tx); err != nil {
+		LogToDB("ERROR", "Cannot change chain configuration state: ", err)
+		return err
+	}
+	res, err := tx.Exec(SchemaSQL("UPDATE timetable.chain_execution_config SET live = $2 WHERE chain_execution_config = $1"), chainConfigID, enabled)
+	if err != nil {
+		LogToDB("ERROR", "Cannot change chain configuration state: ", err)
+		return err
+	}
+	rowsUpdated, err := res.RowsAffected()
+	if err == nil && rowsUpdated != 1 {
+		err = fmt.Errorf("%w: ID %d", ErrChainNotFound, chainConfigID)
+	}
+	if err == nil {
+		LogToDB("LOG", fmt.Sprintf("Chain configuration ID %d enabled: %t", chainConfigID, enabled))
+	}
+	return err
+}
+
+// PauseChain suppresses starting of the chain configuration until ResumeChain is called, unlike disabling the
+// chain it's meant for transient operational control. Running executions are allowed to finish
+func PauseChain(chainConfigID int) error {
+	return setChainPaused(chainConfigID, true)
+}
+
+// ResumeChain starts the chain configuration paused with PauseChain again on its schedule
+func ResumeChain(chainConfigID int) error {
+	return setChainPaused(chainConfigID, false)
+}
+
+func setChainPaused(chainConfigID int, paused bool) error {
+	tx, err := ConfigDb().Beginx()
+	if err == nil {
+		err = setChangeClientName(tx)
+	}
+	var res sql.Result
+	if err == nil {
+		res, err = tx.Exec(SchemaSQL("UPDATE timetable.chain_execution_config SET paused = $2 WHERE chain_execution_config = $1"),
+			chainConfigID, paused)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else if tx != nil {
+		_ = tx.Rollback()
+	}
+	if err != nil {
+		err = queryError("chain pause", err)
+		LogToDB("ERROR", "Cannot change chain configuration state: ", err)
+		return err
+	}
+	rowsUpdated, err := res.RowsAffected()
+	if err == nil && rowsUpdated != 1 {
+		err = fmt.Errorf("%w: ID %d", ErrChainNotFound, chainConfigID)
+	}
+	if err == nil {
+		LogToDB("LOG", fmt.Sprintf("Chain configuration ID %d paused: %t", chainConfigID, paused))
+	}
+	return err
+}
+
+// IsChainPaused returns true if the chain configuration is paused, it's read right before the chain is started,
+// so pausing takes effect immediately. Errors are logged and the chain is considered not paused
+func IsChainPaused(chainConfigID int) bool {
+	var paused bool
+	err := ConfigDb().Get(&paused, SchemaSQL("SELECT paused FROM timetable.chain_execution_config WHERE chain_execution_config = $1"),
+		chainConfigID)
+	if err != nil && err != sql.ErrNoRows {
+		LogToDB("ERROR", "Cannot read chain configuration state: ", queryError("chain pause check", err))
 	}
+	return paused
 }
 
 // DeleteChainConfig delete chaing configuration for self destructive chains
-func DeleteChainConfig(chainConfigID int) bool {
-	LogToDB("LOG", "Deleting self destructive chain configuration ID: ", chainConfigID)
-	res, err := ConfigDb.Exec("DELETE FROM timetable.chain_execution_config WHERE chain_execution_config = $1 ", chainConfigID)
+func DeleteChainConfig(chainConfigID int) error {
+	LogToDB("LOG", "Deleting chain configuration ID: ", chainConfigID)
+	tx, err := ConfigDb().Beginx()
+	if err != nil {
+		LogToDB("ERROR", "Error occurred during deleting chain configuration: ", err)
+		return err
+	}
+	var res sql.Result
+	if err = setChangeClientName(tx); err == nil {
+		res, err = tx.Exec(SchemaSQL("DELETE FROM timetable.chain_execution_config WHERE chain_execution_config = $1 "), chainConfigID)
+	}
 	if err != nil {
-		LogToDB("ERROR", "Error occurred during deleting self destructive chains: ", err)
+		LogToDB("ERROR", "Error occurred during deleting chain configuration: ", err)
+		_ = tx.Rollback()
+		return err
 	}
 	rowsDeleted, err := res.RowsAffected()
-	return err == nil && rowsDeleted == 1
+	if err == nil && rowsDeleted != 1 {
+		err = fmt.Errorf("%w: ID %d", ErrChainNotFound, chainConfigID)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// setChangeClientName makes triggers record the client name in timetable.change_log for changes made
+// by the transaction
+func setChangeClientName(tx *sqlx.Tx) error {
+	_, err := tx.Exec("SELECT set_config('pg_timetable.client_name', $1, true)", ClientName)
+	return err
 }
 
-// TryLockClientName obtains lock on the server to prevent another client with the same name
-func TryLockClientName() (res bool) {
-	adler32Int := adler32.Checksum([]byte(ClientName))
-	LogToDB("DEBUG", fmt.Sprintf("Trying to get advisory lock for '%s' with hash 0x%x", ClientName, adler32Int))
-	err := ConfigDb.Get(&res, "select pg_try_advisory_lock($1, $2)", AppID, adler32Int)
+// VerifyChainTasks checks that every built-in task referenced by live chains is known to the application
+func VerifyChainTasks(builtinTasks []string) error {
+	const sqlSelectUnknownTasks = `
+WITH RECURSIVE x (chain_execution_config, chain_id, task_id) AS (
+	SELECT cec.chain_execution_config, tc.chain_id, tc.task_id 
+	FROM timetable.chain_execution_config cec JOIN 
+	timetable.task_chain tc USING (chain_id) 
+	WHERE cec.live AND ` + SQLChainFilter + `
+	UNION ALL 
+	SELECT x.chain_execution_config, tc.chain_id, tc.task_id 
+	FROM timetable.task_chain tc JOIN 
+	x ON (x.chain_id = tc.parent_id) 
+) 
+SELECT x.chain_execution_config, x.chain_id, bt.name 
+FROM x JOIN timetable.base_task bt USING (task_id) 
+WHERE bt.kind = 'BUILTIN' AND NOT bt.name = ANY($4)`
+	var unknownTasks []struct {
+		ChainConfig int    `db:"chain_execution_config"`
+		ChainID     int    `db:"chain_id"`
+		TaskName    string `db:"name"`
+	}
+	LogToDB("DEBUG", "Verifying built-in tasks referenced by live chains...")
+	if err := ConfigDb().Select(&unknownTasks, SchemaSQL(sqlSelectUnknownTasks), ChainFilterArgs(pq.Array(builtinTasks))...); err != nil {
+		LogToDB("ERROR", "Cannot verify built-in tasks of live chains: ", err)
+		return err
+	}
+	for _, t := range unknownTasks {
+		LogToDB("ERROR", fmt.Sprintf("Chain element ID: %d of configuration ID: %d references unknown built-in task '%s'",
+			t.ChainID, t.ChainConfig, t.TaskName))
+	}
+	if len(unknownTasks) > 0 {
+		return fmt.Errorf("%d chain element(s) reference unknown built-in tasks", len(unknownTasks))
+	}
+	return nil
+}
+
+// configTables lists tables of the configuration schema checked by SchemaExists
+var configTables = []string{"database_connection", "base_task", "task_chain",
+	"chain_execution_config", "chain_execution_parameters",
+	"log", "execution_log", "run_status", "active_session", "migrations"}
+
+// ErrSchemaMissing is wrapped by the error of SchemaExists if the configuration schema is connected, but its tables
+// are missing, e.g. while the schema is being restored
+var ErrSchemaMissing = errors.New("Configuration schema is not available")
+
+// SchemaExists returns error if any table of the timetable schema is missing
+func SchemaExists() error {
+	var missing []string
+	err := ConfigDb().Select(&missing, SchemaSQL(`SELECT t FROM unnest($1 :: text[]) AS t 
+		WHERE to_regclass('timetable.' || t) IS NULL`), pq.Array(configTables))
 	if err != nil {
-		LogToDB("ERROR", "Error occurred during client name locking: ", err)
+		return err
 	}
-	return
+	if len(missing) > 0 {
+		return fmt.Errorf("%w, missing %s schema tables: %v", ErrSchemaMissing, Schema, missing)
+	}
+	return nil
 }
 
 // SetupCloseHandler creates a 'listener' on a new goroutine which will notify the
 // program if it receives an interrupt from the OS. We then handle this by calling
-// our clean up procedure and exiting the program.
-func SetupCloseHandler() {
+// our clean up procedure and exiting the program. Drain is called right after the shutdown
+// is started to wait for running chains, it may be nil
+func SetupCloseHandler(drain func()) {
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+		shutdown()
+		if drain != nil {
+			drain()
+		}
+		shutdownWaiters.Wait()
 		FinalizeConfigDBConnection()
 		os.Exit(0)
 	}()
 }
 
-// InsertChainRunStatus inits the execution run log, which will be use to effectively control scheduler concurrency
-func InsertChainRunStatus(chainConfigID int, chainID int) int {
-	const sqlInsertRunStatus = `
-INSERT INTO timetable.run_status 
-(chain_id, execution_status, started, chain_execution_config, client_name) 
-VALUES 
-($1, 'STARTED', now(), $2, $3) 
-RETURNING run_status`
-	var id int
-	err := ConfigDb.Get(&id, sqlInsertRunStatus, chainID, chainConfigID, ClientName)
-	if err != nil {
-		LogToDB("ERROR", "Cannot save information about the chain run status: ", err)
-	}
-	return id
+// SetupReloadHandler creates a 'listener' on a new goroutine which calls reload every time
+// the program receives SIGHUP from the OS, running chains are not interrupted
+func SetupReloadHandler(reload func() error) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-c:
+				LogToDB("LOG", "Reloading configuration...")
+				if err := reload(); err != nil {
+					LogToDB("ERROR", "Cannot reload configuration: ", err)
+				}
+			case <-ShutdownContext().Done():
+				return
+			}
+		}
+	}()
 }
 
 // UpdateChainRunStatus inserts status information about running chain elements
 func UpdateChainRunStatus(chainElemExec *ChainElementExecution, runStatusID int, status string) {
+	insertRunStatus(chainElemExec, runStatusID, sql.NullInt64{}, status)
+}
+
+// UpdateFanOutRunStatus inserts status information about the execution of the item of fan-out chain element,
+// items are numbered from 1
+func UpdateFanOutRunStatus(chainElemExec *ChainElementExecution, runStatusID int, item int, status string) {
+	insertRunStatus(chainElemExec, runStatusID, sql.NullInt64{Int64: int64(item), Valid: true}, status)
+}
+
+func insertRunStatus(chainElemExec *ChainElementExecution, runStatusID int, fanOutItem sql.NullInt64, status string) {
 
 	const sqlInsertFinishStatus = `
 INSERT INTO timetable.run_status 
-(chain_id, execution_status, current_execution_element, started, last_status_update, start_status, chain_execution_config, client_name)
+(chain_id, execution_status, current_execution_element, started, last_status_update, start_status, chain_execution_config, client_name, stderr_tail, fan_out_item)
 VALUES 
-($1, $2, $3, clock_timestamp(), now(), $4, $5, $6)`
+($1, $2, $3, clock_timestamp(), now(), $4, $5, $6, NULLIF($7, ''), $8)`
 	var err error
 
-	_, err = ConfigDb.Exec(sqlInsertFinishStatus, chainElemExec.ChainID, status, chainElemExec.TaskID,
-		runStatusID, chainElemExec.ChainConfig, ClientName)
+	_, err = ConfigDb().Exec(SchemaSQL(sqlInsertFinishStatus), chainElemExec.ChainID, status, chainElemExec.TaskID,
+		runStatusID, chainElemExec.ChainConfig, ClientName, MaskSecrets(chainElemExec.StderrTail), fanOutItem)
 	if err != nil {
 		LogToDB("ERROR", "Update Chain Status failed: ", err)
 	}
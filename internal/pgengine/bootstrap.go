@@ -1,10 +1,14 @@
 package pgengine
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -18,9 +22,6 @@ const waitTime = 5
 // maximum wait time before reconnect attempts
 const maxWaitTime = waitTime * 16
 
-// ConfigDb is the global database object
-var ConfigDb *sqlx.DB
-
 // Host is used to reconnect to data base
 var Host string = "localhost"
 
@@ -39,85 +40,528 @@ var Password string = "somestrong"
 // ClientName is unique ifentifier of the scheduler application running
 var ClientName string
 
+// GenerateClientName returns unique client name made of the host name, the process ID and a random suffix
+func GenerateClientName() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "pg_timetable"
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%x", host, os.Getpid(), suffix)
+}
+
 // SSLMode parameter determines whether or with what priority a secure SSL TCP/IP connection will
 // be negotiated with the server
 var SSLMode string = "disable"
 
+// SSLRootCert parameter specifies the name of a file containing SSL certificate authority (CA) certificate(s)
+var SSLRootCert string
+
+// SSLCert parameter specifies the file name of the client SSL certificate
+var SSLCert string
+
+// SSLKey parameter specifies the location for the secret key used for the client certificate
+var SSLKey string
+
+// WaitForDB parameter specifies how many seconds the initial connection to the configuration database is retried
+// before giving up, 0 means the scheduler exits on the first failed attempt
+var WaitForDB int
+
 // Upgrade parameter specifies if database should be upgraded to latest version
 var Upgrade bool
 
 // NoShellTasks parameter disables SHELL tasks executing
-var NoShellTasks bool
+var NoShellTasks BoolSetting
+
+// MaxOutputSize parameter specifies the maximum number of bytes of shell task output to be captured, 0 means no limit
+var MaxOutputSize = IntSetting{v: 1024 * 1024}
+
+// InitOnly parameter specifies if only configuration schema should be created or upgraded without running scheduler
+var InitOnly bool
+
+// ListChains parameter specifies if configured chains should be printed as JSON without running scheduler
+var ListChains bool
+
+// RunChainID parameter specifies the chain configuration to be executed once without running scheduler
+var RunChainID int
+
+// RunChainIDs parameter specifies chain configurations to be executed at once without running scheduler
+var RunChainIDs []int
+
+// RunChainsTimeout parameter specifies in seconds how long to wait for RunChainIDs to finish, 0 means no limit
+var RunChainsTimeout int
+
+// TestTask parameter specifies the name or ID of the base task to be executed once outside of any chain with
+// TestParams positional parameter values without running scheduler
+var TestTask string
+
+// TestParams parameter lists JSON values of positional parameters passed to TestTask
+var TestParams []string
+
+// RunHistory parameter specifies the chain configuration which runs started within HistorySince should be printed
+// as a table, or as JSON if HistoryJSON is set, without running scheduler
+var RunHistory int
+
+// HistorySince parameter specifies the time window of the printed run history
+var HistorySince = 24 * time.Hour
+
+// HistoryJSON parameter specifies if the run history should be printed as JSON
+var HistoryJSON bool
+
+// CheckConnection parameter specifies if diagnostics of the configuration database should be printed
+// without running scheduler
+var CheckConnection bool
+
+// CheckJSON parameter specifies if the diagnostics should be printed as JSON
+var CheckJSON bool
+
+// EnableChains and DisableChains parameters specify chain configurations to be enabled or disabled without running scheduler
+var EnableChains, DisableChains []int
+
+// listenerMinReconnect and listenerMaxReconnect bound the delay between reconnection attempts of the listener
+const (
+	listenerMinReconnect = 10 * time.Second
+	listenerMaxReconnect = time.Minute
+)
+
+// MaxRunningTasks parameter specifies the maximum number of chain elements executed at once by all chains,
+// 0 means no limit
+var MaxRunningTasks IntSetting
+
+// TaskWaitTimeout parameter specifies in seconds how long a task waits for a free slot if MaxRunningTasks
+// is reached, 0 means wait without limit
+var TaskWaitTimeout = IntSetting{v: 300}
+
+// RefreshInterval parameter specifies in seconds how often interval chains are re-read from the database
+var RefreshInterval = IntSetting{v: 60}
+
+// MaxJitter parameter specifies the maximum random delay in seconds before cron chains start, 0 disables jitter
+var MaxJitter IntSetting
+
+// EmptyChain parameter specifies if runs of chain configurations without chain are marked as CHAIN_SKIPPED ("skip")
+// or CHAIN_FAILED ("fail")
+var EmptyChain = StringSetting{v: "skip"}
+
+// OnFailureChain parameter specifies the chain configuration started when a run of a chain without its own
+// on_failure_chain_id fails or times out, 0 disables it
+var OnFailureChain IntSetting
+
+// WatchdogInterval parameter specifies in seconds how often runs exceeding their timeout are looked for, 0 disables
+// the watchdog
+var WatchdogInterval = IntSetting{v: 60}
+
+// DrainTimeout parameter specifies in seconds how long running chains are waited for on graceful shutdown before
+// they are interrupted, 0 means waiting forever
+var DrainTimeout = IntSetting{v: 300}
+
+// CatchUpLimit parameter specifies the maximum number of missed cron ticks caught up by chains with catch_up_all
+// missed_ticks, later missed ticks are skipped
+var CatchUpLimit = IntSetting{v: 10}
 
+// LoopRestarts parameter specifies how many times in a row the main scheduler loop is restarted after it failed,
+// e.g. the configuration schema is not available, before the scheduler gives up, 0 stops it on the first failure
+var LoopRestarts = IntSetting{v: 5}
+
+// LoopBackoff parameter specifies in seconds how long the scheduler waits before the first restart of the failed
+// main loop, the delay is doubled on every next restart in a row up to 5 minutes
+var LoopBackoff = IntSetting{v: 5}
+
+// WatchdogGrace parameter specifies in seconds how long a run may exceed its timeout before it's considered stuck
+var WatchdogGrace = IntSetting{v: 60}
+
+// WatchdogKill parameter specifies if shell commands are started in their own process group killed by the watchdog
+// together with the children when the run is stuck
+var WatchdogKill BoolSetting
+
+// DryRun parameter specifies if chain transactions are started by StartTransactionDry, so SQL tasks are rolled back
+// at the end of the chain instead of committed. It's set only explicitly by --dry-run command line option
+var DryRun bool
+
+// PreconditionTimeout parameter specifies in seconds how long the precondition query of a chain may run, 0 means
+// no limit
+var PreconditionTimeout = IntSetting{v: 10}
+
+// SchemaDrift parameter specifies if missing objects of the configuration schema found at startup fail the
+// start ("fail") or are created again by the schema scripts ("repair")
+var SchemaDrift = "fail"
+
+// LogBufferSize parameter specifies how many log entries may wait to be written asynchronously in batches,
+// 0 writes every entry synchronously. ERROR and PANIC entries are always written synchronously
+var LogBufferSize = 0
+
+// LogOverflow parameter specifies if logging blocks ("block") or entries are dropped ("drop") if the buffer is full
+var LogOverflow = StringSetting{v: "block"}
+
+// LogFlushInterval parameter specifies milliseconds between writes of buffered log entries
+var LogFlushInterval = 1000
+
+// HTTPListen parameter specifies address of HTTP server for health checks, empty value disables server
+var HTTPListen string
+
+// APIToken parameter specifies bearer token of HTTP endpoints running chains on demand, empty value disables them
+var APIToken string
+
+// APIReadToken parameter specifies bearer token of the read-only JSON API, the API is disabled if both tokens are empty
+var APIReadToken string
+
+// OTLPEndpoint parameter specifies base URL of OTLP/HTTP endpoint spans of chain runs are exported to, e.g.
+// http://localhost:4318, empty value disables tracing
+var OTLPEndpoint string
+
+// OTLPService parameter specifies service.name of exported spans
+var OTLPService = "pg_timetable"
+
+// PauseFile parameter specifies the file which existence pauses starting of new chains
+var PauseFile StringSetting
+
+// Schema parameter specifies the name of the configuration schema, it must be a valid unquoted identifier
+var Schema = "timetable"
+
+// schemaRef matches references to the configuration schema in SQL written for the default schema name
+var schemaRef = regexp.MustCompile(`\btimetable\.|\bSCHEMA timetable\b`)
+
+// schemaNameRe matches names accepted by ValidateSchemaName, such identifiers never need quoting
+var schemaNameRe = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// ValidateSchemaName returns error if the name cannot be used as the configuration schema name. Only lower case
+// unquoted identifiers not reserved for system schemas are accepted, so the name is safe to be put into SQL
+func ValidateSchemaName(name string) error {
+	if !schemaNameRe.MatchString(name) || strings.HasPrefix(name, "pg_") || name == "information_schema" {
+		return fmt.Errorf("Invalid schema name %q, lower case letters, digits and underscores are allowed, "+
+			"system schema names are not", name)
+	}
+	return nil
+}
+
+// SchemaSQL returns the SQL statement written for the "timetable" schema with references changed to Schema
+func SchemaSQL(query string) string {
+	if Schema == "timetable" {
+		return query
+	}
+	return schemaRef.ReplaceAllStringFunc(query, func(ref string) string {
+		return strings.Replace(ref, "timetable", Schema, 1)
+	})
+}
+
+// schemaCreated is set when configuration schema was created during current session
+var schemaCreated bool
+
+// sqls are scripts creating the configuration schema in the order of execution, the built-in ones come first
+// followed by scripts added with RegisterSchemaFile
 var sqls = []string{sqlDDL, sqlJSONSchema, sqlTasks, sqlJobFunctions}
 var sqlNames = []string{"DDL", "JSON Schema", "Built-in Tasks", "Job Functions"}
 
+// RegisterSchemaFile adds the script executed after the built-in ones when the configuration schema is created,
+// e.g. with stored procedures or tables of an extension. Scripts are executed in the order of registration,
+// references to the timetable schema are replaced with Schema. It must be called before CreateConfigDBSchema
+func RegisterSchemaFile(name string, sql string) {
+	sqls = append(sqls, sql)
+	sqlNames = append(sqlNames, name)
+}
+
+// LoadSchemaFiles reads SQL files and registers them with RegisterSchemaFile under their paths
+func LoadSchemaFiles(paths []string) error {
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Cannot read schema file: %w", err)
+		}
+		RegisterSchemaFile(path, string(data))
+	}
+	return nil
+}
+
+// connValueReplacer escapes backslashes and single quotes in single-quoted connection string values
+var connValueReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+func quoteConnValue(s string) string {
+	return connValueReplacer.Replace(s)
+}
+
 // InitAndTestConfigDBConnection opens connection and creates schema
 func InitAndTestConfigDBConnection() {
-	var wt int = waitTime
-	var err error
+	ConnectConfigDB()
+	CreateConfigDBSchema()
+}
+
+// configConnString returns connection string of the configuration database built from current connection parameters
+func configConnString() string {
 	connstr := fmt.Sprintf("application_name=pg_timetable host='%s' port='%s' dbname='%s' sslmode='%s' user='%s' password='%s'",
-		Host, Port, DbName, SSLMode, User, Password)
+		quoteConnValue(Host), quoteConnValue(Port), quoteConnValue(DbName), quoteConnValue(SSLMode),
+		quoteConnValue(User), quoteConnValue(Password))
+	if SSLRootCert != "" {
+		connstr += fmt.Sprintf(" sslrootcert='%s'", quoteConnValue(SSLRootCert))
+	}
+	if SSLCert != "" {
+		connstr += fmt.Sprintf(" sslcert='%s' sslkey='%s'", quoteConnValue(SSLCert), quoteConnValue(SSLKey))
+	}
+	return connstr
+}
 
+// openConfigDB prepares connection pool to the configuration database using current connection parameters
+func openConfigDB() (*sql.DB, error) {
+	connstr := configConnString()
 	// Base connector to wrap
 	base, err := pq.NewConnector(connstr)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	// Wrap the connector to simply print out the message
 	connector := pq.ConnectorWithNoticeHandler(base, func(notice *pq.Error) {
 		LogToDB("USER", "Severity: ", notice.Severity, "; Message: ", notice.Message)
 	})
-	db := sql.OpenDB(connector)
 	LogToDB("DEBUG", "Connection string: ", connstr)
+	return sql.OpenDB(connector), nil
+}
 
-	err = db.Ping()
-	for err != nil {
-		fmt.Printf(GetLogPrefixLn("ERROR")+"\n", err)
-		fmt.Printf(GetLogPrefixLn("LOG"), fmt.Sprintf("Reconnecting in %d sec...", wt))
-		time.Sleep(time.Duration(wt) * time.Second)
-		err = db.Ping()
-		if wt < maxWaitTime {
-			wt = wt * 2
+// NewConfigDBListener returns listener of notifications sent in the configuration database, the listener
+// reconnects automatically and reports connection events to eventCallback
+func NewConfigDBListener(eventCallback pq.EventCallbackType) *pq.Listener {
+	return pq.NewListener(configConnString(), listenerMinReconnect, listenerMaxReconnect, eventCallback)
+}
+
+// ConnectConfigDB opens connection to the configuration database without touching the schema. If the database
+// is not available, the connection is retried with exponential backoff for WaitForDB seconds
+func ConnectConfigDB() {
+	db, err := openConfigDB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Duration(WaitForDB) * time.Second)
+	wt := waitTime * time.Second
+	for attempt := 1; ; attempt++ {
+		if err = db.Ping(); err == nil {
+			break
 		}
+		fmt.Printf(GetLogPrefixLn("ERROR"), fmt.Sprintf("Connection attempt %d failed: %v", attempt, err))
+		delay, ok := backoffDelay(wt, time.Until(deadline))
+		if !ok {
+			fmt.Printf(GetLogPrefixLn("PANIC"), fmt.Sprintf("Cannot connect to the configuration database after %d attempt(s), see --wait-for-db", attempt))
+			os.Exit(2)
+		}
+		fmt.Printf(GetLogPrefixLn("LOG"), fmt.Sprintf("Reconnecting in %v...", delay))
+		time.Sleep(delay)
+		wt = delay * 2
 	}
 
-	ConfigDb = sqlx.NewDb(db, "postgres")
+	SetConfigDb(sqlx.NewDb(db, "postgres"))
 	LogToDB("LOG", "Connection established...")
 	LogToDB("LOG", fmt.Sprintf("Proceeding as '%s' with client PID %d", ClientName, os.Getpid()))
+}
+
+// backoffDelay returns the wait time before the next connection attempt limited by maxWaitTime and the time left
+// till the deadline, false is returned if no time is left
+func backoffDelay(wt time.Duration, left time.Duration) (time.Duration, bool) {
+	if left <= 0 {
+		return 0, false
+	}
+	if wt > maxWaitTime*time.Second {
+		wt = maxWaitTime * time.Second
+	}
+	if wt > left {
+		wt = left
+	}
+	return wt, true
+}
 
+// CreateConfigDBSchema executes SQL scripts to create the configuration schema if it doesn't exist yet
+func CreateConfigDBSchema() {
 	var exists bool
-	err = ConfigDb.Get(&exists, "SELECT EXISTS(SELECT 1 FROM pg_namespace WHERE nspname = 'timetable')")
-	if err != nil || !exists {
-		for i, sql := range sqls {
-			sqlName := sqlNames[i]
-			fmt.Printf(GetLogPrefixLn("LOG"), "Executing script: "+sqlName)
-			if _, err = ConfigDb.Exec(sql); err != nil {
+	err := ConfigDb().Get(&exists, "SELECT EXISTS(SELECT 1 FROM pg_namespace WHERE nspname = $1)", Schema)
+	if err == nil && exists {
+		return
+	}
+	for i, sql := range sqls {
+		sqlName := sqlNames[i]
+		fmt.Printf(GetLogPrefixLn("LOG"), "Executing script: "+sqlName)
+		if _, err = ConfigDb().Exec(SchemaSQL(sql)); err != nil {
+			fmt.Printf(GetLogPrefixLn("PANIC"), fmt.Sprintf("Script %s failed: %v", sqlName, err))
+			fmt.Printf(GetLogPrefixLn("PANIC"), fmt.Sprintf("Dropping %q schema", Schema))
+			_, err = ConfigDb().Exec("DROP SCHEMA IF EXISTS " + Schema + " CASCADE")
+			if err != nil {
 				fmt.Printf(GetLogPrefixLn("PANIC"), err)
-				fmt.Printf(GetLogPrefixLn("PANIC"), "Dropping \"timetable\" schema")
-				_, err = ConfigDb.Exec("DROP SCHEMA IF EXISTS timetable CASCADE")
-				if err != nil {
-					fmt.Printf(GetLogPrefixLn("PANIC"), err)
-				}
-				os.Exit(2)
-			} else {
-				LogToDB("LOG", "Schema file executed: "+sqlName)
 			}
+			os.Exit(2)
+		} else {
+			LogToDB("LOG", "Schema file executed: "+sqlName)
+		}
+	}
+	schemaCreated = true
+	LogToDB("LOG", "Configuration schema created...")
+}
+
+// schemaObject is the object of the configuration schema created by the script with sqls index script
+type schemaObject struct {
+	kind   string // "table", "type" or "function"
+	name   string // name with argument types for functions
+	script int
+}
+
+// schemaObjects lists objects the scheduler relies on, the schema self-check looks for every one of them
+var schemaObjects = []schemaObject{
+	{"table", "migrations", 0},
+	{"table", "database_connection", 0},
+	{"table", "base_task", 0},
+	{"table", "task_chain", 0},
+	{"table", "chain_execution_config", 0},
+	{"table", "chain_execution_parameters", 0},
+	{"table", "log", 0},
+	{"table", "execution_log", 0},
+	{"table", "run_status", 0},
+	{"table", "run_status_archive", 0},
+	{"table", "execution_log_archive", 0},
+	{"table", "active_session", 0},
+	{"table", "change_log", 0},
+	{"table", "chain_last_fired", 0},
+	{"type", "task_kind", 0},
+	{"type", "cron", 0},
+	{"type", "log_type", 0},
+	{"type", "execution_status", 0},
+	{"function", "parse_interval(text)", 0},
+	{"function", "trig_chain_fixer()", 0},
+	{"function", "log_change()", 0},
+	{"function", "reset_last_fired()", 0},
+	{"function", "task_chain_delete(bigint, bigint)", 0},
+	{"function", "_validate_json_schema_type(text, jsonb)", 1},
+	{"function", "validate_json_schema(jsonb, jsonb, jsonb)", 1},
+	{"function", "get_task_id(text)", 2},
+	{"function", "get_running_jobs(bigint, interval)", 3},
+	{"function", "insert_base_task(text, bigint)", 3},
+	{"function", "cron_expression(timetable.cron)", 3},
+	{"function", "is_cron_in_time(timetable.cron, timestamptz)", 3},
+	{"function", "next_run_time(timetable.cron, timestamptz)", 3},
+	{"function", "window_delay(time, time, text, timestamptz)", 3},
+	{"function", "cron_element_to_array(text, text)", 3},
+	{"function", "job_add(text, text, text, timetable.task_kind, timetable.cron, integer, boolean, boolean)", 3},
+}
+
+// missingSchemaObjects returns objects of schemaObjects not found in the configuration database
+func missingSchemaObjects() ([]schemaObject, error) {
+	var missing []schemaObject
+	for _, obj := range schemaObjects {
+		var exists bool
+		query := "SELECT to_regclass($1 || '.' || $2) IS NOT NULL"
+		switch obj.kind {
+		case "type":
+			query = "SELECT to_regtype($1 || '.' || $2) IS NOT NULL"
+		case "function":
+			query = "SELECT to_regprocedure($1 || '.' || $2) IS NOT NULL"
+		}
+		if err := ConfigDb().Get(&exists, query, Schema, SchemaSQL(obj.name)); err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, obj)
+		}
+	}
+	return missing, nil
+}
+
+// formatSchemaObjects returns the list of objects for the log, e.g. "table timetable.log (DDL)"
+func formatSchemaObjects(objects []schemaObject) string {
+	names := make([]string, len(objects))
+	for i, obj := range objects {
+		names[i] = fmt.Sprintf("%s %s.%s (%s)", obj.kind, Schema, SchemaSQL(obj.name), sqlNames[obj.script])
+	}
+	return strings.Join(names, ", ")
+}
+
+// CheckConfigDBSchema makes sure every object the scheduler relies on exists in the configuration schema. Missing
+// objects are listed in the log and the error is returned, unless SchemaDrift is "repair": then the scripts
+// creating the missing objects are executed again in one transaction and the schema is checked once more
+func CheckConfigDBSchema() error {
+	missing, err := missingSchemaObjects()
+	if err != nil {
+		LogToDB("ERROR", "Cannot check configuration schema: ", err)
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	LogToDB("ERROR", "Configuration schema is incomplete, missing objects: ", formatSchemaObjects(missing))
+	if SchemaDrift != "repair" {
+		return fmt.Errorf("Configuration schema is missing %d object(s)", len(missing))
+	}
+	if err = repairConfigDBSchema(missing); err != nil {
+		LogToDB("ERROR", "Cannot repair configuration schema: ", err)
+		return err
+	}
+	if missing, err = missingSchemaObjects(); err == nil && len(missing) > 0 {
+		LogToDB("ERROR", "Configuration schema is still missing objects after repair: ", formatSchemaObjects(missing))
+		err = fmt.Errorf("Configuration schema is missing %d object(s)", len(missing))
+	}
+	if err != nil {
+		return err
+	}
+	LogToDB("LOG", "Configuration schema repaired")
+	return nil
+}
+
+// repairConfigDBSchema executes scripts creating the missing objects again in one transaction, so a script that
+// cannot be executed twice, e.g. DDL creating the schema, changes nothing
+func repairConfigDBSchema(missing []schemaObject) error {
+	scripts := make([]bool, len(sqls))
+	for _, obj := range missing {
+		scripts[obj.script] = true
+	}
+	tx, err := ConfigDb().Beginx()
+	if err != nil {
+		return err
+	}
+	for i, sql := range sqls {
+		if !scripts[i] {
+			continue
+		}
+		LogToDB("LOG", "Executing script again: "+sqlNames[i])
+		if _, err = tx.Exec(SchemaSQL(sql)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("script %s failed: %w", sqlNames[i], err)
 		}
-		LogToDB("LOG", "Configuration schema created...")
 	}
+	return tx.Commit()
 }
 
 // FinalizeConfigDBConnection closes session
 func FinalizeConfigDBConnection() {
 	fmt.Printf(GetLogPrefixLn("LOG"), "Closing session")
-	if _, err := ConfigDb.Exec("SELECT pg_advisory_unlock_all()"); err != nil {
+	StopLogBuffer()
+	UnregisterSession()
+	CloseRemoteDBs()
+	ReleaseInstanceLock()
+	if _, err := ConfigDb().Exec("SELECT pg_advisory_unlock_all()"); err != nil {
 		fmt.Printf(GetLogPrefixLn("ERROR"), fmt.Sprintf("Error occurred during locks releasing: %v", err))
 	}
-	if err := ConfigDb.Close(); err != nil {
+	if err := ConfigDb().Close(); err != nil {
 		fmt.Printf(GetLogPrefixLn("ERROR"), fmt.Sprintf("Error occurred during connection closing: %v", err))
 	}
-	ConfigDb = nil
+	SetConfigDb(nil)
+}
+
+// ReconnectConfigDB replaces the configuration database connection after connection parameters changed.
+// The old connections are closed as soon as running chains release them, the client name lock held
+// by the old session is handed over to the new one, see moveInstanceLock
+func ReconnectConfigDB() error {
+	db, err := openConfigDB()
+	if err != nil {
+		return err
+	}
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return err
+	}
+	oldDb := ConfigDb()
+	newDb := sqlx.NewDb(db, "postgres")
+	newDb.SetMaxOpenConns(oldDb.Stats().MaxOpenConnections)
+	if err = moveInstanceLock(newDb); err != nil {
+		LogToDB("ERROR", "Cannot move client name lock to the new connection: ", err)
+	}
+	SetConfigDb(newDb)
+	if err = oldDb.Close(); err != nil {
+		LogToDB("ERROR", "Error occurred during old connection closing: ", err)
+	}
+	LogToDB("LOG", "Connection reestablished with new parameters...")
+	return nil
 }
 
 //ReconnectDbAndFixLeftovers keeps trying reconnecting every `waitTime` seconds till connection established
@@ -127,7 +571,7 @@ func ReconnectDbAndFixLeftovers() {
 		fmt.Printf(GetLogPrefixLn("REPAIR"), fmt.Sprintf("Connection to the server was lost. Waiting for %d sec...", waitTime))
 		time.Sleep(waitTime * time.Second)
 		fmt.Printf(GetLogPrefix("REPAIR"), "Reconnecting...\n")
-		err = ConfigDb.Ping()
+		err = ConfigDb().Ping()
 		if err == nil {
 			LogToDB("LOG", "Connection reestablished...")
 			FixSchedulerCrash()
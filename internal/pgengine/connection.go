@@ -0,0 +1,95 @@
+package pgengine
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// DatabaseConnection represents timetable.database_connection row. The password is not a part of the row,
+// it's resolved from the secret named by PasswordSecret
+type DatabaseConnection struct {
+	ID             int64          `db:"database_connection"`
+	ConnectString  string         `db:"connect_string"`
+	PasswordSecret sql.NullString `db:"password_secret"`
+	SSLMode        sql.NullString `db:"sslmode"`
+	SSLRootCert    sql.NullString `db:"sslrootcert"`
+	SSLCert        sql.NullString `db:"sslcert"`
+	SSLKey         sql.NullString `db:"sslkey"`
+}
+
+const sqlSelectDatabaseConnection = `SELECT database_connection, connect_string, password_secret,
+	sslmode, sslrootcert, sslcert, sslkey
+FROM timetable.database_connection WHERE database_connection = $1`
+
+// plaintextWarned holds IDs of database connections already reported for plaintext passwords
+var plaintextWarned sync.Map
+
+// ConnectionDSN returns the validated connection string of the database defined in timetable.database_connection.
+// The result contains the resolved password and must never be logged
+func ConnectionDSN(ctx context.Context, databaseConnection int64) (string, error) {
+	var c DatabaseConnection
+	err := ConfigDb().GetContext(ctx, &c, SchemaSQL(sqlSelectDatabaseConnection), databaseConnection)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("Database connection %d not found", databaseConnection)
+	}
+	if err != nil {
+		return "", err
+	}
+	return c.DSN()
+}
+
+// DSN returns key/value connection string built from connect_string with the password resolved from
+// password_secret and SSL columns applied, the columns take precedence over the options of connect_string
+func (c DatabaseConnection) DSN() (string, error) {
+	dsn := strings.TrimSpace(c.ConnectString)
+	if dsn == "" {
+		return "", fmt.Errorf("Connection string of database connection %d is blank", c.ID)
+	}
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		// parse errors contain the URL with the password, so they are not reported
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			return "", fmt.Errorf("Connection string of database connection %d is not a valid URL", c.ID)
+		}
+	}
+	plaintext := reKeyValuePassword.MatchString(dsn)
+	if c.PasswordSecret.Valid {
+		if plaintext {
+			return "", fmt.Errorf("Database connection %d has both password_secret and password in connect_string", c.ID)
+		}
+		password, err := GetSecret(c.PasswordSecret.String)
+		if err != nil {
+			return "", err
+		}
+		dsn += " password=" + quoteDSNValue(password)
+	} else if plaintext {
+		if _, warned := plaintextWarned.LoadOrStore(c.ID, true); !warned {
+			LogToDB("LOG", fmt.Sprintf("Database connection %d stores plaintext password in connect_string, use password_secret instead", c.ID))
+		}
+	}
+	if c.SSLCert.Valid != c.SSLKey.Valid {
+		return "", fmt.Errorf("Database connection %d must have both sslcert and sslkey set or none", c.ID)
+	}
+	for _, opt := range []struct {
+		name  string
+		value sql.NullString
+	}{{"sslmode", c.SSLMode}, {"sslrootcert", c.SSLRootCert}, {"sslcert", c.SSLCert}, {"sslkey", c.SSLKey}} {
+		if opt.value.Valid {
+			dsn += " " + opt.name + "=" + quoteDSNValue(opt.value.String)
+		}
+	}
+	if _, err := pq.NewConnector(dsn); err != nil {
+		return "", fmt.Errorf("Invalid connection string of database connection %d: %s", c.ID, MaskSecrets(redactPassword(err.Error())))
+	}
+	return dsn, nil
+}
+
+// quoteDSNValue returns the value quoted for key/value connection string
+func quoteDSNValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
@@ -0,0 +1,188 @@
+package pgengine
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// cronMacros maps schedule macros accepted by run_at to cron expressions they stand for, @reboot is not a clock
+// schedule and started once on scheduler start instead
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronMacroNames lists macros accepted by run_at for error messages
+const cronMacroNames = "@yearly, @annually, @monthly, @weekly, @daily, @midnight, @hourly, @reboot, @every <interval> or @after <interval>"
+
+// cronExpr matches five fields cron expressions same as timetable.cron domain does
+var cronExpr = regexp.MustCompile(`^(((\d+,)+\d+|(\d+(\/|-)\d+)|(\*(\/|-)\d+)|\d+|\*) +){4}(((\d+,)+\d+|(\d+(\/|-)\d+)|(\*(\/|-)\d+)|\d+|\*) ?)$`)
+
+// ValidateRunAt returns error describing why run_at is not a valid schedule. Empty run_at stands for every minute,
+// intervals of @every and @after are checked by the database
+func ValidateRunAt(runAt string) error {
+	switch {
+	case runAt == "" || runAt == "@reboot":
+		return nil
+	case strings.HasPrefix(runAt, "@every") || strings.HasPrefix(runAt, "@after"):
+		if strings.TrimSpace(runAt[6:]) == "" {
+			return fmt.Errorf("Schedule '%s' has no interval", runAt)
+		}
+		return nil
+	case strings.HasPrefix(runAt, "@"):
+		if _, ok := cronMacros[runAt]; !ok {
+			return fmt.Errorf("Unknown schedule macro '%s', expected %s", runAt, cronMacroNames)
+		}
+		return nil
+	case !cronExpr.MatchString(runAt):
+		return fmt.Errorf("Invalid cron expression '%s', expected minute, hour, day, month and day of week fields or %s",
+			runAt, cronMacroNames)
+	}
+	return nil
+}
+
+// VerifyChainSchedules checks that run_at of every live chain configuration is a valid schedule. The domain of
+// run_at rejects invalid schedules, but configuration schemas created by old versions accepted some of them
+func VerifyChainSchedules() error {
+	var configs []struct {
+		ChainConfig int    `db:"chain_execution_config"`
+		RunAt       string `db:"run_at"`
+	}
+	LogToDB("DEBUG", "Verifying schedules of live chains...")
+	if err := ConfigDb().Select(&configs, SchemaSQL(`SELECT chain_execution_config, run_at FROM timetable.chain_execution_config
+		WHERE live AND `+SQLChainFilter+` AND run_at IS NOT NULL`), ChainFilterArgs()...); err != nil {
+		LogToDB("ERROR", "Cannot verify schedules of live chains: ", err)
+		return err
+	}
+	invalid := 0
+	for _, c := range configs {
+		if err := ValidateRunAt(c.RunAt); err != nil {
+			LogToDB("ERROR", fmt.Sprintf("Chain configuration ID: %d has invalid schedule: %v", c.ChainConfig, err))
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d chain configuration(s) have invalid schedules", invalid)
+	}
+	return nil
+}
+
+// sqlSelectNextRunTime selects the next time the chain configuration is started by its clock schedule, the
+// schedule is evaluated by timetable.next_run_time the same way the scheduler evaluates it with is_cron_in_time
+const sqlSelectNextRunTime = `SELECT CASE WHEN live THEN timetable.next_run_time(run_at, now()) END
+FROM timetable.chain_execution_config WHERE chain_execution_config = $1`
+
+// NextRunTime returns the next time the chain configuration is started by its schedule in the session time zone
+// of the configuration database, same as the scheduler uses. Nil is returned if the chain is not time based, i.e.
+// it's disabled, started on notifications only, by @reboot or by an interval, since interval runs depend on the
+// previous run. Returns ErrChainNotFound if the configuration doesn't exist
+func NextRunTime(chainConfigID int) (*time.Time, error) {
+	var next *time.Time
+	err := ConfigDb().Get(&next, SchemaSQL(sqlSelectNextRunTime), chainConfigID)
+	if err == sql.ErrNoRows {
+		return nil, ErrChainNotFound
+	}
+	return next, err
+}
+
+// NextRunTimes returns the next start time of every time based live chain configuration handled by the scheduler
+func NextRunTimes() (map[int]time.Time, error) {
+	var rows []struct {
+		ChainConfig int       `db:"chain_execution_config"`
+		NextRun     time.Time `db:"next_run"`
+	}
+	if err := ConfigDb().Select(&rows, SchemaSQL(`SELECT chain_execution_config, next_run
+	FROM (SELECT chain_execution_config, timetable.next_run_time(run_at, now()) AS next_run
+		FROM timetable.chain_execution_config WHERE live AND `+SQLChainFilter+`) c
+	WHERE next_run IS NOT NULL`), ChainFilterArgs()...); err != nil {
+		return nil, err
+	}
+	next := make(map[int]time.Time, len(rows))
+	for _, r := range rows {
+		next[r.ChainConfig] = r.NextRun
+	}
+	return next, nil
+}
+
+// SetLastFired records the cron tick the chain configuration was started or skipped on purpose for, so the tick is
+// not caught up by ClaimMissedTicks. Older ticks never replace newer ones. Errors are logged
+func SetLastFired(chainConfigID int, tick time.Time) {
+	_, err := ConfigDb().Exec(SchemaSQL(`INSERT INTO timetable.chain_last_fired (chain_execution_config, last_fired) 
+VALUES ($1, $2) 
+ON CONFLICT (chain_execution_config) DO UPDATE SET last_fired = GREATEST(chain_last_fired.last_fired, EXCLUDED.last_fired)`),
+		chainConfigID, tick)
+	if err != nil {
+		LogToDB("ERROR", "Cannot record last fired tick of chain configuration: ", queryError("last fired tick", err))
+	}
+}
+
+// sqlSelectMissedTicks lists ticks of the chain configuration schedule after the last fired tick and before the
+// current minute, at most $2 + 1 ticks are listed
+const sqlSelectMissedTicks = `
+WITH RECURSIVE t AS (
+	SELECT timetable.next_run_time(c.run_at, f.last_fired) AS tick, 1 AS n
+	FROM timetable.chain_execution_config c JOIN timetable.chain_last_fired f USING (chain_execution_config)
+	WHERE c.chain_execution_config = $1
+	UNION ALL
+	SELECT timetable.next_run_time(c.run_at, t.tick), t.n + 1
+	FROM t JOIN timetable.chain_execution_config c ON c.chain_execution_config = $1
+	WHERE t.tick < date_trunc('minute', now()) AND t.n <= $2
+)
+SELECT tick FROM t WHERE tick < date_trunc('minute', now()) ORDER BY tick`
+
+// ClaimMissedTicks returns up to limit ticks of the chain configuration schedule missed since the last fired tick
+// recorded by SetLastFired, oldest first, and marks them as fired, so every missed tick is claimed by exactly one
+// scheduler session. If more ticks were missed, more is returned and the ticks beyond limit are marked as fired
+// without being returned. No ticks are returned if no tick was recorded yet or another session is claiming them
+func ClaimMissedTicks(chainConfigID int, limit int) (ticks []time.Time, more bool, err error) {
+	tx, err := ConfigDb().Beginx()
+	if err != nil {
+		return nil, false, queryError("missed ticks", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			err = queryError("missed ticks", err)
+		}
+	}()
+	var lastFired time.Time
+	err = tx.Get(&lastFired, SchemaSQL(`SELECT last_fired FROM timetable.chain_last_fired 
+WHERE chain_execution_config = $1 FOR UPDATE SKIP LOCKED`), chainConfigID)
+	if err == sql.ErrNoRows {
+		return nil, false, tx.Rollback()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if err = tx.Select(&ticks, SchemaSQL(sqlSelectMissedTicks), chainConfigID, limit); err != nil {
+		return nil, false, err
+	}
+	if len(ticks) == 0 {
+		return nil, false, tx.Rollback()
+	}
+	const sqlUpdateLastFired = `UPDATE timetable.chain_last_fired SET last_fired = GREATEST(last_fired, $2) 
+WHERE chain_execution_config = $1`
+	fired := ticks[len(ticks)-1]
+	if len(ticks) > limit {
+		// ticks missed beyond the limit are skipped up to the current minute
+		ticks, more = ticks[:limit], true
+		if err = tx.Get(&fired, "SELECT date_trunc('minute', now()) - interval '1 second'"); err != nil {
+			return nil, false, err
+		}
+	}
+	if _, err = tx.Exec(SchemaSQL(sqlUpdateLastFired), chainConfigID, fired); err != nil {
+		return nil, false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return ticks, more, nil
+}
@@ -0,0 +1,342 @@
+package pgengine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// ChainDescription represents chain execution configuration with its elements and the last run
+type ChainDescription struct {
+	ChainExecutionConfigID int                  `json:"chain_execution_config"`
+	ChainID                int                  `json:"chain_id"`
+	ChainName              string               `json:"chain_name"`
+	RunAt                  *string              `json:"run_at"`
+	MaxInstances           *int64               `json:"max_instances"`
+	Live                   bool                 `json:"live"`
+	SelfDestruct           bool                 `json:"self_destruct"`
+	ExclusiveExecution     bool                 `json:"exclusive_execution"`
+	ExcludedConfigs        []int64              `json:"excluded_execution_configs"`
+	ClientName             *string              `json:"client_name"`
+	MaxJitter              *int64               `json:"max_jitter"`
+	Timeout                *int64               `json:"timeout"`
+	NotifyChannel          *string              `json:"notify_channel"`
+	Priority               int                  `json:"priority"`
+	Precondition           *string              `json:"precondition"`
+	Tags                   []string             `json:"tags"`
+	WindowStart            *string              `json:"window_start"`
+	WindowEnd              *string              `json:"window_end"`
+	WindowTimezone         *string              `json:"window_timezone"`
+	WindowAction           string               `json:"window_action"`
+	OnFailureChainID       *int64               `json:"on_failure_chain_id"`
+	Paused                 bool                 `json:"paused"`
+	MissedTicks            string               `json:"missed_ticks"`
+	Elements               []ElementDescription `json:"elements"`
+	LastRun                *RunSummary          `json:"last_run"`
+	NextRun                *time.Time           `json:"next_run"`
+}
+
+// ElementDescription represents chain element with its parameters for the chain execution configuration
+type ElementDescription struct {
+	ChainID            int                        `json:"chain_id"`
+	TaskID             int                        `json:"task_id"`
+	TaskName           string                     `json:"task_name"`
+	Kind               string                     `json:"kind"`
+	Script             string                     `json:"script"`
+	RunUID             *string                    `json:"run_uid"`
+	IgnoreError        bool                       `json:"ignore_error"`
+	DatabaseConnection *string                    `json:"database_connection"`
+	SeparateOutput     bool                       `json:"separate_output"`
+	WorkDir            *string                    `json:"work_dir"`
+	MinInterval        int                        `json:"min_interval"`
+	Nice               int                        `json:"nice"`
+	MaxCPUTime         int                        `json:"max_cpu_time"`
+	MaxMemory          int                        `json:"max_memory"`
+	MaxOpenFiles       int                        `json:"max_open_files"`
+	ParamsSchema       json.RawMessage            `json:"params_schema"`
+	OutputTable        *string                    `json:"output_table"`
+	RunIfExitCodes     []int64                    `json:"run_if_exit_codes"`
+	AbortIfNotMet      bool                       `json:"abort_if_not_met"`
+	FanOutParam        *string                    `json:"fan_out_param"`
+	FanOutLimit        int                        `json:"fan_out_limit"`
+	FanOutFailFast     bool                       `json:"fan_out_fail_fast"`
+	StderrAsError      bool                       `json:"treat_stderr_as_error"`
+	StderrPattern      *string                    `json:"stderr_error_pattern"`
+	ExitCodeMap        json.RawMessage            `json:"exit_code_map"`
+	ExpectOutput       *string                    `json:"expect_output"`
+	ExpectOutputMode   string                     `json:"expect_output_mode"`
+	RunAsUser          *string                    `json:"run_as_user"`
+	RunAsGroup         *string                    `json:"run_as_group"`
+	EmptyParams        string                     `json:"empty_params"`
+	DependsOn          []int64                    `json:"depends_on"`
+	Parameters         []json.RawMessage          `json:"parameters"`
+	NamedParameters    map[string]json.RawMessage `json:"named_parameters"`
+}
+
+// RunSummary represents the outcome of the last chain run
+type RunSummary struct {
+	Status   string     `json:"status"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished"`
+}
+
+const sqlSelectChainConfigs = `SELECT ` + sqlSelectChainConfigColumns + `
+FROM timetable.chain_execution_config
+ORDER BY chain_execution_config`
+
+const sqlSelectParamValues = `
+SELECT value
+FROM timetable.chain_execution_parameters
+WHERE chain_execution_config = $1 AND chain_id = $2 AND param_name IS NULL
+ORDER BY order_id ASC`
+
+const sqlSelectNamedParamValues = `
+SELECT param_name, value
+FROM timetable.chain_execution_parameters
+WHERE chain_execution_config = $1 AND chain_id = $2 AND param_name IS NOT NULL
+ORDER BY param_name`
+
+const sqlSelectLastRun = `
+SELECT COALESCE(f.execution_status :: text, h.execution_status :: text) AS status, h.started,
+	CASE WHEN f.execution_status <> 'STARTED' THEN f.last_status_update END AS finished
+FROM timetable.run_status h LEFT JOIN LATERAL (
+	SELECT execution_status, last_status_update
+	FROM timetable.run_status
+	WHERE start_status = h.run_status AND fan_out_item IS NULL
+	ORDER BY run_status DESC
+	LIMIT 1) f ON true
+WHERE h.chain_execution_config = $1 AND h.start_status IS NULL
+ORDER BY h.run_status DESC
+LIMIT 1`
+
+// DescribeChains writes all chain execution configurations with their elements, parameters, the last run
+// outcome and the next scheduled run as a single JSON document. Connection strings are not included
+func DescribeChains(w io.Writer) error {
+	tx, err := ConfigDb().BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var configs []ChainConfig
+	if err = tx.Select(&configs, SchemaSQL(sqlSelectChainConfigs)); err != nil {
+		return err
+	}
+	descriptions := make([]ChainDescription, 0, len(configs))
+	for _, cfg := range configs {
+		d := ChainDescription{
+			ChainExecutionConfigID: cfg.ChainExecutionConfigID,
+			ChainID:                cfg.ChainID,
+			ChainName:              cfg.ChainName,
+			RunAt:                  nullString(cfg.RunAt),
+			Live:                   cfg.Live,
+			SelfDestruct:           cfg.SelfDestruct,
+			ExclusiveExecution:     cfg.ExclusiveExecution,
+			ExcludedConfigs:        cfg.ExcludedExecutionConfigs,
+			ClientName:             nullString(cfg.ClientName),
+			NotifyChannel:          nullString(cfg.NotifyChannel),
+			Priority:               cfg.Priority,
+			Precondition:           nullString(cfg.Precondition),
+			Tags:                   cfg.Tags,
+			WindowStart:            nullString(cfg.WindowStart),
+			WindowEnd:              nullString(cfg.WindowEnd),
+			WindowTimezone:         nullString(cfg.WindowTimezone),
+			WindowAction:           cfg.WindowAction,
+			Paused:                 cfg.Paused,
+			MissedTicks:            cfg.MissedTicks,
+			Elements:               []ElementDescription{},
+		}
+		if cfg.MaxInstances.Valid {
+			d.MaxInstances = &cfg.MaxInstances.Int64
+		}
+		if cfg.MaxJitter.Valid {
+			d.MaxJitter = &cfg.MaxJitter.Int64
+		}
+		if cfg.Timeout.Valid {
+			d.Timeout = &cfg.Timeout.Int64
+		}
+		if cfg.OnFailureChainID.Valid {
+			d.OnFailureChainID = &cfg.OnFailureChainID.Int64
+		}
+		var elements []ChainElementExecution
+		if err = GetChainElements(tx, &elements, cfg.ChainID); err != nil {
+			return err
+		}
+		for _, elem := range elements {
+			elem.ChainConfig = cfg.ChainExecutionConfigID
+			// parameters are selected directly to keep secret placeholders unresolved
+			var paramValues []string
+			if err = tx.Select(&paramValues, SchemaSQL(sqlSelectParamValues), cfg.ChainExecutionConfigID, elem.ChainID); err != nil {
+				return err
+			}
+			e := ElementDescription{
+				ChainID:            elem.ChainID,
+				TaskID:             elem.TaskID,
+				TaskName:           elem.TaskName,
+				Kind:               elem.Kind,
+				Script:             elem.Script,
+				RunUID:             nullString(elem.RunUID),
+				IgnoreError:        elem.IgnoreError,
+				DatabaseConnection: nullString(elem.DatabaseConnection),
+				SeparateOutput:     elem.SeparateOutput,
+				MinInterval:        elem.MinInterval,
+				Nice:               elem.Nice,
+				MaxCPUTime:         elem.MaxCPUTime,
+				MaxMemory:          elem.MaxMemory,
+				MaxOpenFiles:       elem.MaxOpenFiles,
+				RunIfExitCodes:     elem.RunIfExitCodes,
+				AbortIfNotMet:      elem.AbortIfNotMet,
+				FanOutLimit:        elem.FanOutLimit,
+				FanOutFailFast:     elem.FanOutFailFast,
+				StderrAsError:      elem.StderrAsError,
+				ExpectOutputMode:   elem.ExpectOutputMode,
+				EmptyParams:        elem.EmptyParams,
+				DependsOn:          elem.DependsOn,
+				Parameters:         make([]json.RawMessage, 0, len(paramValues)),
+				NamedParameters:    make(map[string]json.RawMessage),
+			}
+			if elem.WorkDir != "" {
+				e.WorkDir = &elem.WorkDir
+			}
+			if elem.ParamsSchema.Valid {
+				e.ParamsSchema = json.RawMessage(elem.ParamsSchema.String)
+			}
+			if elem.ExitCodeMap.Valid {
+				e.ExitCodeMap = json.RawMessage(elem.ExitCodeMap.String)
+			}
+			if elem.FanOutParam != "" {
+				fanOutParam := elem.FanOutParam
+				e.FanOutParam = &fanOutParam
+			}
+			if elem.OutputTable != "" {
+				outputTable := elem.OutputTable
+				e.OutputTable = &outputTable
+			}
+			if elem.StderrPattern != "" {
+				stderrPattern := elem.StderrPattern
+				e.StderrPattern = &stderrPattern
+			}
+			if elem.ExpectOutput != "" {
+				expectOutput := elem.ExpectOutput
+				e.ExpectOutput = &expectOutput
+			}
+			if elem.RunAsUser != "" {
+				runAsUser := elem.RunAsUser
+				e.RunAsUser = &runAsUser
+			}
+			if elem.RunAsGroup != "" {
+				runAsGroup := elem.RunAsGroup
+				e.RunAsGroup = &runAsGroup
+			}
+			for _, val := range paramValues {
+				e.Parameters = append(e.Parameters, json.RawMessage(val))
+			}
+			var namedValues []struct {
+				Name  string `db:"param_name"`
+				Value string `db:"value"`
+			}
+			if err = tx.Select(&namedValues, SchemaSQL(sqlSelectNamedParamValues), cfg.ChainExecutionConfigID, elem.ChainID); err != nil {
+				return err
+			}
+			for _, p := range namedValues {
+				e.NamedParameters[p.Name] = json.RawMessage(p.Value)
+			}
+			d.Elements = append(d.Elements, e)
+		}
+		if d.LastRun, err = getLastRun(tx, cfg.ChainExecutionConfigID); err != nil {
+			return err
+		}
+		if err = tx.Get(&d.NextRun, SchemaSQL(sqlSelectNextRunTime), cfg.ChainExecutionConfigID); err != nil {
+			return err
+		}
+		descriptions = append(descriptions, d)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(descriptions)
+}
+
+// ChainState represents the chain execution configuration handled by the scheduler with its last and next run
+type ChainState struct {
+	ChainExecutionConfigID int         `json:"chain_execution_config"`
+	ChainName              string      `json:"chain_name"`
+	RunAt                  *string     `json:"run_at"`
+	Live                   bool        `json:"live"`
+	Paused                 bool        `json:"paused"`
+	Tags                   []string    `json:"tags"`
+	LastRun                *RunSummary `json:"last_run"`
+	NextRun                *time.Time  `json:"next_run"`
+}
+
+const sqlSelectChainStates = `
+SELECT chain_execution_config, chain_name, run_at, COALESCE(live, false) AS live, paused, tags
+FROM timetable.chain_execution_config
+WHERE ` + SQLChainFilter + `
+ORDER BY chain_execution_config`
+
+// GetChainStates returns chain execution configurations handled by the scheduler, i.e. matching its client name and
+// tag filters, with the last run outcome and the next scheduled run
+func GetChainStates() ([]ChainState, error) {
+	tx, err := ConfigDb().BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var rows []struct {
+		ChainConfig int            `db:"chain_execution_config"`
+		ChainName   string         `db:"chain_name"`
+		RunAt       sql.NullString `db:"run_at"`
+		Live        bool           `db:"live"`
+		Paused      bool           `db:"paused"`
+		Tags        pq.StringArray `db:"tags"`
+	}
+	if err = tx.Select(&rows, SchemaSQL(sqlSelectChainStates), ChainFilterArgs()...); err != nil {
+		return nil, err
+	}
+	states := make([]ChainState, 0, len(rows))
+	for _, r := range rows {
+		st := ChainState{ChainExecutionConfigID: r.ChainConfig, ChainName: r.ChainName, RunAt: nullString(r.RunAt),
+			Live: r.Live, Paused: r.Paused, Tags: []string(r.Tags)}
+		if st.Tags == nil {
+			st.Tags = []string{}
+		}
+		if st.LastRun, err = getLastRun(tx, r.ChainConfig); err != nil {
+			return nil, err
+		}
+		if err = tx.Get(&st.NextRun, SchemaSQL(sqlSelectNextRunTime), r.ChainConfig); err != nil {
+			return nil, err
+		}
+		states = append(states, st)
+	}
+	return states, nil
+}
+
+// getLastRun returns the outcome of the last run of the chain configuration, nil if it has never run
+func getLastRun(tx *sqlx.Tx, chainConfigID int) (*RunSummary, error) {
+	var run RunSummary
+	var finished sql.NullTime
+	err := tx.QueryRowx(SchemaSQL(sqlSelectLastRun), chainConfigID).Scan(&run.Status, &run.Started, &finished)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	if finished.Valid {
+		run.Finished = &finished.Time
+	}
+	return &run, nil
+}
+
+func nullString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
@@ -0,0 +1,133 @@
+package pgengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Diagnostics describes the state of the configuration database checked by DiagnoseConfigDB
+type Diagnostics struct {
+	Connected      bool     `json:"connected"`
+	Error          string   `json:"error,omitempty"` // the first check failed
+	ServerVersion  string   `json:"server_version"`
+	Database       string   `json:"database"`
+	User           string   `json:"user"`
+	Schema         string   `json:"schema"`
+	SchemaExists   bool     `json:"schema_exists"`
+	SchemaUpToDate bool     `json:"schema_up_to_date"`
+	MissingObjects []string `json:"missing_objects"`
+	LogLevel       string   `json:"log_level"`
+	ActiveChains   int      `json:"active_chains"` // live chain execution configurations
+}
+
+// Healthy returns true if the database is connected and the configuration schema is complete and up to date
+func (d Diagnostics) Healthy() bool {
+	return d.Connected && d.SchemaExists && d.SchemaUpToDate && len(d.MissingObjects) == 0
+}
+
+// DiagnoseConfigDB connects to the configuration database once and checks the configuration schema without
+// creating or upgrading it, the connection is closed before return
+func DiagnoseConfigDB() Diagnostics {
+	d := Diagnostics{Schema: Schema, LogLevel: "LOG", MissingObjects: []string{}}
+	if VerboseLogLevel.Get() {
+		d.LogLevel = "DEBUG"
+	}
+	db, err := openConfigDB()
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		d.Error = MaskSecrets(err.Error())
+		if db != nil {
+			_ = db.Close()
+		}
+		return d
+	}
+	d.Connected = true
+	SetConfigDb(sqlx.NewDb(db, "postgres"))
+	defer func() {
+		_ = ConfigDb().Close()
+		SetConfigDb(nil)
+	}()
+	if err = diagnoseSchema(&d); err != nil {
+		d.Error = err.Error()
+	}
+	return d
+}
+
+// diagnoseSchema fills in server and schema information, the first failed query is returned
+func diagnoseSchema(d *Diagnostics) error {
+	err := ConfigDb().QueryRow("SELECT current_setting('server_version'), current_database(), current_user").
+		Scan(&d.ServerVersion, &d.Database, &d.User)
+	if err != nil {
+		return err
+	}
+	if err = ConfigDb().Get(&d.SchemaExists, "SELECT EXISTS(SELECT 1 FROM pg_namespace WHERE nspname = $1)", Schema); err != nil {
+		return err
+	}
+	if !d.SchemaExists {
+		return nil
+	}
+	upgrade, err := schemaMigrator().NeedUpgrade(ConfigDb().DB)
+	if err != nil {
+		return err
+	}
+	d.SchemaUpToDate = !upgrade
+	missing, err := missingSchemaObjects()
+	if err != nil {
+		return err
+	}
+	for _, obj := range missing {
+		d.MissingObjects = append(d.MissingObjects, formatSchemaObjects([]schemaObject{obj}))
+	}
+	if len(missing) > 0 {
+		return nil
+	}
+	return ConfigDb().Get(&d.ActiveChains, SchemaSQL("SELECT count(*) FROM timetable.chain_execution_config WHERE live"))
+}
+
+// WriteDiagnostics writes diagnostics as readable lines or as a JSON document
+func WriteDiagnostics(w io.Writer, d Diagnostics, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	}
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Connected:\t%s\n", yesNo(d.Connected))
+	if d.Connected {
+		fmt.Fprintf(tw, "Server version:\t%s\n", d.ServerVersion)
+		fmt.Fprintf(tw, "Database:\t%s\n", d.Database)
+		fmt.Fprintf(tw, "User:\t%s\n", d.User)
+		fmt.Fprintf(tw, "Schema %s exists:\t%s\n", d.Schema, yesNo(d.SchemaExists))
+	}
+	if d.SchemaExists {
+		fmt.Fprintf(tw, "Schema up to date:\t%s\n", yesNo(d.SchemaUpToDate))
+		if len(d.MissingObjects) > 0 {
+			fmt.Fprintf(tw, "Missing objects:\t%s\n", strings.Join(d.MissingObjects, "\n\t"))
+		} else {
+			fmt.Fprintf(tw, "Active chains:\t%d\n", d.ActiveChains)
+		}
+	}
+	fmt.Fprintf(tw, "Log level:\t%s\n", d.LogLevel)
+	if d.Error != "" {
+		fmt.Fprintf(tw, "Error:\t%s\n", d.Error)
+	}
+	status := "healthy"
+	if !d.Healthy() {
+		status = "unhealthy"
+	}
+	fmt.Fprintf(tw, "Status:\t%s\n", status)
+	return tw.Flush()
+}
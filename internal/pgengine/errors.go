@@ -0,0 +1,116 @@
+package pgengine
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/lib/pq"
+)
+
+// ErrConnectionLost is matched by errors of queries failed because the connection to the server is broken or
+// closed by the server, the query may succeed once the connection is established again
+var ErrConnectionLost = errors.New("Database connection lost")
+
+// QueryError is returned by the E-variant functions if the server reported an error executing the query
+type QueryError struct {
+	Query string    // name of the failed operation, e.g. "chain claim"
+	Err   *pq.Error // error reported by the server
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Query, e.Err.Error())
+}
+
+// Unwrap returns the underlying *pq.Error
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrConnectionLost for connection exceptions and errors reported by the server shutting down
+func (e *QueryError) Is(target error) bool {
+	return target == ErrConnectionLost && isConnectionLostCode(e.Err.Code)
+}
+
+// SQLState returns the SQLSTATE code of the error reported by the server, e.g. 40P01 for deadlock_detected
+func (e *QueryError) SQLState() string {
+	return string(e.Err.Code)
+}
+
+// connectionError wraps the driver or network error of the broken connection, it matches ErrConnectionLost
+type connectionError struct {
+	query string
+	err   error
+}
+
+func (e *connectionError) Error() string {
+	return fmt.Sprintf("%s failed: %s: %s", e.query, ErrConnectionLost, e.err)
+}
+
+func (e *connectionError) Unwrap() error {
+	return e.err
+}
+
+func (e *connectionError) Is(target error) bool {
+	return target == ErrConnectionLost
+}
+
+// isConnectionLostCode returns true for SQLSTATE class 08 connection exceptions and for the sessions terminated by
+// admin_shutdown, crash_shutdown or cannot_connect_now
+func isConnectionLostCode(code pq.ErrorCode) bool {
+	return code.Class() == "08" || code == "57P01" || code == "57P02" || code == "57P03"
+}
+
+// queryError returns the error of the operation as QueryError if it's reported by the server or matching
+// ErrConnectionLost if the connection is broken. Other errors, e.g. sql.ErrNoRows or errors already classified,
+// are returned as is
+func queryError(query string, err error) error {
+	var qErr *QueryError
+	var cErr *connectionError
+	if err == nil || errors.As(err, &qErr) || errors.As(err, &cErr) {
+		return err
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return &QueryError{Query: query, Err: pqErr}
+	}
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return &connectionError{query: query, err: err}
+	}
+	return err
+}
+
+// SQLState returns the SQLSTATE code of the error reported by the server, empty string for other errors
+func SQLState(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	return ""
+}
+
+// redacted hides passwords of connection strings and secrets in the message of the wrapped error
+type redacted struct {
+	err error
+}
+
+func (e *redacted) Error() string {
+	return MaskSecrets(redactPassword(e.err.Error()))
+}
+
+func (e *redacted) Unwrap() error {
+	return e.err
+}
+
+// redactedError returns the error with the message redacted, the error chain is kept for errors.Is and errors.As
+func redactedError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redacted{err: err}
+}
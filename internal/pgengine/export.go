@@ -0,0 +1,481 @@
+package pgengine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// RedactedPassword replaces passwords of database connections in exported configuration
+const RedactedPassword = "<redacted>"
+
+// ExportedConnection represents timetable.database_connection row
+type ExportedConnection struct {
+	ID             int64   `json:"database_connection" db:"database_connection"`
+	ConnectString  string  `json:"connect_string" db:"connect_string"`
+	Comment        *string `json:"comment" db:"comment"`
+	PasswordSecret *string `json:"password_secret" db:"password_secret"`
+	SSLMode        *string `json:"sslmode" db:"sslmode"`
+	SSLRootCert    *string `json:"sslrootcert" db:"sslrootcert"`
+	SSLCert        *string `json:"sslcert" db:"sslcert"`
+	SSLKey         *string `json:"sslkey" db:"sslkey"`
+}
+
+// ExportedTask represents timetable.base_task row
+type ExportedTask struct {
+	ID             int64           `json:"task_id" db:"task_id"`
+	Name           string          `json:"name" db:"name"`
+	Kind           string          `json:"kind" db:"kind"`
+	Script         *string         `json:"script" db:"script"`
+	SeparateOutput bool            `json:"separate_output" db:"separate_output"`
+	WorkDir        *string         `json:"work_dir" db:"work_dir"`
+	MinInterval    *int            `json:"min_interval" db:"min_interval"`
+	Nice           *int            `json:"nice" db:"nice"`
+	MaxCPUTime     *int            `json:"max_cpu_time" db:"max_cpu_time"`
+	MaxMemory      *int            `json:"max_memory" db:"max_memory"`
+	MaxOpenFiles   *int            `json:"max_open_files" db:"max_open_files"`
+	ParamsSchema   json.RawMessage `json:"params_schema" db:"-"`
+	OutputTable    *string         `json:"output_table" db:"output_table"`
+	StderrAsError  bool            `json:"treat_stderr_as_error" db:"treat_stderr_as_error"`
+	StderrPattern  *string         `json:"stderr_error_pattern" db:"stderr_error_pattern"`
+	ExitCodeMap    json.RawMessage `json:"exit_code_map" db:"-"`
+	ExpectOutput   *string         `json:"expect_output" db:"expect_output"`
+	ExpectMode     string          `json:"expect_output_mode" db:"expect_output_mode"`
+	RunAsUser      *string         `json:"run_as_user" db:"run_as_user"`
+	RunAsGroup     *string         `json:"run_as_group" db:"run_as_group"`
+	EmptyParams    string          `json:"empty_params" db:"empty_params"`
+	// ParamsSchemaText is the schema selected from the database, JSONB can't be scanned into json.RawMessage safely
+	ParamsSchemaText *string `json:"-" db:"params_schema"`
+	// ExitCodeMapText is the exit code map selected from the database like ParamsSchemaText
+	ExitCodeMapText *string `json:"-" db:"exit_code_map"`
+}
+
+// ExportedChainElement represents timetable.task_chain row
+type ExportedChainElement struct {
+	ID                 int64         `json:"chain_id" db:"chain_id"`
+	ParentID           *int64        `json:"parent_id" db:"parent_id"`
+	TaskID             int64         `json:"task_id" db:"task_id"`
+	RunUID             *string       `json:"run_uid" db:"run_uid"`
+	DatabaseConnection *int64        `json:"database_connection" db:"database_connection"`
+	IgnoreError        *bool         `json:"ignore_error" db:"ignore_error"`
+	RunIfExitCodes     pq.Int64Array `json:"run_if_exit_codes" db:"run_if_exit_codes"`
+	AbortIfNotMet      bool          `json:"abort_if_not_met" db:"abort_if_not_met"`
+	FanOutParam        *string       `json:"fan_out_param" db:"fan_out_param"`
+	FanOutLimit        *int          `json:"fan_out_limit" db:"fan_out_limit"`
+	FanOutFailFast     *bool         `json:"fan_out_fail_fast" db:"fan_out_fail_fast"`
+	DependsOn          pq.Int64Array `json:"depends_on" db:"depends_on"`
+}
+
+// ExportedParameter represents timetable.chain_execution_parameters row
+type ExportedParameter struct {
+	ChainExecutionConfig int64           `json:"chain_execution_config"`
+	ChainID              int64           `json:"chain_id"`
+	OrderID              int             `json:"order_id"`
+	Value                json.RawMessage `json:"value"`
+	ParamName            *string         `json:"param_name"`
+}
+
+// ExportedConfig is the portable representation of the scheduler configuration
+type ExportedConfig struct {
+	DatabaseConnections []ExportedConnection   `json:"database_connections"`
+	BaseTasks           []ExportedTask         `json:"base_tasks"`
+	TaskChains          []ExportedChainElement `json:"task_chains"`
+	ChainConfigs        []ChainConfig          `json:"chain_execution_configs"`
+	Parameters          []ExportedParameter    `json:"chain_execution_parameters"`
+}
+
+// ImportOptions controls how configuration is imported
+type ImportOptions struct {
+	// Replace removes all existing chains, configurations, connections and non built-in tasks before import,
+	// otherwise tasks are updated by name, configurations by chain name and connections are reused if identical
+	Replace bool
+	// Passwords to put instead of redacted ones, by exported database connection ID
+	Passwords map[int64]string
+}
+
+var (
+	reKeyValuePassword = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+	reURLPassword      = regexp.MustCompile(`^(postgres(?:ql)?://[^:@/]*:)([^@/]*)(@)`)
+)
+
+// redactPassword removes password from both key/value and URL style connection strings
+func redactPassword(connStr string) string {
+	connStr = reKeyValuePassword.ReplaceAllString(connStr, "${1}"+RedactedPassword)
+	return reURLPassword.ReplaceAllString(connStr, "${1}"+RedactedPassword+"${3}")
+}
+
+// ExportConfig writes database connections without passwords, base tasks, chains, chain execution configurations
+// and parameters to w as JSON document
+func ExportConfig(w io.Writer) error {
+	var cfg ExportedConfig
+	tx, err := ConfigDb().BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err = tx.Select(&cfg.DatabaseConnections, SchemaSQL(`SELECT database_connection, connect_string, comment,
+		password_secret, sslmode, sslrootcert, sslcert, sslkey
+		FROM timetable.database_connection ORDER BY 1`)); err != nil {
+		return err
+	}
+	for i := range cfg.DatabaseConnections {
+		cfg.DatabaseConnections[i].ConnectString = redactPassword(cfg.DatabaseConnections[i].ConnectString)
+	}
+	if err = tx.Select(&cfg.BaseTasks, SchemaSQL(`SELECT task_id, name, kind, script, separate_output, work_dir,
+		min_interval, nice, max_cpu_time, max_memory, max_open_files, params_schema :: text, output_table,
+		treat_stderr_as_error, stderr_error_pattern, exit_code_map :: text, expect_output, expect_output_mode,
+		run_as_user, run_as_group, empty_params
+		FROM timetable.base_task ORDER BY 1`)); err != nil {
+		return err
+	}
+	for i, t := range cfg.BaseTasks {
+		if t.ParamsSchemaText != nil {
+			cfg.BaseTasks[i].ParamsSchema = json.RawMessage(*t.ParamsSchemaText)
+		}
+		if t.ExitCodeMapText != nil {
+			cfg.BaseTasks[i].ExitCodeMap = json.RawMessage(*t.ExitCodeMapText)
+		}
+	}
+	if err = tx.Select(&cfg.TaskChains, SchemaSQL(`SELECT chain_id, parent_id, task_id, run_uid, database_connection,
+		ignore_error, run_if_exit_codes, abort_if_not_met, fan_out_param, fan_out_limit, fan_out_fail_fast, depends_on
+		FROM timetable.task_chain ORDER BY 1`)); err != nil {
+		return err
+	}
+	if err = tx.Select(&cfg.ChainConfigs, SchemaSQL(sqlSelectChainConfigs)); err != nil {
+		return err
+	}
+	rows, err := tx.Query(SchemaSQL(`SELECT chain_execution_config, chain_id, order_id, value :: text, param_name
+		FROM timetable.chain_execution_parameters ORDER BY 1, 2, 3`))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p ExportedParameter
+		var value string
+		if err = rows.Scan(&p.ChainExecutionConfig, &p.ChainID, &p.OrderID, &value, &p.ParamName); err != nil {
+			return err
+		}
+		p.Value = json.RawMessage(value)
+		cfg.Parameters = append(cfg.Parameters, p)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cfg)
+}
+
+// ImportConfig reads configuration exported by ExportConfig from r and applies it within a transaction.
+// All IDs are remapped, so the configuration can be imported into a database with existing objects
+func ImportConfig(r io.Reader, opts ImportOptions) error {
+	var cfg ExportedConfig
+	if err := json.NewDecoder(r).Decode(&cfg); err != nil {
+		return err
+	}
+	return RetryTransient(context.Background(), "configuration import", func() error {
+		return importConfig(cfg, opts)
+	})
+}
+
+// importConfig imports decoded configuration within one transaction
+func importConfig(cfg ExportedConfig, opts ImportOptions) (err error) {
+	tx, err := ConfigDb().Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	if err = setChangeClientName(tx); err != nil {
+		return err
+	}
+	if opts.Replace {
+		if _, err = tx.Exec(SchemaSQL(`DELETE FROM timetable.chain_execution_config`)); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(SchemaSQL(`DELETE FROM timetable.task_chain`)); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(SchemaSQL(`DELETE FROM timetable.base_task WHERE kind <> 'BUILTIN'`)); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(SchemaSQL(`DELETE FROM timetable.database_connection`)); err != nil {
+			return err
+		}
+	}
+	connIDs, err := importConnections(tx, cfg.DatabaseConnections, opts.Passwords)
+	if err != nil {
+		return err
+	}
+	taskIDs, err := importTasks(tx, cfg.BaseTasks)
+	if err != nil {
+		return err
+	}
+	chainIDs, err := importChains(tx, cfg.TaskChains, taskIDs, connIDs)
+	if err != nil {
+		return err
+	}
+	configIDs, err := importChainConfigs(tx, cfg.ChainConfigs, chainIDs)
+	if err != nil {
+		return err
+	}
+	return importParameters(tx, cfg.Parameters, configIDs, chainIDs)
+}
+
+func importConnections(tx *sqlx.Tx, conns []ExportedConnection, passwords map[int64]string) (map[int64]int64, error) {
+	ids := make(map[int64]int64, len(conns))
+	for _, c := range conns {
+		connStr := c.ConnectString
+		if strings.Contains(connStr, RedactedPassword) {
+			pwd, ok := passwords[c.ID]
+			if !ok {
+				return nil, fmt.Errorf("Password for database connection %d is not supplied", c.ID)
+			}
+			connStr = strings.Replace(connStr, RedactedPassword, pwd, -1)
+		}
+		var id int64
+		err := tx.Get(&id, SchemaSQL(`SELECT database_connection FROM timetable.database_connection
+			WHERE connect_string = $1 AND password_secret IS NOT DISTINCT FROM $2 AND sslmode IS NOT DISTINCT FROM $3
+				AND sslrootcert IS NOT DISTINCT FROM $4 AND sslcert IS NOT DISTINCT FROM $5 AND sslkey IS NOT DISTINCT FROM $6
+			ORDER BY 1 LIMIT 1`), connStr, c.PasswordSecret, c.SSLMode, c.SSLRootCert, c.SSLCert, c.SSLKey)
+		if err == sql.ErrNoRows {
+			err = tx.Get(&id, SchemaSQL(`INSERT INTO timetable.database_connection (connect_string, comment,
+				password_secret, sslmode, sslrootcert, sslcert, sslkey)
+				VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING database_connection`),
+				connStr, c.Comment, c.PasswordSecret, c.SSLMode, c.SSLRootCert, c.SSLCert, c.SSLKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids[c.ID] = id
+	}
+	return ids, nil
+}
+
+func importTasks(tx *sqlx.Tx, baseTasks []ExportedTask) (map[int64]int64, error) {
+	ids := make(map[int64]int64, len(baseTasks))
+	for _, t := range baseTasks {
+		var id int64
+		var schema *string
+		if len(t.ParamsSchema) > 0 && string(t.ParamsSchema) != "null" {
+			s := string(t.ParamsSchema)
+			schema = &s
+		}
+		var exitCodes *string
+		if len(t.ExitCodeMap) > 0 && string(t.ExitCodeMap) != "null" {
+			s := string(t.ExitCodeMap)
+			exitCodes = &s
+		}
+		var expectMode *string
+		if t.ExpectMode != "" {
+			expectMode = &t.ExpectMode
+		}
+		var emptyParams *string
+		if t.EmptyParams != "" {
+			emptyParams = &t.EmptyParams
+		}
+		err := tx.Get(&id, SchemaSQL(`INSERT INTO timetable.base_task (name, kind, script, separate_output, work_dir, min_interval,
+				nice, max_cpu_time, max_memory, max_open_files, params_schema, output_table, treat_stderr_as_error,
+				stderr_error_pattern, exit_code_map, expect_output, expect_output_mode, run_as_user, run_as_group,
+				empty_params)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, COALESCE($17, 'contains'),
+				$18, $19, COALESCE($20, 'run'))
+			ON CONFLICT (name) DO UPDATE SET kind = EXCLUDED.kind, script = EXCLUDED.script,
+				separate_output = EXCLUDED.separate_output, work_dir = EXCLUDED.work_dir,
+				min_interval = EXCLUDED.min_interval, nice = EXCLUDED.nice, max_cpu_time = EXCLUDED.max_cpu_time,
+				max_memory = EXCLUDED.max_memory, max_open_files = EXCLUDED.max_open_files,
+				params_schema = EXCLUDED.params_schema, output_table = EXCLUDED.output_table,
+				treat_stderr_as_error = EXCLUDED.treat_stderr_as_error, stderr_error_pattern = EXCLUDED.stderr_error_pattern,
+				exit_code_map = EXCLUDED.exit_code_map, expect_output = EXCLUDED.expect_output,
+				expect_output_mode = EXCLUDED.expect_output_mode, run_as_user = EXCLUDED.run_as_user,
+				run_as_group = EXCLUDED.run_as_group, empty_params = EXCLUDED.empty_params
+			RETURNING task_id`), t.Name, t.Kind, t.Script, t.SeparateOutput, t.WorkDir, t.MinInterval,
+			t.Nice, t.MaxCPUTime, t.MaxMemory, t.MaxOpenFiles, schema, t.OutputTable, t.StderrAsError, t.StderrPattern,
+			exitCodes, t.ExpectOutput, expectMode, t.RunAsUser, t.RunAsGroup, emptyParams)
+		if err != nil {
+			return nil, err
+		}
+		ids[t.ID] = id
+	}
+	return ids, nil
+}
+
+// importChains inserts chain elements parents first, so parent_id can be remapped, depends_on is remapped afterwards
+func importChains(tx *sqlx.Tx, elements []ExportedChainElement, taskIDs, connIDs map[int64]int64) (map[int64]int64, error) {
+	ids := make(map[int64]int64, len(elements))
+	pending := elements
+	for len(pending) > 0 {
+		var postponed []ExportedChainElement
+		for _, e := range pending {
+			var parentID *int64
+			if e.ParentID != nil {
+				id, ok := ids[*e.ParentID]
+				if !ok {
+					postponed = append(postponed, e)
+					continue
+				}
+				parentID = &id
+			}
+			taskID, ok := taskIDs[e.TaskID]
+			if !ok {
+				return nil, fmt.Errorf("Base task %d of chain element %d is not exported", e.TaskID, e.ID)
+			}
+			var connID *int64
+			if e.DatabaseConnection != nil {
+				id, ok := connIDs[*e.DatabaseConnection]
+				if !ok {
+					return nil, fmt.Errorf("Database connection %d of chain element %d is not exported", *e.DatabaseConnection, e.ID)
+				}
+				connID = &id
+			}
+			var id int64
+			err := tx.Get(&id, SchemaSQL(`INSERT INTO timetable.task_chain (parent_id, task_id, run_uid, database_connection,
+				ignore_error, run_if_exit_codes, abort_if_not_met, fan_out_param, fan_out_limit, fan_out_fail_fast)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, COALESCE($10, true)) RETURNING chain_id`),
+				parentID, taskID, e.RunUID, connID, e.IgnoreError, e.RunIfExitCodes, e.AbortIfNotMet,
+				e.FanOutParam, e.FanOutLimit, e.FanOutFailFast)
+			if err != nil {
+				return nil, err
+			}
+			ids[e.ID] = id
+		}
+		if len(postponed) == len(pending) {
+			return nil, fmt.Errorf("Parent of chain element %d is not exported", pending[0].ID)
+		}
+		pending = postponed
+	}
+	// dependencies may refer to elements inserted later, so they are remapped when all elements are inserted
+	for _, e := range elements {
+		if e.DependsOn == nil {
+			continue
+		}
+		deps := make(pq.Int64Array, len(e.DependsOn))
+		for i, dep := range e.DependsOn {
+			id, ok := ids[dep]
+			if !ok {
+				return nil, fmt.Errorf("Dependency %d of chain element %d is not exported", dep, e.ID)
+			}
+			deps[i] = id
+		}
+		if _, err := tx.Exec(SchemaSQL(`UPDATE timetable.task_chain SET depends_on = $1 WHERE chain_id = $2`),
+			deps, ids[e.ID]); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+func importChainConfigs(tx *sqlx.Tx, configs []ChainConfig, chainIDs map[int64]int64) (map[int64]int64, error) {
+	const sqlUpsertChainConfig = `
+INSERT INTO timetable.chain_execution_config 
+(chain_id, chain_name, run_at, max_instances, live, self_destruct, exclusive_execution, client_name, max_jitter, timeout, notify_channel, 
+	priority, precondition, tags, window_start, window_end, window_timezone, window_action, missed_ticks) 
+VALUES 
+(NULLIF(:chain_id, 0), :chain_name, :run_at, :max_instances, :live, :self_destruct, :exclusive_execution, :client_name, :max_jitter, :timeout, 
+	:notify_channel, :priority, :precondition, :tags, :window_start, :window_end, :window_timezone, COALESCE(NULLIF(:window_action, ''), 'skip'), 
+	COALESCE(NULLIF(:missed_ticks, ''), 'skip')) 
+ON CONFLICT (chain_name) DO UPDATE SET chain_id = EXCLUDED.chain_id, run_at = EXCLUDED.run_at,
+	max_instances = EXCLUDED.max_instances, live = EXCLUDED.live, self_destruct = EXCLUDED.self_destruct,
+	exclusive_execution = EXCLUDED.exclusive_execution, client_name = EXCLUDED.client_name,
+	max_jitter = EXCLUDED.max_jitter, timeout = EXCLUDED.timeout, notify_channel = EXCLUDED.notify_channel,
+	priority = EXCLUDED.priority, precondition = EXCLUDED.precondition, tags = EXCLUDED.tags,
+	window_start = EXCLUDED.window_start, window_end = EXCLUDED.window_end, window_timezone = EXCLUDED.window_timezone,
+	window_action = EXCLUDED.window_action, missed_ticks = EXCLUDED.missed_ticks
+RETURNING chain_execution_config`
+	upsert, err := tx.PrepareNamed(SchemaSQL(sqlUpsertChainConfig))
+	if err != nil {
+		return nil, err
+	}
+	defer upsert.Close()
+	ids := make(map[int64]int64, len(configs))
+	for _, c := range configs {
+		if err := ValidateRunAt(c.RunAt.String); err != nil {
+			return nil, fmt.Errorf("Chain configuration %s: %w", c.ChainName, err)
+		}
+		if c.ChainID != 0 {
+			id, ok := chainIDs[int64(c.ChainID)]
+			if !ok {
+				return nil, fmt.Errorf("Chain %d of configuration %s is not exported", c.ChainID, c.ChainName)
+			}
+			c.ChainID = int(id)
+		}
+		var oldChainID *int64
+		err := tx.Get(&oldChainID, SchemaSQL(`SELECT chain_id FROM timetable.chain_execution_config WHERE chain_name = $1`), c.ChainName)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		var id int64
+		if err = upsert.Get(&id, c); err != nil {
+			return nil, err
+		}
+		ids[int64(c.ChainExecutionConfigID)] = id
+		if _, err = tx.Exec(SchemaSQL(`DELETE FROM timetable.chain_execution_parameters WHERE chain_execution_config = $1`), id); err != nil {
+			return nil, err
+		}
+		// remove the replaced chain if no other configuration uses it
+		if oldChainID != nil {
+			if _, err = tx.Exec(SchemaSQL(`DELETE FROM timetable.task_chain tc WHERE chain_id = $1
+				AND NOT EXISTS (SELECT 1 FROM timetable.chain_execution_config c WHERE c.chain_id = tc.chain_id)`),
+				*oldChainID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// excluded configurations and on-failure chains can reference any configuration, so remap them after all are
+	// imported, on-failure chains which are not exported are removed like excluded configurations
+	for _, c := range configs {
+		id, ok := ids[c.OnFailureChainID.Int64]
+		onFailure := sql.NullInt64{Int64: id, Valid: ok && c.OnFailureChainID.Valid}
+		if _, err := tx.Exec(SchemaSQL(`UPDATE timetable.chain_execution_config SET on_failure_chain_id = $1
+			WHERE chain_execution_config = $2`), onFailure, ids[int64(c.ChainExecutionConfigID)]); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range configs {
+		if c.ExcludedExecutionConfigs == nil {
+			continue
+		}
+		excluded := make(pq.Int64Array, 0, len(c.ExcludedExecutionConfigs))
+		for _, oldID := range c.ExcludedExecutionConfigs {
+			if id, ok := ids[oldID]; ok {
+				excluded = append(excluded, id)
+			}
+		}
+		if _, err := tx.Exec(SchemaSQL(`UPDATE timetable.chain_execution_config SET excluded_execution_configs = $1
+			WHERE chain_execution_config = $2`), excluded, ids[int64(c.ChainExecutionConfigID)]); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+func importParameters(tx *sqlx.Tx, params []ExportedParameter, configIDs, chainIDs map[int64]int64) error {
+	for _, p := range params {
+		configID, ok := configIDs[p.ChainExecutionConfig]
+		if !ok {
+			return fmt.Errorf("Configuration %d of parameter is not exported", p.ChainExecutionConfig)
+		}
+		chainID, ok := chainIDs[p.ChainID]
+		if !ok {
+			return fmt.Errorf("Chain element %d of parameter is not exported", p.ChainID)
+		}
+		if _, err := tx.Exec(SchemaSQL(`INSERT INTO timetable.chain_execution_parameters (chain_execution_config, chain_id, order_id, value, param_name)
+			VALUES ($1, $2, $3, $4, $5)`), configID, chainID, p.OrderID, string(p.Value), p.ParamName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
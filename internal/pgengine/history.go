@@ -0,0 +1,162 @@
+package pgengine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// historySnippetSize is the maximum number of characters of task output and stderr selected for the run history
+const historySnippetSize = 1024
+
+// historyColumnSize is the maximum number of characters of output printed in the run history table
+const historyColumnSize = 60
+
+// RunRecord represents one chain run with the outcome of its elements
+type RunRecord struct {
+	RunStatus  int           `json:"run_status" db:"run_status"`
+	Status     string        `json:"status" db:"status"`
+	Started    time.Time     `json:"started" db:"started"`
+	Finished   *time.Time    `json:"finished" db:"finished"`
+	ClientName string        `json:"client_name" db:"client_name"`
+	StderrTail *string       `json:"stderr_tail" db:"stderr_tail"`
+	Elements   []TaskOutcome `json:"elements" db:"-"`
+}
+
+// TaskOutcome represents the execution log entry of a chain element, Result holds data of the task result
+type TaskOutcome struct {
+	TaskID     int             `json:"task_id" db:"task_id"`
+	Name       string          `json:"name" db:"name"`
+	Started    time.Time       `json:"started" db:"last_run"`
+	Finished   *time.Time      `json:"finished" db:"finished"`
+	ReturnCode *int            `json:"returncode" db:"returncode"`
+	Output     *string         `json:"output" db:"output"`
+	Stderr     *string         `json:"stderr" db:"stderr"`
+	Result     json.RawMessage `json:"result" db:"result"`
+}
+
+// RunningChain represents the chain run being executed by the scheduler process
+type RunningChain struct {
+	RunStatus              int       `json:"run_status"`
+	ChainExecutionConfigID int       `json:"chain_execution_config"`
+	ChainName              string    `json:"chain_name"`
+	Started                time.Time `json:"started"`
+}
+
+const sqlSelectRunHistory = `
+SELECT h.run_status, COALESCE(f.execution_status :: text, h.execution_status :: text) AS status, h.started,
+	CASE WHEN f.execution_status <> 'STARTED' THEN f.last_status_update END AS finished,
+	h.client_name, f.stderr_tail
+FROM timetable.run_status h LEFT JOIN LATERAL (
+	SELECT execution_status, last_status_update, stderr_tail
+	FROM timetable.run_status
+	WHERE start_status = h.run_status AND fan_out_item IS NULL
+	ORDER BY run_status DESC
+	LIMIT 1) f ON true
+WHERE h.chain_execution_config = $1 AND h.start_status IS NULL AND h.started >= now() - $2 * interval '1 second'
+ORDER BY h.run_status DESC`
+
+var sqlSelectRunTasks = fmt.Sprintf(`
+SELECT task_id, name, last_run, finished, returncode, left(output, %[1]d) AS output, left(stderr, %[1]d) AS stderr, result
+FROM timetable.execution_log
+WHERE chain_execution_config = $1 AND client_name = $2 AND last_run >= $3 AND ($4 :: timestamptz IS NULL OR last_run <= $4)
+ORDER BY last_run`, historySnippetSize)
+
+// GetRunHistory returns runs of the chain configuration started within the last since duration, newest first.
+// Elements are matched to the run by the client name and the execution time
+func GetRunHistory(chainConfigID int, since time.Duration) ([]RunRecord, error) {
+	tx, err := ConfigDb().BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var exists bool
+	if err = tx.Get(&exists, SchemaSQL("SELECT EXISTS(SELECT 1 FROM timetable.chain_execution_config WHERE chain_execution_config = $1)"),
+		chainConfigID); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrChainNotFound
+	}
+	runs := []RunRecord{}
+	if err = tx.Select(&runs, SchemaSQL(sqlSelectRunHistory), chainConfigID, since.Seconds()); err != nil {
+		return nil, err
+	}
+	for i := range runs {
+		runs[i].Elements = []TaskOutcome{}
+		if err = tx.Select(&runs[i].Elements, SchemaSQL(sqlSelectRunTasks), chainConfigID, runs[i].ClientName,
+			runs[i].Started, runs[i].Finished); err != nil {
+			return nil, err
+		}
+	}
+	return runs, nil
+}
+
+// WriteRunHistory writes runs as a readable table or as a JSON document
+func WriteRunHistory(w io.Writer, runs []RunRecord, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(runs)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tSTARTED\tDURATION\tSTATUS\tTASK\tRC\tOUTPUT")
+	for _, run := range runs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t\t\t%s\n", run.RunStatus, run.Started.Format(time.RFC3339),
+			formatDuration(run.Started, run.Finished), run.Status, snippet(run.StderrTail))
+		for _, task := range run.Elements {
+			rc := "-"
+			if task.ReturnCode != nil {
+				rc = fmt.Sprint(*task.ReturnCode)
+			}
+			out := task.Stderr
+			if out == nil || *out == "" {
+				out = task.Output
+			}
+			fmt.Fprintf(tw, "\t%s\t%s\t\t%s\t%s\t%s\n", task.Started.Format(time.RFC3339),
+				formatDuration(task.Started, task.Finished), task.Name, rc, snippet(out))
+		}
+	}
+	return tw.Flush()
+}
+
+// PrintRunHistory writes runs of the chain configuration started within the last since duration
+func PrintRunHistory(w io.Writer, chainConfigID int, since time.Duration, asJSON bool) error {
+	runs, err := GetRunHistory(chainConfigID, since)
+	if err != nil {
+		LogToDB("ERROR", "Cannot read run history: ", err)
+		return err
+	}
+	return WriteRunHistory(w, runs, asJSON)
+}
+
+// formatDuration returns the time between started and finished or "-" if not finished yet
+func formatDuration(started time.Time, finished *time.Time) string {
+	if finished == nil {
+		return "-"
+	}
+	return finished.Sub(started).Round(time.Millisecond).String()
+}
+
+// snippet returns the first non-empty line of s shortened to fit the table column
+func snippet(s *string) string {
+	if s == nil {
+		return ""
+	}
+	var line string
+	for _, line = range strings.Split(*s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			break
+		}
+	}
+	if r := []rune(line); len(r) > historyColumnSize {
+		line = string(r[:historyColumnSize-3]) + "..."
+	}
+	return line
+}
@@ -0,0 +1,227 @@
+package pgengine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// InstanceLock parameter specifies if the start is refused ("refuse") or waits ("wait") while another scheduler
+// holds the instance lock of the same schema and client name, "off" doesn't take the lock at all
+var InstanceLock = "refuse"
+
+// ClientNameGenerated is true if ClientName was generated by GenerateClientName. The instance lock is keyed by
+// the host name then, so processes started on one host without client name exclude each other too
+var ClientNameGenerated bool
+
+// ErrInstanceLocked is returned if the instance lock is held by another session
+var ErrInstanceLocked = errors.New("Another pg_timetable instance is already running")
+
+// instanceLockRetry specifies how often the instance lock is tried again while waiting for it
+var instanceLockRetry = HeartbeatInterval
+
+// instanceLock holds the dedicated connection of the session level advisory lock, so the lock isn't lost when
+// the pool closes idle connections and it's released by the server as soon as the session dies
+var instanceLock struct {
+	sync.Mutex
+	conn *sql.Conn
+}
+
+// instanceLockName returns the name the instance lock key is hashed from
+func instanceLockName() string {
+	name := ClientName
+	if ClientNameGenerated {
+		if name, _ = os.Hostname(); name == "" {
+			name = "pg_timetable"
+		}
+	}
+	return Schema + "/" + name
+}
+
+// instanceLockKey returns the advisory lock key made of AppID and Adler32 hash of the instance lock name
+func instanceLockKey() int64 {
+	return int64(AppID)<<32 | int64(adler32.Checksum([]byte(instanceLockName())))
+}
+
+// tryLockInstance takes the instance lock on a dedicated connection unless the process holds it already
+func tryLockInstance() (bool, error) {
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+	if instanceLock.conn != nil {
+		return true, nil
+	}
+	ctx := context.Background()
+	conn, err := ConfigDb().Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	LogToDB("DEBUG", fmt.Sprintf("Trying to get advisory lock for '%s' with key 0x%x", instanceLockName(), instanceLockKey()))
+	var res bool
+	if err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", instanceLockKey()).Scan(&res); err != nil || !res {
+		_ = conn.Close()
+		return false, err
+	}
+	instanceLock.conn = conn
+	return true, nil
+}
+
+// TryLockClientName obtains lock on the server to prevent another client with the same name
+func TryLockClientName() bool {
+	res, err := TryLockClientNameE()
+	if err != nil {
+		LogToDB("ERROR", "Error occurred during client name locking: ", err)
+	}
+	return res
+}
+
+// TryLockClientNameE is TryLockClientName returning the error instead of logging it, false and no error are
+// returned if the lock is held by another session
+func TryLockClientNameE() (bool, error) {
+	res, err := tryLockInstance()
+	return res, queryError("client name lock", err)
+}
+
+// instanceLockHolder describes the session holding the instance lock for log messages
+func instanceLockHolder() string {
+	const sqlLockHolder = `SELECT a.pid, coalesce(host(a.client_addr), 'local socket') AS addr, a.backend_start
+FROM pg_locks l JOIN pg_stat_activity a USING (pid)
+WHERE l.locktype = 'advisory' AND l.granted AND l.objsubid = 1
+	AND l.database = (SELECT oid FROM pg_database WHERE datname = current_database())
+	AND ((l.classid :: bigint << 32) | l.objid :: bigint) = $1`
+	var holder struct {
+		PID     int       `db:"pid"`
+		Addr    string    `db:"addr"`
+		Started time.Time `db:"backend_start"`
+	}
+	if err := ConfigDb().Get(&holder, sqlLockHolder, instanceLockKey()); err != nil {
+		return "unknown session"
+	}
+	return fmt.Sprintf("backend PID %d connected from %s at %s", holder.PID, holder.Addr,
+		holder.Started.Format(time.RFC3339))
+}
+
+// AcquireInstanceLock takes the instance lock according to InstanceLock setting. If the lock is held by another
+// session, fails with ErrInstanceLocked for "refuse" or tries again till the context is done for "wait"
+func AcquireInstanceLock(ctx context.Context) error {
+	if InstanceLock == "off" {
+		LogToDB("LOG", "Instance lock is disabled, other instances with the same schema and client name are not detected")
+		return nil
+	}
+	for {
+		ok, err := tryLockInstance()
+		if err != nil {
+			return fmt.Errorf("Cannot take instance lock: %w", err)
+		}
+		if ok {
+			break
+		}
+		if InstanceLock != "wait" {
+			return fmt.Errorf("%w: instance lock '%s' is held by %s", ErrInstanceLocked, instanceLockName(), instanceLockHolder())
+		}
+		LogToDB("LOG", fmt.Sprintf("Waiting for instance lock '%s' held by %s", instanceLockName(), instanceLockHolder()))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(instanceLockRetry):
+		}
+	}
+	LogToDB("LOG", fmt.Sprintf("Instance lock '%s' acquired", instanceLockName()))
+	return nil
+}
+
+// CheckInstanceLock makes sure the connection holding the instance lock is alive. If the connection was lost, the
+// server has released the lock and it's taken again, unless another instance has taken it meanwhile
+func CheckInstanceLock() {
+	instanceLock.Lock()
+	conn := instanceLock.conn
+	instanceLock.Unlock()
+	if conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HeartbeatInterval)
+	defer cancel()
+	_, err := conn.ExecContext(ctx, "SELECT 1")
+	if err == nil {
+		return
+	}
+	LogToDB("ERROR", "Connection holding instance lock lost: ", err)
+	ReleaseInstanceLock()
+	if !TryLockClientName() {
+		LogToDB("ERROR", fmt.Sprintf("Cannot take instance lock '%s' again, it's held by %s", instanceLockName(), instanceLockHolder()))
+	}
+}
+
+// ReleaseInstanceLock releases the instance lock and closes its connection, returns true if the lock was held
+func ReleaseInstanceLock() bool {
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+	conn := instanceLock.conn
+	if conn == nil {
+		return false
+	}
+	instanceLock.conn = nil
+	_, _ = conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", instanceLockKey())
+	_ = conn.Close()
+	return true
+}
+
+// moveInstanceLock hands the instance lock over to a dedicated connection of the new configuration database. The
+// new session waits for the lock before the old one releases it, so the server grants it to the new session at once
+// and another instance cannot take it meanwhile. The lock is kept by the old session if the handover fails
+func moveInstanceLock(db *sqlx.DB) error {
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+	old := instanceLock.conn
+	if old == nil {
+		return nil
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	var pid int
+	if err = conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	lockCtx, cancel := context.WithTimeout(ctx, HeartbeatInterval)
+	defer cancel()
+	locked := make(chan error, 1)
+	go func() {
+		_, err := conn.ExecContext(lockCtx, "SELECT pg_advisory_lock($1)", instanceLockKey())
+		locked <- err
+	}()
+	const sqlWaiting = `SELECT EXISTS (SELECT FROM pg_locks WHERE pid = $1 AND locktype = 'advisory' AND NOT granted)`
+	for waiting := false; !waiting && err == nil; {
+		if err = old.QueryRowContext(lockCtx, sqlWaiting, pid).Scan(&waiting); err == nil && !waiting {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err == nil {
+		_, err = old.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", instanceLockKey())
+	}
+	if err != nil {
+		cancel()
+	}
+	if lockErr := <-locked; lockErr != nil {
+		_ = conn.Close()
+		if err == nil {
+			// released by the old session, but not granted to the new one
+			instanceLock.conn = nil
+			_ = old.Close()
+			err = lockErr
+		}
+		return err
+	}
+	instanceLock.conn = conn
+	_ = old.Close()
+	return nil
+}
@@ -1,8 +1,12 @@
 package pgengine
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -27,7 +31,7 @@ var levelColors = map[string]int{
 	"DEBUG":  gray}
 
 // VerboseLogLevel specifies if log messages with level LOG should be logged
-var VerboseLogLevel = true
+var VerboseLogLevel = BoolSetting{v: 1}
 
 func getColorizedLevel(level string) string {
 	return fmt.Sprintf("\x1b[%dm%s\x1b[0m", levelColors[level], level)
@@ -43,40 +47,132 @@ func GetLogPrefixLn(level string) string {
 	return GetLogPrefix(level) + "\n"
 }
 
-const logTemplate = `INSERT INTO timetable.log(pid, client_name, log_level, message) VALUES ($1, $2, $3, $4)`
+const logTemplate = `INSERT INTO timetable.log(pid, client_name, log_level, message, message_data) VALUES ($1, $2, $3, $4, $5)`
 
 // LogToDB performs logging to configuration database ConfigDB initiated during bootstrap
 func LogToDB(level string, msg ...interface{}) {
-	if !VerboseLogLevel {
+	logToDB(level, fmt.Sprint(msg...), nil)
+}
+
+// LogToDBWithFields performs logging to configuration database storing fields in message_data column,
+// e.g. LogToDBWithFields("ERROR", map[string]interface{}{"chain_id": 42}, "Task failed")
+func LogToDBWithFields(level string, fields map[string]interface{}, message string) {
+	logToDB(level, message, fields)
+}
+
+// ExecutionInfo identifies the chain run and the chain element a task is executed within
+type ExecutionInfo struct {
+	ChainConfig int // chain execution configuration ID
+	RunStatusID int
+	ChainID     int // chain element ID, 0 outside of an element
+	Element     int // position of the element in the chain starting from 1
+	FanOutItem  int // number of the fan-out item starting from 1, 0 if the element doesn't fan out
+}
+
+type executionKey struct{}
+
+// WithExecution returns the context carrying the identity of the execution, tasks receiving the context
+// tag their log entries with it, see LogToDBContext
+func WithExecution(ctx context.Context, info ExecutionInfo) context.Context {
+	return context.WithValue(ctx, executionKey{}, info)
+}
+
+// ExecutionFromContext returns the identity of the execution carried by the context, ok is false if there is none
+func ExecutionFromContext(ctx context.Context) (info ExecutionInfo, ok bool) {
+	info, ok = ctx.Value(executionKey{}).(ExecutionInfo)
+	return
+}
+
+// Fields returns the identity as log fields, unset values are omitted
+func (info ExecutionInfo) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"chain_execution_config": info.ChainConfig,
+		"run_status":             info.RunStatusID,
+	}
+	if info.ChainID != 0 {
+		fields["chain_id"] = info.ChainID
+		fields["element"] = info.Element
+	}
+	if info.FanOutItem != 0 {
+		fields["fan_out_item"] = info.FanOutItem
+	}
+	return fields
+}
+
+// LogToDBContext performs logging to configuration database like LogToDB, the entry is tagged with the identity
+// of the execution carried by the context, if any
+func LogToDBContext(ctx context.Context, level string, msg ...interface{}) {
+	var fields map[string]interface{}
+	if info, ok := ExecutionFromContext(ctx); ok {
+		fields = info.Fields()
+	}
+	logToDB(level, fmt.Sprint(msg...), fields)
+}
+
+// formatFields returns fields as sorted key=value pairs for console output
+func formatFields(fields map[string]interface{}) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%v", k, fields[k])
+	}
+	return strings.Join(pairs, " ")
+}
+
+func logToDB(level string, message string, fields map[string]interface{}) {
+	if !VerboseLogLevel.Get() {
 		switch level {
 		case
 			"DEBUG", "NOTICE":
 			return
 		}
 	}
-	s := fmt.Sprintf(GetLogPrefix(level), fmt.Sprint(msg...))
+	m := MaskSecrets(message)
+	var data interface{}
+	if len(fields) > 0 {
+		b, err := json.Marshal(fields)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{"error": err.Error()})
+		}
+		data = MaskSecrets(string(b))
+		message += " " + formatFields(fields)
+	}
+	s := fmt.Sprintf(GetLogPrefix(level), MaskSecrets(message))
 	fmt.Println(s)
-	if ConfigDb != nil {
-		_, err := ConfigDb.Exec(logTemplate, os.Getpid(), ClientName, level, fmt.Sprint(msg...))
-		for err != nil && ConfigDb.Ping() != nil {
+	if ConfigDb() != nil {
+		if level != "ERROR" && level != "PANIC" && logBuf.add(logEntry{time.Now(), level, m, data}) {
+			return
+		}
+		_, err := ConfigDb().Exec(SchemaSQL(logTemplate), os.Getpid(), ClientName, level, m, data)
+		for err != nil && ConfigDb().Ping() != nil {
 			// If there is DB outage, reconnect and write missing log
 			ReconnectDbAndFixLeftovers()
-			_, err = ConfigDb.Exec(logTemplate, os.Getpid(), ClientName, level, fmt.Sprint(msg...))
+			_, err = ConfigDb().Exec(SchemaSQL(logTemplate), os.Getpid(), ClientName, level, m, data)
 			level = "ERROR" //we don't want panic in case of disconnect
 		}
 	}
 }
 
-// LogChainElementExecution will log current chain element execution status including retcode
-func LogChainElementExecution(chainElemExec *ChainElementExecution, retCode int, output string) {
-	_, err := ConfigDb.Exec("INSERT INTO timetable.execution_log (chain_execution_config, chain_id, task_id, name, script, "+
-		"kind, last_run, finished, returncode, pid, output, client_name) "+
+// LogChainElementExecution will log current chain element execution status including retcode, output, stderr
+// and data of the task result. Stderr is set only for shell tasks capturing output separately
+func LogChainElementExecution(chainElemExec *ChainElementExecution, result *TaskResult) {
+	var data interface{}
+	if d := result.DataJSON(); d != nil {
+		data = MaskSecrets(string(d))
+	}
+	_, err := ConfigDb().Exec(SchemaSQL("INSERT INTO timetable.execution_log (chain_execution_config, chain_id, task_id, name, script, "+
+		"kind, last_run, finished, returncode, pid, output, client_name, stderr, result) "+
 		"VALUES ($1, $2, $3, $4, $5, $6, clock_timestamp() - $7 :: interval, clock_timestamp(), $8, $9, "+
-		"NULLIF($10, ''), $11)",
+		"NULLIF($10, ''), $11, NULLIF($12, ''), $13 :: jsonb)"),
 		chainElemExec.ChainConfig, chainElemExec.ChainID, chainElemExec.TaskID, chainElemExec.TaskName,
 		chainElemExec.Script, chainElemExec.Kind,
 		fmt.Sprintf("%d microsecond", chainElemExec.Duration),
-		retCode, os.Getpid(), output, ClientName)
+		result.ExitCode, os.Getpid(), MaskSecrets(strings.TrimSpace(string(result.Stdout))), ClientName,
+		MaskSecrets(strings.TrimSpace(string(result.Stderr))), data)
 	if err != nil {
 		LogToDB("ERROR", "Error occurred during logging current chain element execution status including retcode: ", err)
 	}
@@ -0,0 +1,179 @@
+package pgengine
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logBatchSize is the maximum number of log entries written by one INSERT
+const logBatchSize = 100
+
+// logEntry is the log message waiting in the buffer to be written to timetable.log
+type logEntry struct {
+	ts      time.Time
+	level   string
+	message string
+	data    interface{}
+}
+
+// logBuffer collects log entries and writes them in batches on the background goroutine
+type logBuffer struct {
+	sync.RWMutex
+	running bool
+	entries chan logEntry
+	quit    chan struct{} // closed on stop, so writers blocked on the full buffer give up
+	stopped chan struct{} // closed when the background goroutine wrote the rest of entries
+	dropped int64
+}
+
+var logBuf = &logBuffer{}
+
+// logBufStop serializes stopping of the buffer, e.g. on shutdown and on panic of a worker at once
+var logBufStop sync.Mutex
+
+// StartLogBuffer starts writing log entries of levels other than ERROR and PANIC to timetable.log
+// asynchronously in batches if LogBufferSize is set. The buffer is flushed by FinalizeConfigDBConnection
+func StartLogBuffer() {
+	if LogBufferSize <= 0 {
+		return
+	}
+	logBuf.Lock()
+	defer logBuf.Unlock()
+	if logBuf.running {
+		return
+	}
+	logBuf.entries = make(chan logEntry, LogBufferSize)
+	logBuf.quit = make(chan struct{})
+	logBuf.stopped = make(chan struct{})
+	logBuf.running = true
+	interval := time.Duration(LogFlushInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	go logBuf.run(logBuf.entries, interval)
+}
+
+// StopLogBuffer writes the buffered entries and switches logging back to synchronous inserts
+func StopLogBuffer() {
+	logBufStop.Lock()
+	defer logBufStop.Unlock()
+	logBuf.RLock()
+	running := logBuf.running
+	logBuf.RUnlock()
+	if !running {
+		return
+	}
+	close(logBuf.quit)
+	logBuf.Lock()
+	logBuf.running = false
+	close(logBuf.entries)
+	logBuf.Unlock()
+	<-logBuf.stopped
+}
+
+// DroppedLogEntries returns the number of log entries not written to timetable.log since the process start,
+// because the buffer was full and LogOverflow is "drop" or the process was stopping
+func DroppedLogEntries() int64 {
+	return atomic.LoadInt64(&logBuf.dropped)
+}
+
+// add puts the entry into the buffer and returns true, or returns false if the buffer is not running and the
+// entry must be written synchronously. If the buffer is full, the entry is dropped or the call blocks until
+// there is free space depending on LogOverflow
+func (b *logBuffer) add(e logEntry) bool {
+	b.RLock()
+	defer b.RUnlock()
+	if !b.running {
+		return false
+	}
+	if LogOverflow.Get() == "drop" {
+		select {
+		case b.entries <- e:
+		default:
+			atomic.AddInt64(&b.dropped, 1)
+		}
+		return true
+	}
+	select {
+	case b.entries <- e:
+	case <-b.quit:
+		atomic.AddInt64(&b.dropped, 1)
+	}
+	return true
+}
+
+// run writes entries as soon as a batch is full or every interval. While the database cannot keep up, the
+// failed batch is retried every interval and no more entries are taken, so the buffer fills up
+func (b *logBuffer) run(entries <-chan logEntry, interval time.Duration) {
+	defer close(b.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	batch := make([]logEntry, 0, logBatchSize)
+	for {
+		in := entries
+		if len(batch) >= logBatchSize {
+			in = nil
+		}
+		select {
+		case e, ok := <-in:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) < logBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-b.quit:
+			for e := range entries {
+				batch = append(batch, e)
+			}
+			b.flush(batch)
+			return
+		}
+		if len(batch) > 0 && writeLogEntries(batch) {
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes all entries left on stop in batches, entries which cannot be written are counted as dropped
+func (b *logBuffer) flush(batch []logEntry) {
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > logBatchSize {
+			n = logBatchSize
+		}
+		if !writeLogEntries(batch[:n]) {
+			atomic.AddInt64(&b.dropped, int64(len(batch)))
+			return
+		}
+		batch = batch[n:]
+	}
+}
+
+// writeLogEntries inserts entries into timetable.log with one statement keeping their original timestamps
+func writeLogEntries(batch []logEntry) bool {
+	if len(batch) == 0 || ConfigDb() == nil {
+		return true
+	}
+	values := make([]string, len(batch))
+	args := make([]interface{}, 0, len(batch)*6)
+	for i, e := range batch {
+		n := i * 6
+		values[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6)
+		args = append(args, e.ts, os.Getpid(), ClientName, e.level, e.message, e.data)
+	}
+	_, err := ConfigDb().Exec(SchemaSQL("INSERT INTO timetable.log(ts, pid, client_name, log_level, message, message_data) VALUES "+
+		strings.Join(values, ", ")), args...)
+	if err != nil {
+		fmt.Printf(GetLogPrefixLn("ERROR"), fmt.Sprintf("Cannot write %d buffered log entries: %v", len(batch), err))
+		return false
+	}
+	return true
+}
@@ -9,10 +9,16 @@ import (
 
 var m *migrator.Migrator
 
+// schemaMigrator returns the migrator keeping applied migrations in the configuration schema
+func schemaMigrator() *migrator.Migrator {
+	m.TableName = SchemaSQL("timetable.migrations")
+	return m
+}
+
 // MigrateDb upgrades database with all migrations
 func MigrateDb() {
 	LogToDB("LOG", "Upgrading database...")
-	if err := m.Migrate(ConfigDb.DB); err != nil {
+	if err := schemaMigrator().Migrate(ConfigDb().DB); err != nil {
 		LogToDB("PANIC", err)
 		os.Exit(3)
 	}
@@ -21,15 +27,39 @@ func MigrateDb() {
 // CheckNeedMigrateDb checks need of upgrading database and throws error if that's true
 func CheckNeedMigrateDb() {
 	LogToDB("DEBUG", "Check need of upgrading database...")
-	upgrade, err := m.NeedUpgrade(ConfigDb.DB)
+	upgrade, err := schemaMigrator().NeedUpgrade(ConfigDb().DB)
+	if err != nil {
+		LogToDB("PANIC", "Cannot verify database schema version: ", err)
+		os.Exit(3)
+	}
 	if upgrade {
 		LogToDB("PANIC", "You need to upgrade your database before proceeding, use --upgrade option")
-		defer os.Exit(3)
+		os.Exit(3)
 	}
+}
+
+// InitSchema makes sure configuration schema is created and up to date, reporting which action was taken
+func InitSchema() error {
+	if schemaCreated {
+		LogToDB("LOG", "Configuration schema created, nothing to upgrade")
+		return nil
+	}
+	upgrade, err := schemaMigrator().NeedUpgrade(ConfigDb().DB)
 	if err != nil {
-		LogToDB("PANIC", err)
-		os.Exit(3)
+		LogToDB("ERROR", err)
+		return err
+	}
+	if !upgrade {
+		LogToDB("LOG", "Configuration schema is already up to date")
+		return nil
+	}
+	LogToDB("LOG", "Upgrading database...")
+	if err = schemaMigrator().Migrate(ConfigDb().DB); err != nil {
+		LogToDB("ERROR", err)
+		return err
 	}
+	LogToDB("LOG", "Configuration schema upgraded")
+	return nil
 }
 
 func init() {
@@ -54,8 +84,8 @@ func init() {
 			&migrator.Migration{
 				Name: "0086 Add task output to execution_log",
 				Func: func(tx *sql.Tx) error {
-					_, err := tx.Exec("ALTER TABLE timetable.execution_log " +
-						"ADD COLUMN output TEXT")
+					_, err := tx.Exec(SchemaSQL("ALTER TABLE timetable.execution_log " +
+						"ADD COLUMN output TEXT"))
 					return err
 				},
 			},
@@ -63,6 +93,206 @@ func init() {
 				Name: "0108 Add client_name column to timetable.run_status",
 				Func: migration108,
 			},
+			&migrator.Migration{
+				Name: "0283 Capture stdout and stderr of shell tasks separately",
+				Func: migration283,
+			},
+			&migrator.Migration{
+				Name: "0285 Add timetable.active_session heartbeat table",
+				Func: migration285,
+			},
+			&migrator.Migration{
+				Name: "0286 Ignore jobs of dead sessions in get_running_jobs",
+				Func: migration286,
+			},
+			&migrator.Migration{
+				Name: "0287 Add conditional execution of chain elements",
+				Func: migration287,
+			},
+			&migrator.Migration{
+				Name: "0288 Add working directory to base tasks",
+				Func: migration288,
+			},
+			&migrator.Migration{
+				Name: "0289 Add CopyFromFile built-in task",
+				Func: migration289,
+			},
+			&migrator.Migration{
+				Name: "0290 Accept Go durations and seconds in interval schedules",
+				Func: migration290,
+			},
+			&migrator.Migration{
+				Name: "0295 Add max_jitter to chain execution config",
+				Func: migration295,
+			},
+			&migrator.Migration{
+				Name: "0296 Add last_tick to timetable.active_session",
+				Func: migration296,
+			},
+			&migrator.Migration{
+				Name: "0298 Add RemoteSQL built-in task",
+				Func: migration298,
+			},
+			&migrator.Migration{
+				Name: "0300 Add message_data to timetable.log",
+				Func: migration300,
+			},
+			&migrator.Migration{
+				Name: "0283 Add stderr to timetable.execution_log",
+				Func: migration283Stderr,
+			},
+			&migrator.Migration{
+				Name: "0286 Check heartbeat freshness in get_running_jobs",
+				Func: migration286Heartbeat,
+			},
+			&migrator.Migration{
+				Name: "0302 Add chain timeout",
+				Func: migration302,
+			},
+			&migrator.Migration{
+				Name: "0305 Add named chain execution parameters",
+				Func: migration305,
+			},
+			&migrator.Migration{
+				Name: "0306 Add FileArchive built-in task",
+				Func: migration306,
+			},
+			&migrator.Migration{
+				Name: "0307 Add minimum interval between identical shell commands",
+				Func: migration307,
+			},
+			&migrator.Migration{
+				Name: "0310 Add audit log of configuration changes",
+				Func: migration310,
+			},
+			&migrator.Migration{
+				Name: "0312 Add notification triggered chains",
+				Func: migration312,
+			},
+			&migrator.Migration{
+				Name: "0316 Add indexes for log pruning",
+				Func: migration316,
+			},
+			&migrator.Migration{
+				Name: "0317 Add resource limits of shell tasks",
+				Func: migration317,
+			},
+			&migrator.Migration{
+				Name: "0319 Add JSON Schema of task parameters",
+				Func: migration319,
+			},
+			&migrator.Migration{
+				Name: "0322 Add DownloadFile built-in task",
+				Func: migration322,
+			},
+			&migrator.Migration{
+				Name: "0324 Add priority to chain execution config",
+				Func: migration324,
+			},
+			&migrator.Migration{
+				Name: "0327 Add EncryptFile and DecryptFile built-in tasks",
+				Func: migration327,
+			},
+			&migrator.Migration{
+				Name: "0328 Add CHAIN_SKIPPED execution status for empty chains",
+				Func: migration328,
+			},
+			&migrator.Migration{
+				Name: "0330 Add output_table column to base_task",
+				Func: migration330,
+			},
+			&migrator.Migration{
+				Name: "0331 Add fan-out columns to task_chain and run_status",
+				Func: migration331,
+			},
+			&migrator.Migration{
+				Name: "0334 Add precondition to chain execution config",
+				Func: migration334,
+			},
+			&migrator.Migration{
+				Name: "0337 Add WaitForSQL built-in task",
+				Func: migration337,
+			},
+			&migrator.Migration{
+				Name: "0340 Add credentials to database connection",
+				Func: migration340,
+			},
+			&migrator.Migration{
+				Name: "0341 Add treat_stderr_as_error to base_task",
+				Func: migration341,
+			},
+			&migrator.Migration{
+				Name: "0343 Add CHAIN_CANCELLED execution status",
+				Func: migration343,
+			},
+			&migrator.Migration{
+				Name: "0344 Add depends_on to task_chain",
+				Func: migration344,
+			},
+			&migrator.Migration{
+				Name: "0345 Add ArchiveDirectory built-in task",
+				Func: migration345,
+			},
+			&migrator.Migration{
+				Name: "0346 Add exit_code_map to base_task",
+				Func: migration346,
+			},
+			&migrator.Migration{
+				Name: "0349 Add cron macros to timetable.cron",
+				Func: migration349,
+			},
+			&migrator.Migration{
+				Name: "0350 Add tags to chain_execution_config",
+				Func: migration350,
+			},
+			&migrator.Migration{
+				Name: "0352 Add expect_output to base_task",
+				Func: migration352,
+			},
+			&migrator.Migration{
+				Name: "0353 Add next_run_time function",
+				Func: migration353,
+			},
+			&migrator.Migration{
+				Name: "0354 Add run_status_archive and execution_log_archive",
+				Func: migration354,
+			},
+			&migrator.Migration{
+				Name: "0355 Add BackupTables built-in task",
+				Func: migration355,
+			},
+			&migrator.Migration{
+				Name: "0357 Add execution windows to chain_execution_config",
+				Func: migration357,
+			},
+			&migrator.Migration{
+				Name: "0360 Add on-failure handler chain to chain_execution_config",
+				Func: migration360,
+			},
+			&migrator.Migration{
+				Name: "0364 Add run_as_user and run_as_group to base_task",
+				Func: migration364,
+			},
+			&migrator.Migration{
+				Name: "0365 Add empty_params to base_task",
+				Func: migration365,
+			},
+			&migrator.Migration{
+				Name: "0367 Add paused to chain_execution_config",
+				Func: migration367,
+			},
+			&migrator.Migration{
+				Name: "0368 Add result to execution_log",
+				Func: migration368,
+			},
+			&migrator.Migration{
+				Name: "0369 Add CHAIN_INTERRUPTED execution status",
+				Func: migration369,
+			},
+			&migrator.Migration{
+				Name: "0371 Add missed_ticks to chain_execution_config",
+				Func: migration371,
+			},
 			// adding new migration here, update "timetable"."migrations" in "sql_ddl.go"
 		),
 	)
@@ -73,9 +303,722 @@ func init() {
 
 // below this line should appear migration funсtions only
 
+func migration371(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.chain_execution_config 
+	ADD COLUMN missed_ticks TEXT NOT NULL DEFAULT 'skip' CHECK (missed_ticks IN ('skip', 'catch_up_once', 'catch_up_all'));
+
+CREATE TABLE timetable.chain_last_fired (
+	chain_execution_config	BIGINT		PRIMARY KEY REFERENCES timetable.chain_execution_config (chain_execution_config)
+										ON UPDATE CASCADE
+										ON DELETE CASCADE,
+	last_fired				TIMESTAMPTZ	NOT NULL
+);
+
+CREATE OR REPLACE FUNCTION timetable.reset_last_fired() RETURNS trigger AS $$
+BEGIN
+	DELETE FROM timetable.chain_last_fired WHERE chain_execution_config = NEW.chain_execution_config;
+	RETURN NULL;
+END;
+$$ LANGUAGE 'plpgsql';
+
+CREATE TRIGGER trig_chain_execution_config_reset_last_fired
+        AFTER UPDATE OF live, run_at, missed_ticks ON timetable.chain_execution_config
+        FOR EACH ROW WHEN (OLD.live IS DISTINCT FROM NEW.live OR OLD.run_at IS DISTINCT FROM NEW.run_at
+            OR OLD.missed_ticks IS DISTINCT FROM NEW.missed_ticks)
+        EXECUTE PROCEDURE timetable.reset_last_fired();`))
+	return err
+}
+
+func migration369(tx *sql.Tx) error {
+	// enum is recreated the same way as in migration328, the archive table has the column of the same type
+	_, err := tx.Exec(SchemaSQL(`
+ALTER TYPE timetable.execution_status RENAME TO execution_status_old;
+
+CREATE TYPE timetable.execution_status AS ENUM ('STARTED', 'CHAIN_FAILED', 'CHAIN_DONE', 'DEAD', 'CHAIN_TIMEOUT', 'CHAIN_SKIPPED', 'CHAIN_CANCELLED', 'CHAIN_INTERRUPTED');
+
+ALTER TABLE timetable.run_status 
+	ALTER COLUMN execution_status TYPE timetable.execution_status 
+	USING execution_status :: text :: timetable.execution_status;
+
+ALTER TABLE timetable.run_status_archive 
+	ALTER COLUMN execution_status TYPE timetable.execution_status 
+	USING execution_status :: text :: timetable.execution_status;
+
+DROP TYPE timetable.execution_status_old;
+
+CREATE OR REPLACE FUNCTION timetable.get_running_jobs(BIGINT, stale_timeout INTERVAL DEFAULT '1 minute') 
+RETURNS SETOF record AS $$
+    SELECT  chain_execution_config, start_status
+        FROM    timetable.run_status
+        WHERE   start_status IN ( SELECT   start_status
+                FROM    timetable.run_status
+                WHERE   execution_status IN ('STARTED', 'CHAIN_FAILED',
+                             'CHAIN_DONE', 'DEAD', 'CHAIN_TIMEOUT', 'CHAIN_SKIPPED', 'CHAIN_CANCELLED', 'CHAIN_INTERRUPTED')
+                    AND (chain_execution_config = $1 OR chain_execution_config = 0)
+                GROUP BY 1
+                HAVING count(*) < 2 
+                ORDER BY 1)
+            AND chain_execution_config = $1 
+            AND client_name IN (SELECT client_name FROM timetable.active_session WHERE last_seen > now() - $2)
+        GROUP BY 1, 2
+        ORDER BY 1, 2 DESC
+$$ LANGUAGE 'sql';`))
+	return err
+}
+
+func migration368(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.execution_log ADD COLUMN result JSONB;
+ALTER TABLE timetable.execution_log_archive ADD COLUMN result JSONB;`))
+	return err
+}
+
+func migration367(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.chain_execution_config ADD COLUMN paused BOOLEAN NOT NULL DEFAULT false;`))
+	return err
+}
+
+func migration365(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.base_task 
+	ADD COLUMN empty_params TEXT NOT NULL DEFAULT 'run' CHECK (empty_params IN ('run', 'skip', 'fail'));`))
+	return err
+}
+
+func migration364(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.base_task 
+	ADD COLUMN run_as_user TEXT CHECK (run_as_user <> ''),
+	ADD COLUMN run_as_group TEXT CHECK (run_as_group <> '');`))
+	return err
+}
+
+func migration360(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.chain_execution_config 
+	ADD COLUMN on_failure_chain_id BIGINT REFERENCES timetable.chain_execution_config(chain_execution_config)
+		ON UPDATE CASCADE ON DELETE SET NULL,
+	ADD CHECK (on_failure_chain_id <> chain_execution_config);`))
+	return err
+}
+
+func migration357(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.chain_execution_config 
+	ADD COLUMN window_start TIME,
+	ADD COLUMN window_end TIME,
+	ADD COLUMN window_timezone TEXT CHECK (timestamptz '2000-01-01 00:00:00+00' AT TIME ZONE window_timezone IS NOT NULL),
+	ADD COLUMN window_action TEXT NOT NULL DEFAULT 'skip' CHECK (window_action IN ('skip', 'defer')),
+	ADD CHECK ((window_start IS NULL) = (window_end IS NULL) AND window_start <> window_end);
+CREATE OR REPLACE FUNCTION timetable.window_delay(window_start time, window_end time, window_timezone text,
+    ts timestamptz) RETURNS interval AS
+$$
+    SELECT CASE
+        WHEN window_start IS NULL OR window_end IS NULL THEN NULL
+        WHEN CASE WHEN window_start < window_end
+            THEN l.t :: time >= window_start AND l.t :: time < window_end
+            ELSE l.t :: time >= window_start OR l.t :: time < window_end END
+        THEN interval '0'
+        ELSE ((date_trunc('day', l.t) + window_start +
+            CASE WHEN l.t :: time > window_start THEN interval '1 day' ELSE interval '0' END) AT TIME ZONE z.tz) - ts
+    END
+    FROM (SELECT COALESCE(window_timezone, current_setting('TimeZone')) AS tz) z,
+        LATERAL (SELECT ts AT TIME ZONE z.tz AS t) l
+$$ LANGUAGE 'sql' STABLE;`))
+	return err
+}
+
+func migration355(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`INSERT INTO timetable.base_task(name, script, kind) 
+	VALUES ('BackupTables', 'BackupTables', 'BUILTIN') 
+	ON CONFLICT (name) DO NOTHING;`))
+	return err
+}
+
+func migration354(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+CREATE INDEX ON timetable.run_status (start_status);
+
+CREATE TABLE timetable.run_status_archive (LIKE timetable.run_status);
+
+CREATE TABLE timetable.execution_log_archive (LIKE timetable.execution_log);`))
+	return err
+}
+
+func migration353(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+CREATE OR REPLACE FUNCTION timetable.cron_expression(run_at timetable.cron) RETURNS TEXT AS
+$$
+    SELECT CASE
+        WHEN run_at IS NULL THEN '* * * * *'
+        WHEN run_at = '@reboot' OR substr(run_at, 1, 6) IN ('@every', '@after') THEN NULL
+        WHEN run_at IN ('@yearly', '@annually') THEN '0 0 1 1 *'
+        WHEN run_at = '@monthly' THEN '0 0 1 * *'
+        WHEN run_at = '@weekly' THEN '0 0 * * 0'
+        WHEN run_at IN ('@daily', '@midnight') THEN '0 0 * * *'
+        WHEN run_at = '@hourly' THEN '0 * * * *'
+        ELSE run_at
+    END
+$$ LANGUAGE SQL IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION timetable.is_cron_in_time(run_at timetable.cron, ts timestamptz) RETURNS BOOLEAN AS
+$$
+DECLARE 
+    a_by_minute integer[];
+    a_by_hour integer[];
+    a_by_day integer[];
+    a_by_month integer[];
+    a_by_day_of_week integer[]; 
+    cron_expr text;
+BEGIN
+    cron_expr := timetable.cron_expression(run_at);
+    IF cron_expr IS NULL
+    THEN
+        RETURN FALSE;
+    END IF;
+    a_by_minute := timetable.cron_element_to_array(cron_expr, 'minute');
+    a_by_hour := timetable.cron_element_to_array(cron_expr, 'hour');
+    a_by_day := timetable.cron_element_to_array(cron_expr, 'day');
+    a_by_month := timetable.cron_element_to_array(cron_expr, 'month');
+    a_by_day_of_week := timetable.cron_element_to_array(cron_expr, 'day_of_week'); 
+    RETURN  (a_by_month[1]       IS NULL OR date_part('month', ts) = ANY(a_by_month))
+        AND (a_by_day_of_week[1] IS NULL OR date_part('dow', ts) = ANY(a_by_day_of_week))
+        AND (a_by_day[1]         IS NULL OR date_part('day', ts) = ANY(a_by_day))
+        AND (a_by_hour[1]        IS NULL OR date_part('hour', ts) = ANY(a_by_hour))
+        AND (a_by_minute[1]      IS NULL OR date_part('minute', ts) = ANY(a_by_minute));    
+END;
+$$ LANGUAGE 'plpgsql';
+
+CREATE OR REPLACE FUNCTION timetable.next_run_time(run_at timetable.cron, ts timestamptz) RETURNS timestamptz AS
+$$
+DECLARE 
+    a_by_minute integer[];
+    a_by_hour integer[];
+    a_by_day integer[];
+    a_by_month integer[];
+    a_by_day_of_week integer[]; 
+    cron_expr text;
+    day_start timestamp;
+    next_ts timestamptz;
+BEGIN
+    cron_expr := timetable.cron_expression(run_at);
+    IF cron_expr IS NULL
+    THEN
+        RETURN NULL;
+    END IF;
+    a_by_minute := timetable.cron_element_to_array(cron_expr, 'minute');
+    a_by_hour := timetable.cron_element_to_array(cron_expr, 'hour');
+    a_by_day := timetable.cron_element_to_array(cron_expr, 'day');
+    a_by_month := timetable.cron_element_to_array(cron_expr, 'month');
+    a_by_day_of_week := timetable.cron_element_to_array(cron_expr, 'day_of_week'); 
+    IF a_by_minute[1] IS NULL THEN
+        a_by_minute := ARRAY(SELECT generate_series(0, 59));
+    END IF;
+    IF a_by_hour[1] IS NULL THEN
+        a_by_hour := ARRAY(SELECT generate_series(0, 23));
+    END IF;
+    day_start := date_trunc('day', ts :: timestamp);
+    FOR i IN 0 .. 366 * 28 LOOP
+        IF  (a_by_month[1]       IS NULL OR date_part('month', day_start) = ANY(a_by_month))
+        AND (a_by_day_of_week[1] IS NULL OR date_part('dow', day_start) = ANY(a_by_day_of_week))
+        AND (a_by_day[1]         IS NULL OR date_part('day', day_start) = ANY(a_by_day))
+        THEN
+            SELECT min(c.t) INTO next_ts FROM (
+                SELECT (day_start + make_interval(hours => h, mins => m)) :: timestamptz AS t
+                FROM unnest(a_by_hour) h, unnest(a_by_minute) m) c
+            WHERE c.t > ts;
+            IF next_ts IS NOT NULL THEN
+                RETURN next_ts;
+            END IF;
+        END IF;
+        day_start := day_start + interval '1 day';
+    END LOOP;
+    RETURN NULL;
+END;
+$$ LANGUAGE 'plpgsql';`))
+	return err
+}
+
+func migration352(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.base_task 
+	ADD COLUMN expect_output TEXT,
+	ADD COLUMN expect_output_mode TEXT NOT NULL DEFAULT 'contains' CHECK (expect_output_mode IN ('contains', 'regex'));`))
+	return err
+}
+
+func migration350(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.chain_execution_config ADD COLUMN tags TEXT[];`))
+	return err
+}
+
+func migration349(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+ALTER DOMAIN timetable.cron DROP CONSTRAINT cron_check;
+
+ALTER DOMAIN timetable.cron ADD CONSTRAINT cron_check CHECK(
+	substr(VALUE, 1, 6) IN ('@every', '@after') AND timetable.parse_interval(substr(VALUE, 7)) IS NOT NULL
+	OR VALUE IN ('@annually', '@yearly', '@monthly', '@weekly', '@daily', '@midnight', '@hourly', '@reboot')
+	OR VALUE ~ '^(((\d+,)+\d+|(\d+(\/|-)\d+)|(\*(\/|-)\d+)|\d+|\*) +){4}(((\d+,)+\d+|(\d+(\/|-)\d+)|(\*(\/|-)\d+)|\d+|\*) ?)$'
+);
+
+CREATE OR REPLACE FUNCTION timetable.is_cron_in_time(run_at timetable.cron, ts timestamptz) RETURNS BOOLEAN AS
+$$
+DECLARE 
+    a_by_minute integer[];
+    a_by_hour integer[];
+    a_by_day integer[];
+    a_by_month integer[];
+    a_by_day_of_week integer[]; 
+    cron_expr text;
+BEGIN
+    IF run_at IS NULL
+    THEN
+        RETURN TRUE;
+    END IF;
+    cron_expr := CASE run_at
+        WHEN '@yearly' THEN '0 0 1 1 *'
+        WHEN '@annually' THEN '0 0 1 1 *'
+        WHEN '@monthly' THEN '0 0 1 * *'
+        WHEN '@weekly' THEN '0 0 * * 0'
+        WHEN '@daily' THEN '0 0 * * *'
+        WHEN '@midnight' THEN '0 0 * * *'
+        WHEN '@hourly' THEN '0 * * * *'
+        ELSE run_at
+    END;
+    a_by_minute := timetable.cron_element_to_array(cron_expr, 'minute');
+    a_by_hour := timetable.cron_element_to_array(cron_expr, 'hour');
+    a_by_day := timetable.cron_element_to_array(cron_expr, 'day');
+    a_by_month := timetable.cron_element_to_array(cron_expr, 'month');
+    a_by_day_of_week := timetable.cron_element_to_array(cron_expr, 'day_of_week'); 
+    RETURN  (a_by_month[1]       IS NULL OR date_part('month', ts) = ANY(a_by_month))
+        AND (a_by_day_of_week[1] IS NULL OR date_part('dow', ts) = ANY(a_by_day_of_week))
+        AND (a_by_day[1]         IS NULL OR date_part('day', ts) = ANY(a_by_day))
+        AND (a_by_hour[1]        IS NULL OR date_part('hour', ts) = ANY(a_by_hour))
+        AND (a_by_minute[1]      IS NULL OR date_part('minute', ts) = ANY(a_by_minute));    
+END;
+$$ LANGUAGE 'plpgsql';`))
+	return err
+}
+
+func migration346(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.base_task 
+	ADD COLUMN exit_code_map JSONB CHECK (jsonb_typeof(exit_code_map) = 'object');`))
+	return err
+}
+
+func migration345(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`INSERT INTO timetable.base_task(name, script, kind) 
+	VALUES ('ArchiveDirectory', 'ArchiveDirectory', 'BUILTIN') 
+	ON CONFLICT (name) DO NOTHING;`))
+	return err
+}
+
+func migration344(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.task_chain ADD COLUMN depends_on BIGINT[];`))
+	return err
+}
+
+func migration343(tx *sql.Tx) error {
+	// enum is recreated the same way as in migration328
+	_, err := tx.Exec(SchemaSQL(`
+ALTER TYPE timetable.execution_status RENAME TO execution_status_old;
+
+CREATE TYPE timetable.execution_status AS ENUM ('STARTED', 'CHAIN_FAILED', 'CHAIN_DONE', 'DEAD', 'CHAIN_TIMEOUT', 'CHAIN_SKIPPED', 'CHAIN_CANCELLED');
+
+ALTER TABLE timetable.run_status 
+	ALTER COLUMN execution_status TYPE timetable.execution_status 
+	USING execution_status :: text :: timetable.execution_status;
+
+DROP TYPE timetable.execution_status_old;
+
+CREATE OR REPLACE FUNCTION timetable.get_running_jobs(BIGINT, stale_timeout INTERVAL DEFAULT '1 minute') 
+RETURNS SETOF record AS $$
+    SELECT  chain_execution_config, start_status
+        FROM    timetable.run_status
+        WHERE   start_status IN ( SELECT   start_status
+                FROM    timetable.run_status
+                WHERE   execution_status IN ('STARTED', 'CHAIN_FAILED',
+                             'CHAIN_DONE', 'DEAD', 'CHAIN_TIMEOUT', 'CHAIN_SKIPPED', 'CHAIN_CANCELLED')
+                    AND (chain_execution_config = $1 OR chain_execution_config = 0)
+                GROUP BY 1
+                HAVING count(*) < 2 
+                ORDER BY 1)
+            AND chain_execution_config = $1 
+            AND client_name IN (SELECT client_name FROM timetable.active_session WHERE last_seen > now() - $2)
+        GROUP BY 1, 2
+        ORDER BY 1, 2 DESC
+$$ LANGUAGE 'sql';`))
+	return err
+}
+
+func migration341(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+ALTER TABLE timetable.base_task 
+	ADD COLUMN treat_stderr_as_error BOOLEAN NOT NULL DEFAULT false,
+	ADD COLUMN stderr_error_pattern TEXT,
+	ADD CHECK (NOT treat_stderr_as_error OR separate_output);`))
+	return err
+}
+
+func migration340(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+ALTER TABLE timetable.database_connection 
+	ADD COLUMN password_secret TEXT,
+	ADD COLUMN sslmode TEXT CHECK (sslmode IN ('disable', 'allow', 'prefer', 'require', 'verify-ca', 'verify-full')),
+	ADD COLUMN sslrootcert TEXT,
+	ADD COLUMN sslcert TEXT,
+	ADD COLUMN sslkey TEXT;`))
+	return err
+}
+
+func migration337(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`INSERT INTO timetable.base_task(name, script, kind) 
+	VALUES ('WaitForSQL', 'WaitForSQL', 'BUILTIN') 
+	ON CONFLICT (name) DO NOTHING;`))
+	return err
+}
+
+func migration334(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.chain_execution_config ADD COLUMN precondition TEXT;`))
+	return err
+}
+
+func migration331(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+ALTER TABLE timetable.task_chain 
+	ADD COLUMN fan_out_param TEXT,
+	ADD COLUMN fan_out_limit INTEGER CHECK (fan_out_limit > 0),
+	ADD COLUMN fan_out_fail_fast BOOLEAN NOT NULL DEFAULT true;
+ALTER TABLE timetable.run_status ADD COLUMN fan_out_item INTEGER;`))
+	return err
+}
+
+func migration330(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.base_task ADD COLUMN output_table TEXT;`))
+	return err
+}
+
+func migration328(tx *sql.Tx) error {
+	// enum is recreated instead of ALTER TYPE ... ADD VALUE, since the latter cannot run in a transaction before v12
+	_, err := tx.Exec(SchemaSQL(`
+ALTER TYPE timetable.execution_status RENAME TO execution_status_old;
+
+CREATE TYPE timetable.execution_status AS ENUM ('STARTED', 'CHAIN_FAILED', 'CHAIN_DONE', 'DEAD', 'CHAIN_TIMEOUT', 'CHAIN_SKIPPED');
+
+ALTER TABLE timetable.run_status 
+	ALTER COLUMN execution_status TYPE timetable.execution_status 
+	USING execution_status :: text :: timetable.execution_status;
+
+DROP TYPE timetable.execution_status_old;
+
+CREATE OR REPLACE FUNCTION timetable.get_running_jobs(BIGINT, stale_timeout INTERVAL DEFAULT '1 minute') 
+RETURNS SETOF record AS $$
+    SELECT  chain_execution_config, start_status
+        FROM    timetable.run_status
+        WHERE   start_status IN ( SELECT   start_status
+                FROM    timetable.run_status
+                WHERE   execution_status IN ('STARTED', 'CHAIN_FAILED',
+                             'CHAIN_DONE', 'DEAD', 'CHAIN_TIMEOUT', 'CHAIN_SKIPPED')
+                    AND (chain_execution_config = $1 OR chain_execution_config = 0)
+                GROUP BY 1
+                HAVING count(*) < 2 
+                ORDER BY 1)
+            AND chain_execution_config = $1 
+            AND client_name IN (SELECT client_name FROM timetable.active_session WHERE last_seen > now() - $2)
+        GROUP BY 1, 2
+        ORDER BY 1, 2 DESC
+$$ LANGUAGE 'sql';`))
+	return err
+}
+
+func migration327(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`INSERT INTO timetable.base_task(name, script, kind) 
+	VALUES ('EncryptFile', 'EncryptFile', 'BUILTIN'), ('DecryptFile', 'DecryptFile', 'BUILTIN') 
+	ON CONFLICT (name) DO NOTHING;`))
+	return err
+}
+
+func migration324(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.chain_execution_config ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;`))
+	return err
+}
+
+func migration322(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`INSERT INTO timetable.base_task(name, script, kind) 
+	VALUES ('DownloadFile', 'DownloadFile', 'BUILTIN') ON CONFLICT (name) DO NOTHING;`))
+	return err
+}
+
+func migration319(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.base_task ADD COLUMN params_schema JSONB;`))
+	return err
+}
+
+func migration317(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.base_task 
+	ADD COLUMN nice INTEGER CHECK (nice BETWEEN -20 AND 19),
+	ADD COLUMN max_cpu_time INTEGER CHECK (max_cpu_time > 0),
+	ADD COLUMN max_memory INTEGER CHECK (max_memory > 0),
+	ADD COLUMN max_open_files INTEGER CHECK (max_open_files > 0);`))
+	return err
+}
+
+func migration316(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+CREATE INDEX ON timetable.log (ts);
+CREATE INDEX ON timetable.execution_log (last_run);`))
+	return err
+}
+
+func migration312(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.chain_execution_config 
+	ADD COLUMN notify_channel TEXT CHECK (notify_channel <> '');`))
+	return err
+}
+
+func migration310(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+-- audit trail of changes of chain configurations and tasks written by triggers, "client_name" is set
+-- if the change was made by pg_timetable, "changed_by" is the database user
+CREATE TABLE timetable.change_log (
+	change_id		BIGSERIAL	PRIMARY KEY,
+	changed_at		TIMESTAMPTZ	NOT NULL	DEFAULT now(),
+	table_name		TEXT		NOT NULL,
+	operation		TEXT		NOT NULL,
+	object_id		BIGINT,
+	changed_by		TEXT		NOT NULL	DEFAULT session_user,
+	client_name		TEXT,
+	old_value		JSONB,
+	new_value		JSONB
+);
+
+CREATE INDEX ON timetable.change_log (table_name, object_id);
+
+-- log_change() writes the changed row into change_log, the primary key column name is the trigger argument
+CREATE OR REPLACE FUNCTION timetable.log_change() RETURNS trigger AS $$
+	DECLARE
+		old_row JSONB;
+		new_row JSONB;
+	BEGIN
+		IF TG_OP <> 'INSERT' THEN
+			old_row := to_jsonb(OLD);
+		END IF;
+		IF TG_OP <> 'DELETE' THEN
+			new_row := to_jsonb(NEW);
+		END IF;
+		IF old_row = new_row THEN
+			RETURN NULL;
+		END IF;
+		INSERT INTO timetable.change_log (table_name, operation, object_id, client_name, old_value, new_value)
+			VALUES (TG_TABLE_NAME, TG_OP, (COALESCE(new_row, old_row) ->> TG_ARGV[0]) :: BIGINT,
+				NULLIF(current_setting('pg_timetable.client_name', true), ''), old_row, new_row);
+		RETURN NULL;
+	END;
+$$ LANGUAGE 'plpgsql';
+
+CREATE TRIGGER trig_chain_execution_config_log
+        AFTER INSERT OR UPDATE OR DELETE ON timetable.chain_execution_config
+        FOR EACH ROW EXECUTE PROCEDURE timetable.log_change('chain_execution_config');
+
+CREATE TRIGGER trig_base_task_log
+        AFTER INSERT OR UPDATE OR DELETE ON timetable.base_task
+        FOR EACH ROW EXECUTE PROCEDURE timetable.log_change('task_id');
+`))
+	return err
+}
+
+func migration307(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.base_task ADD COLUMN min_interval INTEGER CHECK (min_interval > 0);`))
+	return err
+}
+
+func migration306(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`INSERT INTO timetable.base_task(name, script, kind) 
+	VALUES ('FileArchive', 'FileArchive', 'BUILTIN') ON CONFLICT (name) DO NOTHING;`))
+	return err
+}
+
+func migration305(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.chain_execution_parameters 
+	ADD COLUMN param_name TEXT CHECK (param_name ~ '^[A-Za-z_][A-Za-z0-9_]*$'),
+	ADD UNIQUE (chain_execution_config, chain_id, param_name);`))
+	return err
+}
+
+func migration302(tx *sql.Tx) error {
+	// enum is recreated instead of ALTER TYPE ... ADD VALUE, since the latter cannot run in a transaction before v12
+	_, err := tx.Exec(SchemaSQL(`
+ALTER TABLE timetable.chain_execution_config 
+	ADD COLUMN timeout INTEGER CHECK (timeout >= 0);
+
+ALTER TYPE timetable.execution_status RENAME TO execution_status_old;
+
+CREATE TYPE timetable.execution_status AS ENUM ('STARTED', 'CHAIN_FAILED', 'CHAIN_DONE', 'DEAD', 'CHAIN_TIMEOUT');
+
+ALTER TABLE timetable.run_status 
+	ALTER COLUMN execution_status TYPE timetable.execution_status 
+	USING execution_status :: text :: timetable.execution_status;
+
+DROP TYPE timetable.execution_status_old;
+
+CREATE OR REPLACE FUNCTION timetable.get_running_jobs(BIGINT, stale_timeout INTERVAL DEFAULT '1 minute') 
+RETURNS SETOF record AS $$
+    SELECT  chain_execution_config, start_status
+        FROM    timetable.run_status
+        WHERE   start_status IN ( SELECT   start_status
+                FROM    timetable.run_status
+                WHERE   execution_status IN ('STARTED', 'CHAIN_FAILED',
+                             'CHAIN_DONE', 'DEAD', 'CHAIN_TIMEOUT')
+                    AND (chain_execution_config = $1 OR chain_execution_config = 0)
+                GROUP BY 1
+                HAVING count(*) < 2 
+                ORDER BY 1)
+            AND chain_execution_config = $1 
+            AND client_name IN (SELECT client_name FROM timetable.active_session WHERE last_seen > now() - $2)
+        GROUP BY 1, 2
+        ORDER BY 1, 2 DESC
+$$ LANGUAGE 'sql';`))
+	return err
+}
+
+func migration286Heartbeat(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+DROP FUNCTION IF EXISTS timetable.get_running_jobs(BIGINT);
+
+CREATE OR REPLACE FUNCTION timetable.get_running_jobs(BIGINT, stale_timeout INTERVAL DEFAULT '1 minute') 
+RETURNS SETOF record AS $$
+    SELECT  chain_execution_config, start_status
+        FROM    timetable.run_status
+        WHERE   start_status IN ( SELECT   start_status
+                FROM    timetable.run_status
+                WHERE   execution_status IN ('STARTED', 'CHAIN_FAILED',
+                             'CHAIN_DONE', 'DEAD')
+                    AND (chain_execution_config = $1 OR chain_execution_config = 0)
+                GROUP BY 1
+                HAVING count(*) < 2 
+                ORDER BY 1)
+            AND chain_execution_config = $1 
+            AND client_name IN (SELECT client_name FROM timetable.active_session WHERE last_seen > now() - $2)
+        GROUP BY 1, 2
+        ORDER BY 1, 2 DESC
+$$ LANGUAGE 'sql';`))
+	return err
+}
+
+func migration283Stderr(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.execution_log ADD COLUMN stderr TEXT;`))
+	return err
+}
+
+func migration300(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.log ADD COLUMN message_data JSONB;`))
+	return err
+}
+
+func migration298(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`INSERT INTO timetable.base_task(name, script, kind) 
+	VALUES ('RemoteSQL', 'RemoteSQL', 'BUILTIN') ON CONFLICT (name) DO NOTHING;`))
+	return err
+}
+
+func migration296(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.active_session ADD COLUMN last_tick TIMESTAMPTZ;`))
+	return err
+}
+
+func migration295(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.chain_execution_config 
+	ADD COLUMN max_jitter INTEGER CHECK (max_jitter >= 0);`))
+	return err
+}
+
+func migration290(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+-- parse_interval accepts PostgreSQL interval, Go duration (e.g. 1h30m) or integer seconds
+CREATE OR REPLACE FUNCTION timetable.parse_interval(value TEXT) RETURNS INTERVAL AS $$
+	SELECT CASE WHEN value ~ '^\s*([0-9]+(\.[0-9]+)?(h|m|s|ms|us|µs))+\s*$' THEN
+		regexp_replace(regexp_replace(regexp_replace(regexp_replace(regexp_replace(value,
+			'([0-9.]+)(us|µs)', '\1 microseconds ', 'g'),
+			'([0-9.]+)ms', '\1 milliseconds ', 'g'),
+			'([0-9.]+)h', '\1 hours ', 'g'),
+			'([0-9.]+)m', '\1 minutes ', 'g'),
+			'([0-9.]+)s', '\1 seconds ', 'g') :: INTERVAL
+	ELSE
+		value :: INTERVAL
+	END
+$$ LANGUAGE 'sql'
+IMMUTABLE STRICT;
+
+ALTER DOMAIN timetable.cron DROP CONSTRAINT cron_check;
+
+ALTER DOMAIN timetable.cron ADD CONSTRAINT cron_check CHECK(
+	substr(VALUE, 1, 6) IN ('@every', '@after') AND timetable.parse_interval(substr(VALUE, 7)) IS NOT NULL
+	OR VALUE IN ('@annually', '@yearly', '@monthly', '@weekly', '@daily', '@hourly', '@reboot')
+	OR VALUE ~ '^(((\d+,)+\d+|(\d+(\/|-)\d+)|(\*(\/|-)\d+)|\d+|\*) +){4}(((\d+,)+\d+|(\d+(\/|-)\d+)|(\*(\/|-)\d+)|\d+|\*) ?)$'
+);`))
+	return err
+}
+
+func migration289(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`INSERT INTO timetable.base_task(name, script, kind) 
+	VALUES ('CopyFromFile', 'CopyFromFile', 'BUILTIN') ON CONFLICT (name) DO NOTHING;`))
+	return err
+}
+
+func migration288(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`ALTER TABLE timetable.base_task ADD COLUMN work_dir TEXT;`))
+	return err
+}
+
+func migration287(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+ALTER TABLE timetable.task_chain
+	ADD COLUMN run_if_exit_codes INTEGER[],
+	ADD COLUMN abort_if_not_met BOOLEAN NOT NULL DEFAULT false;`))
+	return err
+}
+
+func migration286(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+CREATE OR REPLACE FUNCTION timetable.get_running_jobs(BIGINT) 
+RETURNS SETOF record AS $$
+    SELECT  chain_execution_config, start_status
+        FROM    timetable.run_status
+        WHERE   start_status IN ( SELECT   start_status
+                FROM    timetable.run_status
+                WHERE   execution_status IN ('STARTED', 'CHAIN_FAILED',
+                             'CHAIN_DONE', 'DEAD')
+                    AND (chain_execution_config = $1 OR chain_execution_config = 0)
+                GROUP BY 1
+                HAVING count(*) < 2 
+                ORDER BY 1)
+            AND chain_execution_config = $1 
+            AND client_name IN (SELECT client_name FROM timetable.active_session)
+        GROUP BY 1, 2
+        ORDER BY 1, 2 DESC
+$$ LANGUAGE 'sql';`))
+	return err
+}
+
+func migration285(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+CREATE TABLE timetable.active_session (
+	client_pid		BIGINT		NOT NULL,
+	client_name		TEXT		NOT NULL,
+	started_at		TIMESTAMPTZ	NOT NULL	DEFAULT now(),
+	last_seen		TIMESTAMPTZ	NOT NULL	DEFAULT now(),
+	PRIMARY KEY (client_pid, client_name)
+);`))
+	return err
+}
+
+func migration283(tx *sql.Tx) error {
+	_, err := tx.Exec(SchemaSQL(`
+ALTER TABLE timetable.base_task
+	ADD COLUMN separate_output BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE timetable.run_status
+	ADD COLUMN stderr_tail TEXT;`))
+	return err
+}
+
 func migration108(tx *sql.Tx) error {
 	// first set <unknown> for existing rows, then drop default to force application to set it
-	_, err := tx.Exec(`
+	_, err := tx.Exec(SchemaSQL(`
 ALTER TABLE timetable.execution_log
 	ADD COLUMN client_name TEXT NOT NULL DEFAULT '<unknown>';
 ALTER TABLE timetable.run_status
@@ -83,12 +1026,12 @@ ALTER TABLE timetable.run_status
 ALTER TABLE timetable.execution_log
 	ALTER COLUMN client_name DROP DEFAULT;
 ALTER TABLE timetable.run_status
-	ALTER COLUMN client_name DROP DEFAULT;`)
+	ALTER COLUMN client_name DROP DEFAULT;`))
 	return err
 }
 
 func migration70(tx *sql.Tx) error {
-	if _, err := tx.Exec(`
+	if _, err := tx.Exec(SchemaSQL(`
 CREATE DOMAIN timetable.cron AS TEXT CHECK(
 	substr(VALUE, 1, 6) IN ('@every', '@after') AND (substr(VALUE, 7) :: INTERVAL) IS NOT NULL	
 	OR VALUE IN ('@annually', '@yearly', '@monthly', '@weekly', '@daily', '@hourly', '@reboot')
@@ -179,7 +1122,7 @@ INSERT INTO timetable.chain_execution_config (
     self_destruct
 FROM cte_chain
 RETURNING chain_execution_config 
-' LANGUAGE 'sql';`); err != nil {
+' LANGUAGE 'sql';`)); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,83 @@
+package pgengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// FileReferencePrefix starts JSON string parameter value referencing the file with the actual value
+const FileReferencePrefix = "@"
+
+// fileReference returns the path if s is a file reference, i.e. @ followed by absolute path or path
+// relative to the working directory starting with ./ or ../, other values starting with @ are kept as is
+func fileReference(s string) (string, bool) {
+	if !strings.HasPrefix(s, FileReferencePrefix) {
+		return "", false
+	}
+	path := strings.TrimPrefix(s, FileReferencePrefix)
+	isRelative := strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../")
+	return path, filepath.IsAbs(path) || isRelative
+}
+
+// ResolveFileReferences replaces string values of JSON parameter referencing files, e.g. "@/path/to/query.sql",
+// with the file contents. The value is returned unchanged if it contains no file references
+func ResolveFileReferences(value string) (string, error) {
+	if !strings.Contains(value, `"`+FileReferencePrefix) {
+		return value, nil
+	}
+	var v interface{}
+	d := json.NewDecoder(strings.NewReader(value))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		// malformed values are reported by the task itself
+		return value, nil
+	}
+	v, replaced, err := replaceFileReferences(v)
+	if err != nil || !replaced {
+		return value, err
+	}
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err = e.Encode(v); err != nil {
+		return value, err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+func replaceFileReferences(v interface{}) (interface{}, bool, error) {
+	var replaced bool
+	switch val := v.(type) {
+	case string:
+		path, ok := fileReference(val)
+		if !ok {
+			return v, false, nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return v, false, fmt.Errorf("Cannot read parameter file: %w", err)
+		}
+		return string(data), true, nil
+	case []interface{}:
+		for i := range val {
+			r, ok, err := replaceFileReferences(val[i])
+			if err != nil {
+				return v, false, err
+			}
+			val[i], replaced = r, replaced || ok
+		}
+	case map[string]interface{}:
+		for k := range val {
+			r, ok, err := replaceFileReferences(val[k])
+			if err != nil {
+				return v, false, err
+			}
+			val[k], replaced = r, replaced || ok
+		}
+	}
+	return v, replaced, nil
+}
@@ -0,0 +1,204 @@
+package pgengine
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// RemoteMaxOpenConns parameter specifies the maximum number of open connections per remote database, 0 means no limit
+var RemoteMaxOpenConns = IntSetting{v: 2}
+
+// RemoteMaxIdleConns parameter specifies the maximum number of idle connections kept per remote database
+var RemoteMaxIdleConns = IntSetting{v: 1}
+
+// RemoteIdleTimeout parameter specifies in seconds how long unused remote database handle is kept in the pool
+var RemoteIdleTimeout = IntSetting{v: 300}
+
+// remoteDB is the pooled handle of the database defined in timetable.database_connection.
+// Evicted handle is removed from the pool and closed as soon as the last user releases it
+type remoteDB struct {
+	db               *sqlx.DB
+	connectionString string
+	lastUsed         time.Time
+	users            int
+	evicted          bool
+}
+
+// RemoteDBStats describes pooled handle of the remote database
+type RemoteDBStats struct {
+	DatabaseConnection int64
+	sql.DBStats
+}
+
+// remoteDBs guards the pool map and usage counters only, no network I/O is done while it's locked
+var remoteDBs = struct {
+	sync.Mutex
+	pool map[int64]*remoteDB
+}{pool: make(map[int64]*remoteDB)}
+
+// GetRemoteDB returns pooled connection to the database defined in timetable.database_connection,
+// release must be called with the execution result when the connection is not needed anymore
+func GetRemoteDB(ctx context.Context, databaseConnection int64) (db *sqlx.DB, release func(err error), err error) {
+	connectionString, err := ConnectionDSN(ctx, databaseConnection)
+	if err != nil {
+		return nil, nil, err
+	}
+	closeRemoteDBs(evictIdleRemoteDBs(time.Now()))
+
+	if r := acquireRemoteDB(databaseConnection, connectionString); r != nil {
+		if err = r.db.PingContext(ctx); err == nil {
+			return r.db, func(err error) { releaseRemoteDB(databaseConnection, r, isConnectionError(err)) }, nil
+		}
+		LogToDB("LOG", fmt.Sprintf("Remote database connection %d from the pool failed ping: %v", databaseConnection, err))
+		releaseRemoteDB(databaseConnection, r, true)
+	}
+
+	if db, err = sqlx.ConnectContext(ctx, "postgres", connectionString); err != nil {
+		return nil, nil, err
+	}
+	db.SetMaxOpenConns(RemoteMaxOpenConns.Get())
+	db.SetMaxIdleConns(RemoteMaxIdleConns.Get())
+	r := addRemoteDB(databaseConnection, &remoteDB{db: db, connectionString: connectionString})
+	if r.db != db {
+		// another execution has connected meanwhile, use its handle
+		FinalizeRemoteDBConnection(db)
+	} else {
+		LogToDB("DEBUG", fmt.Sprintf("Remote database connection %d added to the pool", databaseConnection))
+	}
+	return r.db, func(err error) { releaseRemoteDB(databaseConnection, r, isConnectionError(err)) }, nil
+}
+
+// isConnectionError returns true if execution failed not because of the error reported by the server
+func isConnectionError(err error) bool {
+	_, isSQLError := err.(*pq.Error)
+	return err != nil && !isSQLError
+}
+
+// acquireRemoteDB returns pooled handle with the same connection string marked as used, handle with
+// outdated connection string is evicted
+func acquireRemoteDB(databaseConnection int64, connectionString string) *remoteDB {
+	remoteDBs.Lock()
+	r, ok := remoteDBs.pool[databaseConnection]
+	var outdated []*remoteDB
+	if ok && r.connectionString != connectionString {
+		outdated = append(outdated, evictRemoteDB(databaseConnection)...)
+		ok = false
+	}
+	if ok {
+		r.users++
+		r.lastUsed = time.Now()
+	}
+	remoteDBs.Unlock()
+	closeRemoteDBs(outdated)
+	if !ok {
+		return nil
+	}
+	return r
+}
+
+// addRemoteDB puts the new handle into the pool unless another one with the same connection string exists,
+// the handle in the pool is returned marked as used
+func addRemoteDB(databaseConnection int64, r *remoteDB) *remoteDB {
+	remoteDBs.Lock()
+	var outdated []*remoteDB
+	if existing, ok := remoteDBs.pool[databaseConnection]; ok {
+		if existing.connectionString == r.connectionString {
+			r = existing
+		} else {
+			outdated = evictRemoteDB(databaseConnection)
+		}
+	}
+	remoteDBs.pool[databaseConnection] = r
+	r.users++
+	r.lastUsed = time.Now()
+	remoteDBs.Unlock()
+	closeRemoteDBs(outdated)
+	return r
+}
+
+// releaseRemoteDB marks the handle as unused and evicts it from the pool if asked,
+// evicted handle is closed by its last user
+func releaseRemoteDB(databaseConnection int64, r *remoteDB, evict bool) {
+	remoteDBs.Lock()
+	r.users--
+	r.lastUsed = time.Now()
+	var unused []*remoteDB
+	evicted := evict && remoteDBs.pool[databaseConnection] == r
+	if evicted {
+		unused = evictRemoteDB(databaseConnection)
+	} else if r.evicted && r.users == 0 {
+		unused = []*remoteDB{r}
+	}
+	remoteDBs.Unlock()
+	if evicted {
+		LogToDB("DEBUG", fmt.Sprintf("Remote database connection %d evicted from the pool", databaseConnection))
+	}
+	closeRemoteDBs(unused)
+}
+
+// evictRemoteDB must be called with remoteDBs locked, returns the handle if it is not used and should be closed
+func evictRemoteDB(databaseConnection int64) []*remoteDB {
+	r, ok := remoteDBs.pool[databaseConnection]
+	if !ok {
+		return nil
+	}
+	delete(remoteDBs.pool, databaseConnection)
+	r.evicted = true
+	if r.users > 0 {
+		return nil
+	}
+	return []*remoteDB{r}
+}
+
+// evictIdleRemoteDBs returns unused handles idle longer than RemoteIdleTimeout removed from the pool
+func evictIdleRemoteDBs(now time.Time) (idle []*remoteDB) {
+	remoteDBs.Lock()
+	defer remoteDBs.Unlock()
+	for id, r := range remoteDBs.pool {
+		if r.users == 0 && now.Sub(r.lastUsed) > time.Duration(RemoteIdleTimeout.Get())*time.Second {
+			idle = append(idle, evictRemoteDB(id)...)
+		}
+	}
+	return idle
+}
+
+func closeRemoteDBs(handles []*remoteDB) {
+	for _, r := range handles {
+		FinalizeRemoteDBConnection(r.db)
+	}
+}
+
+// GetRemoteDBStats returns statistics of pooled remote database handles ordered by database connection ID
+func GetRemoteDBStats() []RemoteDBStats {
+	remoteDBs.Lock()
+	stats := make([]RemoteDBStats, 0, len(remoteDBs.pool))
+	handles := make([]*sqlx.DB, 0, len(remoteDBs.pool))
+	for id, r := range remoteDBs.pool {
+		stats = append(stats, RemoteDBStats{DatabaseConnection: id})
+		handles = append(handles, r.db)
+	}
+	remoteDBs.Unlock()
+	for i, db := range handles {
+		stats[i].DBStats = db.Stats()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].DatabaseConnection < stats[j].DatabaseConnection })
+	return stats
+}
+
+// CloseRemoteDBs drains the pool, handles in use are closed when released
+func CloseRemoteDBs() {
+	remoteDBs.Lock()
+	var unused []*remoteDB
+	for id := range remoteDBs.pool {
+		unused = append(unused, evictRemoteDB(id)...)
+	}
+	remoteDBs.Unlock()
+	closeRemoteDBs(unused)
+}
@@ -0,0 +1,163 @@
+package pgengine
+
+import (
+	"context"
+	"fmt"
+)
+
+// LogRetention parameter specifies the number of days to keep timetable.log entries and successful task
+// executions in timetable.execution_log, 0 means forever
+var LogRetention IntSetting
+
+// ErrorLogRetention parameter specifies the number of days to keep ERROR and PANIC entries of timetable.log
+// and failed task executions in timetable.execution_log, 0 means forever
+var ErrorLogRetention IntSetting
+
+// RunRetention parameter specifies the number of days to keep finished runs in timetable.run_status, 0 means forever
+var RunRetention IntSetting
+
+// ArchiveRuns parameter specifies if finished runs older than RunRetention and their task executions are moved to
+// timetable.run_status_archive and timetable.execution_log_archive instead of being deleted
+var ArchiveRuns BoolSetting
+
+// PruneLogs parameter specifies if old log rows should be deleted once without running scheduler
+var PruneLogs bool
+
+// pruneBatchSize is the maximum number of rows deleted in one transaction
+const pruneBatchSize = 10000
+
+// rows locked by another pruning instance are skipped, it will delete them itself
+const sqlPruneLog = `DELETE FROM timetable.log WHERE id IN (
+	SELECT id FROM timetable.log
+	WHERE ts < now() - $1 * interval '1 day' AND (log_level IN ('ERROR', 'PANIC')) = $2
+	LIMIT $3 FOR UPDATE SKIP LOCKED)`
+
+const sqlPruneExecutionLog = `DELETE FROM timetable.execution_log WHERE ctid = ANY(ARRAY(
+	SELECT ctid FROM timetable.execution_log
+	WHERE last_run < now() - $1 * interval '1 day' AND (returncode IS DISTINCT FROM 0) = $2
+	LIMIT $3 FOR UPDATE SKIP LOCKED))`
+
+// runPruneBatchSize is the maximum number of runs deleted or archived in one transaction, every run consists
+// of several run_status rows and task executions
+const runPruneBatchSize = 1000
+
+// sqlPruneRuns deletes finished runs, i.e. the start row with all status rows of the run, and task executions
+// matched to them the same way the run history does. Runs without a final status are never selected, so active
+// runs are not affected. Runs locked by another pruning instance are skipped
+const sqlPruneRuns = `WITH runs AS (
+	SELECT h.run_status, h.chain_execution_config, h.client_name, h.started, f.last_status_update AS finished
+	FROM timetable.run_status h JOIN LATERAL (
+		SELECT execution_status, last_status_update
+		FROM timetable.run_status
+		WHERE start_status = h.run_status AND fan_out_item IS NULL
+		ORDER BY run_status DESC
+		LIMIT 1) f ON f.execution_status <> 'STARTED'
+	WHERE h.start_status IS NULL AND h.started < now() - $1 * interval '1 day'
+	ORDER BY h.run_status
+	LIMIT $2 FOR UPDATE OF h SKIP LOCKED
+), moved_runs AS (
+	DELETE FROM timetable.run_status s USING runs r
+	WHERE s.run_status = r.run_status OR s.start_status = r.run_status
+	RETURNING s.*
+), moved_logs AS (
+	DELETE FROM timetable.execution_log l USING runs r
+	WHERE l.chain_execution_config = r.chain_execution_config AND l.client_name = r.client_name
+		AND l.last_run >= r.started AND l.last_run <= r.finished
+	RETURNING l.*
+)`
+
+// sqlArchiveRuns inserts rows deleted by sqlPruneRuns into archive tables in the same statement
+const sqlArchiveRuns = `, archived_runs AS (
+	INSERT INTO timetable.run_status_archive SELECT * FROM moved_runs
+), archived_logs AS (
+	INSERT INTO timetable.execution_log_archive SELECT * FROM moved_logs
+)`
+
+const sqlPruneRunsCount = `
+SELECT (SELECT count(*) FROM runs), (SELECT count(*) FROM moved_runs), (SELECT count(*) FROM moved_logs)`
+
+// pruneRuns deletes or archives finished runs older than RunRetention days in batches until no runs are left or
+// the context is done. Every batch is a single statement, so archived rows are never lost or duplicated
+func pruneRuns(ctx context.Context) (runs, statusRows, execRows int64, err error) {
+	if RunRetention.Get() <= 0 {
+		return
+	}
+	query := sqlPruneRuns
+	if ArchiveRuns.Get() {
+		query += sqlArchiveRuns
+	}
+	query = SchemaSQL(query + sqlPruneRunsCount)
+	for ctx.Err() == nil {
+		var n, s, e int64
+		if err = ConfigDb().QueryRowContext(ctx, query, RunRetention.Get(), runPruneBatchSize).Scan(&n, &s, &e); err != nil {
+			return
+		}
+		runs, statusRows, execRows = runs+n, statusRows+s, execRows+e
+		if n < runPruneBatchSize {
+			break
+		}
+	}
+	return runs, statusRows, execRows, ctx.Err()
+}
+
+// pruneTable deletes rows selected by the prune query in batches until no rows are left or the context is done
+func pruneTable(ctx context.Context, query string, days int, errors bool) (int64, error) {
+	var deleted int64
+	if days <= 0 {
+		return 0, nil
+	}
+	for ctx.Err() == nil {
+		res, err := ConfigDb().ExecContext(ctx, SchemaSQL(query), days, errors, pruneBatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+		if n < pruneBatchSize {
+			break
+		}
+	}
+	return deleted, ctx.Err()
+}
+
+// PruneOldLogs deletes rows of timetable.log and timetable.execution_log older than LogRetention and
+// ErrorLogRetention days and finished runs older than RunRetention days, see pruneRuns. Every batch of rows
+// is deleted in its own transaction, so the scheduler writing logs at the same time is never blocked for long
+func PruneOldLogs(ctx context.Context) error {
+	var logRows, execRows int64
+	runs, statusRows, runExecRows, err := pruneRuns(ctx)
+	if RunRetention.Get() > 0 && (runs > 0 || err == nil) {
+		action := "Pruned"
+		if ArchiveRuns.Get() {
+			action = "Archived"
+		}
+		LogToDB("LOG", fmt.Sprintf("%s %d runs with %d rows of %s.run_status and %d rows of %s.execution_log",
+			action, runs, statusRows, Schema, runExecRows, Schema))
+	}
+	for _, r := range []struct {
+		days   int
+		errors bool
+	}{{LogRetention.Get(), false}, {ErrorLogRetention.Get(), true}} {
+		if err != nil {
+			break
+		}
+		var n int64
+		n, err = pruneTable(ctx, sqlPruneLog, r.days, r.errors)
+		logRows += n
+		if err != nil {
+			break
+		}
+		n, err = pruneTable(ctx, sqlPruneExecutionLog, r.days, r.errors)
+		execRows += n
+		if err != nil {
+			break
+		}
+	}
+	if logRows+execRows > 0 || err == nil {
+		LogToDB("LOG", fmt.Sprintf("Pruned %d rows of %s.log and %d rows of %s.execution_log", logRows, Schema, execRows, Schema))
+	}
+	if err != nil {
+		LogToDB("ERROR", "Cannot prune logs and runs: ", err)
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package pgengine
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// TaskResult represents the outcome of the task execution. ExitCode is set by shell tasks, Stdout holds the
+// combined output unless the task captures output separately. Data holds structured values reported by the task,
+// e.g. rows_affected of SQL tasks or status_code of downloads
+type TaskResult struct {
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+	Data     map[string]interface{}
+}
+
+// SetData stores the value of the key, values must be marshalable to JSON
+func (r *TaskResult) SetData(key string, value interface{}) {
+	if r.Data == nil {
+		r.Data = make(map[string]interface{})
+	}
+	r.Data[key] = value
+}
+
+// DataJSON returns Data as JSON object, nil if there is no data
+func (r *TaskResult) DataJSON() []byte {
+	if len(r.Data) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(r.Data)
+	if err != nil {
+		LogToDB("ERROR", "Cannot marshal task result data: ", err)
+		return nil
+	}
+	return data
+}
+
+type taskResultKey struct{}
+
+// WithTaskResult returns the context collecting data reported by the task executed with it, see SetResultData
+func WithTaskResult(ctx context.Context, result *TaskResult) context.Context {
+	return context.WithValue(ctx, taskResultKey{}, result)
+}
+
+// SetResultData stores the value of the key in the result of the task executed with the context, if any
+func SetResultData(ctx context.Context, key string, value interface{}) {
+	if r, ok := ctx.Value(taskResultKey{}).(*TaskResult); ok {
+		r.SetData(key, value)
+	}
+}
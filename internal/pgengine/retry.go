@@ -0,0 +1,52 @@
+package pgengine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MaxTransientRetries specifies how many times the work failed with a serialization failure or a deadlock is repeated
+const MaxTransientRetries = 3
+
+// transientRetryDelay is the delay before the first retry, it's doubled for every next one
+var transientRetryDelay = 100 * time.Millisecond
+
+// transientErrorCodes are SQLSTATE codes of errors which are transient by definition
+var transientErrorCodes = map[pq.ErrorCode]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+}
+
+// IsTransientError returns true for serialization failures and deadlocks, the failed work may succeed if repeated
+func IsTransientError(err error) bool {
+	return transientErrorCodes[pq.ErrorCode(SQLState(err))]
+}
+
+// RetryTransient calls fn again while it fails with a transient error, at most MaxTransientRetries times
+// with exponential backoff. Since the failed transaction cannot be continued, fn should start it from scratch
+// or roll it back to a savepoint. The last error is returned if the retries are exhausted or the context is done
+func RetryTransient(ctx context.Context, name string, fn func() error) error {
+	delay := transientRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !IsTransientError(err) {
+			return err
+		}
+		if attempt > MaxTransientRetries {
+			LogToDB("ERROR", fmt.Sprintf("Transient error in %s persists after %d retries: %v", name, MaxTransientRetries, err))
+			return err
+		}
+		LogToDB("LOG", fmt.Sprintf("Transient error in %s, retry %d of %d in %v: %v", name, attempt, MaxTransientRetries, delay, err))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		delay *= 2
+	}
+}
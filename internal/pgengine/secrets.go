@@ -0,0 +1,263 @@
+package pgengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SecretEnvPrefix is prepended to the secret name to get environment variable holding the secret
+const SecretEnvPrefix = "PGTT_SECRET_"
+
+// SecretsDir parameter specifies directory with files holding secrets, one file per secret named after it
+var SecretsDir StringSetting
+
+// VaultAddr parameter specifies address of HashiCorp Vault server secrets are resolved from, empty value disables it
+var VaultAddr string
+
+// VaultToken parameter specifies token used to read secrets from Vault
+var VaultToken string
+
+// VaultPath parameter specifies path of Vault key/value secret holding secrets as its keys
+var VaultPath = "secret/data/pg_timetable"
+
+// AWSSecretsRegion parameter specifies region of AWS Secrets Manager secrets are resolved from, empty value disables it
+var AWSSecretsRegion string
+
+// AWSSecretsPrefix parameter specifies prefix prepended to secret names to get AWS Secrets Manager secret IDs
+var AWSSecretsPrefix string
+
+// SecretsCacheTTL parameter specifies in seconds how long secrets of external secret managers are cached, 0 disables
+// the cache
+var SecretsCacheTTL = 60
+
+// SecretResolver returns the value of the named secret, ok is false if the secret is unknown to resolver
+type SecretResolver interface {
+	Resolve(name string) (value string, ok bool, err error)
+}
+
+// SecretResolverFunc is an adapter to allow the use of ordinary functions as secret resolvers
+type SecretResolverFunc func(name string) (string, bool, error)
+
+// Resolve calls f(name)
+func (f SecretResolverFunc) Resolve(name string) (string, bool, error) {
+	return f(name)
+}
+
+// secretResolvers are asked in order, environment and files are checked first
+var secretResolvers = []SecretResolver{SecretResolverFunc(resolveEnvSecret), SecretResolverFunc(resolveFileSecret)}
+
+// RegisterSecretResolver adds resolver for an external secret store
+func RegisterSecretResolver(r SecretResolver) {
+	secretResolvers = append(secretResolvers, r)
+}
+
+var reSecret = regexp.MustCompile(`\$\{secret:([A-Za-z0-9_][A-Za-z0-9_.-]*)\}`)
+
+// MinMaskedSecretLength specifies the minimal length of secret value masked in logs, shorter values
+// would corrupt unrelated log text
+const MinMaskedSecretLength = 4
+
+// resolvedSecrets maps resolved secret values to their placeholders, so they can be masked in logs
+var resolvedSecrets = struct {
+	sync.RWMutex
+	placeholders map[string]string
+	masker       *strings.Replacer
+}{placeholders: make(map[string]string)}
+
+// storeSecret registers secret value to be masked, the masker is rebuilt only if the value is new
+func storeSecret(value string, placeholder string) {
+	if len(value) < MinMaskedSecretLength {
+		return
+	}
+	resolvedSecrets.Lock()
+	defer resolvedSecrets.Unlock()
+	if _, ok := resolvedSecrets.placeholders[value]; ok {
+		return
+	}
+	resolvedSecrets.placeholders[value] = placeholder
+	values := make([]string, 0, len(resolvedSecrets.placeholders))
+	for v := range resolvedSecrets.placeholders {
+		values = append(values, v)
+	}
+	// longer values first, so a secret containing another one is masked as a whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	pairs := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		pairs = append(pairs, v, resolvedSecrets.placeholders[v])
+	}
+	resolvedSecrets.masker = strings.NewReplacer(pairs...)
+}
+
+func resolveEnvSecret(name string) (string, bool, error) {
+	value, ok := os.LookupEnv(SecretEnvPrefix + name)
+	return value, ok, nil
+}
+
+func resolveFileSecret(name string) (string, bool, error) {
+	if SecretsDir.Get() == "" {
+		return "", false, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(SecretsDir.Get(), name))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	return strings.TrimRight(string(data), "\r\n"), err == nil, err
+}
+
+func resolveSecret(name string) (string, error) {
+	for _, r := range secretResolvers {
+		value, ok, err := r.Resolve(name)
+		if err != nil {
+			return "", fmt.Errorf("Cannot resolve secret %s: %v", name, err)
+		}
+		if ok {
+			storeSecret(value, "${secret:"+name+"}")
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("Secret %s not found", name)
+}
+
+// GetSecret returns the value of the named secret asking resolvers in order, the value is masked in logs
+func GetSecret(name string) (string, error) {
+	return resolveSecret(name)
+}
+
+// ResolveSecrets replaces ${secret:NAME} placeholders in JSON parameter value with the secret values
+func ResolveSecrets(value string) (string, error) {
+	var err error
+	resolved := reSecret.ReplaceAllStringFunc(value, func(placeholder string) string {
+		if err != nil {
+			return placeholder
+		}
+		var secret string
+		if secret, err = resolveSecret(reSecret.FindStringSubmatch(placeholder)[1]); err != nil {
+			return placeholder
+		}
+		// secrets are put into JSON string values, so they must be escaped
+		escaped, _ := json.Marshal(secret)
+		secret = string(escaped[1 : len(escaped)-1])
+		storeSecret(secret, placeholder)
+		return secret
+	})
+	return resolved, err
+}
+
+var reEnv = regexp.MustCompile(`\$\{env:([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// ResolveEnv replaces ${env:NAME} placeholders in JSON parameter value with values of the environment variables,
+// ${env:NAME:-default} is replaced with the default if the variable is not set or empty. Resolved values are
+// masked in logs like secrets, defaults are kept since they are stored in the parameter anyway
+func ResolveEnv(value string) (string, error) {
+	var err error
+	resolved := reEnv.ReplaceAllStringFunc(value, func(placeholder string) string {
+		if err != nil {
+			return placeholder
+		}
+		m := reEnv.FindStringSubmatch(placeholder)
+		env := os.Getenv(m[1])
+		if env == "" {
+			if !strings.Contains(placeholder, ":-") {
+				err = fmt.Errorf("Environment variable %s is not set", m[1])
+				return placeholder
+			}
+			return m[2]
+		}
+		storeSecret(env, placeholder)
+		// like secrets, values are put into JSON string values
+		escaped, _ := json.Marshal(env)
+		env = string(escaped[1 : len(escaped)-1])
+		storeSecret(env, placeholder)
+		return env
+	})
+	return resolved, err
+}
+
+// MaskSecrets replaces resolved secret values in s with their placeholders and text matching
+// redaction patterns with RedactedValue
+func MaskSecrets(s string) string {
+	resolvedSecrets.RLock()
+	masker := resolvedSecrets.masker
+	resolvedSecrets.RUnlock()
+	if masker != nil {
+		s = masker.Replace(s)
+	}
+	s, _ = redact(s)
+	return s
+}
+
+// RedactedValue replaces text matching redaction patterns in logs
+const RedactedValue = "****"
+
+// redactPatterns are regular expressions matching sensitive text, e.g. passwords in command lines
+var redactPatterns = struct {
+	sync.RWMutex
+	list []*regexp.Regexp
+}{}
+
+// SetRedactPatterns sets regular expressions matching sensitive text to be masked in logs. If the expression
+// has capture groups only the text matching groups is masked, e.g. `--password[= ](\S+)`
+func SetRedactPatterns(exprs []string) error {
+	list := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("Invalid redaction pattern %s: %v", expr, err)
+		}
+		list = append(list, re)
+	}
+	redactPatterns.Lock()
+	redactPatterns.list = list
+	redactPatterns.Unlock()
+	return nil
+}
+
+// RedactSensitive registers text of s matching redaction patterns to be masked in logs, so it's masked
+// wherever it appears later, e.g. in the output of the command which command line is s
+func RedactSensitive(s string) {
+	_, values := redact(s)
+	for _, v := range values {
+		storeSecret(v, RedactedValue)
+	}
+}
+
+// redact replaces text matching redaction patterns with RedactedValue and returns the replaced values
+func redact(s string) (string, []string) {
+	redactPatterns.RLock()
+	list := redactPatterns.list
+	redactPatterns.RUnlock()
+	var values []string
+	for _, re := range list {
+		matches := re.FindAllStringSubmatchIndex(s, -1)
+		if matches == nil {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			if len(m) > 2 { // mask groups only
+				m = m[2:]
+			}
+			for i := 0; i < len(m); i += 2 {
+				start, end := m[i], m[i+1]
+				if start < last || start == end { // group didn't match or is nested
+					continue
+				}
+				b.WriteString(s[last:start])
+				b.WriteString(RedactedValue)
+				values = append(values, s[start:end])
+				last = end
+			}
+		}
+		b.WriteString(s[last:])
+		s = b.String()
+	}
+	return s, values
+}
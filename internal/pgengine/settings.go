@@ -0,0 +1,85 @@
+package pgengine
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Options changeable at runtime are reloaded on SIGHUP while chains are running, so they're kept in settings
+// read and written atomically rather than in plain variables
+
+// IntSetting is the integer option changeable at runtime
+type IntSetting struct {
+	v int64
+}
+
+// Get returns the current value of the option
+func (s *IntSetting) Get() int {
+	return int(atomic.LoadInt64(&s.v))
+}
+
+// Set changes the value of the option
+func (s *IntSetting) Set(v int) {
+	atomic.StoreInt64(&s.v, int64(v))
+}
+
+// BoolSetting is the boolean option changeable at runtime
+type BoolSetting struct {
+	v int32
+}
+
+// Get returns the current value of the option
+func (s *BoolSetting) Get() bool {
+	return atomic.LoadInt32(&s.v) != 0
+}
+
+// Set changes the value of the option
+func (s *BoolSetting) Set(v bool) {
+	var i int32
+	if v {
+		i = 1
+	}
+	atomic.StoreInt32(&s.v, i)
+}
+
+// StringSetting is the string option changeable at runtime
+type StringSetting struct {
+	sync.RWMutex
+	v string
+}
+
+// Get returns the current value of the option
+func (s *StringSetting) Get() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.v
+}
+
+// Set changes the value of the option
+func (s *StringSetting) Set(v string) {
+	s.Lock()
+	defer s.Unlock()
+	s.v = v
+}
+
+// configDb holds the configuration database, which is replaced by ReconnectConfigDB while chains are running
+var configDb struct {
+	sync.RWMutex
+	db *sqlx.DB
+}
+
+// ConfigDb returns the configuration database, nil if it's not connected
+func ConfigDb() *sqlx.DB {
+	configDb.RLock()
+	defer configDb.RUnlock()
+	return configDb.db
+}
+
+// SetConfigDb replaces the configuration database
+func SetConfigDb(db *sqlx.DB) {
+	configDb.Lock()
+	defer configDb.Unlock()
+	configDb.db = db
+}
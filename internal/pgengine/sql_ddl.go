@@ -18,13 +18,70 @@ VALUES
 	(0, '0051 Implement upgrade machinery'),
 	(1, '0070 Interval scheduling and cron only syntax'),
 	(2, '0086 Add task output to execution_log'),
-	(3, '0108 Add client_name column to timetable.run_status');
+	(3, '0108 Add client_name column to timetable.run_status'),
+	(4, '0283 Capture stdout and stderr of shell tasks separately'),
+	(5, '0285 Add timetable.active_session heartbeat table'),
+	(6, '0286 Ignore jobs of dead sessions in get_running_jobs'),
+	(7, '0287 Add conditional execution of chain elements'),
+	(8, '0288 Add working directory to base tasks'),
+	(9, '0289 Add CopyFromFile built-in task'),
+	(10, '0290 Accept Go durations and seconds in interval schedules'),
+	(11, '0295 Add max_jitter to chain execution config'),
+	(12, '0296 Add last_tick to timetable.active_session'),
+	(13, '0298 Add RemoteSQL built-in task'),
+	(14, '0300 Add message_data to timetable.log'),
+	(15, '0283 Add stderr to timetable.execution_log'),
+	(16, '0286 Check heartbeat freshness in get_running_jobs'),
+	(17, '0302 Add chain timeout'),
+	(18, '0305 Add named chain execution parameters'),
+	(19, '0306 Add FileArchive built-in task'),
+	(20, '0307 Add minimum interval between identical shell commands'),
+	(21, '0310 Add audit log of configuration changes'),
+	(22, '0312 Add notification triggered chains'),
+	(23, '0316 Add indexes for log pruning'),
+	(24, '0317 Add resource limits of shell tasks'),
+	(25, '0319 Add JSON Schema of task parameters'),
+	(26, '0322 Add DownloadFile built-in task'),
+	(27, '0324 Add priority to chain execution config'),
+	(28, '0327 Add EncryptFile and DecryptFile built-in tasks'),
+	(29, '0328 Add CHAIN_SKIPPED execution status for empty chains'),
+	(30, '0330 Add output_table column to base_task'),
+	(31, '0331 Add fan-out columns to task_chain and run_status'),
+	(32, '0334 Add precondition to chain execution config'),
+	(33, '0337 Add WaitForSQL built-in task'),
+	(34, '0340 Add credentials to database connection'),
+	(35, '0341 Add treat_stderr_as_error to base_task'),
+	(36, '0343 Add CHAIN_CANCELLED execution status'),
+	(37, '0344 Add depends_on to task_chain'),
+	(38, '0345 Add ArchiveDirectory built-in task'),
+	(39, '0346 Add exit_code_map to base_task'),
+	(40, '0349 Add cron macros to timetable.cron'),
+	(41, '0350 Add tags to chain_execution_config'),
+	(42, '0352 Add expect_output to base_task'),
+	(43, '0353 Add next_run_time function'),
+	(44, '0354 Add run_status_archive and execution_log_archive'),
+	(45, '0355 Add BackupTables built-in task'),
+	(46, '0357 Add execution windows to chain_execution_config'),
+	(47, '0360 Add on-failure handler chain to chain_execution_config'),
+	(48, '0364 Add run_as_user and run_as_group to base_task'),
+	(49, '0365 Add empty_params to base_task'),
+	(50, '0367 Add paused to chain_execution_config'),
+	(51, '0368 Add result to execution_log'),
+	(52, '0369 Add CHAIN_INTERRUPTED execution status'),
+	(53, '0371 Add missed_ticks to chain_execution_config');
 
 -- define database connections for script execution
+-- "password_secret" is the name of the secret holding the password, so it's not stored in "connect_string",
+-- SSL columns take precedence over the same options of "connect_string"
 CREATE TABLE timetable.database_connection (
 	database_connection BIGSERIAL,
 	connect_string 		TEXT		NOT NULL,
 	comment 			TEXT,
+	password_secret		TEXT,
+	sslmode				TEXT		CHECK (sslmode IN ('disable', 'allow', 'prefer', 'require', 'verify-ca', 'verify-full')),
+	sslrootcert			TEXT,
+	sslcert				TEXT,
+	sslkey				TEXT,
 	PRIMARY KEY (database_connection)
 );
 
@@ -35,14 +92,72 @@ CREATE TABLE timetable.database_connection (
 --      command string to be executed
 --
 -- "kind" indicates whether "script" is SQL, built-in function or external program
+--
+-- "separate_output" indicates whether stdout and stderr of external program
+--      should be captured separately
+--
+-- "work_dir" is the working directory of external program,
+--      if NULL the scheduler's working directory is used
+--
+-- "min_interval" is the minimum number of seconds between executions of
+--      external program with the same parameters, if NULL it's not throttled
+--
+-- "nice", "max_cpu_time" (seconds), "max_memory" (megabytes) and "max_open_files"
+--      limit resources of external program, if NULL the limit is not set
+--
+-- "params_schema" is the JSON Schema every parameter value of the task must match,
+--      named parameters are validated as one object, if NULL parameters are not validated
+--
+-- "output_table" is the table the output of external program is inserted into within
+--      the chain transaction instead of "timetable.execution_log", the table must have
+--      "chain_id", "task_id", "finished" and "output" columns, if NULL output is logged
+--
+-- "treat_stderr_as_error" marks execution of external program as failed if it wrote to stderr
+--      despite zero exit code, stderr must be captured with "separate_output"
+--
+-- "stderr_error_pattern" is the regular expression stderr must match to fail the task,
+--      if NULL any stderr output fails it
+--
+-- "exit_code_map" maps non-zero exit codes of external program like "2" or ranges like "3-9"
+--      to "success", "warn" or "fail", exit codes not listed fail the task
+--
+-- "expect_output" is the text the output of external program must contain, or the regular
+--      expression it must match if "expect_output_mode" is 'regex', otherwise the task fails,
+--      only stdout is checked with "separate_output"
+--
+-- "run_as_user" and "run_as_group" are the OS user and group, names or numeric IDs, external program
+--      is executed as, the scheduler must run as root to use them, if NULL the scheduler's ones are used,
+--      without "run_as_group" the primary group of "run_as_user" is used
+--
+-- "empty_params" specifies what happens to external program without parameters in the chain
+--      configuration: 'run' executes it once without arguments, 'skip' doesn't execute it,
+--      'fail' fails the task
 CREATE TYPE timetable.task_kind AS ENUM ('SQL', 'SHELL', 'BUILTIN');
 
 CREATE TABLE timetable.base_task (
-	task_id		BIGSERIAL  			PRIMARY KEY,
-	name		TEXT    		    NOT NULL UNIQUE,
-	kind		timetable.task_kind	NOT NULL DEFAULT 'SQL',
-	script		TEXT				NOT NULL,
-	CHECK (CASE WHEN kind <> 'BUILTIN' THEN script IS NOT NULL ELSE TRUE END)
+	task_id			BIGSERIAL  			PRIMARY KEY,
+	name			TEXT    		    NOT NULL UNIQUE,
+	kind			timetable.task_kind	NOT NULL DEFAULT 'SQL',
+	script			TEXT				NOT NULL,
+	separate_output	BOOLEAN				NOT NULL DEFAULT false,
+	work_dir		TEXT,
+	min_interval	INTEGER				CHECK (min_interval > 0),
+	nice			INTEGER				CHECK (nice BETWEEN -20 AND 19),
+	max_cpu_time	INTEGER				CHECK (max_cpu_time > 0),
+	max_memory		INTEGER				CHECK (max_memory > 0),
+	max_open_files	INTEGER				CHECK (max_open_files > 0),
+	params_schema	JSONB,
+	output_table	TEXT,
+	treat_stderr_as_error	BOOLEAN		NOT NULL DEFAULT false,
+	stderr_error_pattern	TEXT,
+	exit_code_map	JSONB				CHECK (jsonb_typeof(exit_code_map) = 'object'),
+	expect_output	TEXT,
+	expect_output_mode	TEXT			NOT NULL DEFAULT 'contains' CHECK (expect_output_mode IN ('contains', 'regex')),
+	run_as_user		TEXT				CHECK (run_as_user <> ''),
+	run_as_group	TEXT				CHECK (run_as_group <> ''),
+	empty_params	TEXT				NOT NULL DEFAULT 'run' CHECK (empty_params IN ('run', 'skip', 'fail')),
+	CHECK (CASE WHEN kind <> 'BUILTIN' THEN script IS NOT NULL ELSE TRUE END),
+	CHECK (NOT treat_stderr_as_error OR separate_output)
 );
 
 -- Task chain declaration:
@@ -55,6 +170,18 @@ CREATE TABLE timetable.base_task (
 -- "ignore_error" indicates whether the next task
 --      in the chain can be executed regardless of the
 --      success of the current one
+-- "run_if_exit_codes" if set, the task is executed only when
+--      exit code of the previous task is listed
+-- "abort_if_not_met" indicates whether the chain should fail
+--      instead of skipping the task if condition is not met
+-- "fan_out_param" is the named parameter holding an array, if set the task
+--      is executed once per array item passed as the parameter value
+-- "fan_out_limit" is the number of items executed at once, if NULL items
+--      are executed one by one
+-- "fan_out_fail_fast" indicates whether items are no longer started after
+--      an item failed, otherwise all items are executed before failing
+-- "depends_on" lists chain_id of elements of the same chain the task waits
+--      for, if NULL the task depends on the previous element
 CREATE TABLE timetable.task_chain (
 	chain_id        	BIGSERIAL	PRIMARY KEY,
 	parent_id			BIGINT 		UNIQUE  REFERENCES timetable.task_chain(chain_id)
@@ -67,7 +194,13 @@ CREATE TABLE timetable.task_chain (
 	database_connection	BIGINT		REFERENCES timetable.database_connection(database_connection)
 									ON UPDATE CASCADE
 									ON DELETE CASCADE,
-	ignore_error		BOOLEAN		DEFAULT false
+	ignore_error		BOOLEAN		DEFAULT false,
+	run_if_exit_codes	INTEGER[],
+	abort_if_not_met	BOOLEAN		NOT NULL DEFAULT false,
+	fan_out_param		TEXT,
+	fan_out_limit		INTEGER		CHECK (fan_out_limit > 0),
+	fan_out_fail_fast	BOOLEAN		NOT NULL DEFAULT true,
+	depends_on			BIGINT[]
 );
 
 
@@ -80,9 +213,42 @@ CREATE TABLE timetable.task_chain (
 -- "live" is the indication that the chain is finalized, the system can run it
 -- "self_destruct" is the indication that this chain will delete itself after run
 -- "client_name" is the indication that this chain will run only under this tag
+-- "max_jitter" is the maximum random delay in seconds before the chain starts,
+--      if NULL the global setting is used
+-- "timeout" is the maximum run duration of the whole chain in seconds, remaining tasks are skipped
+--      and the run is marked as CHAIN_TIMEOUT, NULL or 0 means unlimited
+-- "notify_channel" is the notification channel the chain is started on, the payload
+--      of NOTIFY is passed to tasks as "payload" named parameter
+-- "priority" orders chains waiting for a free worker, higher values are dispatched first
+-- "precondition" is the query returning single boolean evaluated before the run, the run is
+--      skipped unless it returns true, NULL or empty string means the chain always runs
+-- "tags" groups chains, schedulers started with --only-tags or --exclude-tags handle only
+--      chains matching their filter
+-- "window_start" and "window_end" limit cron and @reboot runs to the daily execution window in "window_timezone",
+--      the session time zone is used if NULL. The window crosses midnight if it ends before it starts.
+--      "window_action" tells whether runs outside the window are skipped or deferred until the window opens
+-- "on_failure_chain_id" is the chain configuration started when a run of the chain fails or times out,
+--      if NULL the global setting is used
+-- "missed_ticks" tells whether cron ticks missed while no scheduler could start the chain are skipped,
+--      caught up by a single run or by a run per missed tick
+-- parse_interval accepts PostgreSQL interval, Go duration (e.g. 1h30m) or integer seconds
+CREATE OR REPLACE FUNCTION timetable.parse_interval(value TEXT) RETURNS INTERVAL AS $$
+	SELECT CASE WHEN value ~ '^\s*([0-9]+(\.[0-9]+)?(h|m|s|ms|us|µs))+\s*$' THEN
+		regexp_replace(regexp_replace(regexp_replace(regexp_replace(regexp_replace(value,
+			'([0-9.]+)(us|µs)', '\1 microseconds ', 'g'),
+			'([0-9.]+)ms', '\1 milliseconds ', 'g'),
+			'([0-9.]+)h', '\1 hours ', 'g'),
+			'([0-9.]+)m', '\1 minutes ', 'g'),
+			'([0-9.]+)s', '\1 seconds ', 'g') :: INTERVAL
+	ELSE
+		value :: INTERVAL
+	END
+$$ LANGUAGE 'sql'
+IMMUTABLE STRICT;
+
 CREATE DOMAIN timetable.cron AS TEXT CHECK(
-	substr(VALUE, 1, 6) IN ('@every', '@after') AND (substr(VALUE, 7) :: INTERVAL) IS NOT NULL	
-	OR VALUE = '@reboot'
+	substr(VALUE, 1, 6) IN ('@every', '@after') AND timetable.parse_interval(substr(VALUE, 7)) IS NOT NULL
+	OR VALUE IN ('@annually', '@yearly', '@monthly', '@weekly', '@daily', '@midnight', '@hourly', '@reboot')
 	OR VALUE ~ '^(((\d+,)+\d+|(\d+(\/|-)\d+)|(\*(\/|-)\d+)|\d+|\*) +){4}(((\d+,)+\d+|(\d+(\/|-)\d+)|(\*(\/|-)\d+)|\d+|\*) ?)$'
 );
 
@@ -99,10 +265,28 @@ CREATE TABLE timetable.chain_execution_config (
     self_destruct				BOOLEAN		DEFAULT false,
 	exclusive_execution			BOOLEAN		DEFAULT false,
 	excluded_execution_configs	INTEGER[],
-	client_name					TEXT
+	client_name					TEXT,
+	max_jitter					INTEGER		CHECK (max_jitter >= 0),
+	timeout						INTEGER		CHECK (timeout >= 0),
+	notify_channel				TEXT		CHECK (notify_channel <> ''),
+	priority					INTEGER		NOT NULL DEFAULT 0,
+	precondition				TEXT,
+	tags						TEXT[],
+	window_start				TIME,
+	window_end					TIME,
+	window_timezone				TEXT		CHECK (timestamptz '2000-01-01 00:00:00+00' AT TIME ZONE window_timezone IS NOT NULL),
+	window_action				TEXT		NOT NULL DEFAULT 'skip' CHECK (window_action IN ('skip', 'defer')),
+	on_failure_chain_id			BIGINT		REFERENCES timetable.chain_execution_config(chain_execution_config)
+											ON UPDATE CASCADE
+											ON DELETE SET NULL,
+	paused						BOOLEAN		NOT NULL DEFAULT false,
+	missed_ticks				TEXT		NOT NULL DEFAULT 'skip' CHECK (missed_ticks IN ('skip', 'catch_up_once', 'catch_up_all')),
+	CHECK ((window_start IS NULL) = (window_end IS NULL) AND window_start <> window_end),
+	CHECK (on_failure_chain_id <> chain_execution_config)
 );
 
--- parameter passing for config
+-- parameter passing for config, rows with "param_name" set are named parameters,
+-- others are positional and passed in "order_id" order
 CREATE TABLE timetable.chain_execution_parameters(
 	chain_execution_config	BIGINT	REFERENCES timetable.chain_execution_config (chain_execution_config)
 									ON UPDATE CASCADE
@@ -112,7 +296,17 @@ CREATE TABLE timetable.chain_execution_parameters(
 									ON DELETE CASCADE,
 	order_id 				INTEGER	CHECK (order_id > 0),
 	value 					jsonb,
-	PRIMARY KEY (chain_execution_config, chain_id, order_id)
+	param_name				TEXT	CHECK (param_name ~ '^[A-Za-z_][A-Za-z0-9_]*$'),
+	PRIMARY KEY (chain_execution_config, chain_id, order_id),
+	UNIQUE (chain_execution_config, chain_id, param_name)
+);
+
+-- the last cron tick the chain was started or skipped on purpose for, tracked for chains catching up missed ticks
+CREATE TABLE timetable.chain_last_fired (
+	chain_execution_config	BIGINT		PRIMARY KEY REFERENCES timetable.chain_execution_config (chain_execution_config)
+										ON UPDATE CASCADE
+										ON DELETE CASCADE,
+	last_fired				TIMESTAMPTZ	NOT NULL
 );
 
 
@@ -126,9 +320,12 @@ CREATE TABLE timetable.log
 	client_name	        TEXT,
 	pid					INTEGER 			NOT NULL,
 	log_level			timetable.log_type	NOT NULL,
-	message				TEXT
+	message				TEXT,
+	message_data		JSONB
 );
 
+CREATE INDEX ON timetable.log (ts);
+
 -- log timetable related action
 CREATE TABLE timetable.execution_log (
 	chain_execution_config	BIGINT,
@@ -142,10 +339,14 @@ CREATE TABLE timetable.execution_log (
 	returncode      		INTEGER,
 	pid             		BIGINT,
 	output					TEXT,
-	client_name				TEXT		NOT NULL
+	client_name				TEXT		NOT NULL,
+	stderr					TEXT,
+	result					JSONB
 );
 
-CREATE TYPE timetable.execution_status AS ENUM ('STARTED', 'CHAIN_FAILED', 'CHAIN_DONE', 'DEAD');
+CREATE INDEX ON timetable.execution_log (last_run);
+
+CREATE TYPE timetable.execution_status AS ENUM ('STARTED', 'CHAIN_FAILED', 'CHAIN_DONE', 'DEAD', 'CHAIN_TIMEOUT', 'CHAIN_SKIPPED', 'CHAIN_CANCELLED', 'CHAIN_INTERRUPTED');
 
 CREATE TABLE timetable.run_status (
 	run_status 					BIGSERIAL,
@@ -157,9 +358,30 @@ CREATE TABLE timetable.run_status (
 	last_status_update 			TIMESTAMPTZ 				DEFAULT clock_timestamp(),
 	chain_execution_config 		BIGINT,
 	client_name					TEXT	NOT NULL,
+	stderr_tail					TEXT,
+	fan_out_item				INTEGER,
 	PRIMARY KEY (run_status)
 );
 
+CREATE INDEX ON timetable.run_status (start_status);
+
+-- finished runs and their task executions moved out of "run_status" and "execution_log" by archiving,
+-- the columns must match the source tables, so columns added there must be added here too
+CREATE TABLE timetable.run_status_archive (LIKE timetable.run_status);
+
+CREATE TABLE timetable.execution_log_archive (LIKE timetable.execution_log);
+
+-- active scheduler sessions, "last_seen" is updated periodically by every running scheduler,
+-- "last_tick" is the time when the scheduler evaluated schedules last time
+CREATE TABLE timetable.active_session (
+	client_pid		BIGINT		NOT NULL,
+	client_name		TEXT		NOT NULL,
+	started_at		TIMESTAMPTZ	NOT NULL	DEFAULT now(),
+	last_seen		TIMESTAMPTZ	NOT NULL	DEFAULT now(),
+	last_tick		TIMESTAMPTZ,
+	PRIMARY KEY (client_pid, client_name)
+);
+
 CREATE OR REPLACE FUNCTION timetable.trig_chain_fixer() RETURNS trigger AS $$
 	DECLARE
 		tmp_parent_id BIGINT;
@@ -205,6 +427,67 @@ CREATE TRIGGER trig_task_chain_fixer
         BEFORE DELETE ON timetable.base_task
         FOR EACH ROW EXECUTE PROCEDURE timetable.trig_chain_fixer();
 
+-- audit trail of changes of chain configurations and tasks written by triggers, "client_name" is set
+-- if the change was made by pg_timetable, "changed_by" is the database user
+CREATE TABLE timetable.change_log (
+	change_id		BIGSERIAL	PRIMARY KEY,
+	changed_at		TIMESTAMPTZ	NOT NULL	DEFAULT now(),
+	table_name		TEXT		NOT NULL,
+	operation		TEXT		NOT NULL,
+	object_id		BIGINT,
+	changed_by		TEXT		NOT NULL	DEFAULT session_user,
+	client_name		TEXT,
+	old_value		JSONB,
+	new_value		JSONB
+);
+
+CREATE INDEX ON timetable.change_log (table_name, object_id);
+
+-- log_change() writes the changed row into change_log, the primary key column name is the trigger argument
+CREATE OR REPLACE FUNCTION timetable.log_change() RETURNS trigger AS $$
+	DECLARE
+		old_row JSONB;
+		new_row JSONB;
+	BEGIN
+		IF TG_OP <> 'INSERT' THEN
+			old_row := to_jsonb(OLD);
+		END IF;
+		IF TG_OP <> 'DELETE' THEN
+			new_row := to_jsonb(NEW);
+		END IF;
+		IF old_row = new_row THEN
+			RETURN NULL;
+		END IF;
+		INSERT INTO timetable.change_log (table_name, operation, object_id, client_name, old_value, new_value)
+			VALUES (TG_TABLE_NAME, TG_OP, (COALESCE(new_row, old_row) ->> TG_ARGV[0]) :: BIGINT,
+				NULLIF(current_setting('pg_timetable.client_name', true), ''), old_row, new_row);
+		RETURN NULL;
+	END;
+$$ LANGUAGE 'plpgsql';
+
+CREATE TRIGGER trig_chain_execution_config_log
+        AFTER INSERT OR UPDATE OR DELETE ON timetable.chain_execution_config
+        FOR EACH ROW EXECUTE PROCEDURE timetable.log_change('chain_execution_config');
+
+CREATE TRIGGER trig_base_task_log
+        AFTER INSERT OR UPDATE OR DELETE ON timetable.base_task
+        FOR EACH ROW EXECUTE PROCEDURE timetable.log_change('task_id');
+
+-- reset_last_fired() forgets the last fired tick of the chain enabled, rescheduled or changing missed_ticks,
+-- so ticks before the change are not caught up
+CREATE OR REPLACE FUNCTION timetable.reset_last_fired() RETURNS trigger AS $$
+BEGIN
+	DELETE FROM timetable.chain_last_fired WHERE chain_execution_config = NEW.chain_execution_config;
+	RETURN NULL;
+END;
+$$ LANGUAGE 'plpgsql';
+
+CREATE TRIGGER trig_chain_execution_config_reset_last_fired
+        AFTER UPDATE OF live, run_at, missed_ticks ON timetable.chain_execution_config
+        FOR EACH ROW WHEN (OLD.live IS DISTINCT FROM NEW.live OR OLD.run_at IS DISTINCT FROM NEW.run_at
+            OR OLD.missed_ticks IS DISTINCT FROM NEW.missed_ticks)
+        EXECUTE PROCEDURE timetable.reset_last_fired();
+
 CREATE OR REPLACE FUNCTION timetable.task_chain_delete(config_ bigint, chain_id_ bigint) RETURNS boolean AS $$
 DECLARE
 		chain_id_1st_   bigint;
@@ -1,19 +1,21 @@
 package pgengine
 
 const sqlJobFunctions = `-- get_running_jobs() returns jobs are running for particular chain_execution_config
-CREATE OR REPLACE FUNCTION timetable.get_running_jobs(BIGINT) 
+-- by alive scheduler sessions, i.e. listed in active_session table with heartbeat not older than stale_timeout
+CREATE OR REPLACE FUNCTION timetable.get_running_jobs(BIGINT, stale_timeout INTERVAL DEFAULT '1 minute') 
 RETURNS SETOF record AS $$
     SELECT  chain_execution_config, start_status
         FROM    timetable.run_status
         WHERE   start_status IN ( SELECT   start_status
                 FROM    timetable.run_status
                 WHERE   execution_status IN ('STARTED', 'CHAIN_FAILED',
-                             'CHAIN_DONE', 'DEAD')
+                             'CHAIN_DONE', 'DEAD', 'CHAIN_TIMEOUT', 'CHAIN_SKIPPED', 'CHAIN_CANCELLED', 'CHAIN_INTERRUPTED')
                     AND (chain_execution_config = $1 OR chain_execution_config = 0)
                 GROUP BY 1
                 HAVING count(*) < 2 
                 ORDER BY 1)
             AND chain_execution_config = $1 
+            AND client_name IN (SELECT client_name FROM timetable.active_session WHERE last_seen > now() - $2)
         GROUP BY 1, 2
         ORDER BY 1, 2 DESC
 $$ LANGUAGE 'sql';
@@ -40,7 +42,24 @@ BEGIN
 END
 $$ LANGUAGE 'plpgsql';
 
--- is_cron_in_time returns TRUE if timestamp is listed in cron expression
+-- cron_expression returns the cron expression run_at stands for, macros are expanded and NULL stands for every
+-- minute. NULL is returned for schedules not bound to the clock, i.e. @reboot, @every and @after
+CREATE OR REPLACE FUNCTION timetable.cron_expression(run_at timetable.cron) RETURNS TEXT AS
+$$
+    SELECT CASE
+        WHEN run_at IS NULL THEN '* * * * *'
+        WHEN run_at = '@reboot' OR substr(run_at, 1, 6) IN ('@every', '@after') THEN NULL
+        WHEN run_at IN ('@yearly', '@annually') THEN '0 0 1 1 *'
+        WHEN run_at = '@monthly' THEN '0 0 1 * *'
+        WHEN run_at = '@weekly' THEN '0 0 * * 0'
+        WHEN run_at IN ('@daily', '@midnight') THEN '0 0 * * *'
+        WHEN run_at = '@hourly' THEN '0 * * * *'
+        ELSE run_at
+    END
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- is_cron_in_time returns TRUE if timestamp is listed in cron expression, macros are expanded to cron expressions,
+-- schedules not bound to the clock are never in time
 CREATE OR REPLACE FUNCTION timetable.is_cron_in_time(run_at timetable.cron, ts timestamptz) RETURNS BOOLEAN AS
 $$
 DECLARE 
@@ -49,16 +68,18 @@ DECLARE
     a_by_day integer[];
     a_by_month integer[];
     a_by_day_of_week integer[]; 
+    cron_expr text;
 BEGIN
-    IF run_at IS NULL
+    cron_expr := timetable.cron_expression(run_at);
+    IF cron_expr IS NULL
     THEN
-        RETURN TRUE;
+        RETURN FALSE;
     END IF;
-    a_by_minute := timetable.cron_element_to_array(run_at, 'minute');
-    a_by_hour := timetable.cron_element_to_array(run_at, 'hour');
-    a_by_day := timetable.cron_element_to_array(run_at, 'day');
-    a_by_month := timetable.cron_element_to_array(run_at, 'month');
-    a_by_day_of_week := timetable.cron_element_to_array(run_at, 'day_of_week'); 
+    a_by_minute := timetable.cron_element_to_array(cron_expr, 'minute');
+    a_by_hour := timetable.cron_element_to_array(cron_expr, 'hour');
+    a_by_day := timetable.cron_element_to_array(cron_expr, 'day');
+    a_by_month := timetable.cron_element_to_array(cron_expr, 'month');
+    a_by_day_of_week := timetable.cron_element_to_array(cron_expr, 'day_of_week'); 
     RETURN  (a_by_month[1]       IS NULL OR date_part('month', ts) = ANY(a_by_month))
         AND (a_by_day_of_week[1] IS NULL OR date_part('dow', ts) = ANY(a_by_day_of_week))
         AND (a_by_day[1]         IS NULL OR date_part('day', ts) = ANY(a_by_day))
@@ -67,6 +88,76 @@ BEGIN
 END;
 $$ LANGUAGE 'plpgsql';
 
+-- next_run_time returns the first minute after timestamp listed in cron expression, matched the same way and in the
+-- same session time zone as is_cron_in_time does. NULL is returned for schedules not bound to the clock and if no
+-- such minute exists within 28 years, e.g. for February 30
+CREATE OR REPLACE FUNCTION timetable.next_run_time(run_at timetable.cron, ts timestamptz) RETURNS timestamptz AS
+$$
+DECLARE 
+    a_by_minute integer[];
+    a_by_hour integer[];
+    a_by_day integer[];
+    a_by_month integer[];
+    a_by_day_of_week integer[]; 
+    cron_expr text;
+    day_start timestamp;
+    next_ts timestamptz;
+BEGIN
+    cron_expr := timetable.cron_expression(run_at);
+    IF cron_expr IS NULL
+    THEN
+        RETURN NULL;
+    END IF;
+    a_by_minute := timetable.cron_element_to_array(cron_expr, 'minute');
+    a_by_hour := timetable.cron_element_to_array(cron_expr, 'hour');
+    a_by_day := timetable.cron_element_to_array(cron_expr, 'day');
+    a_by_month := timetable.cron_element_to_array(cron_expr, 'month');
+    a_by_day_of_week := timetable.cron_element_to_array(cron_expr, 'day_of_week'); 
+    IF a_by_minute[1] IS NULL THEN
+        a_by_minute := ARRAY(SELECT generate_series(0, 59));
+    END IF;
+    IF a_by_hour[1] IS NULL THEN
+        a_by_hour := ARRAY(SELECT generate_series(0, 23));
+    END IF;
+    day_start := date_trunc('day', ts :: timestamp);
+    FOR i IN 0 .. 366 * 28 LOOP
+        IF  (a_by_month[1]       IS NULL OR date_part('month', day_start) = ANY(a_by_month))
+        AND (a_by_day_of_week[1] IS NULL OR date_part('dow', day_start) = ANY(a_by_day_of_week))
+        AND (a_by_day[1]         IS NULL OR date_part('day', day_start) = ANY(a_by_day))
+        THEN
+            SELECT min(c.t) INTO next_ts FROM (
+                SELECT (day_start + make_interval(hours => h, mins => m)) :: timestamptz AS t
+                FROM unnest(a_by_hour) h, unnest(a_by_minute) m) c
+            WHERE c.t > ts;
+            IF next_ts IS NOT NULL THEN
+                RETURN next_ts;
+            END IF;
+        END IF;
+        day_start := day_start + interval '1 day';
+    END LOOP;
+    RETURN NULL;
+END;
+$$ LANGUAGE 'plpgsql';
+
+-- window_delay returns how long the run at timestamp waits for the daily execution window from window_start to
+-- window_end in the time zone to open, the window crosses midnight if it ends before it starts. Zero is returned
+-- within the window and NULL if no window is set. The session time zone is used if window_timezone is NULL
+CREATE OR REPLACE FUNCTION timetable.window_delay(window_start time, window_end time, window_timezone text,
+    ts timestamptz) RETURNS interval AS
+$$
+    SELECT CASE
+        WHEN window_start IS NULL OR window_end IS NULL THEN NULL
+        WHEN CASE WHEN window_start < window_end
+            THEN l.t :: time >= window_start AND l.t :: time < window_end
+            ELSE l.t :: time >= window_start OR l.t :: time < window_end END
+        THEN interval '0'
+        ELSE ((date_trunc('day', l.t) + window_start +
+            CASE WHEN l.t :: time > window_start THEN interval '1 day' ELSE interval '0' END) AT TIME ZONE z.tz) - ts
+    END
+    FROM (SELECT COALESCE(window_timezone, current_setting('TimeZone')) AS tz) z,
+        LATERAL (SELECT ts AT TIME ZONE z.tz AS t) l
+$$ LANGUAGE 'sql' STABLE;
+
 -- cron_element_to_array() will return array with minutes, hours, days etc. of execution
 CREATE OR REPLACE FUNCTION timetable.cron_element_to_array(element text, element_type text) RETURNS integer[] AS
 $$
@@ -5,7 +5,16 @@ const sqlTasks = `INSERT INTO timetable.base_task(task_id, name, script, kind) V
 	(DEFAULT, 'Sleep', 'Sleep', 'BUILTIN'),
 	(DEFAULT, 'Log', 'Log', 'BUILTIN'),
 	(DEFAULT, 'SendMail', 'SendMail', 'BUILTIN'),
-	(DEFAULT, 'Download', 'Download', 'BUILTIN');
+	(DEFAULT, 'Download', 'Download', 'BUILTIN'),
+	(DEFAULT, 'CopyFromFile', 'CopyFromFile', 'BUILTIN'),
+	(DEFAULT, 'RemoteSQL', 'RemoteSQL', 'BUILTIN'),
+	(DEFAULT, 'FileArchive', 'FileArchive', 'BUILTIN'),
+	(DEFAULT, 'DownloadFile', 'DownloadFile', 'BUILTIN'),
+	(DEFAULT, 'EncryptFile', 'EncryptFile', 'BUILTIN'),
+	(DEFAULT, 'DecryptFile', 'DecryptFile', 'BUILTIN'),
+	(DEFAULT, 'WaitForSQL', 'WaitForSQL', 'BUILTIN'),
+	(DEFAULT, 'ArchiveDirectory', 'ArchiveDirectory', 'BUILTIN'),
+	(DEFAULT, 'BackupTables', 'BackupTables', 'BUILTIN');
 
 CREATE OR REPLACE FUNCTION timetable.get_task_id(task_name TEXT) 
 RETURNS BIGINT AS $$
@@ -0,0 +1,49 @@
+package pgengine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// OnlyTags parameter lists tags of chain configurations handled by the scheduler, empty list stands for all of them
+var OnlyTags []string
+
+// ExcludeTags parameter lists tags of chain configurations never handled by the scheduler, it takes precedence
+// over OnlyTags
+var ExcludeTags []string
+
+// SQLChainFilter is the condition selecting chain configurations handled by the scheduler. It expects ClientName
+// as $1, OnlyTags as $2 and ExcludeTags as $3, see ChainFilterArgs
+const SQLChainFilter = `(client_name = $1 OR client_name IS NULL)
+	AND (cardinality($2 :: text[]) = 0 OR tags && $2 :: text[]) AND NOT COALESCE(tags && $3 :: text[], FALSE)`
+
+// ChainFilterArgs returns arguments of SQLChainFilter followed by args of the query
+func ChainFilterArgs(args ...interface{}) []interface{} {
+	return append([]interface{}{ClientName, pq.Array(OnlyTags), pq.Array(ExcludeTags)}, args...)
+}
+
+// ParseTags splits comma separated lists of tags, returns error if any tag is empty
+func ParseTags(tags []string) ([]string, error) {
+	var res []string
+	for _, t := range tags {
+		for _, tag := range strings.Split(t, ",") {
+			if tag = strings.TrimSpace(tag); tag == "" {
+				return nil, fmt.Errorf("Empty tag in %q", t)
+			}
+			res = append(res, tag)
+		}
+	}
+	return res, nil
+}
+
+// LogChainFilter logs which chain configurations are handled by the scheduler if a tag filter is set
+func LogChainFilter() {
+	if len(OnlyTags) > 0 {
+		LogToDB("LOG", "Handling only chain configurations tagged ", strings.Join(OnlyTags, ", "))
+	}
+	if len(ExcludeTags) > 0 {
+		LogToDB("LOG", "Ignoring chain configurations tagged ", strings.Join(ExcludeTags, ", "))
+	}
+}
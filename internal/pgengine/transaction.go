@@ -1,15 +1,18 @@
 package pgengine
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 // ChainElementExecution structure describes each chain execution process
@@ -24,8 +27,32 @@ type ChainElementExecution struct {
 	IgnoreError        bool           `db:"ignore_error"`
 	DatabaseConnection sql.NullString `db:"database_connection"`
 	ConnectString      sql.NullString `db:"connect_string"`
+	SeparateOutput     bool           `db:"separate_output"`
+	WorkDir            string         `db:"work_dir"`
+	MinInterval        int            `db:"min_interval"` // in seconds, 0 means no throttling
+	Nice               int            `db:"nice"`
+	MaxCPUTime         int            `db:"max_cpu_time"`   // in seconds, 0 means no limit
+	MaxMemory          int            `db:"max_memory"`     // in megabytes, 0 means no limit
+	MaxOpenFiles       int            `db:"max_open_files"` // 0 means no limit
+	ParamsSchema       sql.NullString `db:"params_schema"`
+	OutputTable        string         `db:"output_table"` // empty if output is logged to execution_log
+	RunIfExitCodes     pq.Int64Array  `db:"run_if_exit_codes"`
+	AbortIfNotMet      bool           `db:"abort_if_not_met"`
+	FanOutParam        string         `db:"fan_out_param"` // empty if the task is executed once
+	FanOutLimit        int            `db:"fan_out_limit"` // 0 means items are executed one by one
+	FanOutFailFast     bool           `db:"fan_out_fail_fast"`
+	StderrAsError      bool           `db:"treat_stderr_as_error"`
+	StderrPattern      string         `db:"stderr_error_pattern"` // empty if any stderr output fails the task
+	DependsOn          pq.Int64Array  `db:"depends_on"`           // nil if the element depends on the previous one
+	ExitCodeMap        sql.NullString `db:"exit_code_map"`        // outcomes of non-zero exit codes of shell tasks
+	ExpectOutput       string         `db:"expect_output"`        // empty if the output of shell tasks is not checked
+	ExpectOutputMode   string         `db:"expect_output_mode"`   // "contains" or "regex"
+	RunAsUser          string         `db:"run_as_user"`          // empty if shell tasks run as the scheduler user
+	RunAsGroup         string         `db:"run_as_group"`         // empty if the primary group of the user is used
+	EmptyParams        string         `db:"empty_params"`         // "run", "skip" or "fail" shell tasks without parameters
 	StartedAt          time.Time
-	Duration           int64 // in microseconds
+	Duration           int64  // in microseconds
+	StderrTail         string // the tail of stderr output stored in run_status
 }
 
 func (chainElem ChainElementExecution) String() string {
@@ -35,11 +62,43 @@ func (chainElem ChainElementExecution) String() string {
 
 // StartTransaction return transaction object and panic in the case of error
 func StartTransaction() *sqlx.Tx {
-	return ConfigDb.MustBegin()
+	return ConfigDb().MustBegin()
 }
 
-// MustCommitTransaction commits transaction and log error in the case of error
+// StartTransactionE is StartTransaction returning the error instead of panicking
+func StartTransactionE() (*sqlx.Tx, error) {
+	tx, err := ConfigDb().Beginx()
+	return tx, queryError("transaction start", err)
+}
+
+// dryTransactions holds transactions rolled back instead of committed by MustCommitTransaction
+var dryTransactions sync.Map
+
+// StartTransactionDry returns transaction object which MustCommitTransaction rolls back instead of committing,
+// and panic in the case of error. Only transactions started this way are affected, so a commit is never
+// suppressed by accident
+func StartTransactionDry() *sqlx.Tx {
+	tx := ConfigDb().MustBegin()
+	dryTransactions.Store(tx, struct{}{})
+	return tx
+}
+
+// IsDryTransaction returns true if the transaction was started by StartTransactionDry and is not finished yet
+func IsDryTransaction(tx *sqlx.Tx) bool {
+	_, ok := dryTransactions.Load(tx)
+	return ok
+}
+
+// MustCommitTransaction commits transaction and log error in the case of error, dry transaction is rolled back
 func MustCommitTransaction(tx *sqlx.Tx) {
+	if IsDryTransaction(tx) {
+		dryTransactions.Delete(tx)
+		LogToDB("LOG", "Dry run, rolling back transaction instead of commit")
+		if err := tx.Rollback(); err != nil {
+			LogToDB("ERROR", "Application cannot rollback dry run transaction: ", err)
+		}
+		return
+	}
 	LogToDB("DEBUG", "Commit transaction for successful chain execution")
 	err := tx.Commit()
 	if err != nil {
@@ -49,6 +108,7 @@ func MustCommitTransaction(tx *sqlx.Tx) {
 
 // MustRollbackTransaction rollbacks transaction and log error in the case of error
 func MustRollbackTransaction(tx *sqlx.Tx) {
+	dryTransactions.Delete(tx)
 	LogToDB("DEBUG", "Rollback transaction for failed chain execution")
 	err := tx.Rollback()
 	if err != nil {
@@ -56,17 +116,45 @@ func MustRollbackTransaction(tx *sqlx.Tx) {
 	}
 }
 
-// GetChainElements returns all elements for a given chain
-func GetChainElements(tx *sqlx.Tx, chains interface{}, chainID int) bool {
+// GetChainElements returns all elements for a given chain in the chain order, DependsOn of the elements
+// defines the dependency graph
+func GetChainElements(tx *sqlx.Tx, chains interface{}, chainID int) error {
 	const sqlSelectChains = `
 WITH RECURSIVE x
-(chain_id, task_id, task_name, script, kind, run_uid, ignore_error, database_connection) AS 
+(chain_id, task_id, task_name, script, kind, run_uid, ignore_error, database_connection, separate_output, 
+	work_dir, min_interval, nice, max_cpu_time, max_memory, max_open_files, params_schema, output_table, 
+	run_if_exit_codes, abort_if_not_met, fan_out_param, fan_out_limit, fan_out_fail_fast, 
+	treat_stderr_as_error, stderr_error_pattern, depends_on, exit_code_map, expect_output, expect_output_mode, 
+	run_as_user, run_as_group, empty_params) AS 
 (
 	SELECT tc.chain_id, tc.task_id, bt.name, 
 	bt.script, bt.kind, 
 	tc.run_uid, 
 	tc.ignore_error, 
-	tc.database_connection 
+	tc.database_connection, 
+	bt.separate_output, 
+	COALESCE(bt.work_dir, ''), 
+	COALESCE(bt.min_interval, 0), 
+	COALESCE(bt.nice, 0), 
+	COALESCE(bt.max_cpu_time, 0), 
+	COALESCE(bt.max_memory, 0), 
+	COALESCE(bt.max_open_files, 0), 
+	bt.params_schema :: text, 
+	COALESCE(bt.output_table, ''), 
+	tc.run_if_exit_codes, 
+	tc.abort_if_not_met, 
+	COALESCE(tc.fan_out_param, ''), 
+	COALESCE(tc.fan_out_limit, 0), 
+	tc.fan_out_fail_fast, 
+	bt.treat_stderr_as_error, 
+	COALESCE(bt.stderr_error_pattern, ''), 
+	tc.depends_on, 
+	bt.exit_code_map :: text, 
+	COALESCE(bt.expect_output, ''), 
+	bt.expect_output_mode, 
+	COALESCE(bt.run_as_user, ''), 
+	COALESCE(bt.run_as_group, ''), 
+	bt.empty_params 
 	FROM timetable.task_chain tc JOIN 
 	timetable.base_task bt USING (task_id) 
 	WHERE tc.parent_id IS NULL AND tc.chain_id = $1 
@@ -75,7 +163,30 @@ WITH RECURSIVE x
 	bt.script, bt.kind, 
 	tc.run_uid, 
 	tc.ignore_error, 
-	tc.database_connection 
+	tc.database_connection, 
+	bt.separate_output, 
+	COALESCE(bt.work_dir, ''), 
+	COALESCE(bt.min_interval, 0), 
+	COALESCE(bt.nice, 0), 
+	COALESCE(bt.max_cpu_time, 0), 
+	COALESCE(bt.max_memory, 0), 
+	COALESCE(bt.max_open_files, 0), 
+	bt.params_schema :: text, 
+	COALESCE(bt.output_table, ''), 
+	tc.run_if_exit_codes, 
+	tc.abort_if_not_met, 
+	COALESCE(tc.fan_out_param, ''), 
+	COALESCE(tc.fan_out_limit, 0), 
+	tc.fan_out_fail_fast, 
+	bt.treat_stderr_as_error, 
+	COALESCE(bt.stderr_error_pattern, ''), 
+	tc.depends_on, 
+	bt.exit_code_map :: text, 
+	COALESCE(bt.expect_output, ''), 
+	bt.expect_output_mode, 
+	COALESCE(bt.run_as_user, ''), 
+	COALESCE(bt.run_as_group, ''), 
+	bt.empty_params 
 	FROM timetable.task_chain tc JOIN 
 	timetable.base_task bt USING (task_id) JOIN 
 	x ON (x.chain_id = tc.parent_id) 
@@ -86,48 +197,191 @@ WITH RECURSIVE x
 		WHERE a.database_connection = x.database_connection) 
 	FROM x`
 
-	err := tx.Select(chains, sqlSelectChains, chainID)
+	if err := tx.Select(chains, SchemaSQL(sqlSelectChains), chainID); err != nil {
+		return fmt.Errorf("Recursive queries to fetch chain tasks failed: %w", err)
+	}
+	return nil
+}
+
+// ErrTaskNotFound is returned if the base task requested to be tried doesn't exist
+var ErrTaskNotFound = errors.New("Base task not found")
 
+// GetBaseTaskElement returns the base task with the given name or ID as an element outside of any chain, options of
+// chain elements are left unset. Returns ErrTaskNotFound if the task doesn't exist
+func GetBaseTaskElement(task string) (*ChainElementExecution, error) {
+	const sqlSelectBaseTask = `SELECT task_id, name AS task_name, script, kind, separate_output, 
+	COALESCE(work_dir, '') AS work_dir, COALESCE(min_interval, 0) AS min_interval, COALESCE(nice, 0) AS nice, 
+	COALESCE(max_cpu_time, 0) AS max_cpu_time, COALESCE(max_memory, 0) AS max_memory, 
+	COALESCE(max_open_files, 0) AS max_open_files, params_schema :: text AS params_schema, 
+	treat_stderr_as_error, COALESCE(stderr_error_pattern, '') AS stderr_error_pattern, 
+	exit_code_map :: text AS exit_code_map, COALESCE(expect_output, '') AS expect_output, expect_output_mode, 
+	COALESCE(run_as_user, '') AS run_as_user, COALESCE(run_as_group, '') AS run_as_group, empty_params 
+FROM timetable.base_task 
+WHERE name = $1 OR task_id :: text = $1 
+ORDER BY name = $1 DESC 
+LIMIT 1`
+	var elem ChainElementExecution
+	err := ConfigDb().Get(&elem, SchemaSQL(sqlSelectBaseTask), task)
+	if err == sql.ErrNoRows {
+		return nil, ErrTaskNotFound
+	}
 	if err != nil {
-		LogToDB("ERROR", "Recursive queries to fetch chain tasks failed: ", err)
-		return false
+		return nil, err
 	}
-	return true
+	return &elem, nil
 }
 
-// GetChainParamValues returns parameter values to pass for task being executed
-func GetChainParamValues(tx *sqlx.Tx, paramValues interface{}, chainElemExec *ChainElementExecution) bool {
+// ResolveOutputTable returns the quoted name of the output table, so it's safe to be used in the query text.
+// An error is returned if the table doesn't exist or is not visible within the chain transaction
+func ResolveOutputTable(tx *sqlx.Tx, name string) (string, error) {
+	var resolved sql.NullString
+	if err := tx.Get(&resolved, `SELECT to_regclass($1) :: text`, name); err != nil {
+		return "", fmt.Errorf("Cannot check output table %s: %w", name, err)
+	}
+	if !resolved.Valid {
+		return "", fmt.Errorf("Output table %s does not exist", name)
+	}
+	return resolved.String, nil
+}
+
+// InsertTaskOutput stores the output of the chain element in its output table within the chain transaction,
+// so the output is kept only if the chain succeeds. OutputTable must be resolved by ResolveOutputTable
+func InsertTaskOutput(tx *sqlx.Tx, chainElemExec *ChainElementExecution, output string) error {
+	_, err := tx.Exec("INSERT INTO "+chainElemExec.OutputTable+" (chain_id, task_id, finished, output) "+
+		"VALUES ($1, $2, clock_timestamp(), $3)", chainElemExec.ChainID, chainElemExec.TaskID, MaskSecrets(output))
+	if err != nil {
+		return fmt.Errorf("Cannot insert output into table %s: %w", chainElemExec.OutputTable, err)
+	}
+	return nil
+}
+
+// GetChainParamValues returns parameter values to pass for task being executed, file references
+// are replaced with the file contents, ${env:NAME} placeholders with the environment variables and
+// ${secret:NAME} placeholders with the secret values
+func GetChainParamValues(tx *sqlx.Tx, paramValues interface{}, chainElemExec *ChainElementExecution) error {
 	const sqlGetParamValues = `
 SELECT value
 FROM  timetable.chain_execution_parameters
 WHERE chain_execution_config = $1
   AND chain_id = $2
+  AND param_name IS NULL
 ORDER BY order_id ASC`
-	err := tx.Select(paramValues, sqlGetParamValues, chainElemExec.ChainConfig, chainElemExec.ChainID)
+	err := tx.Select(paramValues, SchemaSQL(sqlGetParamValues), chainElemExec.ChainConfig, chainElemExec.ChainID)
+	if err != nil {
+		return fmt.Errorf("Cannot fetch parameters values for chain: %w", err)
+	}
+	if values, ok := paramValues.(*[]string); ok {
+		for i, val := range *values {
+			if val, err = ResolveFileReferences(val); err != nil {
+				return fmt.Errorf("Cannot resolve parameters values for chain: %w", err)
+			}
+			if val, err = ResolveEnv(val); err != nil {
+				return fmt.Errorf("Cannot resolve parameters values for chain: %w", err)
+			}
+			if (*values)[i], err = ResolveSecrets(val); err != nil {
+				return fmt.Errorf("Cannot resolve parameters values for chain: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// GetChainNamedParams returns named parameter values of the task being executed, file references
+// are replaced with the file contents, ${env:NAME} placeholders with the environment variables and
+// ${secret:NAME} placeholders with the secret values
+func GetChainNamedParams(tx *sqlx.Tx, chainElemExec *ChainElementExecution) (map[string]json.RawMessage, error) {
+	const sqlGetNamedParams = `
+SELECT param_name, value :: text
+FROM  timetable.chain_execution_parameters
+WHERE chain_execution_config = $1
+  AND chain_id = $2
+  AND param_name IS NOT NULL`
+	rows, err := tx.Query(SchemaSQL(sqlGetNamedParams), chainElemExec.ChainConfig, chainElemExec.ChainID)
 	if err != nil {
-		LogToDB("ERROR", "cannot fetch parameters values for chain: ", err)
-		return false
+		return nil, fmt.Errorf("Cannot fetch named parameters for chain: %w", err)
+	}
+	defer rows.Close()
+	named := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var name, value string
+		if err = rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		if value, err = ResolveFileReferences(value); err != nil {
+			return nil, fmt.Errorf("Cannot resolve named parameters for chain: %w", err)
+		}
+		if value, err = ResolveEnv(value); err != nil {
+			return nil, fmt.Errorf("Cannot resolve named parameters for chain: %w", err)
+		}
+		if value, err = ResolveSecrets(value); err != nil {
+			return nil, fmt.Errorf("Cannot resolve named parameters for chain: %w", err)
+		}
+		named[name] = json.RawMessage(value)
 	}
-	return true
+	return named, rows.Err()
 }
 
-// ExecuteSQLTask executes SQL task
-func ExecuteSQLTask(tx *sqlx.Tx, chainElemExec *ChainElementExecution, paramValues []string) error {
+// ValidateParams checks parameter values and the object of named parameters against the JSON Schema
+// of the task, if it's set
+func ValidateParams(chainElemExec *ChainElementExecution, paramValues []string, namedParams map[string]json.RawMessage) error {
+	if !chainElemExec.ParamsSchema.Valid {
+		return nil
+	}
+	const sqlValidate = `SELECT timetable.validate_json_schema($1 :: jsonb, $2 :: jsonb)`
+	validate := func(value string, what string) error {
+		var valid bool
+		if err := ConfigDb().Get(&valid, SchemaSQL(sqlValidate), chainElemExec.ParamsSchema.String, value); err != nil {
+			return fmt.Errorf("Cannot validate %s: %w", what, err)
+		}
+		if !valid {
+			return fmt.Errorf("%s doesn't match parameters schema of task %s: %s", what, chainElemExec.TaskName, value)
+		}
+		return nil
+	}
+	for i, value := range paramValues {
+		if err := validate(value, fmt.Sprintf("Parameter value %d", i+1)); err != nil {
+			return err
+		}
+	}
+	if len(namedParams) == 0 {
+		return nil
+	}
+	named, err := json.Marshal(namedParams)
+	if err != nil {
+		return err
+	}
+	return validate(string(named), "Named parameters")
+}
+
+// ExecuteSQLTask executes SQL task, the statement is cancelled when the context is done. The result holds
+// the number of rows affected by the statements as rows_affected data
+func ExecuteSQLTask(ctx context.Context, tx *sqlx.Tx, chainElemExec *ChainElementExecution, paramValues []string,
+	namedParams map[string]json.RawMessage) (result TaskResult, err error) {
 	var execTx *sqlx.Tx
 	var remoteDb *sqlx.DB
 
+	ctx = WithTaskResult(ctx, &result)
 	execTx = tx
 	//Connect to Remote DB
 	if chainElemExec.DatabaseConnection.Valid {
-		connectionString := GetConnectionString(chainElemExec.DatabaseConnection)
+		var connectionString string
+		connectionString, err = GetConnectionStringE(chainElemExec.DatabaseConnection)
+		if err != nil {
+			LogToDBContext(ctx, "ERROR", "Issue while fetching connection string:", err)
+			return result, err
+		}
 		//connection string is empty then don't proceed
 		if strings.TrimSpace(connectionString) == "" {
-			return errors.New("Connection string is blank")
+			return result, errors.New("Connection string is blank")
 		}
-		remoteDb, execTx = GetRemoteDBTransaction(connectionString)
 		//don't proceed when remote db connection not established
-		if execTx == nil {
-			return errors.New("Couldn't connect to remote database")
+		if remoteDb, execTx, err = GetRemoteDBTransactionE(connectionString); err != nil {
+			LogToDBContext(ctx, "ERROR", "Error in remote connection: ", err)
+			return result, fmt.Errorf("Couldn't connect to remote database: %w", err)
+		}
+		// changes of the remote database are previewed as well during dry run
+		if IsDryTransaction(tx) {
+			dryTransactions.Store(execTx, struct{}{})
 		}
 		defer FinalizeRemoteDBConnection(remoteDb)
 	}
@@ -137,21 +391,28 @@ func ExecuteSQLTask(tx *sqlx.Tx, chainElemExec *ChainElementExecution, paramValu
 		SetRole(execTx, chainElemExec.RunUID)
 	}
 
-	if chainElemExec.IgnoreError {
-		LogToDB("DEBUG", "Define savepoint to ignore an error for the task: ", chainElemExec.TaskName)
-		_, err := execTx.Exec("SAVEPOINT " + strconv.Quote(chainElemExec.TaskName))
-		if err != nil {
-			LogToDB("ERROR", err)
-		}
+	// savepoint allows to repeat the task after a transient error and to ignore an error for the task
+	savepoint := strconv.Quote(chainElemExec.TaskName)
+	LogToDBContext(ctx, "DEBUG", "Define savepoint for the task: ", chainElemExec.TaskName)
+	if _, err := execTx.Exec("SAVEPOINT " + savepoint); err != nil {
+		LogToDBContext(ctx, "ERROR", err)
 	}
 
-	err := ExecuteSQLCommand(execTx, chainElemExec.Script, paramValues)
+	err = RetryTransient(ctx, "task "+chainElemExec.TaskName, func() error {
+		err := ExecuteSQLCommand(ctx, execTx, chainElemExec.Script, paramValues, namedParams)
+		if IsTransientError(err) {
+			if _, rbErr := execTx.Exec("ROLLBACK TO SAVEPOINT " + savepoint); rbErr != nil {
+				return rbErr
+			}
+		}
+		return err
+	})
 
 	if err != nil && chainElemExec.IgnoreError {
-		LogToDB("DEBUG", "Rollback to savepoint ignoring error for the task: ", chainElemExec.TaskName)
+		LogToDBContext(ctx, "DEBUG", "Rollback to savepoint ignoring error for the task: ", chainElemExec.TaskName)
 		_, err := execTx.Exec("ROLLBACK TO SAVEPOINT " + strconv.Quote(chainElemExec.TaskName))
 		if err != nil {
-			LogToDB("ERROR", err)
+			LogToDBContext(ctx, "ERROR", err)
 		}
 	}
 
@@ -165,52 +426,154 @@ func ExecuteSQLTask(tx *sqlx.Tx, chainElemExec *ChainElementExecution, paramValu
 		MustCommitTransaction(execTx)
 	}
 
-	return err
+	return result, err
 }
 
-// ExecuteSQLCommand executes chain script with parameters inside transaction
-func ExecuteSQLCommand(tx *sqlx.Tx, script string, paramValues []string) error {
-	var err error
+// ExecuteSQLCommand executes chain script with parameters inside transaction. Positional parameters are bound
+// to $1, $2, etc. and named parameters to :name placeholders, which are numbered after the positional ones.
+// The number of affected rows is reported as rows_affected result data, see SetResultData
+func ExecuteSQLCommand(ctx context.Context, tx *sqlx.Tx, script string, paramValues []string,
+	namedParams map[string]json.RawMessage) error {
 	var params []interface{}
+	var rows int64
 
 	if strings.TrimSpace(script) == "" {
 		return errors.New("SQL script cannot be empty")
 	}
 	if len(paramValues) == 0 { //mimic empty param
-		_, err = tx.Exec(script)
-	} else {
-		for _, val := range paramValues {
-			if val > "" {
-				if err := json.Unmarshal([]byte(val), &params); err != nil {
-					return err
+		query, args, err := bindNamedParams(script, namedParams, 0)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		rows, _ = res.RowsAffected()
+		SetResultData(ctx, "rows_affected", rows)
+		return nil
+	}
+	for _, val := range paramValues {
+		if val > "" {
+			if err := json.Unmarshal([]byte(val), &params); err != nil {
+				return err
+			}
+			query, args, err := bindNamedParams(script, namedParams, len(params))
+			if err != nil {
+				return err
+			}
+			params = append(params, args...)
+			LogToDBContext(ctx, "DEBUG", "Executing the command: ", query, fmt.Sprintf("; With parameters: %+v", params))
+			res, err := tx.ExecContext(ctx, query, params...)
+			if err != nil {
+				return err
+			}
+			n, _ := res.RowsAffected()
+			rows += n
+		}
+	}
+	SetResultData(ctx, "rows_affected", rows)
+	return nil
+}
+
+// bindNamedParams replaces :name placeholders of known named parameters with $N placeholders numbered
+// after offset positional ones and returns their values. Quoted literals, identifiers and :: casts are left intact
+func bindNamedParams(script string, namedParams map[string]json.RawMessage, offset int) (string, []interface{}, error) {
+	if len(namedParams) == 0 {
+		return script, nil, nil
+	}
+	var b strings.Builder
+	var args []interface{}
+	positions := make(map[string]int)
+	var quote byte
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ':' && i+1 < len(script) && script[i+1] == ':':
+			b.WriteString("::")
+			i++
+			continue
+		case c == ':':
+			j := i + 1
+			for j < len(script) && isIdentChar(script[j], j == i+1) {
+				j++
+			}
+			value, ok := namedParams[script[i+1:j]]
+			if !ok {
+				break
+			}
+			pos, ok := positions[script[i+1:j]]
+			if !ok {
+				var arg interface{}
+				if err := json.Unmarshal(value, &arg); err != nil {
+					return "", nil, fmt.Errorf("Invalid value of named parameter %s: %w", script[i+1:j], err)
 				}
-				LogToDB("DEBUG", "Executing the command: ", script, fmt.Sprintf("; With parameters: %+v", params))
-				_, err = tx.Exec(script, params...)
+				args = append(args, arg)
+				pos = offset + len(args)
+				positions[script[i+1:j]] = pos
 			}
+			fmt.Fprintf(&b, "$%d", pos)
+			i = j - 1
+			continue
 		}
+		b.WriteByte(c)
 	}
-	return err
+	return b.String(), args, nil
 }
 
-//GetConnectionString of database_connection
+func isIdentChar(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+//GetConnectionString of database_connection with credentials resolved, see ConnectionDSN
 func GetConnectionString(databaseConnection sql.NullString) (connectionString string) {
-	rows := ConfigDb.QueryRow("SELECT connect_string FROM  timetable.database_connection WHERE database_connection = $1", databaseConnection)
-	err := rows.Scan(&connectionString)
+	connectionString, err := GetConnectionStringE(databaseConnection)
 	if err != nil {
 		LogToDB("ERROR", "Issue while fetching connection string:", err)
 	}
 	return connectionString
 }
 
+// GetConnectionStringE is GetConnectionString returning the error instead of logging it
+func GetConnectionStringE(databaseConnection sql.NullString) (string, error) {
+	id, err := strconv.ParseInt(databaseConnection.String, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	connectionString, err := ConnectionDSN(context.Background(), id)
+	return connectionString, queryError("connection string fetch", err)
+}
+
 //GetRemoteDBTransaction create a remote db connection and returns transaction object
 func GetRemoteDBTransaction(connectionString string) (*sqlx.DB, *sqlx.Tx) {
-	remoteDb, err := sqlx.Connect("postgres", connectionString)
+	remoteDb, tx, err := GetRemoteDBTransactionE(connectionString)
 	if err != nil {
-		LogToDB("ERROR", fmt.Sprintf("Error in remote connection %v", connectionString))
+		LogToDB("ERROR", "Error in remote connection: ", err)
 		return nil, nil
 	}
+	return remoteDb, tx
+}
+
+// GetRemoteDBTransactionE is GetRemoteDBTransaction returning the error instead of logging it or panicking, the
+// error message has the password of the connection string redacted
+func GetRemoteDBTransactionE(connectionString string) (*sqlx.DB, *sqlx.Tx, error) {
+	remoteDb, err := sqlx.Connect("postgres", connectionString)
+	if err != nil {
+		return nil, nil, redactedError(queryError("remote connection", err))
+	}
 	LogToDB("LOG", "Remote Connection established...")
-	return remoteDb, remoteDb.MustBegin()
+	tx, err := remoteDb.Beginx()
+	if err != nil {
+		FinalizeRemoteDBConnection(remoteDb)
+		return nil, nil, redactedError(queryError("remote transaction start", err))
+	}
+	return remoteDb, tx, nil
 }
 
 // FinalizeRemoteDBConnection closes session
@@ -224,19 +587,29 @@ func FinalizeRemoteDBConnection(remoteDb *sqlx.DB) {
 
 // SetRole - set the current user identifier of the current session
 func SetRole(tx *sqlx.Tx, runUID sql.NullString) {
-	LogToDB("LOG", "Setting Role to ", runUID.String)
-	_, err := tx.Exec(fmt.Sprintf("SET ROLE %v", runUID.String))
-	if err != nil {
+	if err := SetRoleE(tx, runUID); err != nil {
 		LogToDB("ERROR", "Error in Setting role", err)
 	}
 }
 
+// SetRoleE is SetRole returning the error instead of logging it
+func SetRoleE(tx *sqlx.Tx, runUID sql.NullString) error {
+	LogToDB("LOG", "Setting Role to ", runUID.String)
+	_, err := tx.Exec(fmt.Sprintf("SET ROLE %v", runUID.String))
+	return queryError("SET ROLE", err)
+}
+
 //ResetRole - RESET forms reset the current user identifier to be the current session user identifier
 func ResetRole(tx *sqlx.Tx) {
+	if err := ResetRoleE(tx); err != nil {
+		LogToDB("ERROR", "Error in ReSetting role", err)
+	}
+}
+
+// ResetRoleE is ResetRole returning the error instead of logging it
+func ResetRoleE(tx *sqlx.Tx) error {
 	LogToDB("LOG", "Resetting Role")
 	const sqlResetRole = `RESET ROLE`
 	_, err := tx.Exec(sqlResetRole)
-	if err != nil {
-		LogToDB("ERROR", "Error in ReSetting role", err)
-	}
+	return queryError("RESET ROLE", err)
 }
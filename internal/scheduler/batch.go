@@ -0,0 +1,126 @@
+package scheduler
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// ChainResult is the outcome of the chain configuration executed by RunChains
+type ChainResult struct {
+	ChainConfigID int
+	ChainName     string
+	RunStatusID   int
+	Status        string        // final status of the run, empty if the chain was not started
+	Duration      time.Duration // time from the start of RunChains until the run finished
+	Err           error         // reason the chain was not started
+}
+
+// Succeeded returns true if the run is done or skipped
+func (r ChainResult) Succeeded() bool {
+	return r.Status == "CHAIN_DONE" || r.Status == "CHAIN_SKIPPED"
+}
+
+// finishedRun is the final status of the run executed by a worker
+type finishedRun struct {
+	index  int
+	status string
+}
+
+// RunChains executes the live chain configurations synchronously bypassing the scheduling loop and returns their
+// outcomes in the given order. Chains are claimed like by RunChainOnce and passed to workers through the dispatch
+// queue, so they run in parallel up to the number of workers, by priority, respecting exclusive_execution.
+// Runs not finished within timeout, 0 means no limit, are cancelled and awaited
+func RunChains(chainConfigIDs []int, timeout time.Duration) []ChainResult {
+	pgengine.RegisterSession()
+	defer pgengine.UnregisterSession()
+	stop := make(chan struct{})
+	defer close(stop)
+	go keepSessionAlive(stop)
+	go dispatchQueue.feed(chains, stop)
+	for w := 1; w <= workersNumber; w++ {
+		go chainWorker(chains)
+	}
+
+	results := make([]ChainResult, len(chainConfigIDs))
+	finished := make(chan finishedRun)
+	started := time.Now()
+	running := 0
+	for i, id := range chainConfigIDs {
+		results[i].ChainConfigID = id
+		chain, err := claimChainRun(id)
+		if err != nil {
+			pgengine.LogToDB("ERROR", "Cannot run chain configuration ID: ", id, ": ", err)
+			results[i].Err = err
+			continue
+		}
+		results[i].ChainName, results[i].RunStatusID = chain.ChainName, chain.RunStatusID
+		i := i
+		chain.Once = true
+		chain.Done = func(status string) { finished <- finishedRun{index: i, status: status} }
+		dispatchChain(chain, started)
+		running++
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for running > 0 {
+		select {
+		case run := <-finished:
+			running--
+			results[run.index].Status = run.status
+			results[run.index].Duration = time.Since(started)
+			pgengine.LogToDB("LOG", fmt.Sprintf("Chain configuration ID: %d finished with status %s",
+				results[run.index].ChainConfigID, run.status))
+		case <-deadline:
+			deadline = nil
+			pgengine.LogToDB("ERROR", fmt.Sprintf("%d chain(s) not finished within %v, cancelling", running, timeout))
+			for _, r := range results {
+				if r.RunStatusID != 0 && r.Status == "" {
+					// runs still waiting for a worker are cancelled as soon as they start
+					cancelWhenStarted(r.RunStatusID, stop)
+				}
+			}
+		}
+	}
+	return results
+}
+
+// cancelWhenStarted cancels the run as soon as it's executed by a worker, unless stop is closed before
+func cancelWhenStarted(runStatusID int, stop <-chan struct{}) {
+	go func() {
+		for CancelRun(runStatusID) != nil {
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// WriteChainResults writes outcomes of RunChains as a readable table
+func WriteChainResults(w io.Writer, results []ChainResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONFIG\tCHAIN\tRUN\tSTATUS\tDURATION\tERROR")
+	for _, r := range results {
+		run, status, duration, reason := "-", r.Status, "-", ""
+		if r.RunStatusID != 0 {
+			run = fmt.Sprint(r.RunStatusID)
+		}
+		if r.Err != nil {
+			status, reason = "NOT_STARTED", r.Err.Error()
+		} else {
+			duration = r.Duration.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", r.ChainConfigID, r.ChainName, run, status, duration, reason)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,173 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// activeRun is the chain run executed by the process
+type activeRun struct {
+	chain   Chain
+	cancel  context.CancelFunc
+	started time.Time
+	failed  bool // marked as failed by the watchdog
+}
+
+// activeRuns holds the chain runs executed by the process keyed by the run status ID, interrupted is set once
+// the runs are interrupted by shutdown, see Drain
+var activeRuns = struct {
+	sync.Mutex
+	runs        map[int]activeRun
+	interrupted bool
+}{runs: make(map[int]activeRun)}
+
+// drainPollInterval specifies how often the running chains are checked while the shutdown waits for them
+const drainPollInterval = 100 * time.Millisecond
+
+// trackRun registers the run with its cancel function, the returned function unregisters it. The run started
+// after running chains are interrupted is cancelled at once
+func trackRun(runStatusID int, chain Chain, cancel context.CancelFunc) func() {
+	activeRuns.Lock()
+	activeRuns.runs[runStatusID] = activeRun{chain: chain, cancel: cancel, started: time.Now()}
+	if activeRuns.interrupted {
+		cancel()
+	}
+	activeRuns.Unlock()
+	return func() {
+		activeRuns.Lock()
+		delete(activeRuns.runs, runStatusID)
+		activeRuns.Unlock()
+	}
+}
+
+// CancelRun cancels the context of the chain run being executed by the process, so the running task is
+// interrupted, the remaining tasks are skipped and the run is marked as CHAIN_CANCELLED. Fails with
+// pgengine.ErrRunNotActive if the run doesn't exist, has already finished or is executed by another process
+func CancelRun(runStatusID int) error {
+	activeRuns.Lock()
+	run, ok := activeRuns.runs[runStatusID]
+	activeRuns.Unlock()
+	if !ok {
+		return pgengine.ErrRunNotActive
+	}
+	pgengine.LogToDB("LOG", fmt.Sprintf("Cancelling run status ID: %d", runStatusID))
+	run.cancel()
+	return nil
+}
+
+// failActiveRun cancels the run executed by the process marked as failed by the watchdog, so its worker is freed
+// and the run doesn't record its status anymore. Returns false if the run isn't executed by the process
+func failActiveRun(runStatusID int) bool {
+	activeRuns.Lock()
+	run, ok := activeRuns.runs[runStatusID]
+	if ok {
+		run.failed = true
+		activeRuns.runs[runStatusID] = run
+	}
+	activeRuns.Unlock()
+	if ok {
+		run.cancel()
+	}
+	return ok
+}
+
+// runFailed returns true if the run executed by the process was marked as failed by the watchdog
+func runFailed(runStatusID int) bool {
+	activeRuns.Lock()
+	defer activeRuns.Unlock()
+	return activeRuns.runs[runStatusID].failed
+}
+
+// updateRunStatus records the status of the run unless the watchdog has already marked it as failed
+func updateRunStatus(chainElemExec *pgengine.ChainElementExecution, runStatusID int, status string) {
+	if !runFailed(runStatusID) {
+		pgengine.UpdateChainRunStatus(chainElemExec, runStatusID, status)
+	}
+}
+
+// updateFanOutRunStatus records the status of the fan-out item unless the watchdog has already marked the run
+// as failed
+func updateFanOutRunStatus(chainElemExec *pgengine.ChainElementExecution, runStatusID int, item int, status string) {
+	if !runFailed(runStatusID) {
+		pgengine.UpdateFanOutRunStatus(chainElemExec, runStatusID, item, status)
+	}
+}
+
+// RunningChains returns the chain runs being executed by the process ordered by the run status ID
+func RunningChains() []pgengine.RunningChain {
+	activeRuns.Lock()
+	runs := make([]pgengine.RunningChain, 0, len(activeRuns.runs))
+	for runStatusID, run := range activeRuns.runs {
+		runs = append(runs, pgengine.RunningChain{RunStatus: runStatusID, ChainExecutionConfigID: run.chain.ChainExecutionConfigID,
+			ChainName: run.chain.ChainName, Started: run.started})
+	}
+	activeRuns.Unlock()
+	sort.Slice(runs, func(i, j int) bool { return runs[i].RunStatus < runs[j].RunStatus })
+	return runs
+}
+
+// runsInterrupted returns true if running chains are interrupted by shutdown
+func runsInterrupted() bool {
+	activeRuns.Lock()
+	defer activeRuns.Unlock()
+	return activeRuns.interrupted
+}
+
+// Drain waits on shutdown up to pgengine.DrainTimeout seconds for the chain runs executed by the process to finish,
+// 0 means waiting forever. Runs still executed then are interrupted like by CancelRun, but marked as
+// CHAIN_INTERRUPTED, and waited for until they are stopped
+func Drain() {
+	timeout := time.Duration(pgengine.DrainTimeout.Get()) * time.Second
+	if n := countActiveRuns(); n > 0 {
+		pgengine.LogToDB("LOG", fmt.Sprintf("Waiting for %d running chain(s) to finish...", n))
+	}
+	if waitActiveRuns(timeout) {
+		return
+	}
+	activeRuns.Lock()
+	activeRuns.interrupted = true
+	runs := make(map[int]activeRun, len(activeRuns.runs))
+	for runStatusID, run := range activeRuns.runs {
+		runs[runStatusID] = run
+	}
+	activeRuns.Unlock()
+	for runStatusID, run := range runs {
+		pgengine.LogToDB("ERROR", fmt.Sprintf("Interrupting chain configuration ID: %d (%s) with run status ID: %d, "+
+			"it didn't finish within drain timeout of %d seconds", run.chain.ChainExecutionConfigID, run.chain.ChainName,
+			runStatusID, pgengine.DrainTimeout.Get()))
+		run.cancel()
+	}
+	_ = waitActiveRuns(0)
+}
+
+func countActiveRuns() int {
+	activeRuns.Lock()
+	defer activeRuns.Unlock()
+	return len(activeRuns.runs)
+}
+
+// waitActiveRuns waits until no runs are executed by the process or timeout is over, 0 means waiting forever.
+// Returns true if all runs are finished
+func waitActiveRuns(timeout time.Duration) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for countActiveRuns() > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return countActiveRuns() == 0
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+//go:build !windows
+// +build !windows
+
+package scheduler
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// checkRunAs returns error if the user or the group of the limits cannot be resolved or the scheduler is not
+// allowed to run programs as them
+func checkRunAs(limits ResourceLimits) error {
+	_, err := credential(limits)
+	return err
+}
+
+// setCredential makes the program run as the user and the group of the limits
+func setCredential(cmd *exec.Cmd, limits ResourceLimits) error {
+	cred, err := credential(limits)
+	if err != nil || cred == nil {
+		return err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+	return nil
+}
+
+// credential returns the credential the program runs with, nil if the scheduler's one is kept. Names and numeric
+// IDs are accepted, the primary group of the user is used unless the group is set. Supplementary groups of the
+// scheduler are dropped. Only the scheduler running as root may run programs as another user or group
+func credential(limits ResourceLimits) (*syscall.Credential, error) {
+	if limits.User == "" && limits.Group == "" {
+		return nil, nil
+	}
+	uid, gid := os.Geteuid(), os.Getegid()
+	var err error
+	if limits.User != "" {
+		if uid, gid, err = lookupUser(limits.User); err != nil {
+			return nil, err
+		}
+	}
+	if limits.Group != "" {
+		if gid, err = lookupGroup(limits.Group); err != nil {
+			return nil, err
+		}
+	}
+	if gid < 0 {
+		return nil, fmt.Errorf("User %s has no passwd entry, run_as_group must be set", limits.User)
+	}
+	if os.Geteuid() != 0 {
+		if uid == os.Geteuid() && gid == os.Getegid() {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Cannot run command as uid %d and gid %d, the scheduler must run as root to drop privileges", uid, gid)
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// lookupUser returns IDs of the user and its primary group, numeric ID without passwd entry is returned as is
+// with the group ID of -1
+func lookupUser(name string) (uid int, gid int, err error) {
+	var u *user.User
+	if id, numErr := strconv.ParseUint(name, 10, 32); numErr == nil {
+		u, err = user.LookupId(name)
+		if _, unknown := err.(user.UnknownUserIdError); unknown {
+			return int(id), -1, nil
+		}
+	} else {
+		u, err = user.Lookup(name)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("Cannot resolve run_as_user %s: %v", name, err)
+	}
+	uid, _ = strconv.Atoi(u.Uid)
+	gid, _ = strconv.Atoi(u.Gid)
+	return uid, gid, nil
+}
+
+// lookupGroup returns ID of the group, numeric ID without group entry is returned as is
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return int(id), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot resolve run_as_group %s: %v", name, err)
+	}
+	gid, _ := strconv.Atoi(g.Gid)
+	return gid, nil
+}
@@ -0,0 +1,21 @@
+package scheduler
+
+import (
+	"os/exec"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// checkRunAs logs the user and the group of the limits are ignored, running programs as another user is not
+// supported on Windows
+func checkRunAs(limits ResourceLimits) error {
+	if limits.User != "" || limits.Group != "" {
+		pgengine.LogToDB("LOG", "Running commands as another user is not supported on Windows, command is executed as the scheduler user")
+	}
+	return nil
+}
+
+// setCredential does nothing, programs run as the scheduler user on Windows
+func setCredential(cmd *exec.Cmd, limits ResourceLimits) error {
+	return nil
+}
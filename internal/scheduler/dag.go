@@ -0,0 +1,227 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+	"github.com/jmoiron/sqlx"
+)
+
+// chainDependencies returns indexes of elements every chain element depends on. An element without depends_on
+// depends on the previous element, so linear chains are executed one element after another. Fails if an element
+// depends on an element of another chain or dependencies form a cycle
+func chainDependencies(elements []pgengine.ChainElementExecution) ([][]int, error) {
+	index := make(map[int64]int, len(elements))
+	for i, e := range elements {
+		index[int64(e.ChainID)] = i
+	}
+	deps := make([][]int, len(elements))
+	for i, e := range elements {
+		if e.DependsOn == nil {
+			if i > 0 {
+				deps[i] = []int{i - 1}
+			}
+			continue
+		}
+		seen := make(map[int]bool, len(e.DependsOn))
+		for _, id := range e.DependsOn {
+			j, ok := index[id]
+			if !ok {
+				return nil, fmt.Errorf("Task %s depends on chain element %d which doesn't belong to the chain", e.TaskName, id)
+			}
+			if !seen[j] {
+				seen[j] = true
+				deps[i] = append(deps[i], j)
+			}
+		}
+		sort.Ints(deps[i])
+	}
+	// elements never getting free of unfinished dependencies are in a cycle or depend on one
+	waiting := make([]int, len(deps))
+	var queue []int
+	for i := range deps {
+		if waiting[i] = len(deps[i]); waiting[i] == 0 {
+			queue = append(queue, i)
+		}
+	}
+	dependents := dependentsOf(deps)
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		for _, j := range dependents[i] {
+			waiting[j]--
+			if waiting[j] == 0 {
+				queue = append(queue, j)
+			}
+		}
+	}
+	var cycle []string
+	for i, n := range waiting {
+		if n > 0 {
+			cycle = append(cycle, fmt.Sprint(elements[i].ChainID))
+		}
+	}
+	if len(cycle) > 0 {
+		return nil, fmt.Errorf("Chain elements %s are in or depend on a dependency cycle", strings.Join(cycle, ", "))
+	}
+	return deps, nil
+}
+
+// dependentsOf returns indexes of elements depending on every element in the chain order
+func dependentsOf(deps [][]int) [][]int {
+	dependents := make([][]int, len(deps))
+	for i, d := range deps {
+		for _, j := range d {
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+	return dependents
+}
+
+// dependencyCode returns the exit code matched against run_if_exit_codes of the element, that is the exit code
+// of its first dependency in the chain order which didn't succeed, or 0
+func dependencyCode(deps []int, codes []int) int {
+	for _, j := range deps {
+		if codes[j] != 0 {
+			return codes[j]
+		}
+	}
+	return 0
+}
+
+type chainTxKey struct{}
+
+// withChainTx returns the context guarding the chain transaction of the run, see lockChainTx
+func withChainTx(ctx context.Context) context.Context {
+	return context.WithValue(ctx, chainTxKey{}, &sync.Mutex{})
+}
+
+// lockChainTx locks the chain transaction of the run and returns the function unlocking it. The transaction is
+// one connection, so statements of tasks running in parallel must not interleave
+func lockChainTx(ctx context.Context) func() {
+	mu, ok := ctx.Value(chainTxKey{}).(*sync.Mutex)
+	if !ok {
+		return func() {}
+	}
+	mu.Lock()
+	return mu.Unlock
+}
+
+// elementResult is the exit code of the chain element executed in the background
+type elementResult struct {
+	index int
+	code  int
+}
+
+// executeChainElements executes every chain element as soon as all elements it depends on have finished, so
+// independent elements run in parallel, while statements of elements sharing the chain transaction never
+// interleave, see lockChainTx. No more elements are started after an element failed or the chain was cancelled or timed out, the running ones are
+// awaited. Returns empty status if all elements succeeded or were skipped, otherwise the run is marked with the
+// returned status and the chain transaction is rolled back
+func executeChainElements(ctx context.Context, tx *sqlx.Tx, chain Chain, runStatusID int,
+	elements []pgengine.ChainElementExecution, deps [][]int, runParams map[string]json.RawMessage) string {
+	chainID, chainConfigID := chain.ChainID, chain.ChainExecutionConfigID
+	ctx = withChainTx(ctx)
+	dependents := dependentsOf(deps)
+	waiting := make([]int, len(elements))
+	codes := make([]int, len(elements))
+	var ready []int
+	for i := range elements {
+		elements[i].ChainConfig = chainConfigID
+		if waiting[i] = len(deps[i]); waiting[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	// finish makes dependents of the finished element ready, ready elements are started in the chain order
+	finish := func(i int) {
+		for _, j := range dependents[i] {
+			waiting[j]--
+			if waiting[j] == 0 {
+				ready = append(ready, j)
+			}
+		}
+		sort.Ints(ready)
+	}
+
+	var status string
+	var stoppedAt *pgengine.ChainElementExecution
+	stop := func(s string, chainElemExec *pgengine.ChainElementExecution) {
+		if status == "" {
+			status, stoppedAt = s, chainElemExec
+		}
+	}
+	results := make(chan elementResult)
+	running := 0
+	for {
+		for status == "" && len(ready) > 0 {
+			i := ready[0]
+			ready = ready[1:]
+			chainElemExec := &elements[i]
+			if ctx.Err() != nil {
+				stop(abortStatus(ctx), chainElemExec)
+				break
+			}
+			prevRetCode := dependencyCode(deps[i], codes)
+			if !isConditionMet(chainElemExec, prevRetCode) {
+				if chainElemExec.AbortIfNotMet {
+					pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Chain ID: %d aborted, previous task exit code %d doesn't match condition of task %s",
+						chainID, prevRetCode, chainElemExec.TaskName))
+					recordFailure(ctx, "Previous task exit code %d doesn't match condition of task %s", prevRetCode,
+						chainElemExec.TaskName)
+					stop("CHAIN_FAILED", chainElemExec)
+					break
+				}
+				pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Task %s skipped, previous task exit code %d doesn't match condition",
+					chainElemExec.TaskName, prevRetCode))
+				codes[i] = prevRetCode
+				finish(i)
+				continue
+			}
+			updateRunStatus(chainElemExec, runStatusID, "STARTED")
+			elemCtx := pgengine.WithExecution(ctx, pgengine.ExecutionInfo{ChainConfig: chainConfigID,
+				RunStatusID: runStatusID, ChainID: chainElemExec.ChainID, Element: i + 1})
+			running++
+			go func(i int, chainElemExec *pgengine.ChainElementExecution) {
+				defer recoverRun(elemCtx, chainElemExec)
+				elemCtx, span := startTaskSpan(elemCtx, chainElemExec)
+				code := executeСhainElement(elemCtx, tx, chainElemExec, runParams)
+				endTaskSpan(span, code)
+				results <- elementResult{index: i, code: code}
+			}(i, chainElemExec)
+		}
+		if running == 0 {
+			break
+		}
+		r := <-results
+		running--
+		chainElemExec := &elements[r.index]
+		switch {
+		case ctx.Err() != nil:
+			stop(abortStatus(ctx), chainElemExec)
+		case r.code != 0 && !chainElemExec.IgnoreError:
+			if status == "" {
+				pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Chain ID: %d failed", chainID))
+			}
+			stop("CHAIN_FAILED", chainElemExec)
+		default:
+			codes[r.index] = r.code
+			updateRunStatus(chainElemExec, runStatusID, "CHAIN_DONE")
+			finish(r.index)
+		}
+	}
+
+	switch status {
+	case "":
+	case "CHAIN_FAILED":
+		updateRunStatus(stoppedAt, runStatusID, status)
+		pgengine.MustRollbackTransaction(tx)
+	default:
+		abortChain(ctx, tx, chainID, stoppedAt, runStatusID, chain.Timeout)
+	}
+	return status
+}
@@ -0,0 +1,80 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// outcomes of non-zero exit codes of shell commands set by exit_code_map of the task
+const (
+	outcomeSuccess = "success" // the command is considered successful
+	outcomeWarn    = "warn"    // the command is considered successful, a warning is logged
+	outcomeFail    = "fail"    // the command fails the task, the default for exit codes not listed
+)
+
+// exitCodeRange maps exit codes from low to high inclusive to the outcome
+type exitCodeRange struct {
+	low, high int
+	outcome   string
+}
+
+// exitCodeMap holds outcomes of exit codes sorted by exit code, zero exit code always succeeds
+type exitCodeMap []exitCodeRange
+
+// parseExitCodeMap parses JSON object mapping positive exit codes like "2" or inclusive ranges like "3-9"
+// to outcomes. Overlapping entries are rejected, so the outcome of every exit code is unambiguous
+func parseExitCodeMap(s string) (exitCodeMap, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var obj map[string]string
+	if err := json.Unmarshal([]byte(s), &obj); err != nil {
+		return nil, err
+	}
+	m := make(exitCodeMap, 0, len(obj))
+	for key, outcome := range obj {
+		r := exitCodeRange{outcome: outcome}
+		var err error
+		if i := strings.Index(key, "-"); i > 0 {
+			r.low, err = strconv.Atoi(strings.TrimSpace(key[:i]))
+			if err == nil {
+				r.high, err = strconv.Atoi(strings.TrimSpace(key[i+1:]))
+			}
+		} else {
+			r.low, err = strconv.Atoi(strings.TrimSpace(key))
+			r.high = r.low
+		}
+		if err != nil || r.low < 1 || r.high < r.low {
+			return nil, fmt.Errorf("%q is not a positive exit code or range of exit codes", key)
+		}
+		switch outcome {
+		case outcomeSuccess, outcomeWarn, outcomeFail:
+		default:
+			return nil, fmt.Errorf("Outcome of %q must be %s, %s or %s", key, outcomeSuccess, outcomeWarn, outcomeFail)
+		}
+		m = append(m, r)
+	}
+	sort.Slice(m, func(i, j int) bool { return m[i].low < m[j].low })
+	for i := 1; i < len(m); i++ {
+		if m[i].low <= m[i-1].high {
+			return nil, fmt.Errorf("Exit codes %d-%d and %d-%d overlap", m[i-1].low, m[i-1].high, m[i].low, m[i].high)
+		}
+	}
+	return m, nil
+}
+
+// outcome returns the outcome of the exit code, zero succeeds and exit codes not listed fail
+func (m exitCodeMap) outcome(code int) string {
+	if code == 0 {
+		return outcomeSuccess
+	}
+	for _, r := range m {
+		if code >= r.low && code <= r.high {
+			return r.outcome
+		}
+	}
+	return outcomeFail
+}
@@ -0,0 +1,96 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// FakeResult is the scripted result of a command executed by FakeCommander
+type FakeResult struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int   // non-zero value is returned as FakeExitError
+	Err      error // returned instead of the exit code if set, e.g. *exec.Error for a missing program
+}
+
+// FakeCall is the command invocation recorded by FakeCommander
+type FakeCall struct {
+	Dir      string
+	Limits   ResourceLimits
+	Command  string
+	Args     []string
+	Separate bool // true if stdout and stderr were requested separately
+}
+
+// FakeExitError reports non-zero exit code of the command executed by FakeCommander
+type FakeExitError struct {
+	Code int
+}
+
+func (e FakeExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the scripted exit code
+func (e FakeExitError) ExitCode() int {
+	return e.Code
+}
+
+// FakeCommander is the Commander returning scripted results without running programs, every invocation
+// is recorded. Results are looked up by the command name, Default is used for commands not listed.
+// It's safe for concurrent use, e.g.
+//
+//	fake := &scheduler.FakeCommander{Results: map[string]scheduler.FakeResult{"false": {ExitCode: 1}}}
+//	defer scheduler.SetCommander(scheduler.SetCommander(fake))
+type FakeCommander struct {
+	sync.Mutex
+	Results map[string]FakeResult
+	Default FakeResult
+	calls   []FakeCall
+}
+
+func (c *FakeCommander) execute(ctx context.Context, call FakeCall) (FakeResult, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.calls = append(c.calls, call)
+	res, ok := c.Results[call.Command]
+	if !ok {
+		res = c.Default
+	}
+	switch {
+	case ctx.Err() != nil:
+		return res, ctx.Err()
+	case res.Err != nil:
+		return res, res.Err
+	case res.ExitCode != 0:
+		return res, FakeExitError{res.ExitCode}
+	}
+	return res, nil
+}
+
+// CombinedOutput records the call and returns the scripted stdout followed by stderr
+func (c *FakeCommander) CombinedOutput(ctx context.Context, dir string, limits ResourceLimits, command string, args ...string) ([]byte, error) {
+	res, err := c.execute(ctx, FakeCall{Dir: dir, Limits: limits, Command: command, Args: args})
+	return append(append([]byte{}, res.Stdout...), res.Stderr...), err
+}
+
+// SeparateOutput records the call and returns the scripted stdout and stderr
+func (c *FakeCommander) SeparateOutput(ctx context.Context, dir string, limits ResourceLimits, command string, args ...string) ([]byte, []byte, error) {
+	res, err := c.execute(ctx, FakeCall{Dir: dir, Limits: limits, Command: command, Args: args, Separate: true})
+	return res.Stdout, res.Stderr, err
+}
+
+// Calls returns the recorded invocations in the order they were made
+func (c *FakeCommander) Calls() []FakeCall {
+	c.Lock()
+	defer c.Unlock()
+	return append([]FakeCall{}, c.calls...)
+}
+
+// Reset forgets the recorded invocations
+func (c *FakeCommander) Reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.calls = nil
+}
@@ -0,0 +1,129 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+	"github.com/cybertec-postgresql/pg_timetable/internal/tracing"
+	"github.com/jmoiron/sqlx"
+)
+
+// fanOutItems returns items of the array held by the fan-out parameter of the chain element
+func fanOutItems(chainElemExec *pgengine.ChainElementExecution, namedParams map[string]json.RawMessage) ([]json.RawMessage, error) {
+	value, ok := namedParams[chainElemExec.FanOutParam]
+	if !ok {
+		return nil, fmt.Errorf("Fan-out parameter %s is not set", chainElemExec.FanOutParam)
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(value, &items); err != nil || items == nil {
+		return nil, fmt.Errorf("Fan-out parameter %s must be an array", chainElemExec.FanOutParam)
+	}
+	return items, nil
+}
+
+// fanOutLimit returns the number of items executed at once. SQL tasks share the chain transaction, so their
+// items are always executed one by one. Outputs of other tasks are stored one by one, see lockChainTx
+func fanOutLimit(chainElemExec *pgengine.ChainElementExecution) int {
+	if chainElemExec.FanOutLimit < 1 || chainElemExec.Kind == "SQL" {
+		return 1
+	}
+	return chainElemExec.FanOutLimit
+}
+
+// executeFanOut executes the task of the chain element once per item of the fan-out parameter passing the item
+// as the parameter value, up to FanOutLimit items at once. Every item execution is recorded in run_status.
+// If FanOutFailFast is set, no items are started after one failed, otherwise all items are executed. Returns
+// the exit code of the first failed item or 0 if all items succeeded
+func executeFanOut(ctx context.Context, tx *sqlx.Tx, chainElemExec *pgengine.ChainElementExecution,
+	paramValues []string, namedParams map[string]json.RawMessage) int {
+	items, err := fanOutItems(chainElemExec, namedParams)
+	if err != nil {
+		pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Task execution failed: %s; Error: %s", chainElemExec, err))
+		recordFailure(ctx, "Task %s failed: %s", chainElemExec.TaskName, err)
+		return -1
+	}
+	runStatusID, _ := runStatusFromContext(ctx)
+	codes := make([]int, len(items))
+	tails := make([]string, len(items))
+	var failed []int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, fanOutLimit(chainElemExec))
+	started := 0
+	for i := range items {
+		slots <- struct{}{}
+		mu.Lock()
+		stop := len(failed) > 0 && chainElemExec.FanOutFailFast
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			break
+		}
+		started++
+		wg.Add(1)
+		go func(i int, item pgengine.ChainElementExecution) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			defer recoverRun(ctx, &item)
+			code := executeFanOutItem(ctx, tx, &item, runStatusID, i+1, items[i], paramValues, namedParams)
+			mu.Lock()
+			codes[i], tails[i] = code, item.StderrTail
+			if code != 0 {
+				failed = append(failed, i)
+			}
+			mu.Unlock()
+		}(i, *chainElemExec)
+	}
+	wg.Wait()
+
+	if len(failed) == 0 {
+		pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Fan-out of task %s succeeded for all %d items", chainElemExec.TaskName, len(items)))
+		return 0
+	}
+	sort.Ints(failed)
+	numbers := make([]string, len(failed))
+	for j, i := range failed {
+		numbers[j] = fmt.Sprint(i + 1)
+	}
+	// the failed element is recorded with stderr of its first failed item
+	chainElemExec.StderrTail = tails[failed[0]]
+	pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Fan-out of task %s failed for %d of %d items, %d not started, failed items: %s",
+		chainElemExec.TaskName, len(failed), len(items), len(items)-started, strings.Join(numbers, ", ")))
+	return codes[failed[0]]
+}
+
+// executeFanOutItem executes the task with the item passed as the fan-out parameter, item numbers start from 1
+func executeFanOutItem(ctx context.Context, tx *sqlx.Tx, chainElemExec *pgengine.ChainElementExecution, runStatusID int,
+	number int, value json.RawMessage, paramValues []string, namedParams map[string]json.RawMessage) int {
+	params := make(map[string]json.RawMessage, len(namedParams))
+	for name, v := range namedParams {
+		params[name] = v
+	}
+	params[chainElemExec.FanOutParam] = value
+	if info, ok := pgengine.ExecutionFromContext(ctx); ok {
+		info.FanOutItem = number
+		ctx = pgengine.WithExecution(ctx, info)
+	}
+	updateFanOutRunStatus(chainElemExec, runStatusID, number, "STARTED")
+	ctx, span := startTaskSpan(ctx, chainElemExec, tracing.Int("pg_timetable.fan_out_item", number))
+	code := -1
+	defer func() { endTaskSpan(span, code) }()
+	if err := pgengine.ValidateParams(chainElemExec, paramValues, params); err != nil {
+		pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Task execution failed: %s; item %d; Error: %s", chainElemExec, number, err))
+		recordFailure(ctx, "Task %s failed at item %d: %s", chainElemExec.TaskName, number, err)
+	} else {
+		code = executeTask(ctx, tx, chainElemExec, paramValues, params)
+	}
+	if code != 0 {
+		updateFanOutRunStatus(chainElemExec, runStatusID, number, "CHAIN_FAILED")
+	} else {
+		updateFanOutRunStatus(chainElemExec, runStatusID, number, "CHAIN_DONE")
+	}
+	return code
+}
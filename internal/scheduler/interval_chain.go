@@ -1,8 +1,10 @@
 package scheduler
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
@@ -11,13 +13,13 @@ import (
 //Select live chains with proper client_name value
 const sqlSelectIntervalChains = `
 SELECT
-	chain_execution_config, chain_id, chain_name, self_destruct, exclusive_execution, COALESCE(max_instances, 16) as max_instances,
-	EXTRACT(EPOCH FROM (substr(run_at, 7) :: interval)) :: int4 as interval_seconds,
-	starts_with(run_at, '@after') as repeat_after
+	chain_execution_config, COALESCE(chain_id, 0) as chain_id, chain_name, self_destruct, exclusive_execution, COALESCE(max_instances, 16) as max_instances,
+	EXTRACT(EPOCH FROM timetable.parse_interval(substr(run_at, 7))) :: int4 as interval_seconds,
+	starts_with(run_at, '@after') as repeat_after, COALESCE(timeout, 0) as timeout, COALESCE(precondition, '') as precondition, COALESCE(on_failure_chain_id, 0) as on_failure_chain_id
 FROM 
 	timetable.chain_execution_config 
 WHERE 
-	live AND (client_name = $1 or client_name IS NULL) AND substr(run_at, 1, 6) IN ('@every', '@after')`
+	live AND ` + pgengine.SQLChainFilter + ` AND substr(run_at, 1, 6) IN ('@every', '@after')`
 
 // IntervalChain structure used to represent repeated chains.
 type IntervalChain struct {
@@ -35,81 +37,167 @@ func (ichain IntervalChain) isListed(ichains []IntervalChain) bool {
 	return false
 }
 
-func (ichain IntervalChain) isValid() bool {
-	return (IntervalChain{}) != intervalChains[ichain.ChainExecutionConfigID]
+// current returns the latest refreshed version of the chain, ok is false if the chain is not active anymore
+func (ichain IntervalChain) current() (IntervalChain, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	current, ok := intervalChains[ichain.ChainExecutionConfigID]
+	return current, ok
 }
 
-// map of active chains, updated every minute
+// map of active chains, updated every RefreshInterval seconds
 var intervalChains map[int]IntervalChain = make(map[int]IntervalChain)
 
+// lastRefresh holds the unix time in nanoseconds of the latest successful refresh of interval chains
+var lastRefresh int64
+
+// LastRefresh returns the time interval chains were successfully re-read from the database last time
+func LastRefresh() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&lastRefresh))
+}
+
 // create channel for passing interval chains to workers
 var intervalChainsChan chan IntervalChain = make(chan IntervalChain)
 
+// dispatchIntervalChain passes the interval chain to a worker, the scheduler keeps ticking while all workers
+// are busy, so waiting for a free worker is not reported as a stuck scheduler
+func dispatchIntervalChain(ichain IntervalChain) {
+	ticker := time.NewTicker(busyTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case intervalChainsChan <- ichain:
+			return
+		case <-ticker.C:
+			tick()
+		}
+	}
+}
+
 var mutex = &sync.Mutex{}
 
+// retriveIntervalChainsAndRun refreshes the map of active interval chains and starts new ones. Scheduled runs
+// use the refreshed settings, running executions are not affected. The map is kept if the query fails
 func retriveIntervalChainsAndRun(sql string) {
-	mutex.Lock()
 	ichains := []IntervalChain{}
-	err := pgengine.ConfigDb.Select(&ichains, sql, pgengine.ClientName)
+	err := pgengine.ConfigDb().Select(&ichains, pgengine.SchemaSQL(sql), pgengine.ChainFilterArgs()...)
 	if err != nil {
 		pgengine.LogToDB("ERROR", "Could not query pending interval tasks: ", err)
-	} else {
-		pgengine.LogToDB("LOG", "Number of active interval chains: ", len(ichains))
+		return
 	}
+	pgengine.LogToDB("LOG", "Number of active interval chains: ", len(ichains))
 
+	mutex.Lock()
 	// delete chains that are not returned from the database
 	for id, ichain := range intervalChains {
 		if !ichain.isListed(ichains) {
 			delete(intervalChains, id)
 		}
 	}
-
-	// update chains from the database and send to working channel new one
+	// update chains from the database and collect new ones
+	newChains := []IntervalChain{}
 	for _, ichain := range ichains {
-		if (IntervalChain{}) == intervalChains[ichain.ChainExecutionConfigID] {
-			intervalChainsChan <- ichain
+		if _, ok := intervalChains[ichain.ChainExecutionConfigID]; !ok {
+			newChains = append(newChains, ichain)
 		}
 		intervalChains[ichain.ChainExecutionConfigID] = ichain
 	}
 	mutex.Unlock()
+	atomic.StoreInt64(&lastRefresh, time.Now().UnixNano())
+
+	// workers look up the map, so it must not be locked while waiting for a free one
+	for _, ichain := range newChains {
+		dispatchIntervalChain(ichain)
+	}
+}
+
+// refreshInterval returns how often chains are re-read from the database
+func refreshInterval() time.Duration {
+	if pgengine.RefreshInterval.Get() <= 0 {
+		return refetchTimeout * time.Second
+	}
+	return time.Duration(pgengine.RefreshInterval.Get()) * time.Second
+}
+
+// refreshIntervalChains re-reads interval chains every RefreshInterval seconds until shutdown
+func refreshIntervalChains() {
+	for {
+		timer := time.NewTimer(refreshInterval())
+		select {
+		case <-timer.C:
+			pgengine.LogToDB("LOG", "Checking for interval task chains...")
+			retriveIntervalChainsAndRun(sqlSelectIntervalChains)
+		case <-pgengine.ShutdownContext().Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// rescheduleIntervalChain passes the chain to a worker again after its interval if it's still active
+func rescheduleIntervalChain(ichain IntervalChain) {
+	pgengine.LogToDB("DEBUG", fmt.Sprintf("Sleeping before next execution in %ds for chain %s", ichain.Interval, ichain))
+	time.Sleep(time.Duration(ichain.Interval) * time.Second)
+	if current, ok := ichain.current(); ok {
+		intervalChainsChan <- current
+	}
 }
 
 func intervalChainWorker(ichains <-chan IntervalChain) {
 
 	for ichain := range ichains {
+		ichain := ichain // capture loop variable for goroutines below
 		pgengine.LogToDB("DEBUG", fmt.Sprintf("Calling process interval chain for %s", ichain))
 
-		if !ichain.isValid() { // chain not in the list of active chains
-			return
+		ichain, ok := ichain.current()
+		if !ok { // chain not in the list of active chains
+			continue
 		}
 
 		if !ichain.RepeatAfter {
-			go func() {
-				pgengine.LogToDB("DEBUG", fmt.Sprintf("Sleeping before next execution in %ds for chain %s", ichain.Interval, ichain))
-				time.Sleep(time.Duration(ichain.Interval) * time.Second)
-				if ichain.isValid() {
-					intervalChainsChan <- ichain
-				}
-			}()
+			go rescheduleIntervalChain(ichain)
+		}
+
+		if Paused() {
+			skipChain(context.Background(), ichain.Chain, skipDisabled)
+			if ichain.RepeatAfter {
+				go rescheduleIntervalChain(ichain)
+			}
+			continue
+		}
+
+		if pgengine.IsChainPaused(ichain.ChainExecutionConfigID) {
+			skipChain(context.Background(), ichain.Chain, skipPaused)
+			if ichain.RepeatAfter {
+				go rescheduleIntervalChain(ichain)
+			}
+			continue
 		}
 
 		if !pgengine.CanProceedChainExecution(ichain.ChainExecutionConfigID, ichain.MaxInstances) {
-			pgengine.LogToDB("LOG", fmt.Sprintf("Cannot proceed with chain ID: %d; configuration ID: %d",
-				ichain.ChainID, ichain.ChainExecutionConfigID))
-			return
+			skipChain(context.Background(), ichain.Chain, skipThrottled)
+			if ichain.RepeatAfter {
+				go rescheduleIntervalChain(ichain)
+			}
+			continue
 		}
 
-		executeChain(ichain.ChainExecutionConfigID, ichain.ChainID)
+		if !runningChains.enter(ichain.ExclusiveExecution) {
+			skipChain(context.Background(), ichain.Chain, skipExclusive)
+			if ichain.RepeatAfter {
+				go rescheduleIntervalChain(ichain)
+			}
+			continue
+		}
+		executeChain(ichain.Chain, ichain.Interval)
+		runningChains.leave()
 		if ichain.SelfDestruct {
-			pgengine.DeleteChainConfig(ichain.ChainExecutionConfigID)
+			if err := pgengine.DeleteChainConfig(ichain.ChainExecutionConfigID); err != nil {
+				pgengine.LogToDB("ERROR", "Cannot delete self destructive chain configuration: ", err)
+			}
 		} else if ichain.RepeatAfter {
-			go func() {
-				pgengine.LogToDB("DEBUG", fmt.Sprintf("Sleeping before next execution in %ds for chain %s", ichain.Interval, ichain))
-				time.Sleep(time.Duration(ichain.Interval) * time.Second)
-				if ichain.isValid() {
-					intervalChainsChan <- ichain
-				}
-			}()
+			// re-arm after failed runs too, anchoring to the last success would retry a failing chain in a tight loop
+			go rescheduleIntervalChain(ichain)
 		}
 	}
 }
@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package scheduler
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// setProcessGroup makes the program the leader of a new process group, so its children can be killed with it
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills the process group led by pid, or the process alone if it's not a group leader
+func killProcessGroup(pid int) error {
+	if err := syscall.Kill(-pid, syscall.SIGKILL); err == nil {
+		return nil
+	}
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
+
+// limitCommand returns the command wrapped into the shell setting resource limits right before the program
+// is executed, so the limits apply to the program and its children only. The user and the group are set by
+// setCredential instead
+func limitCommand(limits ResourceLimits, command string, args []string) (string, []string) {
+	if !limits.isSet() {
+		return command, args
+	}
+	var script []string
+	if limits.CPUTime > 0 {
+		script = append(script, fmt.Sprintf("ulimit -t %d", limits.CPUTime))
+	}
+	if limits.Memory > 0 {
+		script = append(script, fmt.Sprintf("ulimit -v %d", limits.Memory*1024))
+	}
+	if limits.OpenFiles > 0 {
+		script = append(script, fmt.Sprintf("ulimit -n %d", limits.OpenFiles))
+	}
+	if limits.Nice != 0 {
+		script = append(script, fmt.Sprintf(`exec nice -n %d "$0" "$@"`, limits.Nice))
+	} else {
+		script = append(script, `exec "$0" "$@"`)
+	}
+	return "/bin/sh", append([]string{"-c", strings.Join(script, " && "), command}, args...)
+}
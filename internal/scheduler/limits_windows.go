@@ -0,0 +1,28 @@
+package scheduler
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// limitCommand returns the command unchanged, resource limits are not supported on Windows
+func limitCommand(limits ResourceLimits, command string, args []string) (string, []string) {
+	if limits.isSet() {
+		pgengine.LogToDB("LOG", "Resource limits are not supported on Windows, command is executed without them: ", command)
+	}
+	return command, args
+}
+
+// setProcessGroup does nothing, process groups are not supported on Windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the process only, its children are left running on Windows
+func killProcessGroup(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
@@ -0,0 +1,102 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// missed_ticks values of the chain configuration
+const (
+	missedSkip        = "skip"          // missed ticks are skipped, the chain runs on its next tick only
+	missedCatchUpOnce = "catch_up_once" // a single run catches up all missed ticks
+	missedCatchUpAll  = "catch_up_all"  // every missed tick is caught up by its own run, up to pgengine.CatchUpLimit
+)
+
+// Select live chains catching up missed cron ticks
+const sqlSelectCatchUpChains = sqlSelectLiveChains + ` AND missed_ticks <> 'skip'`
+
+// markFired records the tick of the cron chain catching up missed ticks as fired, it's called once the run is
+// claimed or skipped on purpose, so the tick is not caught up later
+func markFired(chain Chain) {
+	if chain.Due.IsZero() || chain.MissedTicks == "" || chain.MissedTicks == missedSkip {
+		return
+	}
+	pgengine.SetLastFired(chain.ChainExecutionConfigID, chain.Due)
+}
+
+// catchUpMissedTicks claims cron ticks missed by chains catching up missed ticks since their last fired tick and
+// dispatches catch-up runs, one for catch_up_once chains and one per missed tick for catch_up_all chains
+func catchUpMissedTicks() {
+	var headChains []Chain
+	err := pgengine.ConfigDb().Select(&headChains, pgengine.SchemaSQL(sqlSelectCatchUpChains), pgengine.ChainFilterArgs()...)
+	if err != nil {
+		pgengine.LogToDB("ERROR", "Could not query chains catching up missed ticks: ", err)
+		return
+	}
+	for _, chain := range headChains {
+		limit := 1
+		if chain.MissedTicks == missedCatchUpAll {
+			limit = pgengine.CatchUpLimit.Get()
+		}
+		ticks, more, err := pgengine.ClaimMissedTicks(chain.ChainExecutionConfigID, limit)
+		if err != nil {
+			pgengine.LogToDB("ERROR", "Cannot claim missed ticks: ", err)
+			continue
+		}
+		switch {
+		case chain.MissedTicks == missedCatchUpOnce && len(ticks) > 0:
+			pgengine.LogToDB("LOG", fmt.Sprintf("Chain ID: %d; configuration ID: %d missed its run scheduled for %s, catching up once",
+				chain.ChainID, chain.ChainExecutionConfigID, ticks[0].Format(time.RFC3339)))
+		case more:
+			pgengine.LogToDB("LOG", fmt.Sprintf("Chain ID: %d; configuration ID: %d missed more than %d runs, catching up %d "+
+				"runs and skipping the rest", chain.ChainID, chain.ChainExecutionConfigID, limit, len(ticks)))
+		case len(ticks) > 0:
+			pgengine.LogToDB("LOG", fmt.Sprintf("Chain ID: %d; configuration ID: %d missed %d runs, catching up all",
+				chain.ChainID, chain.ChainExecutionConfigID, len(ticks)))
+		}
+		catchUp(chain, ticks)
+	}
+}
+
+// catchUp dispatches the run of the chain catching up the first missed tick, the next tick is caught up once the
+// run is finished, so catch-up runs of the chain don't overlap. Ticks due outside the execution window are skipped
+// or deferred like regular runs, the deferred run carries on catching up once it's finished
+func catchUp(chain Chain, ticks []time.Time) {
+	for ; len(ticks) > 0; ticks = ticks[1:] {
+		run := chain
+		run.CatchUp = ticks[0]
+		rest := ticks[1:]
+		run.Done = func(string) { catchUpNext(chain, rest) }
+		if !outsideWindow(run) {
+			enqueueChain(run)
+			return
+		}
+		if run.WindowAction == "defer" {
+			return
+		}
+	}
+}
+
+// catchUpChain returns the current configuration of the chain catching up missed ticks, replaced in tests
+var catchUpChain = liveChain
+
+// catchUpNext catches up the remaining missed ticks with the current configuration of the chain, so the execution
+// window is checked again after a long catch-up run
+func catchUpNext(chain Chain, ticks []time.Time) {
+	if len(ticks) == 0 {
+		return
+	}
+	current, err := catchUpChain(chain.ChainExecutionConfigID)
+	if err == nil && (current.MissedTicks == "" || current.MissedTicks == missedSkip) {
+		err = errors.New("missed ticks are not caught up anymore")
+	}
+	if err != nil {
+		pgengine.LogToDB("LOG", fmt.Sprintf("Chain ID: %d; configuration ID: %d stopped catching up %d missed runs: %s",
+			chain.ChainID, chain.ChainExecutionConfigID, len(ticks), err))
+		return
+	}
+	catchUp(current, ticks)
+}
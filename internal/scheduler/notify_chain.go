@@ -0,0 +1,154 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+	"github.com/lib/pq"
+)
+
+//Select live chains subscribed to notification channels
+const sqlSelectNotifyChains = `
+SELECT
+	chain_execution_config, COALESCE(chain_id, 0) as chain_id, chain_name, self_destruct, exclusive_execution, COALESCE(max_instances, 16) as max_instances,
+	COALESCE(max_jitter, -1) as max_jitter, COALESCE(timeout, 0) as timeout, priority, 
+	COALESCE(precondition, '') as precondition, notify_channel, COALESCE(on_failure_chain_id, 0) as on_failure_chain_id
+FROM
+	timetable.chain_execution_config
+WHERE
+	live AND ` + pgengine.SQLChainFilter + ` AND notify_channel IS NOT NULL`
+
+// NotifyChain structure used to represent chains started by notifications
+type NotifyChain struct {
+	Chain
+	Channel string `db:"notify_channel"`
+}
+
+// subscriptions groups notification chains by channel
+func subscriptions(nchains []NotifyChain) map[string][]Chain {
+	subscribed := make(map[string][]Chain)
+	for _, nchain := range nchains {
+		subscribed[nchain.Channel] = append(subscribed[nchain.Channel], nchain.Chain)
+	}
+	return subscribed
+}
+
+// diffChannels returns channels to start and to stop listening to
+func diffChannels(listening map[string]bool, subscribed map[string][]Chain) (listen []string, unlisten []string) {
+	for channel := range subscribed {
+		if !listening[channel] {
+			listen = append(listen, channel)
+		}
+	}
+	for channel := range listening {
+		if _, ok := subscribed[channel]; !ok {
+			unlisten = append(unlisten, channel)
+		}
+	}
+	return
+}
+
+// notifyListener starts chains on notifications sent to their channels
+type notifyListener struct {
+	listener   *pq.Listener
+	listening  map[string]bool
+	subscribed map[string][]Chain
+}
+
+func onListenerEvent(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventDisconnected:
+		pgengine.LogToDB("ERROR", "Notification listener disconnected, notifications are lost until reconnect: ", err)
+	case pq.ListenerEventConnectionAttemptFailed:
+		pgengine.LogToDB("ERROR", "Notification listener cannot reconnect: ", err)
+	case pq.ListenerEventReconnected:
+		pgengine.LogToDB("LOG", "Notification listener reconnected")
+	}
+}
+
+// refresh re-reads notification chains and updates the set of listened channels, the listener connection
+// is opened only when the first chain subscribes to a channel
+func (l *notifyListener) refresh() {
+	nchains := []NotifyChain{}
+	if err := pgengine.ConfigDb().Select(&nchains, pgengine.SchemaSQL(sqlSelectNotifyChains), pgengine.ChainFilterArgs()...); err != nil {
+		pgengine.LogToDB("ERROR", "Could not query notification chains: ", err)
+		return
+	}
+	l.subscribed = subscriptions(nchains)
+	if l.listener == nil {
+		if len(l.subscribed) == 0 {
+			return
+		}
+		l.listener = pgengine.NewConfigDBListener(onListenerEvent)
+	}
+	listen, unlisten := diffChannels(l.listening, l.subscribed)
+	for _, channel := range listen {
+		if err := l.listener.Listen(channel); err != nil && err != pq.ErrChannelAlreadyOpen {
+			pgengine.LogToDB("ERROR", fmt.Sprintf("Cannot listen to channel %s: %v", channel, err))
+			continue
+		}
+		l.listening[channel] = true
+		pgengine.LogToDB("LOG", "Listening to notification channel ", channel)
+	}
+	for _, channel := range unlisten {
+		if err := l.listener.Unlisten(channel); err != nil && err != pq.ErrChannelNotOpen {
+			pgengine.LogToDB("ERROR", fmt.Sprintf("Cannot stop listening to channel %s: %v", channel, err))
+			continue
+		}
+		delete(l.listening, channel)
+		pgengine.LogToDB("LOG", "Stopped listening to notification channel ", channel)
+	}
+}
+
+// notify passes chains subscribed to the channel of the notification to workers
+func (l *notifyListener) notify(n *pq.Notification) {
+	if Paused() {
+		pgengine.LogToDB("LOG", "Scheduler is paused, notification on channel ", n.Channel, " is ignored")
+		countSkipped(skipDisabled, len(l.subscribed[n.Channel]))
+		return
+	}
+	for _, chain := range l.subscribed[n.Channel] {
+		payload := n.Extra
+		chain.Payload = &payload
+		pgengine.LogToDB("DEBUG", fmt.Sprintf("Putting chain %s notified on channel %s to the execution channel", chain, n.Channel))
+		go enqueueChain(chain)
+	}
+}
+
+// listenNotifications starts notification chains until shutdown, the chains and channels are refreshed
+// every RefreshInterval seconds
+func listenNotifications() {
+	l := &notifyListener{listening: make(map[string]bool)}
+	l.refresh()
+	interval := refreshInterval()
+	ticker := time.NewTicker(interval)
+	defer func() { ticker.Stop() }()
+	var notifications <-chan *pq.Notification
+	for {
+		if l.listener != nil {
+			notifications = l.listener.Notify
+		}
+		select {
+		case n := <-notifications:
+			if n != nil { // nil is sent after reconnect
+				l.notify(n)
+			}
+		case <-ticker.C:
+			l.refresh()
+			if l.listener != nil {
+				// dead connection is only detected by ping if no notifications arrive
+				go func(listener *pq.Listener) { _ = listener.Ping() }(l.listener)
+			}
+			if i := refreshInterval(); i != interval {
+				ticker.Stop()
+				interval, ticker = i, time.NewTicker(i)
+			}
+		case <-pgengine.ShutdownContext().Done():
+			if l.listener != nil {
+				_ = l.listener.Close()
+			}
+			return
+		}
+	}
+}
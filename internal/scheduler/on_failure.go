@@ -0,0 +1,131 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// FailedRun identifies the failed run the on-failure chain is started for
+type FailedRun struct {
+	ChainConfig int    // chain execution configuration ID of the failed chain
+	ChainName   string // name of the failed chain configuration
+	RunStatusID int    // run status ID of the failed run
+	Status      string // final status of the failed run, CHAIN_FAILED or CHAIN_TIMEOUT
+	Error       string // summary of the error the run failed with
+}
+
+// params returns the failed run as named parameters of the on-failure chain run
+func (run FailedRun) params() map[string]json.RawMessage {
+	params := make(map[string]json.RawMessage, 5)
+	for name, value := range map[string]interface{}{
+		"failed_chain_execution_config": run.ChainConfig,
+		"failed_chain_name":             run.ChainName,
+		"failed_run_status":             run.RunStatusID,
+		"failed_status":                 run.Status,
+		"failed_error":                  run.Error,
+	} {
+		params[name], _ = json.Marshal(value)
+	}
+	return params
+}
+
+// runFailure holds the first error recorded during the run
+type runFailure struct {
+	sync.Mutex
+	err string
+}
+
+type runFailureKey struct{}
+
+// withRunFailure returns the context recording the first error of the run, see recordFailure
+func withRunFailure(ctx context.Context) context.Context {
+	return context.WithValue(ctx, runFailureKey{}, &runFailure{})
+}
+
+// recordFailure records the error of the run executed with the context unless one is already recorded, so the
+// error causing the failure is kept rather than errors of tasks running in parallel or following it
+func recordFailure(ctx context.Context, format string, args ...interface{}) {
+	f, ok := ctx.Value(runFailureKey{}).(*runFailure)
+	if !ok {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.err == "" {
+		f.err = fmt.Sprintf(format, args...)
+	}
+}
+
+// failureSummary returns the summary of the error the run executed with the context finished with the status
+func failureSummary(ctx context.Context, chain Chain, status string) string {
+	if status == "CHAIN_TIMEOUT" {
+		return fmt.Sprintf("Chain timed out after %d seconds", chain.Timeout)
+	}
+	if f, ok := ctx.Value(runFailureKey{}).(*runFailure); ok {
+		f.Lock()
+		defer f.Unlock()
+		if f.err != "" {
+			return f.err
+		}
+	}
+	return "Chain finished with status " + status
+}
+
+// failureHandler returns the chain configuration ID of the on-failure chain started when the run of the chain
+// finished with the status, 0 if there is none. Runs of on-failure chains never start one, so neither a failing
+// on-failure chain nor chains handling failures of each other start runs in a loop
+func failureHandler(chain Chain, status string) int {
+	if status != "CHAIN_FAILED" && status != "CHAIN_TIMEOUT" || chain.Failure != nil {
+		return 0
+	}
+	handlerID := chain.OnFailureChainID
+	if handlerID == 0 {
+		handlerID = pgengine.OnFailureChain.Get()
+	}
+	if handlerID == chain.ChainExecutionConfigID {
+		return 0
+	}
+	return handlerID
+}
+
+// startFailureHandler starts the on-failure chain of the run finished with the status, the failed run is passed
+// to it as named parameters. The on-failure chain of the chain executed by RunChainOnce is executed synchronously
+// too, otherwise it's claimed and passed to a worker like chains run on demand
+func startFailureHandler(ctx context.Context, chain Chain, runStatusID int, status string) {
+	if chain.Failure != nil && (status == "CHAIN_FAILED" || status == "CHAIN_TIMEOUT") {
+		pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Failure of on-failure chain configuration ID: %d is not handled",
+			chain.ChainExecutionConfigID))
+	}
+	handlerID := failureHandler(chain, status)
+	if handlerID == 0 {
+		return
+	}
+	if err := pgengine.ShutdownContext().Err(); err != nil {
+		pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("On-failure chain configuration ID: %d not started: %s", handlerID, err))
+		return
+	}
+	if Paused() {
+		pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("On-failure chain configuration ID: %d not started: %s",
+			handlerID, pgengine.ErrSchedulerPaused))
+		return
+	}
+	handler, err := claimChainRun(handlerID)
+	if err != nil {
+		pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Cannot start on-failure chain configuration ID: %d: %s", handlerID, err))
+		return
+	}
+	handler.Failure = &FailedRun{ChainConfig: chain.ChainExecutionConfigID, ChainName: chain.ChainName,
+		RunStatusID: runStatusID, Status: status, Error: failureSummary(ctx, chain, status)}
+	pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Starting on-failure chain %s with run status ID: %d",
+		handler.ChainName, handler.RunStatusID))
+	if chain.Once {
+		handler.Once = true
+		executeChain(handler, cronClaimWindow)
+		return
+	}
+	go enqueueChain(handler)
+}
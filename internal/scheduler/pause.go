@@ -0,0 +1,58 @@
+package scheduler
+
+import (
+	"os"
+	"sync"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// pause holds the state set by SetPaused and the last seen state of the pause file
+var pause = struct {
+	sync.Mutex
+	paused    bool
+	fileFound bool
+}{}
+
+// SetPaused suppresses or resumes starting of new chains, running chains are not affected
+func SetPaused(paused bool) {
+	pause.Lock()
+	changed := pause.paused != paused
+	pause.paused = paused
+	pause.Unlock()
+	switch {
+	case changed && paused:
+		pgengine.LogToDB("LOG", "Scheduler paused, new chains are not started")
+	case changed:
+		pgengine.LogToDB("LOG", "Scheduler resumed")
+	}
+}
+
+// Paused returns true if the scheduler is paused with SetPaused or the pause file exists
+func Paused() bool {
+	var found bool
+	if pgengine.PauseFile.Get() != "" {
+		_, err := os.Stat(pgengine.PauseFile.Get())
+		found = err == nil
+	}
+	pause.Lock()
+	changed := pause.fileFound != found
+	pause.fileFound = found
+	paused := pause.paused
+	pause.Unlock()
+	switch {
+	case changed && found:
+		pgengine.LogToDB("LOG", "Pause file ", pgengine.PauseFile.Get(), " found, new chains are not started")
+	case changed:
+		pgengine.LogToDB("LOG", "Pause file removed, scheduler resumed")
+	}
+	return paused || found
+}
+
+// SetChainPaused pauses or resumes the chain configuration, see pgengine.PauseChain
+func SetChainPaused(chainConfigID int, paused bool) error {
+	if paused {
+		return pgengine.PauseChain(chainConfigID)
+	}
+	return pgengine.ResumeChain(chainConfigID)
+}
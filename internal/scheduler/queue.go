@@ -0,0 +1,123 @@
+package scheduler
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// queuedChain is the chain waiting in the dispatch queue for a free worker
+type queuedChain struct {
+	Chain
+	due time.Time // time the chain was scheduled to start
+	seq uint64    // order of push, keeps chains scheduled at the same time FIFO
+}
+
+// chainHeap orders queued chains by priority, then by the due time and the push order
+type chainHeap []queuedChain
+
+func (h chainHeap) Len() int { return len(h) }
+func (h chainHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority > h[j].Priority
+	}
+	if !h[i].due.Equal(h[j].due) {
+		return h[i].due.Before(h[j].due)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h chainHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *chainHeap) Push(x interface{}) { *h = append(*h, x.(queuedChain)) }
+func (h *chainHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// chainQueue holds chains until a worker is free. Chains are handed over one by one, so under contention
+// the chain with the highest priority is always the next one, otherwise chains are executed immediately
+type chainQueue struct {
+	sync.Mutex
+	items  chainHeap
+	seq    uint64
+	pushed chan struct{} // signals the feeder that the head of the queue may have changed
+}
+
+func newChainQueue() *chainQueue {
+	return &chainQueue{pushed: make(chan struct{}, 1)}
+}
+
+// push adds the chain to the queue without waiting for a worker
+func (q *chainQueue) push(chain Chain, due time.Time) {
+	q.Lock()
+	q.seq++
+	heap.Push(&q.items, queuedChain{Chain: chain, due: due, seq: q.seq})
+	q.Unlock()
+	select {
+	case q.pushed <- struct{}{}:
+	default:
+	}
+}
+
+// head returns the chain to be dispatched next, ok is false if the queue is empty
+func (q *chainQueue) head() (c queuedChain, ok bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.items) == 0 {
+		return c, false
+	}
+	return q.items[0], true
+}
+
+// remove deletes the chain pushed with seq from the queue
+func (q *chainQueue) remove(seq uint64) {
+	q.Lock()
+	defer q.Unlock()
+	for i := range q.items {
+		if q.items[i].seq == seq {
+			heap.Remove(&q.items, i)
+			return
+		}
+	}
+}
+
+// len returns the number of chains waiting for a worker
+func (q *chainQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.items)
+}
+
+// feed passes queued chains to workers reading from out until done is closed. If a chain with a higher
+// priority is pushed while waiting for a worker, it's offered instead
+func (q *chainQueue) feed(out chan<- Chain, done <-chan struct{}) {
+	for {
+		c, ok := q.head()
+		if !ok {
+			select {
+			case <-q.pushed:
+				continue
+			case <-done:
+				return
+			}
+		}
+		select {
+		case out <- c.Chain:
+			q.remove(c.seq)
+		case <-q.pushed:
+		case <-done:
+			if n := q.len(); n > 0 {
+				pgengine.LogToDB("LOG", fmt.Sprintf("%d queued chain(s) cancelled by shutdown", n))
+			}
+			return
+		}
+	}
+}
+
+// dispatchQueue orders chains passed to workers
+var dispatchQueue = newChainQueue()
@@ -0,0 +1,26 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// recoverRun must be deferred by every goroutine executing the run. On panic the stack is logged, the run is
+// marked as CHAIN_FAILED at the element and the buffered log entries are written before the panic goes on
+// unwinding, so the process still crashes with non-zero exit code, but the run and its log are complete. The
+// chain transaction is rolled back by the server when the process exits
+func recoverRun(ctx context.Context, chainElemExec *pgengine.ChainElementExecution) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	runStatusID, _ := runStatusFromContext(ctx)
+	pgengine.LogToDBContext(ctx, "PANIC", fmt.Sprintf("Run status ID: %d crashed executing chain ID: %d: %v\n%s",
+		runStatusID, chainElemExec.ChainID, r, debug.Stack()))
+	updateRunStatus(chainElemExec, runStatusID, "CHAIN_FAILED")
+	pgengine.StopLogBuffer()
+	panic(r)
+}
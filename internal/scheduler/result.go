@@ -0,0 +1,110 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// runResults holds results of the chain elements executed during the run keyed by the chain element ID
+type runResults struct {
+	sync.Mutex
+	results map[int]pgengine.TaskResult
+}
+
+type runResultsKey struct{}
+
+// withRunResults returns the context collecting results of the chain elements of the run, see recordResult
+func withRunResults(ctx context.Context) context.Context {
+	return context.WithValue(ctx, runResultsKey{}, &runResults{results: make(map[int]pgengine.TaskResult)})
+}
+
+// recordResult stores the result of the chain element executed during the run, so later elements can refer to it.
+// The result of the last execution is kept for elements executed more than once, e.g. fanning out
+func recordResult(ctx context.Context, chainID int, result pgengine.TaskResult) {
+	r, ok := ctx.Value(runResultsKey{}).(*runResults)
+	if !ok {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.results[chainID] = result
+}
+
+var reResult = regexp.MustCompile(`\$\{result:([0-9]+)\.(exit_code|stdout|stderr|data\.[A-Za-z0-9_]+)\}`)
+
+// resultValue returns the field of the result of the chain element executed earlier during the run as text
+func resultValue(ctx context.Context, chainID int, field string) (string, error) {
+	r, ok := ctx.Value(runResultsKey{}).(*runResults)
+	if !ok {
+		return "", fmt.Errorf("Result of chain element %d is not available outside of a chain run", chainID)
+	}
+	r.Lock()
+	result, ok := r.results[chainID]
+	r.Unlock()
+	if !ok {
+		return "", fmt.Errorf("Result of chain element %d is not available, it wasn't executed before", chainID)
+	}
+	switch field {
+	case "exit_code":
+		return strconv.Itoa(result.ExitCode), nil
+	case "stdout":
+		return strings.TrimSpace(string(result.Stdout)), nil
+	case "stderr":
+		return strings.TrimSpace(string(result.Stderr)), nil
+	}
+	key := strings.TrimPrefix(field, "data.")
+	value, ok := result.Data[key]
+	if !ok {
+		return "", fmt.Errorf("Result of chain element %d has no %s data", chainID, key)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// resolveResults replaces ${result:CHAIN_ID.FIELD} placeholders in JSON parameter value with the exit code, stdout,
+// stderr or data value of the result of the chain element executed earlier during the run
+func resolveResults(ctx context.Context, value string) (string, error) {
+	var err error
+	resolved := reResult.ReplaceAllStringFunc(value, func(placeholder string) string {
+		if err != nil {
+			return placeholder
+		}
+		m := reResult.FindStringSubmatch(placeholder)
+		chainID, _ := strconv.Atoi(m[1])
+		var v string
+		if v, err = resultValue(ctx, chainID, m[2]); err != nil {
+			return placeholder
+		}
+		// like secrets, values are put into JSON string values
+		escaped, _ := json.Marshal(v)
+		return string(escaped[1 : len(escaped)-1])
+	})
+	return resolved, err
+}
+
+// resolveElementResults replaces ${result:CHAIN_ID.FIELD} placeholders in positional and named parameter values
+func resolveElementResults(ctx context.Context, paramValues []string, namedParams map[string]json.RawMessage) (err error) {
+	for i, val := range paramValues {
+		if paramValues[i], err = resolveResults(ctx, val); err != nil {
+			return fmt.Errorf("Cannot resolve parameters values for chain: %w", err)
+		}
+	}
+	var resolved string
+	for name, val := range namedParams {
+		if resolved, err = resolveResults(ctx, string(val)); err != nil {
+			return fmt.Errorf("Cannot resolve named parameters for chain: %w", err)
+		}
+		namedParams[name] = json.RawMessage(resolved)
+	}
+	return nil
+}
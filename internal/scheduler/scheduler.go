@@ -1,13 +1,19 @@
 package scheduler
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
 	"github.com/cybertec-postgresql/pg_timetable/internal/tasks"
+	"github.com/cybertec-postgresql/pg_timetable/internal/tracing"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -16,77 +22,289 @@ const workersNumber = 16
 /* the main loop period. Should be 60 (sec) for release configuration. Set to 10 (sec) for debug purposes */
 const refetchTimeout = 60
 
+/* cron, cron macro and @reboot chains are claimed for the current minute */
+const cronClaimWindow = 0
+
+/* notification chains are started on every notification without claiming */
+const notifyClaimWindow = -1
+
+/* catch-up runs are claimed together with the missed ticks, see pgengine.ClaimMissedTicks */
+const catchUpClaimWindow = -1
+
+/* old log rows are pruned hourly */
+const pruneInterval = time.Hour
+
 /* if the number of chains pulled for execution is higher than this value, try to spread execution to avoid spikes */
 const maxChainsThreshold = workersNumber * refetchTimeout
 
 //Select live chains with proper client_name value
 const sqlSelectLiveChains = `
 SELECT
-	chain_execution_config, chain_id, chain_name, self_destruct, exclusive_execution, COALESCE(max_instances, 16) as max_instances
+	chain_execution_config, COALESCE(chain_id, 0) as chain_id, chain_name, self_destruct, exclusive_execution, COALESCE(max_instances, 16) as max_instances,
+	COALESCE(max_jitter, -1) as max_jitter, COALESCE(timeout, 0) as timeout, priority, COALESCE(precondition, '') as precondition,
+	window_action, COALESCE(ceil(EXTRACT(EPOCH FROM timetable.window_delay(window_start, window_end, window_timezone, now()))), 0) :: int4 as window_delay,
+	COALESCE(on_failure_chain_id, 0) as on_failure_chain_id, paused, missed_ticks
 FROM 
 	timetable.chain_execution_config 
 WHERE 
-	live AND (client_name = $1 or client_name IS NULL)`
+	live AND ` + pgengine.SQLChainFilter
 
 //Select chains to be executed right now()
-const sqlSelectChains = sqlSelectLiveChains +
-	` AND NOT COALESCE(starts_with(run_at, '@'), FALSE) AND timetable.is_cron_in_time(run_at, now())`
+const sqlSelectChains = sqlSelectLiveChains + ` AND timetable.is_cron_in_time(run_at, now())`
+
+//Select chain to be executed on demand
+const sqlSelectChainByID = sqlSelectLiveChains + ` AND chain_execution_config = $4`
 
 //Select chains to be executed right after reboot
 const sqlSelectRebootChains = sqlSelectLiveChains + ` AND run_at = '@reboot'`
 
 // Chain structure used to represent tasks chains
 type Chain struct {
-	ChainExecutionConfigID int    `db:"chain_execution_config"`
-	ChainID                int    `db:"chain_id"`
-	ChainName              string `db:"chain_name"`
-	SelfDestruct           bool   `db:"self_destruct"`
-	ExclusiveExecution     bool   `db:"exclusive_execution"`
-	MaxInstances           int    `db:"max_instances"`
+	ChainExecutionConfigID int          `db:"chain_execution_config"`
+	ChainID                int          `db:"chain_id"`
+	ChainName              string       `db:"chain_name"`
+	SelfDestruct           bool         `db:"self_destruct"`
+	ExclusiveExecution     bool         `db:"exclusive_execution"`
+	MaxInstances           int          `db:"max_instances"`
+	Precondition           string       `db:"precondition"`
+	MaxJitter              int          `db:"max_jitter"`          // negative value means global setting is used
+	Timeout                int          `db:"timeout"`             // maximum run duration in seconds, 0 means unlimited
+	Priority               int          `db:"priority"`            // chains with higher priority are passed to workers first
+	WindowAction           string       `db:"window_action"`       // "skip" or "defer" runs outside the execution window
+	WindowDelay            int          `db:"window_delay"`        // seconds until the execution window opens, 0 within it
+	OnFailureChainID       int          `db:"on_failure_chain_id"` // chain configuration started on failure, 0 means global setting
+	Paused                 bool         `db:"paused"`              // paused with pgengine.PauseChain, checked again by the worker
+	MissedTicks            string       `db:"missed_ticks"`        // "skip", "catch_up_once" or "catch_up_all" missed cron ticks
+	RunStatusID            int          `db:"-"`                   // run status claimed in advance for on demand run, 0 otherwise
+	Payload                *string      `db:"-"`                   // payload of the notification starting the chain, nil otherwise
+	Due                    time.Time    `db:"-"`                   // minute the cron chain is scheduled for, zero otherwise
+	CatchUp                time.Time    `db:"-"`                   // missed cron tick the run catches up, zero otherwise
+	Failure                *FailedRun   `db:"-"`                   // failed run the on-failure chain is started for, nil otherwise
+	Once                   bool         `db:"-"`                   // executed synchronously by RunChainOnce or RunChains
+	Done                   func(string) `db:"-" json:"-"`          // called by the worker with the final status, nil otherwise
+}
+
+// MaxTickAge specifies how long the main loop may stay without tick before the scheduler is considered unhealthy
+const MaxTickAge = 2 * refetchTimeout * time.Second
+
+// lastTick holds the unix time in nanoseconds of the latest main loop iteration
+var lastTick int64
+
+// startedAt holds the process start time
+var startedAt = time.Now()
+
+// LastTick returns the time of the latest main loop iteration
+func LastTick() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&lastTick))
+}
+
+// StartedAt returns the process start time
+func StartedAt() time.Time {
+	return startedAt
+}
+
+// Uptime returns how long the process is running
+func Uptime() time.Duration {
+	return time.Since(startedAt)
+}
+
+// tick records the time of the main loop iteration in memory and in the session row
+func tick() {
+	now := time.Now()
+	atomic.StoreInt64(&lastTick, now.UnixNano())
+	pgengine.UpdateSessionTick(now)
 }
 
 // create channel for passing chains to workers
 var chains chan Chain = make(chan Chain)
 
+// busyTickInterval specifies how often the scheduler ticks while waiting for a free interval chain worker
+const busyTickInterval = MaxTickAge / 4
+
+// dispatchChain puts the chain scheduled at due time into the dispatch queue without waiting, the chain is
+// passed to a worker as soon as one is free and no chain with a higher priority is waiting
+func dispatchChain(chain Chain, due time.Time) {
+	dispatchQueue.push(chain, due)
+}
+
+// RunChain claims immediate execution of the live chain configuration and passes it to a worker,
+// returns ID of the run status. Fails with pgengine.ErrChainRunning if the chain has an active run
+func RunChain(chainConfigID int) (int, error) {
+	if err := pgengine.ShutdownContext().Err(); err != nil {
+		return 0, err
+	}
+	if Paused() {
+		return 0, pgengine.ErrSchedulerPaused
+	}
+	chain, err := claimChainRun(chainConfigID)
+	if err != nil {
+		return 0, err
+	}
+	go enqueueChain(chain)
+	return chain.RunStatusID, nil
+}
+
+// liveChain returns the live chain configuration handled by the scheduler, fails with pgengine.ErrChainNotFound
+// if there is none
+func liveChain(chainConfigID int) (Chain, error) {
+	var chain Chain
+	err := pgengine.ConfigDb().Get(&chain, pgengine.SchemaSQL(sqlSelectChainByID), pgengine.ChainFilterArgs(chainConfigID)...)
+	if err == sql.ErrNoRows {
+		return chain, pgengine.ErrChainNotFound
+	}
+	return chain, err
+}
+
+// claimChainRun returns the live chain configuration with the run status claimed for immediate execution
+func claimChainRun(chainConfigID int) (Chain, error) {
+	chain, err := liveChain(chainConfigID)
+	if err != nil {
+		return chain, err
+	}
+	if chain.Paused {
+		return chain, pgengine.ErrChainPaused
+	}
+	chain.RunStatusID, err = pgengine.ClaimChainRun(chain.ChainExecutionConfigID, chain.ChainID)
+	return chain, err
+}
+
+// RunChainOnce executes the live chain configuration synchronously bypassing the scheduling loop and
+// returns the final execution status. The session is registered, so the run is seen by other instances
+func RunChainOnce(chainConfigID int) (string, error) {
+	pgengine.RegisterSession()
+	defer pgengine.UnregisterSession()
+	stop := make(chan struct{})
+	defer close(stop)
+	go keepSessionAlive(stop)
+	chain, err := claimChainRun(chainConfigID)
+	if err != nil {
+		return "", err
+	}
+	chain.Once = true
+	status := executeChain(chain, cronClaimWindow)
+	if chain.SelfDestruct {
+		if err := pgengine.DeleteChainConfig(chain.ChainExecutionConfigID); err != nil {
+			pgengine.LogToDB("ERROR", "Cannot delete self destructive chain configuration: ", err)
+		}
+	}
+	return status, nil
+}
+
+// keepSessionAlive updates the heartbeat of the session until stop is closed or shutdown
+func keepSessionAlive(stop <-chan struct{}) {
+	ticker := time.NewTicker(pgengine.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pgengine.UpdateSessionHeartbeat()
+			pgengine.CheckInstanceLock()
+		case <-stop:
+			return
+		case <-pgengine.ShutdownContext().Done():
+			return
+		}
+	}
+}
+
+// enqueueChain passes the chain started outside of the main loop to a worker unless the scheduler is shutting down
+func enqueueChain(chain Chain) {
+	if pgengine.ShutdownContext().Err() != nil {
+		pgengine.LogToDB("LOG", fmt.Sprintf("Run of chain %s cancelled by shutdown", chain))
+		return
+	}
+	dispatchChain(chain, time.Now())
+}
+
 func (chain Chain) String() string {
 	data, _ := json.Marshal(chain)
 	return string(data)
 }
 
-//Run executes jobs
-func Run() {
-	for !pgengine.TryLockClientName() {
-		pgengine.LogToDB("ERROR", "Another client is already connected to server with name: ", pgengine.ClientName)
-		time.Sleep(refetchTimeout * time.Second)
-	}
+//Run executes jobs, returns error if the main loop failed more times in a row than LoopRestarts allows
+func Run() error {
+	tick()
 	// create sleeping workers waiting data on channel
+	go dispatchQueue.feed(chains, pgengine.ShutdownContext().Done())
 	for w := 1; w <= workersNumber; w++ {
 		go chainWorker(chains)
 		go intervalChainWorker(intervalChainsChan)
 	}
-	/* set maximum connection to workersNumber + 1 for system calls */
-	pgengine.ConfigDb.SetMaxOpenConns(workersNumber + 1)
+	/* set maximum connection to workersNumber + 1 for system calls + 1 holding the instance lock */
+	pgengine.ConfigDb().SetMaxOpenConns(workersNumber + 2)
+	/* register session and keep its heartbeat alive */
+	pgengine.RegisterSession()
+	go keepSessionAlive(nil)
 	/* cleanup potential database leftovers */
 	pgengine.FixSchedulerCrash()
+	pgengine.LogChainFilter()
 	pgengine.LogToDB("LOG", "Checking for @reboot task chains...")
-	retriveChainsAndRun(sqlSelectRebootChains)
-	/* loop forever or until we ask it to stop */
-	for {
+	_ = retriveChainsAndRun(sqlSelectRebootChains, false)
+	pgengine.LogToDB("LOG", "Checking for interval task chains...")
+	retriveIntervalChainsAndRun(sqlSelectIntervalChains)
+	go refreshIntervalChains()
+	go listenNotifications()
+	go pruneLogs()
+	go watchStuckRuns()
+	/* loop forever or until we ask it to stop, restarting the loop after failures */
+	return supervise(func() error {
+		tick()
 		pgengine.LogToDB("LOG", "Checking for task chains...")
-		retriveChainsAndRun(sqlSelectChains)
-		pgengine.LogToDB("LOG", "Checking for interval task chains...")
-		retriveIntervalChainsAndRun(sqlSelectIntervalChains)
+		if err := retriveChainsAndRun(sqlSelectChains, true); err != nil {
+			return err
+		}
 		/* wait for the next full minute to show up */
 		time.Sleep(refetchTimeout * time.Second)
+		return nil
+	})
+}
+
+// pruneLogs deletes old log rows on start and every pruneInterval until shutdown, retention
+// options are checked on every run, so pruning can be enabled at runtime
+func pruneLogs() {
+	for {
+		if pgengine.LogRetention.Get() > 0 || pgengine.ErrorLogRetention.Get() > 0 || pgengine.RunRetention.Get() > 0 {
+			_ = pgengine.PruneOldLogs(pgengine.ShutdownContext())
+		}
+		timer := time.NewTimer(pruneInterval)
+		select {
+		case <-timer.C:
+		case <-pgengine.ShutdownContext().Done():
+			timer.Stop()
+			return
+		}
 	}
 }
 
-func retriveChainsAndRun(sql string) {
+// retriveChainsAndRun passes chains selected by the query to workers, cron chains are scheduled for the current
+// minute and skipped if no worker took them within it. Query errors are logged and retried on the next iteration,
+// the error is returned only if the configuration schema is not available, since the loop cannot recover from it
+// by reconnecting
+func retriveChainsAndRun(sql string, cron bool) error {
 	headChains := []Chain{}
-	err := pgengine.ConfigDb.Select(&headChains, sql, pgengine.ClientName)
-	if err != nil {
+	err := pgengine.ConfigDb().Select(&headChains, pgengine.SchemaSQL(sql), pgengine.ChainFilterArgs()...)
+	switch {
+	case err != nil:
 		pgengine.LogToDB("ERROR", "Could not query pending tasks: ", err)
-	} else {
+		if err = pgengine.SchemaExists(); errors.Is(err, pgengine.ErrSchemaMissing) {
+			return err
+		}
+	case Paused():
+		pgengine.LogToDB("LOG", fmt.Sprintf("Scheduler is paused, %d chain(s) are not started", len(headChains)))
+		countSkipped(skipDisabled, len(headChains))
+		if cron {
+			// ticks skipped while paused are not caught up
+			due := time.Now().Truncate(time.Minute)
+			for _, headChain := range headChains {
+				headChain.Due = due
+				markFired(headChain)
+			}
+		}
+	default:
+		if cron {
+			catchUpMissedTicks()
+		}
+		due := time.Now().Truncate(time.Minute)
 		headChainsCount := len(headChains)
 		pgengine.LogToDB("LOG", "Number of chains to be executed: ", headChainsCount)
 		/* now we can loop through so chains */
@@ -94,99 +312,425 @@ func retriveChainsAndRun(sql string) {
 			if headChainsCount > maxChainsThreshold {
 				time.Sleep(time.Duration(refetchTimeout*1000/headChainsCount) * time.Millisecond)
 			}
+			headChain := headChain
+			if cron {
+				headChain.Due = due
+			}
+			if outsideWindow(headChain) {
+				continue
+			}
+			if d := getJitter(jitterRand, headChain.MaxJitter, time.Now()); d > 0 {
+				pgengine.LogToDB("DEBUG", fmt.Sprintf("Putting head chain %s to the execution channel in %v", headChain, d))
+				time.AfterFunc(d, func() { dispatchChain(headChain, due) })
+				continue
+			}
 			pgengine.LogToDB("DEBUG", fmt.Sprintf("Putting head chain %s to the execution channel", headChain))
-			chains <- headChain
+			dispatchChain(headChain, due)
 		}
 	}
+	return nil
+}
+
+// jitterRand is used to generate jitter delays, it's only used from the main loop goroutine
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// getJitter returns random delay up to maxJitter seconds (or global MaxJitter if maxJitter is negative).
+// The delay never exceeds the end of the current minute, so the chain is still claimed for the minute it's scheduled
+func getJitter(r *rand.Rand, maxJitter int, now time.Time) time.Duration {
+	if maxJitter < 0 {
+		maxJitter = pgengine.MaxJitter.Get()
+	}
+	if maxJitter <= 0 {
+		return 0
+	}
+	d := time.Duration(r.Int63n(int64(maxJitter) * int64(time.Second)))
+	if untilNextMinute := now.Truncate(time.Minute).Add(time.Minute - time.Second).Sub(now); d > untilNextMinute {
+		d = untilNextMinute
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// chainOverdue returns true if the scheduled minute of the cron chain is over, so the run would be late
+func chainOverdue(chain Chain, now time.Time) bool {
+	return !chain.Due.IsZero() && chain.RunStatusID == 0 && !now.Before(chain.Due.Add(time.Minute))
 }
 
 func chainWorker(chains <-chan Chain) {
 	for chain := range chains {
 		pgengine.LogToDB("DEBUG", fmt.Sprintf("Calling process chain for %s", chain))
-		for !pgengine.CanProceedChainExecution(chain.ChainExecutionConfigID, chain.MaxInstances) {
+		if chainOverdue(chain, time.Now()) {
+			skipChain(context.Background(), chain, skipCapacity)
+			continue
+		}
+		// on demand run is already checked when claimed
+		if chain.RunStatusID == 0 && pgengine.IsChainPaused(chain.ChainExecutionConfigID) {
+			skipChain(context.Background(), chain, skipPaused)
+			continue
+		}
+		// waiting cron chain is skipped at the end of its minute
+		entered, reason := false, ""
+		for {
+			switch {
+			// on demand run is already checked and counted as running
+			case chain.RunStatusID == 0 && !pgengine.CanProceedChainExecution(chain.ChainExecutionConfigID, chain.MaxInstances):
+				reason = skipThrottled
+			case !runningChains.enter(chain.ExclusiveExecution):
+				reason = skipExclusive
+			default:
+				entered = true
+			}
+			if entered || chainOverdue(chain, time.Now()) {
+				break
+			}
 			pgengine.LogToDB("DEBUG", fmt.Sprintf("Cannot proceed with chain %s. Sleeping...", chain))
 			time.Sleep(3 * time.Second)
 		}
+		if !entered {
+			skipChain(context.Background(), chain, reason)
+			continue
+		}
 
-		executeChain(chain.ChainExecutionConfigID, chain.ChainID)
+		var status string
+		switch {
+		case chain.Payload != nil:
+			status = executeChain(chain, notifyClaimWindow)
+		case !chain.CatchUp.IsZero():
+			status = executeChain(chain, catchUpClaimWindow)
+		default:
+			status = executeChain(chain, cronClaimWindow)
+		}
+		runningChains.leave()
 		if chain.SelfDestruct {
-			pgengine.DeleteChainConfig(chain.ChainExecutionConfigID)
+			if err := pgengine.DeleteChainConfig(chain.ChainExecutionConfigID); err != nil {
+				pgengine.LogToDB("ERROR", "Cannot delete self destructive chain configuration: ", err)
+			}
+		}
+		if chain.Done != nil {
+			chain.Done(status)
 		}
 	}
 }
 
-/* execute a chain of tasks */
-func executeChain(chainConfigID int, chainID int) {
+// checkPrecondition evaluates the precondition of the chain and returns the final run status if the chain must
+// not be started, CHAIN_SKIPPED if the precondition is not met and CHAIN_FAILED if it cannot be evaluated
+func checkPrecondition(ctx context.Context, chain Chain) string {
+	met, err := pgengine.CheckPrecondition(ctx, chain.Precondition)
+	switch {
+	case err != nil:
+		pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Chain configuration ID: %d failed, cannot evaluate precondition: %s",
+			chain.ChainExecutionConfigID, err))
+		recordFailure(ctx, "Cannot evaluate precondition: %s", err)
+		return "CHAIN_FAILED"
+	case !met:
+		skipChain(ctx, chain, skipPrecondition)
+		return "CHAIN_SKIPPED"
+	}
+	return ""
+}
+
+/* execute a chain of tasks if it's not already claimed by another session within claimWindow seconds or claimed
+in advance, the chain is aborted if it runs longer than its timeout seconds, 0 means no limit, or is cancelled
+with CancelRun.
+Returns the final execution status, empty if the chain is not claimed */
+func executeChain(chain Chain, claimWindow int) (status string) {
 	var ChainElements []pgengine.ChainElementExecution
+	chainConfigID, chainID, timeout := chain.ChainExecutionConfigID, chain.ChainID, chain.Timeout
+	var runParams map[string]json.RawMessage
+	if chain.Payload != nil {
+		payload, _ := json.Marshal(*chain.Payload)
+		runParams = map[string]json.RawMessage{"payload": payload}
+	}
+	if chain.Failure != nil {
+		runParams = chain.Failure.params()
+	}
 
-	tx := pgengine.StartTransaction()
+	runStatusID := chain.RunStatusID
+	if runStatusID == 0 {
+		runStatusID = pgengine.ClaimChainExecution(chainConfigID, chainID, claimWindow)
+	}
+	if runStatusID == 0 {
+		return ""
+	}
+	markFired(chain)
 
-	pgengine.LogToDB("LOG", fmt.Sprintf("Starting chain ID: %d; configuration ID: %d", chainID, chainConfigID))
-	runStatusID := pgengine.InsertChainRunStatus(chainConfigID, chainID)
+	ctx := withRunResults(withRunFailure(pgengine.WithExecution(context.Background(),
+		pgengine.ExecutionInfo{ChainConfig: chainConfigID, RunStatusID: runStatusID})))
+	defer func() { startFailureHandler(ctx, chain, runStatusID, status) }()
+	ctx, span := startChainSpan(ctx, chain, runStatusID)
+	defer func() { endChainSpan(span, status) }()
+	defer recoverRun(ctx, &pgengine.ChainElementExecution{ChainID: chainID, ChainConfig: chainConfigID})
+	ctx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+	defer trackRun(runStatusID, chain, cancelRun)()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
 
-	if !pgengine.GetChainElements(tx, &ChainElements, chainID) {
-		return
+	if chain.Precondition != "" {
+		status := checkPrecondition(ctx, chain)
+		if status != "" {
+			updateRunStatus(
+				&pgengine.ChainElementExecution{
+					ChainID:     chainID,
+					ChainConfig: chainConfigID}, runStatusID, status)
+			return status
+		}
 	}
 
-	/* now we can loop through every element of the task chain */
-	for _, chainElemExec := range ChainElements {
-		chainElemExec.ChainConfig = chainConfigID
-		pgengine.UpdateChainRunStatus(&chainElemExec, runStatusID, "STARTED")
-		retCode := executeСhainElement(tx, &chainElemExec)
-		if retCode != 0 && !chainElemExec.IgnoreError {
-			pgengine.LogToDB("ERROR", fmt.Sprintf("Chain ID: %d failed", chainID))
-			pgengine.UpdateChainRunStatus(&chainElemExec, runStatusID, "CHAIN_FAILED")
-			pgengine.MustRollbackTransaction(tx)
-			return
+	var tx *sqlx.Tx
+	if pgengine.DryRun {
+		tx = pgengine.StartTransactionDry()
+	} else {
+		tx = pgengine.StartTransaction()
+	}
+
+	if chain.CatchUp.IsZero() {
+		pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Starting chain ID: %d; configuration ID: %d", chainID, chainConfigID))
+	} else {
+		pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Starting chain ID: %d; configuration ID: %d catching up missed run scheduled for %s",
+			chainID, chainConfigID, chain.CatchUp.Format(time.RFC3339)))
+	}
+
+	if err := pgengine.GetChainElements(tx, &ChainElements, chainID); err != nil {
+		pgengine.LogToDBContext(ctx, "ERROR", err)
+		recordFailure(ctx, "%s", err)
+		updateRunStatus(
+			&pgengine.ChainElementExecution{
+				ChainID:     chainID,
+				ChainConfig: chainConfigID}, runStatusID, "CHAIN_FAILED")
+		pgengine.MustRollbackTransaction(tx)
+		return "CHAIN_FAILED"
+	}
+	if len(ChainElements) == 0 {
+		status := emptyChainStatus(chainID, chainConfigID)
+		if status == "CHAIN_SKIPPED" {
+			countSkipped(skipDisabled, 1)
+		} else {
+			recordFailure(ctx, "Chain has no elements")
 		}
-		pgengine.UpdateChainRunStatus(&chainElemExec, runStatusID, "CHAIN_DONE")
+		updateRunStatus(
+			&pgengine.ChainElementExecution{
+				ChainID:     chainID,
+				ChainConfig: chainConfigID}, runStatusID, status)
+		pgengine.MustRollbackTransaction(tx)
+		return status
+	}
+	countStarted()
+	deps, err := chainDependencies(ChainElements)
+	if err == nil {
+		err = resolveOutputTables(tx, ChainElements)
+	}
+	if err != nil {
+		pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Chain ID: %d failed: %s", chainID, err))
+		recordFailure(ctx, "%s", err)
+		updateRunStatus(
+			&pgengine.ChainElementExecution{
+				ChainID:     chainID,
+				ChainConfig: chainConfigID}, runStatusID, "CHAIN_FAILED")
+		pgengine.MustRollbackTransaction(tx)
+		return "CHAIN_FAILED"
 	}
-	pgengine.LogToDB("LOG", fmt.Sprintf("Executed successfully chain ID: %d; configuration ID: %d", chainID, chainConfigID))
-	pgengine.UpdateChainRunStatus(
+
+	if status := executeChainElements(ctx, tx, chain, runStatusID, ChainElements, deps, runParams); status != "" {
+		return status
+	}
+	pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Executed successfully chain ID: %d; configuration ID: %d", chainID, chainConfigID))
+	updateRunStatus(
 		&pgengine.ChainElementExecution{
 			ChainID:     chainID,
 			ChainConfig: chainConfigID}, runStatusID, "CHAIN_DONE")
 	pgengine.MustCommitTransaction(tx)
+	return "CHAIN_DONE"
+}
+
+/* resolveOutputTables checks output tables of chain elements exist before any element is executed and replaces
+their names with quoted ones */
+func resolveOutputTables(tx *sqlx.Tx, elements []pgengine.ChainElementExecution) (err error) {
+	for i := range elements {
+		if elements[i].OutputTable == "" {
+			continue
+		}
+		if elements[i].OutputTable, err = pgengine.ResolveOutputTable(tx, elements[i].OutputTable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* emptyChainStatus logs and returns the status of the chain without elements. The chain configuration without
+chain is skipped or failed according to EmptyChain setting, the chain which first element cannot be found always fails */
+func emptyChainStatus(chainID int, chainConfigID int) string {
+	if chainID != 0 {
+		pgengine.LogToDB("ERROR", fmt.Sprintf("Chain ID: %d of configuration ID: %d failed, it doesn't exist or is not the first element of a chain",
+			chainID, chainConfigID))
+		return "CHAIN_FAILED"
+	}
+	if pgengine.EmptyChain.Get() == "fail" {
+		pgengine.LogToDB("ERROR", fmt.Sprintf("Chain configuration ID: %d failed, it has no chain", chainConfigID))
+		return "CHAIN_FAILED"
+	}
+	pgengine.LogToDB("LOG", fmt.Sprintf("Chain configuration ID: %d skipped, it has no chain", chainConfigID))
+	return "CHAIN_SKIPPED"
+}
+
+/* abortChain marks the chain as cancelled or timed out at the given element depending on why ctx is done,
+rolls back its transaction and returns the final status */
+func abortChain(ctx context.Context, tx *sqlx.Tx, chainID int, chainElemExec *pgengine.ChainElementExecution, runStatusID int, timeout int) string {
+	status := abortStatus(ctx)
+	switch status {
+	case "CHAIN_CANCELLED":
+		pgengine.LogToDB("ERROR", fmt.Sprintf("Chain ID: %d cancelled at task %s, remaining tasks skipped",
+			chainID, chainElemExec.TaskName))
+	case "CHAIN_INTERRUPTED":
+		pgengine.LogToDB("ERROR", fmt.Sprintf("Chain ID: %d interrupted by shutdown at task %s, remaining tasks skipped",
+			chainID, chainElemExec.TaskName))
+	default:
+		pgengine.LogToDB("ERROR", fmt.Sprintf("Chain ID: %d timed out after %d seconds at task %s, remaining tasks skipped",
+			chainID, timeout, chainElemExec.TaskName))
+	}
+	updateRunStatus(chainElemExec, runStatusID, status)
+	pgengine.MustRollbackTransaction(tx)
+	return status
 }
 
-func executeСhainElement(tx *sqlx.Tx, chainElemExec *pgengine.ChainElementExecution) int {
+/* abortStatus returns CHAIN_CANCELLED if the chain was cancelled with CancelRun, CHAIN_INTERRUPTED if it was
+interrupted by shutdown, CHAIN_FAILED if it was failed by the watchdog and CHAIN_TIMEOUT if it timed out */
+func abortStatus(ctx context.Context) string {
+	if ctx.Err() == context.Canceled {
+		if runStatusID, ok := runStatusFromContext(ctx); ok && runFailed(runStatusID) {
+			return "CHAIN_FAILED"
+		}
+		if runsInterrupted() {
+			return "CHAIN_INTERRUPTED"
+		}
+		return "CHAIN_CANCELLED"
+	}
+	return "CHAIN_TIMEOUT"
+}
+
+/* isConditionMet returns true if chain element has no condition or the exit code of the previous element is listed */
+func isConditionMet(chainElemExec *pgengine.ChainElementExecution, prevRetCode int) bool {
+	if chainElemExec.RunIfExitCodes == nil {
+		return true
+	}
+	for _, code := range chainElemExec.RunIfExitCodes {
+		if int(code) == prevRetCode {
+			return true
+		}
+	}
+	return false
+}
+
+// executeСhainElement executes the task with its parameters, runParams are named parameters of the whole run
+// overriding the configured ones. ${result:CHAIN_ID.FIELD} placeholders of configured parameters are replaced
+// with results of the elements executed earlier during the run, see resolveResults
+func executeСhainElement(ctx context.Context, tx *sqlx.Tx, chainElemExec *pgengine.ChainElementExecution,
+	runParams map[string]json.RawMessage) int {
 	var paramValues []string
 	var err error
-	var out []byte
-	var retCode int
 
-	pgengine.LogToDB("DEBUG", fmt.Sprintf("Executing task: %s", chainElemExec))
+	pgengine.LogToDBContext(ctx, "DEBUG", fmt.Sprintf("Executing task: %s", chainElemExec))
+
+	unlock := lockChainTx(ctx)
+	err = pgengine.GetChainParamValues(tx, &paramValues, chainElemExec)
+	var namedParams map[string]json.RawMessage
+	if err == nil {
+		namedParams, err = pgengine.GetChainNamedParams(tx, chainElemExec)
+	}
+	unlock()
+	if err != nil {
+		pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Task execution failed: %s; Error: %s", chainElemExec, err))
+		recordFailure(ctx, "Task %s failed: %s", chainElemExec.TaskName, err)
+		return -1
+	}
+	if err = resolveElementResults(ctx, paramValues, namedParams); err != nil {
+		pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Task execution failed: %s; Error: %s", chainElemExec, err))
+		recordFailure(ctx, "Task %s failed: %s", chainElemExec.TaskName, err)
+		return -1
+	}
+	for name, value := range runParams {
+		namedParams[name] = value
+	}
+	if chainElemExec.FanOutParam != "" {
+		return executeFanOut(ctx, tx, chainElemExec, paramValues, namedParams)
+	}
+	if err = pgengine.ValidateParams(chainElemExec, paramValues, namedParams); err != nil {
+		pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Task execution failed: %s; Error: %s", chainElemExec, err))
+		recordFailure(ctx, "Task %s failed: %s", chainElemExec.TaskName, err)
+		return -1
+	}
+	return executeTask(ctx, tx, chainElemExec, paramValues, namedParams)
+}
+
+// executeTask executes the task of the chain element with validated parameters, logs the execution and returns
+// the exit code
+func executeTask(ctx context.Context, tx *sqlx.Tx, chainElemExec *pgengine.ChainElementExecution,
+	paramValues []string, namedParams map[string]json.RawMessage) int {
+	var err error
+	var result pgengine.TaskResult
 
-	if !pgengine.GetChainParamValues(tx, &paramValues, chainElemExec) {
+	if err = acquireTaskSlot(ctx); err != nil {
+		pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Task execution failed: %s; Error: no free slot within %d running tasks: %s",
+			chainElemExec, pgengine.MaxRunningTasks.Get(), err))
+		recordFailure(ctx, "Task %s failed: no free slot within %d running tasks: %s", chainElemExec.TaskName,
+			pgengine.MaxRunningTasks.Get(), err)
 		return -1
 	}
+	defer tasksLimiter.release()
 
 	chainElemExec.StartedAt = time.Now()
 	switch chainElemExec.Kind {
 	case "SQL":
-		err = pgengine.ExecuteSQLTask(tx, chainElemExec, paramValues)
+		unlock := lockChainTx(ctx)
+		result, err = pgengine.ExecuteSQLTask(ctx, tx, chainElemExec, paramValues, namedParams)
+		unlock()
 	case "SHELL":
-		if pgengine.NoShellTasks {
-			pgengine.LogToDB("LOG", "Shell task execution skipped: ", chainElemExec)
+		if pgengine.NoShellTasks.Get() {
+			pgengine.LogToDBContext(ctx, "LOG", "Shell task execution skipped: ", chainElemExec)
+			recordFailure(ctx, "Task %s skipped, shell tasks are disabled", chainElemExec.TaskName)
 			return -1
 		}
-		retCode, out, err = executeShellCommand(chainElemExec.Script, paramValues)
+		result, err = executeShellCommand(ctx, chainElemExec, paramValues, namedParams)
 	case "BUILTIN":
-		err = tasks.ExecuteTask(chainElemExec.TaskName, paramValues)
+		result, err = tasks.ExecuteTask(ctx, chainElemExec.TaskName, paramValues, namedParams)
 	}
 
 	chainElemExec.Duration = time.Since(chainElemExec.StartedAt).Microseconds()
-	pgengine.LogChainElementExecution(chainElemExec, retCode, strings.TrimSpace(string(out)))
+	tracing.RecordError(ctx, err)
+	recordResult(ctx, chainElemExec.ChainID, result)
+	logged := result
+	if chainElemExec.OutputTable != "" && chainElemExec.Kind == "SHELL" {
+		// the output is kept out of the log, but it's logged if it cannot be stored
+		unlock := lockChainTx(ctx)
+		insertErr := pgengine.InsertTaskOutput(tx, chainElemExec, strings.TrimSpace(string(result.Stdout)))
+		unlock()
+		if insertErr != nil {
+			if err == nil {
+				err = insertErr
+			} else {
+				pgengine.LogToDBContext(ctx, "ERROR", insertErr)
+			}
+		} else {
+			logged.Stdout = nil
+		}
+	}
+	pgengine.LogChainElementExecution(chainElemExec, &logged)
 
 	if err != nil {
-		pgengine.LogToDB("ERROR", fmt.Sprintf("Task execution failed: %s; Error: %s", chainElemExec, err))
-		if retCode != 0 {
-			return retCode
+		pgengine.LogToDBContext(ctx, "ERROR", fmt.Sprintf("Task execution failed: %s; Error: %s", chainElemExec, err))
+		recordFailure(ctx, "Task %s failed: %s", chainElemExec.TaskName, err)
+		if result.ExitCode != 0 {
+			return result.ExitCode
 		}
 		return -1
 	}
 
-	pgengine.LogToDB("DEBUG", fmt.Sprintf("Task executed successfully: %s", chainElemExec))
+	pgengine.LogToDBContext(ctx, "DEBUG", fmt.Sprintf("Task executed successfully: %s", chainElemExec))
 
 	return 0
 }
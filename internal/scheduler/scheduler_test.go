@@ -1,62 +1,94 @@
 package scheduler
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
 	"os/exec"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+	"github.com/cybertec-postgresql/pg_timetable/internal/tracing"
+	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
 )
 
 type testCommander struct{}
 
 // overwrite CombinedOutput function of os/exec so only parameter syntax and return codes are checked...
-func (c testCommander) CombinedOutput(command string, args ...string) ([]byte, error) {
+func (c testCommander) CombinedOutput(ctx context.Context, dir string, limits ResourceLimits, command string, args ...string) ([]byte, error) {
 	if strings.HasPrefix(command, "ping") {
 		return []byte(fmt.Sprint(command, args)), nil
 	}
 	return []byte(fmt.Sprintf("Command %s not found", command)), &exec.Error{Name: command, Err: exec.ErrNotFound}
 }
 
+// overwrite SeparateOutput function of os/exec so only parameter syntax and return codes are checked...
+func (c testCommander) SeparateOutput(ctx context.Context, dir string, limits ResourceLimits, command string, args ...string) ([]byte, []byte, error) {
+	if strings.HasPrefix(command, "ping") {
+		return []byte(fmt.Sprint(command, args)), []byte{}, nil
+	}
+	return []byte{}, []byte(fmt.Sprintf("Command %s not found", command)), &exec.Error{Name: command, Err: exec.ErrNotFound}
+}
+
+func shellElem(command string) *pgengine.ChainElementExecution {
+	return &pgengine.ChainElementExecution{Script: command}
+}
+
 func TestShellCommand(t *testing.T) {
 	cmd = testCommander{}
 	var err error
-	var out []byte
-	var retCode int
+	var result pgengine.TaskResult
 
-	_, _, err = executeShellCommand("", []string{""})
+	_, err = executeShellCommand(context.Background(), shellElem(""), []string{""}, nil)
 	assert.EqualError(t, err, "Shell command cannot be empty", "Empty command should out, fail")
 
-	_, out, err = executeShellCommand("ping0", nil)
+	result, err = executeShellCommand(context.Background(), shellElem("ping0"), nil, nil)
 	assert.NoError(t, err, "Command with nil param is out, OK")
-	assert.True(t, strings.HasPrefix(string(out), "ping0"), "Output should containt only command ")
+	assert.True(t, strings.HasPrefix(string(result.Stdout), "ping0"), "Output should containt only command ")
 
-	_, _, err = executeShellCommand("ping1", []string{})
+	_, err = executeShellCommand(context.Background(), shellElem("ping1"), []string{}, nil)
 	assert.NoError(t, err, "Command with empty array param is OK")
 
-	_, _, err = executeShellCommand("ping2", []string{""})
+	_, err = executeShellCommand(context.Background(), shellElem("ping2"), []string{""}, nil)
 	assert.NoError(t, err, "Command with empty string param is OK")
 
-	_, _, err = executeShellCommand("ping3", []string{"[]"})
+	_, err = executeShellCommand(context.Background(), shellElem("ping3"), []string{"[]"}, nil)
 	assert.NoError(t, err, "Command with empty json array param is OK")
 
-	_, _, err = executeShellCommand("ping3", []string{"[null]"})
+	_, err = executeShellCommand(context.Background(), shellElem("ping3"), []string{"[null]"}, nil)
 	assert.NoError(t, err, "Command with nil array param is OK")
 
-	_, _, err = executeShellCommand("ping4", []string{`["localhost"]`})
+	_, err = executeShellCommand(context.Background(), shellElem("ping4"), []string{`["localhost"]`}, nil)
 	assert.NoError(t, err, "Command with one param is OK")
 
-	_, _, err = executeShellCommand("ping5", []string{`["localhost", "-4"]`})
+	_, err = executeShellCommand(context.Background(), shellElem("ping5"), []string{`["localhost", "-4"]`}, nil)
 	assert.NoError(t, err, "Command with many params is OK")
 
-	_, _, err = executeShellCommand("pong", nil)
+	_, err = executeShellCommand(context.Background(), shellElem("pong"), nil, nil)
 	assert.IsType(t, (*exec.Error)(nil), err, "Uknown command should produce error")
 
-	retCode, _, err = executeShellCommand("ping5", []string{`{"param1": "localhost"}`})
+	result, err = executeShellCommand(context.Background(), shellElem("ping5"), []string{`{"param1": "localhost"}`}, nil)
 	assert.IsType(t, (*json.UnmarshalTypeError)(nil), err, "Command should fail with mailformed json parameter")
-	assert.NotEqual(t, 0, retCode, "return code should indicate failure.")
+	assert.NotEqual(t, 0, result.ExitCode, "return code should indicate failure.")
+
+	elem := &pgengine.ChainElementExecution{Script: "pong", SeparateOutput: true}
+	result, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.IsType(t, (*exec.Error)(nil), err, "Uknown command should produce error")
+	assert.Empty(t, result.Stdout, "Standard output should be empty for separate output")
+	assert.Equal(t, "Command pong not found", string(result.Stderr), "Error output should be captured separately")
+	assert.Equal(t, "Command pong not found", elem.StderrTail, "Error output tail should be saved")
 
 	//to make the tests below work, it is needed to remove the reimplementation of the CombinedOutput function above.
 	// err, retCode = 	executeShellCommand("/bin/true", nil)
@@ -66,3 +98,1014 @@ func TestShellCommand(t *testing.T) {
 	// assert.Equal(t, 1, retCode, "/bin/false should have 1 return code")
 	// assert.IsType(t, (*exec.ExitError)(nil), err, "/bin/false should produce ExitError")
 }
+
+func TestFakeCommander(t *testing.T) {
+	fake := &FakeCommander{
+		Results: map[string]FakeResult{
+			"backup": {Stdout: []byte("done"), Stderr: []byte("warning")},
+			"false":  {Stderr: []byte("failed"), ExitCode: 3},
+		},
+		Default: FakeResult{Err: &exec.Error{Name: "unknown", Err: exec.ErrNotFound}},
+	}
+	defer SetCommander(SetCommander(fake))
+
+	elem := shellElem("backup")
+	elem.WorkDir = os.TempDir()
+	elem.MaxCPUTime = 10
+	result, err := executeShellCommand(context.Background(), elem, []string{`["--full", "db"]`}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.ExitCode)
+	assert.Equal(t, "donewarning", string(result.Stdout), "Combined output should contain stdout and stderr")
+
+	elem = shellElem("false")
+	elem.SeparateOutput = true
+	result, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 3, result.ExitCode, "Scripted exit code should be returned")
+	assert.Empty(t, result.Stdout)
+	assert.Equal(t, "failed", string(result.Stderr))
+	assert.Equal(t, "failed", elem.StderrTail, "Stderr tail should be stored")
+
+	result, err = executeShellCommand(context.Background(), shellElem("unknown"), nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, -1, result.ExitCode, "Default result should be used for unknown commands")
+
+	assert.Equal(t, []FakeCall{
+		{Dir: os.TempDir(), Limits: ResourceLimits{CPUTime: 10}, Command: "backup", Args: []string{"--full", "db"}},
+		{Command: "false", Args: []string{}, Separate: true},
+		{Command: "unknown", Args: []string{}},
+	}, fake.Calls(), "Invocations should be recorded")
+	fake.Reset()
+	assert.Empty(t, fake.Calls())
+}
+
+func TestStderrAsError(t *testing.T) {
+	fake := &FakeCommander{
+		Results: map[string]FakeResult{
+			"vacuumdb": {Stderr: []byte("WARNING: skipping \"pg_authid\"")},
+			"psql":     {Stderr: []byte("ERROR: relation does not exist")},
+		},
+	}
+	defer SetCommander(SetCommander(fake))
+
+	elem := shellElem("vacuumdb")
+	elem.SeparateOutput = true
+	_, err := executeShellCommand(context.Background(), elem, nil, nil)
+	assert.NoError(t, err, "Stderr should not fail the task by default")
+
+	elem.StderrAsError = true
+	result, err := executeShellCommand(context.Background(), elem, nil, nil)
+	assert.EqualError(t, err, "Command wrote to stderr")
+	assert.Equal(t, 0, result.ExitCode, "Exit code of the command should be returned")
+
+	elem.StderrPattern = "(?m)^ERROR:"
+	_, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.NoError(t, err, "Stderr not matching the pattern should not fail the task")
+	elem.Script = "psql"
+	_, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.EqualError(t, err, "Command stderr matches (?m)^ERROR:")
+
+	elem.StderrPattern = "(ERROR"
+	_, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.Error(t, err, "Invalid pattern should fail the task")
+	assert.Len(t, fake.Calls(), 4, "Command should not be executed with invalid pattern")
+
+	elem = shellElem("true")
+	elem.SeparateOutput, elem.StderrAsError = true, true
+	_, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.NoError(t, err, "Empty stderr should not fail the task")
+}
+
+func TestExpectOutput(t *testing.T) {
+	fake := &FakeCommander{
+		Results: map[string]FakeResult{
+			"report": {Stdout: []byte("rows exported: 42\nDONE")},
+		},
+	}
+	defer SetCommander(SetCommander(fake))
+
+	elem := shellElem("report")
+	elem.ExpectOutput = "DONE"
+	_, err := executeShellCommand(context.Background(), elem, nil, nil)
+	assert.NoError(t, err, "Output containing the text should not fail the task")
+
+	elem.ExpectOutput = "FINISHED"
+	result, err := executeShellCommand(context.Background(), elem, nil, nil)
+	assert.EqualError(t, err, `Command report []: output doesn't contain "FINISHED"`)
+	assert.Equal(t, 0, result.ExitCode, "Exit code of the command should be returned")
+
+	elem.ExpectOutput, elem.ExpectOutputMode = `rows exported: [1-9]\d*`, "regex"
+	_, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.NoError(t, err, "Output matching the pattern should not fail the task")
+	elem.ExpectOutput = `rows exported: 0$`
+	_, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.EqualError(t, err, "Command report []: output doesn't match rows exported: 0$")
+
+	elem.ExpectOutput = "(DONE"
+	_, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.Error(t, err, "Invalid pattern should fail the task")
+	assert.Len(t, fake.Calls(), 4, "Command should not be executed with invalid pattern")
+}
+
+func TestExitCodeMap(t *testing.T) {
+	m, err := parseExitCodeMap(`{"2": "success", "3-9": "warn", "20 - 29": "fail"}`)
+	assert.NoError(t, err)
+	for code, outcome := range map[int]string{0: outcomeSuccess, 1: outcomeFail, 2: outcomeSuccess, 3: outcomeWarn,
+		9: outcomeWarn, 10: outcomeFail, 25: outcomeFail, -1: outcomeFail} {
+		assert.Equal(t, outcome, m.outcome(code), "Wrong outcome of exit code %d", code)
+	}
+	m, err = parseExitCodeMap("")
+	assert.NoError(t, err)
+	assert.Equal(t, outcomeFail, m.outcome(2), "Non-zero exit codes should fail by default")
+	for _, invalid := range []string{`[2]`, `{"0": "success"}`, `{"-1": "success"}`, `{"9-3": "warn"}`,
+		`{"foo": "warn"}`, `{"2": "ignore"}`, `{"2-5": "warn", "5": "success"}`} {
+		_, err = parseExitCodeMap(invalid)
+		assert.Error(t, err, "Exit code map %s should be rejected", invalid)
+	}
+
+	fake := &FakeCommander{Results: map[string]FakeResult{"rsync": {ExitCode: 24}}}
+	defer SetCommander(SetCommander(fake))
+	elem := shellElem("rsync")
+	result, err := executeShellCommand(context.Background(), elem, nil, nil)
+	assert.Error(t, err, "Non-zero exit code should fail without map")
+	assert.Equal(t, 24, result.ExitCode)
+	elem.ExitCodeMap = sql.NullString{String: `{"24": "warn"}`, Valid: true}
+	result, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.NoError(t, err, "Exit code mapped to warning should succeed")
+	assert.Equal(t, 24, result.ExitCode, "Real exit code should be returned")
+	elem.ExitCodeMap.String = `{"24": "maybe"}`
+	_, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.Error(t, err, "Invalid map should fail the task")
+	assert.Len(t, fake.Calls(), 2, "Command should not be executed with invalid map")
+}
+
+func TestInterpolateArgs(t *testing.T) {
+	named := map[string]json.RawMessage{
+		"dbname": json.RawMessage(`"sales; rm -rf /"`),
+		"jobs":   json.RawMessage(`4`),
+		"opts":   json.RawMessage(`{"a": 1}`),
+		"empty":  json.RawMessage(`null`),
+	}
+	args, err := interpolateArgs([]string{"-d", "${dbname}", "--jobs=${jobs}", "${opts}", "x${empty}y", "$${HOME}", "$HOME"}, named)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-d", "sales; rm -rf /", "--jobs=4", `{"a": 1}`, "xy", "${HOME}", "$HOME"}, args,
+		"Placeholders should be replaced within single arguments")
+	_, err = interpolateArgs([]string{"-d", "${database}"}, named)
+	assert.EqualError(t, err, "Undefined parameter ${database} in argument 2 of shell command")
+	args, err = interpolateArgs([]string{"${HOME}"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"${HOME}"}, args, "Arguments should not be changed without named parameters")
+
+	fake := &FakeCommander{}
+	defer SetCommander(SetCommander(fake))
+	_, err = executeShellCommand(context.Background(), shellElem("pg_dump"), []string{`["-d", "${dbname}"]`}, named)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-d", "sales; rm -rf /"}, fake.Calls()[0].Args, "Named parameters should be substituted")
+	_, err = executeShellCommand(context.Background(), shellElem("pg_dump"), []string{`["-d", "${db}"]`}, named)
+	assert.Error(t, err, "Undefined parameter should fail the task")
+	_, err = executeShellCommand(context.Background(), shellElem("${dbname}"), nil, named)
+	assert.Error(t, err, "Parameters should not be substituted into the command")
+	assert.Len(t, fake.Calls(), 1, "Failed interpolation should not execute the command")
+}
+
+func TestThrottledShellCommand(t *testing.T) {
+	now := time.Now()
+	elem := &pgengine.ChainElementExecution{Script: "ping", MinInterval: 60}
+	assert.False(t, isThrottled(elem, []string{"localhost"}, now), "First execution should not be throttled")
+	assert.True(t, isThrottled(elem, []string{"localhost"}, now.Add(59*time.Second)),
+		"Execution within the interval should be throttled")
+	assert.False(t, isThrottled(elem, []string{"127.0.0.1"}, now.Add(time.Second)),
+		"Execution with other parameters should not be throttled")
+	assert.False(t, isThrottled(&pgengine.ChainElementExecution{Script: "ping", WorkDir: "/tmp", MinInterval: 60},
+		[]string{"localhost"}, now.Add(time.Second)), "Execution in other working directory should not be throttled")
+	assert.False(t, isThrottled(elem, []string{"localhost"}, now.Add(60*time.Second)),
+		"Execution after the interval should not be throttled")
+	assert.False(t, isThrottled(shellElem("ping"), []string{"localhost"}, now.Add(61*time.Second)),
+		"Execution without minimum interval should not be throttled")
+
+	cmd = testCommander{}
+	elem = &pgengine.ChainElementExecution{Script: "ping9", MinInterval: 60}
+	result, err := executeShellCommand(context.Background(), elem, []string{`["localhost"]`}, nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, result.Stdout, "First execution should run the command")
+	result, err = executeShellCommand(context.Background(), elem, []string{`["localhost"]`}, nil)
+	assert.NoError(t, err, "Throttled command should not fail")
+	assert.Empty(t, result.Stdout, "Throttled command should not be executed")
+}
+
+func TestEmptyParams(t *testing.T) {
+	fake := &FakeCommander{}
+	defer SetCommander(SetCommander(fake))
+	elem := shellElem("backup")
+	result, err := executeShellCommand(context.Background(), elem, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.ExitCode)
+	elem.EmptyParams = "run"
+	_, err = executeShellCommand(context.Background(), elem, []string{}, nil)
+	assert.NoError(t, err)
+	elem.EmptyParams = "skip"
+	_, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.NoError(t, err, "Skipped command should not fail the task")
+	_, err = executeShellCommand(context.Background(), elem, []string{""}, nil)
+	assert.NoError(t, err, "Empty parameter value should execute the command without arguments")
+	elem.EmptyParams = "fail"
+	result, err = executeShellCommand(context.Background(), elem, nil, nil)
+	assert.EqualError(t, err, "Shell command has no parameters and empty_params is fail")
+	assert.Equal(t, -1, result.ExitCode)
+	_, err = executeShellCommand(context.Background(), elem, []string{`["--full"]`}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []FakeCall{
+		{Command: "backup", Args: []string{}},
+		{Command: "backup", Args: []string{}},
+		{Command: "backup", Args: []string{}},
+		{Command: "backup", Args: []string{"--full"}},
+	}, fake.Calls(), "Commands without parameters should be executed once unless skipped or failed")
+}
+
+func TestResourceLimits(t *testing.T) {
+	command, args := limitCommand(ResourceLimits{}, "ping", []string{"localhost"})
+	assert.Equal(t, "ping", command, "Command without limits should be executed directly")
+	assert.Equal(t, []string{"localhost"}, args)
+	if runtime.GOOS == "windows" {
+		t.Skip("Resource limits are not supported on Windows")
+	}
+	out, err := realCommander{}.CombinedOutput(context.Background(), "", ResourceLimits{Nice: 5, OpenFiles: 64},
+		"sh", "-c", "ulimit -n; nice")
+	assert.NoError(t, err, "Command with limits should succeed")
+	assert.Equal(t, "64\n5\n", string(out), "Limits should be applied to the command")
+	_, err = realCommander{}.CombinedOutput(context.Background(), "", ResourceLimits{CPUTime: 1},
+		"sh", "-c", "while true; do :; done")
+	assert.Error(t, err, "Command exceeding CPU time should be killed")
+}
+
+func TestRunAs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Running commands as another user is not supported on Windows")
+	}
+	assert.NoError(t, checkRunAs(ResourceLimits{}), "Scheduler user should be kept without run_as_user")
+	assert.Error(t, checkRunAs(ResourceLimits{User: "no_such_user_for_test"}), "Should fail for unknown user")
+	assert.Error(t, checkRunAs(ResourceLimits{Group: "no_such_group_for_test"}), "Should fail for unknown group")
+	assert.EqualError(t, checkRunAs(ResourceLimits{User: "4242424"}), "User 4242424 has no passwd entry, run_as_group must be set")
+
+	fake := &FakeCommander{}
+	defer SetCommander(SetCommander(fake))
+	elem := shellElem("whoami")
+	elem.RunAsUser = "no_such_user_for_test"
+	result, err := executeShellCommand(context.Background(), elem, nil, nil)
+	assert.Error(t, err, "Task should fail for unknown user")
+	assert.Equal(t, -1, result.ExitCode)
+	assert.Empty(t, fake.Calls(), "Command should not be started for unknown user")
+
+	if os.Geteuid() != 0 {
+		assert.Error(t, checkRunAs(ResourceLimits{User: "4242424", Group: "4242424"}),
+			"Should fail to drop privileges without root")
+		t.Skip("Privileges can be dropped only by the scheduler running as root")
+	}
+	out, err := realCommander{}.CombinedOutput(context.Background(), "", ResourceLimits{User: "4242424", Group: "4242424"},
+		"sh", "-c", "id -u; id -g")
+	assert.NoError(t, err, "Command should run as another user")
+	assert.Equal(t, "4242424\n4242424\n", string(out), "Command should run with the user and the group set")
+}
+
+func TestWatchdogKill(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Process groups are not supported on Windows")
+	}
+	pgengine.WatchdogKill.Set(true)
+	defer func() { pgengine.WatchdogKill.Set(false) }()
+	assert.Zero(t, killRunProcesses(42), "Nothing should be killed for unknown run")
+	done := make(chan error)
+	go func() {
+		// the child keeps the output open, so only killing the whole group finishes the command
+		_, err := realCommander{}.CombinedOutput(
+			pgengine.WithExecution(context.Background(), pgengine.ExecutionInfo{RunStatusID: 42}), "", ResourceLimits{},
+			"sh", "-c", "sleep 30 & wait")
+		done <- err
+	}()
+	assert.Eventually(t, func() bool {
+		runProcesses.Lock()
+		defer runProcesses.Unlock()
+		return len(runProcesses.pids[42]) == 1
+	}, 5*time.Second, 10*time.Millisecond, "Command should be registered under its run")
+	assert.Equal(t, 1, killRunProcesses(42), "Process group of the run should be killed")
+	select {
+	case err := <-done:
+		assert.Error(t, err, "Killed command should fail")
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Killed command should finish")
+	}
+	runProcesses.Lock()
+	assert.Empty(t, runProcesses.pids, "Finished command should be unregistered")
+	runProcesses.Unlock()
+}
+
+func TestCancelRun(t *testing.T) {
+	assert.Equal(t, pgengine.ErrRunNotActive, CancelRun(42), "Unknown run should not be cancelled")
+	ctx, cancel := context.WithCancel(context.Background())
+	untrack := trackRun(42, Chain{}, cancel)
+	assert.NoError(t, CancelRun(42), "Active run should be cancelled")
+	assert.Equal(t, context.Canceled, ctx.Err(), "Context of the run should be cancelled")
+	untrack()
+	assert.Equal(t, pgengine.ErrRunNotActive, CancelRun(42), "Finished run should not be cancelled")
+}
+
+func TestFailActiveRun(t *testing.T) {
+	rec := &txRecorder{}
+	defer useRecorderConfigDb(rec)()
+	assert.False(t, failActiveRun(48), "Run not executed by the process should not be cancelled")
+	ctx, cancel := context.WithCancel(pgengine.WithExecution(context.Background(), pgengine.ExecutionInfo{RunStatusID: 48}))
+	defer trackRun(48, Chain{}, cancel)()
+	assert.True(t, failActiveRun(48), "Stuck run executed by the process should be cancelled")
+	assert.Equal(t, context.Canceled, ctx.Err())
+	assert.Equal(t, "CHAIN_FAILED", abortStatus(ctx), "Stuck run should be finished as failed")
+	updateRunStatus(&pgengine.ChainElementExecution{}, 48, "CHAIN_FAILED")
+	assert.Zero(t, rec.count("run_status"), "Status of the failed run should not be recorded again")
+	updateRunStatus(&pgengine.ChainElementExecution{}, 49, "CHAIN_DONE")
+	assert.Equal(t, 1, rec.count("run_status"), "Status of other runs should be recorded")
+}
+
+func TestRunningChains(t *testing.T) {
+	assert.Empty(t, RunningChains())
+	defer trackRun(47, Chain{ChainExecutionConfigID: 2, ChainName: "hourly"}, func() {})()
+	defer trackRun(46, Chain{ChainExecutionConfigID: 1, ChainName: "nightly"}, func() {})()
+	runs := RunningChains()
+	if assert.Len(t, runs, 2) {
+		assert.Equal(t, 46, runs[0].RunStatus, "Runs should be ordered by run status ID")
+		assert.Equal(t, "nightly", runs[0].ChainName)
+		assert.Equal(t, 2, runs[1].ChainExecutionConfigID)
+		assert.False(t, runs[1].Started.IsZero(), "Start time of the run should be tracked")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	defer func(timeout int) {
+		pgengine.DrainTimeout.Set(timeout)
+		activeRuns.interrupted = false
+	}(pgengine.DrainTimeout.Get())
+	pgengine.DrainTimeout.Set(0)
+	Drain()
+	ctx, cancel := context.WithCancel(context.Background())
+	untrack := trackRun(43, Chain{ChainExecutionConfigID: 1, ChainName: "nightly"}, cancel)
+	time.AfterFunc(50*time.Millisecond, untrack)
+	Drain()
+	assert.NoError(t, ctx.Err(), "Run finished in time should not be interrupted")
+	assert.Zero(t, countActiveRuns())
+
+	pgengine.DrainTimeout.Set(1)
+	ctx, cancel = context.WithCancel(context.Background())
+	untrack = trackRun(44, Chain{ChainExecutionConfigID: 1, ChainName: "nightly"}, cancel)
+	go func() {
+		<-ctx.Done()
+		untrack()
+	}()
+	Drain()
+	assert.Equal(t, context.Canceled, ctx.Err(), "Run should be interrupted after drain timeout")
+	assert.Equal(t, "CHAIN_INTERRUPTED", abortStatus(ctx))
+	assert.Zero(t, countActiveRuns())
+	ctx, cancel = context.WithCancel(context.Background())
+	defer trackRun(45, Chain{}, cancel)()
+	assert.Equal(t, context.Canceled, ctx.Err(), "Run started after interruption should be cancelled at once")
+}
+
+func TestPaused(t *testing.T) {
+	assert.False(t, Paused(), "Scheduler should not be paused by default")
+	SetPaused(true)
+	assert.True(t, Paused(), "Scheduler should be paused")
+	_, err := RunChain(1)
+	assert.Equal(t, pgengine.ErrSchedulerPaused, err, "On demand run should be refused while paused")
+	SetPaused(false)
+	assert.False(t, Paused(), "Scheduler should be resumed")
+
+	f, err := ioutil.TempFile("", "pause")
+	assert.NoError(t, err)
+	f.Close()
+	pgengine.PauseFile.Set(f.Name())
+	defer func() { pgengine.PauseFile.Set("") }()
+	assert.True(t, Paused(), "Existing pause file should pause scheduler")
+	os.Remove(f.Name())
+	assert.False(t, Paused(), "Removed pause file should resume scheduler")
+}
+
+func TestExclusiveGate(t *testing.T) {
+	g := &exclusiveGate{}
+	assert.True(t, g.enter(false))
+	assert.True(t, g.enter(false), "Regular chains should run in parallel")
+	assert.False(t, g.enter(true), "Exclusive chain should wait for running chains")
+	g.leave()
+	g.leave()
+	assert.True(t, g.enter(true), "Exclusive chain should start if nothing is running")
+	assert.False(t, g.enter(false), "Regular chain should wait for exclusive chain")
+	assert.False(t, g.enter(true), "Exclusive chain should wait for exclusive chain")
+	g.leave()
+	assert.True(t, g.enter(false), "Regular chain should start after exclusive chain")
+}
+
+func TestSkippedRuns(t *testing.T) {
+	skipped := SkippedRuns()
+	for _, reason := range []string{skipExclusive, skipPrecondition, skipDisabled, skipThrottled, skipCapacity, skipWindow, skipPaused} {
+		_, ok := skipped[reason]
+		assert.True(t, ok, "Every skip reason should be reported")
+	}
+	chain := Chain{ChainID: 1, ChainExecutionConfigID: 2}
+	skipChain(context.Background(), chain, skipCapacity)
+	countSkipped(skipDisabled, 3)
+	assert.Equal(t, skipped[skipCapacity]+1, SkippedRuns()[skipCapacity])
+	assert.Equal(t, skipped[skipDisabled]+3, SkippedRuns()[skipDisabled])
+	started := StartedRuns()
+	countStarted()
+	assert.Equal(t, started+1, StartedRuns())
+
+	due := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	chain.Due = due
+	assert.False(t, chainOverdue(chain, due.Add(59*time.Second)), "Chain should not be overdue within its minute")
+	assert.True(t, chainOverdue(chain, due.Add(time.Minute)), "Chain should be overdue after its minute")
+	chain.RunStatusID = 42
+	assert.False(t, chainOverdue(chain, due.Add(time.Hour)), "Claimed on demand run should never be overdue")
+	assert.False(t, chainOverdue(Chain{}, due.Add(time.Hour)), "Chain without schedule should never be overdue")
+}
+
+func TestIntervalChainCurrent(t *testing.T) {
+	ichain := IntervalChain{Chain: Chain{ChainExecutionConfigID: 100500}, Interval: 10}
+	_, ok := ichain.current()
+	assert.False(t, ok, "Chain not refreshed yet should not be active")
+	mutex.Lock()
+	intervalChains[100500] = IntervalChain{Chain: Chain{ChainExecutionConfigID: 100500}, Interval: 20}
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		delete(intervalChains, 100500)
+		mutex.Unlock()
+	}()
+	current, ok := ichain.current()
+	assert.True(t, ok, "Refreshed chain should be active")
+	assert.Equal(t, 20, current.Interval, "Refreshed settings should be used for the next run")
+}
+
+func TestThrottledIntervalChain(t *testing.T) {
+	// failing running jobs check throttles the chain
+	defer useRecorderConfigDb(&txRecorder{failQueries: true})()
+	ichain := IntervalChain{Chain: Chain{ChainExecutionConfigID: 100501, MaxInstances: 1}, RepeatAfter: true}
+	mutex.Lock()
+	intervalChains[100501] = ichain
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		delete(intervalChains, 100501)
+		mutex.Unlock()
+	}()
+	skipped := SkippedRuns()[skipThrottled]
+	ichains := make(chan IntervalChain, 1)
+	ichains <- ichain
+	close(ichains)
+	go intervalChainWorker(ichains)
+	select {
+	case rearmed := <-intervalChainsChan:
+		assert.Equal(t, 100501, rearmed.ChainExecutionConfigID)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Throttled @after chain should be re-armed")
+	}
+	assert.Equal(t, skipped+1, SkippedRuns()[skipThrottled], "Throttled run should be counted as skipped")
+}
+
+func TestNotifyChannels(t *testing.T) {
+	subscribed := subscriptions([]NotifyChain{
+		{Chain: Chain{ChainExecutionConfigID: 1}, Channel: "queue"},
+		{Chain: Chain{ChainExecutionConfigID: 2}, Channel: "queue"},
+		{Chain: Chain{ChainExecutionConfigID: 3}, Channel: "deploy"},
+	})
+	assert.Len(t, subscribed["queue"], 2, "Chains should be grouped by channel")
+	assert.Len(t, subscribed["deploy"], 1)
+
+	listen, unlisten := diffChannels(map[string]bool{"queue": true, "gone": true}, subscribed)
+	assert.Equal(t, []string{"deploy"}, listen, "New channel should be listened to")
+	assert.Equal(t, []string{"gone"}, unlisten, "Channel without chains should be unlistened")
+	listen, unlisten = diffChannels(map[string]bool{}, map[string][]Chain{})
+	assert.Empty(t, listen)
+	assert.Empty(t, unlisten)
+}
+
+func TestTaskLimiter(t *testing.T) {
+	l := newTaskLimiter()
+	ctx := context.Background()
+	assert.NoError(t, l.acquire(ctx, 2))
+	assert.NoError(t, l.acquire(ctx, 2))
+	assert.Equal(t, 2, l.running(), "Acquired slots should be counted")
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, l.acquire(timeoutCtx, 2), "Acquire should wait not longer than context")
+	assert.NoError(t, l.acquire(ctx, 0), "Zero limit should not block")
+
+	acquired := make(chan error)
+	go func() { acquired <- l.acquire(ctx, 3) }()
+	time.Sleep(10 * time.Millisecond)
+	l.release()
+	select {
+	case err := <-acquired:
+		assert.NoError(t, err, "Waiting acquire should succeed after release")
+	case <-time.After(time.Second):
+		t.Fatal("Waiting acquire should be woken up by release")
+	}
+	assert.Equal(t, 3, l.running())
+}
+
+func TestFanOutItems(t *testing.T) {
+	elem := &pgengine.ChainElementExecution{FanOutParam: "tenants", Kind: "SHELL"}
+	_, err := fanOutItems(elem, map[string]json.RawMessage{})
+	assert.Error(t, err, "Should fail for missing fan-out parameter")
+	_, err = fanOutItems(elem, map[string]json.RawMessage{"tenants": json.RawMessage(`"foo"`)})
+	assert.Error(t, err, "Should fail for fan-out parameter not being an array")
+	_, err = fanOutItems(elem, map[string]json.RawMessage{"tenants": json.RawMessage(`null`)})
+	assert.Error(t, err, "Should fail for null fan-out parameter")
+	items, err := fanOutItems(elem, map[string]json.RawMessage{"tenants": json.RawMessage(`["foo", {"id": 2}]`)})
+	assert.NoError(t, err)
+	assert.Equal(t, []json.RawMessage{json.RawMessage(`"foo"`), json.RawMessage(`{"id": 2}`)}, items)
+
+	assert.Equal(t, 1, fanOutLimit(elem), "Items should be executed one by one by default")
+	elem.FanOutLimit = 4
+	assert.Equal(t, 4, fanOutLimit(elem))
+	elem.Kind = "SQL"
+	assert.Equal(t, 1, fanOutLimit(elem), "SQL items sharing the transaction should be executed one by one")
+}
+
+// txRecorder is the database/sql connector recording statements of its single connection, so tests can check
+// how tasks running in parallel use the chain transaction without a database
+type txRecorder struct {
+	sync.Mutex
+	statements  []string
+	openRows    int
+	interleaved bool
+	failQueries bool
+}
+
+func newRecorderTx(t *testing.T) (*txRecorder, *sqlx.Tx) {
+	rec := &txRecorder{}
+	db := sqlx.NewDb(sql.OpenDB(rec), "postgres")
+	tx, err := db.Beginx()
+	assert.NoError(t, err)
+	return rec, tx
+}
+
+func (rec *txRecorder) Connect(context.Context) (driver.Conn, error) { return recorderConn{rec}, nil }
+func (rec *txRecorder) Driver() driver.Driver                        { return nil }
+
+func (rec *txRecorder) record(query string) {
+	rec.Lock()
+	defer rec.Unlock()
+	if rec.openRows > 0 {
+		rec.interleaved = true
+	}
+	rec.statements = append(rec.statements, query)
+}
+
+func (rec *txRecorder) count(part string) (n int) {
+	rec.Lock()
+	defer rec.Unlock()
+	for _, s := range rec.statements {
+		if strings.Contains(s, part) {
+			n++
+		}
+	}
+	return n
+}
+
+type recorderConn struct{ rec *txRecorder }
+
+func (c recorderConn) Prepare(query string) (driver.Stmt, error) {
+	return recorderStmt{c.rec, query}, nil
+}
+
+func (c recorderConn) Close() error              { return nil }
+func (c recorderConn) Begin() (driver.Tx, error) { return c, nil }
+func (c recorderConn) Commit() error             { return nil }
+func (c recorderConn) Rollback() error           { return nil }
+
+type recorderStmt struct {
+	rec   *txRecorder
+	query string
+}
+
+// sleepingScript is the SQL task script taking a while and failing, see recorderStmt.Exec
+const sleepingScript = "SELECT pg_sleep(0.1)"
+
+func (s recorderStmt) Close() error  { return nil }
+func (s recorderStmt) NumInput() int { return -1 }
+
+func (s recorderStmt) Exec([]driver.Value) (driver.Result, error) {
+	s.rec.record(s.query)
+	if s.query == sleepingScript {
+		time.Sleep(100 * time.Millisecond)
+		return nil, errors.New("canceling statement due to user request")
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s recorderStmt) Query([]driver.Value) (driver.Rows, error) {
+	s.rec.record(s.query)
+	if s.rec.failQueries {
+		return nil, errors.New("connection refused")
+	}
+	s.rec.Lock()
+	s.rec.openRows++
+	s.rec.Unlock()
+	return recorderRows{s.rec}, nil
+}
+
+type recorderRows struct{ rec *txRecorder }
+
+func (r recorderRows) Columns() []string { return nil }
+
+func (r recorderRows) Next([]driver.Value) error {
+	// rows stay open for a while, so statements interleaving with them are noticed
+	time.Sleep(10 * time.Millisecond)
+	return io.EOF
+}
+
+func (r recorderRows) Close() error {
+	r.rec.Lock()
+	defer r.rec.Unlock()
+	r.rec.openRows--
+	return nil
+}
+
+// useRecorderConfigDb replaces the configuration database with the recorder, returns the function restoring it
+func useRecorderConfigDb(rec *txRecorder) func() {
+	configDb := pgengine.ConfigDb()
+	pgengine.SetConfigDb(sqlx.NewDb(sql.OpenDB(rec), "postgres"))
+	return func() { pgengine.SetConfigDb(configDb) }
+}
+
+func TestFanOutOutputs(t *testing.T) {
+	cmd = testCommander{}
+	defer useRecorderConfigDb(&txRecorder{})()
+	rec, tx := newRecorderTx(t)
+	elem := &pgengine.ChainElementExecution{ChainID: 1, TaskName: "ping", Kind: "SHELL", Script: "ping",
+		FanOutParam: "hosts", FanOutLimit: 3, OutputTable: "output"}
+	ctx := withChainTx(context.Background())
+	unlock := lockChainTx(ctx)
+	done := make(chan int)
+	go func() {
+		done <- executeFanOut(ctx, tx, elem, nil, map[string]json.RawMessage{"hosts": json.RawMessage(`["a", "b", "c"]`)})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Zero(t, rec.count("INSERT"), "Outputs should not be stored while the chain transaction is in use")
+	unlock()
+	assert.Equal(t, 0, <-done, "All items should succeed")
+	assert.Equal(t, 3, rec.count("INSERT"), "Output of every item should be stored")
+}
+
+func TestParallelBranches(t *testing.T) {
+	cmd = testCommander{}
+	defer useRecorderConfigDb(&txRecorder{})()
+	rec, tx := newRecorderTx(t)
+	elements := []pgengine.ChainElementExecution{
+		{ChainID: 1, TaskName: "sql", Kind: "SQL", Script: sleepingScript, IgnoreError: true, DependsOn: []int64{}},
+		{ChainID: 2, TaskName: "ping", Kind: "SHELL", Script: "ping", OutputTable: "output", DependsOn: []int64{}},
+	}
+	deps, err := chainDependencies(elements)
+	assert.NoError(t, err)
+	assert.Equal(t, "", executeChainElements(context.Background(), tx, Chain{}, 42, elements, deps, nil))
+	assert.False(t, rec.interleaved, "Statements should not be executed while rows of another one are open")
+	rec.Lock()
+	defer rec.Unlock()
+	for i, s := range rec.statements {
+		if strings.HasPrefix(s, "SAVEPOINT") && assert.True(t, i+2 < len(rec.statements)) {
+			assert.Equal(t, sleepingScript, rec.statements[i+1], "SQL task should not be interleaved with other tasks")
+			assert.True(t, strings.HasPrefix(rec.statements[i+2], "ROLLBACK TO SAVEPOINT"),
+				"Ignored error should be rolled back before other tasks use the transaction")
+		}
+	}
+	assert.Contains(t, rec.statements, "SAVEPOINT \"sql\"")
+}
+
+func TestChainQueue(t *testing.T) {
+	q := newChainQueue()
+	now := time.Now()
+	q.push(Chain{ChainName: "low"}, now)
+	q.push(Chain{ChainName: "first", Priority: 5}, now)
+	q.push(Chain{ChainName: "second", Priority: 5}, now)
+	q.push(Chain{ChainName: "earlier", Priority: 5}, now.Add(-time.Minute))
+	q.push(Chain{ChainName: "urgent", Priority: 10}, now)
+	assert.Equal(t, 5, q.len())
+
+	out := make(chan Chain)
+	done := make(chan struct{})
+	defer close(done)
+	go q.feed(out, done)
+	var names []string
+	for i := 0; i < 5; i++ {
+		names = append(names, (<-out).ChainName)
+	}
+	assert.Equal(t, []string{"urgent", "earlier", "first", "second", "low"}, names,
+		"Chains should be dispatched by priority, due time and push order")
+
+	q.push(Chain{ChainName: "later"}, now)
+	select {
+	case c := <-out:
+		assert.Equal(t, "later", c.ChainName, "Chain pushed to empty queue should be dispatched immediately")
+	case <-time.After(time.Second):
+		t.Fatal("Chain pushed to empty queue should be dispatched")
+	}
+}
+
+func TestGetTail(t *testing.T) {
+	assert.Equal(t, "", getTail(nil, 10), "Tail of empty output should be empty")
+	assert.Equal(t, "short", getTail([]byte("short\n"), 10), "Short output should be returned as is")
+	assert.Equal(t, "67890", getTail([]byte("1234567890"), 5), "Long output should be truncated from the beginning")
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := newLimitedBuffer(5, 3)
+	n, err := b.Write([]byte("1234"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n, "Write should report all bytes written")
+	n, err = b.Write([]byte("567890"))
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n, "Write should report all bytes written even if truncated")
+	_, _ = b.Write([]byte("abc"))
+	assert.Equal(t, "12345\n...output truncated (5 bytes omitted)...\nabc", string(b.Bytes()),
+		"Output should be truncated keeping the head and the tail")
+	assert.Equal(t, "abc", getTail(b.Bytes(), 3), "Tail should be the end of the output")
+
+	b = newLimitedBuffer(5, 3)
+	_, _ = b.Write([]byte("1234567"))
+	assert.Equal(t, "1234567", string(b.Bytes()), "Output fitting into the tail should not be truncated")
+
+	b = newLimitedBuffer(0, 3)
+	_, _ = b.Write([]byte("1234567890"))
+	assert.Equal(t, "1234567890", string(b.Bytes()), "Zero limit means no truncation")
+}
+
+func TestIsConditionMet(t *testing.T) {
+	elem := &pgengine.ChainElementExecution{}
+	assert.True(t, isConditionMet(elem, 0), "Element without condition should run after success")
+	assert.True(t, isConditionMet(elem, 1), "Element without condition should run after ignored error")
+	elem.RunIfExitCodes = []int64{2, 3}
+	assert.False(t, isConditionMet(elem, 0), "Element should not run if exit code is not listed")
+	assert.True(t, isConditionMet(elem, 3), "Element should run if exit code is listed")
+	elem.RunIfExitCodes = []int64{}
+	assert.False(t, isConditionMet(elem, 0), "Element with empty condition list should never run")
+}
+
+func TestChainDependencies(t *testing.T) {
+	elems := []pgengine.ChainElementExecution{{ChainID: 1}, {ChainID: 2}, {ChainID: 3}}
+	deps, err := chainDependencies(elems)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int{nil, {0}, {1}}, deps, "Linear chain elements should depend on previous ones")
+
+	elems[1].DependsOn = []int64{}
+	elems[2].DependsOn = []int64{2, 1, 2}
+	deps, err = chainDependencies(elems)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int{nil, nil, {0, 1}}, deps, "Explicit dependencies should replace the previous element")
+	assert.Equal(t, [][]int{{2}, {2}, nil}, dependentsOf(deps))
+
+	elems[2].DependsOn = []int64{4}
+	_, err = chainDependencies(elems)
+	assert.Error(t, err, "Dependency outside of the chain should be rejected")
+
+	elems[0].DependsOn = []int64{3}
+	elems[2].DependsOn = []int64{1}
+	_, err = chainDependencies(elems)
+	assert.EqualError(t, err, "Chain elements 1, 3 are in or depend on a dependency cycle")
+	elems[0].DependsOn = []int64{1}
+	_, err = chainDependencies(elems)
+	assert.Error(t, err, "Element depending on itself should be rejected")
+
+	assert.Equal(t, 0, dependencyCode(nil, nil), "Element without dependencies should see success")
+	assert.Equal(t, 2, dependencyCode([]int{0, 1, 2}, []int{0, 2, -1}), "First failed dependency should be used")
+}
+
+func TestWorkDir(t *testing.T) {
+	cmd = testCommander{}
+	assert.NoError(t, checkWorkDir(""), "Empty working directory should be allowed")
+	assert.NoError(t, checkWorkDir(os.TempDir()), "Existing directory should be allowed")
+	assert.Error(t, checkWorkDir("scheduler_test.go"), "File cannot be used as working directory")
+
+	elem := shellElem("ping")
+	elem.WorkDir = "/non/existing/dir"
+	_, err := executeShellCommand(context.Background(), elem, nil, nil)
+	assert.Error(t, err, "Command with non existing working directory should fail")
+}
+
+func TestGetJitter(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	pgengine.MaxJitter.Set(0)
+	assert.Zero(t, getJitter(r, -1, start), "Jitter should be disabled by default")
+	assert.Zero(t, getJitter(r, 0, start), "Zero chain jitter should disable jitter")
+	for i := 0; i < 100; i++ {
+		d := getJitter(r, 30, start)
+		assert.True(t, d >= 0 && d < 30*time.Second, "Jitter should be less than maximum")
+	}
+	pgengine.MaxJitter.Set(30)
+	assert.Equal(t, getJitter(rand.New(rand.NewSource(1)), -1, start), getJitter(rand.New(rand.NewSource(1)), 30, start),
+		"Global jitter should be used if chain jitter is not set and be deterministic for the same seed")
+	late := start.Add(50 * time.Second)
+	for i := 0; i < 100; i++ {
+		assert.True(t, getJitter(r, 30, late) <= 9*time.Second, "Jitter should not exceed the current minute")
+	}
+	assert.Zero(t, getJitter(r, 30, start.Add(59*time.Second+time.Millisecond)), "No jitter at the end of the minute")
+	pgengine.MaxJitter.Set(0)
+}
+
+func TestSupervise(t *testing.T) {
+	loopBackoffUnit = time.Millisecond
+	defer func() {
+		loopBackoffUnit = time.Second
+		pgengine.LoopRestarts.Set(5)
+		pgengine.LoopBackoff.Set(5)
+	}()
+	pgengine.LoopRestarts.Set(2)
+	pgengine.LoopBackoff.Set(1)
+	restarts := LoopRestarts()
+	calls := 0
+	err := supervise(func() error {
+		calls++
+		switch calls {
+		case 1, 2:
+			return pgengine.ErrSchemaMissing
+		case 3:
+			return nil // success resets attempts in a row
+		case 4:
+			panic("boom")
+		}
+		return fmt.Errorf("failure %d", calls)
+	})
+	assert.EqualError(t, err, "failure 6", "Loop should give up after too many failures in a row")
+	assert.Equal(t, 6, calls)
+	assert.Equal(t, restarts+4, LoopRestarts(), "Every restart should be counted")
+
+	pgengine.LoopRestarts.Set(0)
+	assert.Error(t, supervise(func() error { return pgengine.ErrSchemaMissing }), "Loop should give up on the first failure")
+
+	pgengine.LoopBackoff.Set(5)
+	loopBackoffUnit = time.Second
+	assert.Equal(t, 5*time.Second, loopBackoff(1))
+	assert.Equal(t, 20*time.Second, loopBackoff(3), "Backoff should be doubled on every restart")
+	assert.Equal(t, maxLoopBackoff, loopBackoff(100), "Backoff should be capped")
+}
+
+func TestOutsideWindow(t *testing.T) {
+	skipped := SkippedRuns()[skipWindow]
+	chain := Chain{ChainID: 1, ChainExecutionConfigID: 42, WindowAction: "skip"}
+	assert.False(t, outsideWindow(chain), "Chain within its window should be started")
+	chain.WindowDelay = 3600
+	assert.True(t, outsideWindow(chain), "Chain outside its window should be skipped")
+	assert.Equal(t, skipped+1, SkippedRuns()[skipWindow])
+
+	chain.WindowAction = "defer"
+	assert.True(t, outsideWindow(chain), "Chain outside its window should be deferred")
+	assert.Equal(t, skipped+1, SkippedRuns()[skipWindow], "Deferred run should not be counted as skipped")
+	assert.True(t, outsideWindow(chain), "Run due while one is deferred should be folded")
+	assert.Equal(t, skipped+2, SkippedRuns()[skipWindow], "Folded run should be counted as skipped")
+	undeferChain(chain.ChainExecutionConfigID)
+	assert.True(t, deferChain(chain.ChainExecutionConfigID), "Run should be deferred again after the window opened")
+	undeferChain(chain.ChainExecutionConfigID)
+}
+
+func TestCatchUp(t *testing.T) {
+	tick := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	ticks := []time.Time{tick, tick.Add(time.Hour)}
+	pop := func() Chain {
+		c, ok := dispatchQueue.head()
+		assert.True(t, ok, "Catch-up run should be dispatched")
+		dispatchQueue.remove(c.seq)
+		return c.Chain
+	}
+	current := Chain{ChainExecutionConfigID: 42, MissedTicks: missedCatchUpAll}
+	catchUpChain = func(int) (Chain, error) { return current, nil }
+	defer func() { catchUpChain = liveChain }()
+	n := dispatchQueue.len()
+	catchUp(Chain{ChainExecutionConfigID: 42, MissedTicks: missedCatchUpAll}, ticks)
+	assert.Equal(t, n+1, dispatchQueue.len(), "Missed ticks should be caught up one by one")
+	run := pop()
+	assert.Equal(t, tick, run.CatchUp)
+	assert.True(t, run.Due.IsZero(), "Catch-up run should not be skipped at the end of the current minute")
+	run.Done("CHAIN_DONE")
+	run = pop()
+	assert.Equal(t, ticks[1], run.CatchUp, "Next missed tick should be caught up after the run finished")
+	run.Done("CHAIN_FAILED")
+	assert.Equal(t, n, dispatchQueue.len(), "No run should be dispatched after the last missed tick")
+	catchUp(Chain{ChainExecutionConfigID: 42}, nil)
+	assert.Equal(t, n, dispatchQueue.len())
+
+	skipped := SkippedRuns()[skipWindow]
+	catchUp(Chain{ChainExecutionConfigID: 42, MissedTicks: missedCatchUpAll, WindowAction: "skip", WindowDelay: 60}, ticks)
+	assert.Equal(t, n, dispatchQueue.len(), "Missed ticks outside the execution window should not be caught up")
+	assert.Equal(t, skipped+2, SkippedRuns()[skipWindow], "Every missed tick outside the window should be skipped")
+	catchUp(Chain{ChainExecutionConfigID: 42, MissedTicks: missedCatchUpAll}, ticks)
+	current.WindowAction, current.WindowDelay = "skip", 60
+	pop().Done("CHAIN_DONE")
+	assert.Equal(t, n, dispatchQueue.len(), "Window should be checked again for the next missed tick")
+	assert.Equal(t, skipped+3, SkippedRuns()[skipWindow])
+	current.MissedTicks = missedSkip
+	catchUp(Chain{ChainExecutionConfigID: 42, MissedTicks: missedCatchUpAll}, ticks)
+	pop().Done("CHAIN_DONE")
+	assert.Equal(t, n, dispatchQueue.len(), "Chain not catching up missed ticks anymore should stop")
+}
+
+func TestCommandEnv(t *testing.T) {
+	elem := shellElem("ping")
+	ctx, span := startTaskSpan(context.Background(), elem)
+	assert.Nil(t, span, "No span should be started while tracing is disabled")
+	assert.Nil(t, commandEnv(ctx), "Commands should inherit the environment without trace context")
+
+	tracing.Enable("http://localhost:4318", "pg_timetable", nil)
+	defer tracing.Enable("", "", nil)
+	ctx, span = startTaskSpan(context.Background(), elem)
+	env := commandEnv(ctx)
+	assert.Equal(t, "TRACEPARENT="+tracing.Traceparent(ctx), env[len(env)-1], "Trace context should be passed to commands")
+	assert.True(t, len(env) > 1, "Environment of the process should be kept")
+	endTaskSpan(span, 0)
+}
+
+func TestFailureHandler(t *testing.T) {
+	chain := Chain{ChainExecutionConfigID: 1, ChainName: "nightly", Timeout: 60}
+	assert.Zero(t, failureHandler(chain, "CHAIN_FAILED"), "No on-failure chain should be started if none is set")
+	pgengine.OnFailureChain.Set(3)
+	defer func() { pgengine.OnFailureChain.Set(0) }()
+	assert.Equal(t, 3, failureHandler(chain, "CHAIN_FAILED"), "Global on-failure chain should be used")
+	chain.OnFailureChainID = 2
+	assert.Equal(t, 2, failureHandler(chain, "CHAIN_TIMEOUT"), "Chain setting should override the global one")
+	for _, status := range []string{"CHAIN_DONE", "CHAIN_SKIPPED", "CHAIN_CANCELLED", ""} {
+		assert.Zero(t, failureHandler(chain, status), "No on-failure chain should be started for "+status)
+	}
+	handler := Chain{ChainExecutionConfigID: 3, Failure: &FailedRun{ChainConfig: 1}}
+	assert.Zero(t, failureHandler(handler, "CHAIN_FAILED"), "Failed on-failure chain run should not start one")
+	handler.Failure = nil
+	assert.Zero(t, failureHandler(handler, "CHAIN_FAILED"), "Global on-failure chain should not start itself")
+
+	ctx := withRunFailure(context.Background())
+	assert.Equal(t, "Chain finished with status CHAIN_FAILED", failureSummary(ctx, chain, "CHAIN_FAILED"))
+	recordFailure(ctx, "Task %s failed: %s", "backup", "exit status 2")
+	recordFailure(ctx, "Task %s failed: %s", "cleanup", "exit status 1")
+	assert.Equal(t, "Task backup failed: exit status 2", failureSummary(ctx, chain, "CHAIN_FAILED"), "First error should be kept")
+	assert.Equal(t, "Chain timed out after 60 seconds", failureSummary(ctx, chain, "CHAIN_TIMEOUT"))
+	recordFailure(context.Background(), "ignored outside of a run")
+
+	params := FailedRun{ChainConfig: 1, ChainName: "nightly", RunStatusID: 42, Status: "CHAIN_FAILED",
+		Error: "Task backup failed"}.params()
+	assert.Equal(t, map[string]json.RawMessage{
+		"failed_chain_execution_config": json.RawMessage(`1`),
+		"failed_chain_name":             json.RawMessage(`"nightly"`),
+		"failed_run_status":             json.RawMessage(`42`),
+		"failed_status":                 json.RawMessage(`"CHAIN_FAILED"`),
+		"failed_error":                  json.RawMessage(`"Task backup failed"`),
+	}, params)
+}
+
+func TestResolveResults(t *testing.T) {
+	_, err := resolveResults(context.Background(), `["${result:1.exit_code}"]`)
+	assert.EqualError(t, err, "Result of chain element 1 is not available outside of a chain run")
+	ctx := withRunResults(context.Background())
+	value, err := resolveResults(ctx, `["no placeholders"]`)
+	assert.NoError(t, err)
+	assert.Equal(t, `["no placeholders"]`, value)
+	_, err = resolveResults(ctx, `["${result:1.stdout}"]`)
+	assert.EqualError(t, err, "Result of chain element 1 is not available, it wasn't executed before")
+
+	result := pgengine.TaskResult{ExitCode: 2, Stdout: []byte("/backup/\"db\".dump\n"), Stderr: []byte("warning")}
+	result.SetData("rows_affected", 42)
+	result.SetData("path", "/backup")
+	recordResult(ctx, 1, result)
+	value, err = resolveResults(ctx, `["${result:1.exit_code}", "${result:1.stdout}", "${result:1.stderr}"]`)
+	assert.NoError(t, err)
+	assert.Equal(t, `["2", "/backup/\"db\".dump", "warning"]`, value, "Output should be trimmed and escaped")
+	value, err = resolveResults(ctx, `{"rows": ${result:1.data.rows_affected}, "path": "${result:1.data.path}"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"rows": 42, "path": "/backup"}`, value, "Data values should be resolved")
+	_, err = resolveResults(ctx, `["${result:1.data.missing}"]`)
+	assert.EqualError(t, err, "Result of chain element 1 has no missing data")
+
+	params := []string{`["${result:1.exit_code}"]`}
+	named := map[string]json.RawMessage{"rows": json.RawMessage(`${result:1.data.rows_affected}`)}
+	assert.NoError(t, resolveElementResults(ctx, params, named))
+	assert.Equal(t, []string{`["2"]`}, params)
+	assert.Equal(t, json.RawMessage(`42`), named["rows"])
+	assert.Error(t, resolveElementResults(ctx, []string{`["${result:2.stdout}"]`}, nil))
+}
+
+func TestWriteChainResults(t *testing.T) {
+	results := []ChainResult{
+		{ChainConfigID: 1, ChainName: "nightly", RunStatusID: 42, Status: "CHAIN_DONE", Duration: 1500 * time.Millisecond},
+		{ChainConfigID: 2, ChainName: "report", RunStatusID: 43, Status: "CHAIN_FAILED", Duration: 2 * time.Second},
+		{ChainConfigID: 3, Err: errors.New("Chain configuration ID: 3 is already running")},
+	}
+	assert.True(t, results[0].Succeeded())
+	assert.False(t, results[1].Succeeded())
+	assert.False(t, results[2].Succeeded(), "Chain not started should not succeed")
+	assert.True(t, ChainResult{Status: "CHAIN_SKIPPED"}.Succeeded(), "Skipped chain should succeed")
+	var out strings.Builder
+	assert.NoError(t, WriteChainResults(&out, results))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " ")
+	}
+	assert.Equal(t, []string{
+		"CONFIG  CHAIN    RUN  STATUS        DURATION  ERROR",
+		"1       nightly  42   CHAIN_DONE    1.5s",
+		"2       report   43   CHAIN_FAILED  2s",
+		"3                -    NOT_STARTED   -         Chain configuration ID: 3 is already running",
+	}, lines)
+}
@@ -1,59 +1,404 @@
 package scheduler
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
 )
 
-type commander interface {
-	CombinedOutput(string, ...string) ([]byte, error)
+// the maximum number of stderr bytes stored in run_status, also the number of last output bytes kept on truncation
+const stderrTailSize = 1024
+
+// ResourceLimits restrict resources and privileges available to external program, zero values mean no limit
+type ResourceLimits struct {
+	Nice      int
+	CPUTime   int // in seconds
+	Memory    int // in megabytes
+	OpenFiles int
+	User      string // OS user name or ID the program runs as, empty means the scheduler user
+	Group     string // OS group name or ID, empty means the primary group of User
+}
+
+// isSet returns true if any limit applied by limitCommand is set
+func (l ResourceLimits) isSet() bool {
+	return l.Nice != 0 || l.CPUTime != 0 || l.Memory != 0 || l.OpenFiles != 0
+}
+
+// Commander runs external programs in the given working directory, empty dir means the current one,
+// within the resource limits. The program is killed when the context is done. Non-zero exit code
+// is reported by an error having ExitCode() method, e.g. *exec.ExitError
+type Commander interface {
+	CombinedOutput(context.Context, string, ResourceLimits, string, ...string) ([]byte, error)
+	SeparateOutput(context.Context, string, ResourceLimits, string, ...string) ([]byte, []byte, error)
 }
 
 type realCommander struct{}
 
-func (c realCommander) CombinedOutput(command string, args ...string) ([]byte, error) {
-	return exec.Command(command, args...).CombinedOutput()
+func (c realCommander) CombinedOutput(ctx context.Context, dir string, limits ResourceLimits, command string, args ...string) ([]byte, error) {
+	out := newLimitedBuffer(pgengine.MaxOutputSize.Get(), stderrTailSize)
+	command, args = limitCommand(limits, command, args)
+	cmd := exec.CommandContext(ctx, command, args...)
+	if err := setCredential(cmd, limits); err != nil {
+		return nil, err
+	}
+	cmd.Dir = dir
+	cmd.Env = commandEnv(ctx)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := runTracked(ctx, cmd)
+	return out.Bytes(), err
+}
+
+func (c realCommander) SeparateOutput(ctx context.Context, dir string, limits ResourceLimits, command string, args ...string) ([]byte, []byte, error) {
+	stdout := newLimitedBuffer(pgengine.MaxOutputSize.Get(), stderrTailSize)
+	stderr := newLimitedBuffer(pgengine.MaxOutputSize.Get(), stderrTailSize)
+	command, args = limitCommand(limits, command, args)
+	cmd := exec.CommandContext(ctx, command, args...)
+	if err := setCredential(cmd, limits); err != nil {
+		return nil, nil, err
+	}
+	cmd.Dir = dir
+	cmd.Env = commandEnv(ctx)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := runTracked(ctx, cmd)
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// limitedBuffer keeps the first limit bytes and the last tailSize bytes written and counts the rest as omitted,
+// limit <= 0 means no limit
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	tail     []byte
+	tailSize int
+	omitted  int
+}
+
+func newLimitedBuffer(limit int, tailSize int) *limitedBuffer {
+	return &limitedBuffer{limit: limit, tailSize: tailSize}
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.limit <= 0 {
+		return b.buf.Write(p)
+	}
+	room := b.limit - b.buf.Len()
+	if room < 0 {
+		room = 0
+	}
+	if len(p) <= room {
+		return b.buf.Write(p)
+	}
+	b.buf.Write(p[:room])
+	b.tail = append(b.tail, p[room:]...)
+	if extra := len(b.tail) - b.tailSize; extra > 0 {
+		b.omitted += extra
+		b.tail = append(b.tail[:0], b.tail[extra:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns captured output with truncation marker between the head and the tail if some output was omitted
+func (b *limitedBuffer) Bytes() []byte {
+	if b.omitted > 0 {
+		fmt.Fprintf(&b.buf, "\n...output truncated (%d bytes omitted)...\n", b.omitted)
+		b.omitted = 0
+	}
+	if len(b.tail) > 0 {
+		b.buf.Write(b.tail)
+		b.tail = nil
+	}
+	return b.buf.Bytes()
+}
+
+var cmd Commander
+
+// SetCommander replaces the commander executing shell tasks and returns the previous one, so tests
+// may stub command execution, see FakeCommander
+func SetCommander(c Commander) Commander {
+	prev := cmd
+	cmd = c
+	return prev
+}
+
+// exitCoder is implemented by errors reporting the exit code of the program
+type exitCoder interface {
+	error
+	ExitCode() int
+}
+
+// placeholderRegexp matches ${name} placeholders of named parameters and $$ escaping the dollar sign
+var placeholderRegexp = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolateArgs replaces ${name} placeholders in arguments with values of named parameters, $$ is replaced
+// with $. Every argument stays a single argument whatever the value is, so no shell injection is possible.
+// JSON strings are substituted unquoted, other values as JSON text. Undefined parameters are reported as error
+func interpolateArgs(args []string, namedParams map[string]json.RawMessage) ([]string, error) {
+	if len(namedParams) == 0 {
+		return args, nil
+	}
+	result := make([]string, len(args))
+	for i, arg := range args {
+		var err error
+		result[i] = placeholderRegexp.ReplaceAllStringFunc(arg, func(m string) string {
+			if m == "$$" {
+				return "$"
+			}
+			name := m[2 : len(m)-1]
+			value, ok := namedParams[name]
+			if !ok {
+				if err == nil {
+					err = fmt.Errorf("Undefined parameter %s in argument %d of shell command", m, i+1)
+				}
+				return m
+			}
+			var s string
+			if json.Unmarshal(value, &s) == nil {
+				return s
+			}
+			if string(value) == "null" {
+				return ""
+			}
+			return string(value)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// stderrFailure returns error if stderr output of the command exited with zero code is not empty, or matches
+// the pattern if it's set
+func stderrFailure(pattern *regexp.Regexp, stderr []byte) error {
+	switch {
+	case len(stderr) == 0:
+		return nil
+	case pattern == nil:
+		return errors.New("Command wrote to stderr")
+	case pattern.Match(stderr):
+		return fmt.Errorf("Command stderr matches %s", pattern)
+	}
+	return nil
 }
 
-var cmd commander
+// outputAssertion checks the output of the command against expect_output, the output must contain the text
+// or match the regular expression depending on expect_output_mode. Zero value checks nothing
+type outputAssertion struct {
+	text    string
+	pattern *regexp.Regexp
+}
 
-// ExecuteTask executes built-in task depending on task name and returns err result
-func executeShellCommand(command string, paramValues []string) (code int, out []byte, err error) {
+// newOutputAssertion compiles expect_output of the chain element if the mode is regex
+func newOutputAssertion(chainElemExec *pgengine.ChainElementExecution) (a outputAssertion, err error) {
+	if chainElemExec.ExpectOutput == "" {
+		return a, nil
+	}
+	switch chainElemExec.ExpectOutputMode {
+	case "", "contains":
+		a.text = chainElemExec.ExpectOutput
+	case "regex":
+		if a.pattern, err = regexp.Compile(chainElemExec.ExpectOutput); err != nil {
+			return a, fmt.Errorf("Invalid expect_output %s: %v", chainElemExec.ExpectOutput, err)
+		}
+	default:
+		return a, fmt.Errorf("Unknown expect_output_mode %s, expected contains or regex", chainElemExec.ExpectOutputMode)
+	}
+	return a, nil
+}
 
+// failure returns error describing the mismatch if the output doesn't satisfy the assertion
+func (a outputAssertion) failure(cmdLine string, output []byte) error {
+	switch {
+	case a.pattern != nil && !a.pattern.Match(output):
+		return fmt.Errorf("Command %soutput doesn't match %s", cmdLine, a.pattern)
+	case a.text != "" && !bytes.Contains(output, []byte(a.text)):
+		return fmt.Errorf("Command %soutput doesn't contain %q", cmdLine, a.text)
+	}
+	return nil
+}
+
+// executeShellCommand executes shell command of the chain element and returns the result with exit code and
+// output of the last command executed, and error. If chain element has SeparateOutput set, stdout and stderr are
+// captured separately, otherwise combined output is returned as stdout. Named parameters are substituted into
+// arguments, see interpolateArgs. If StderrAsError is set, the command with zero exit code writing to stderr
+// fails the task with zero exit code returned. Non-zero exit codes fail the task unless ExitCodeMap maps them to
+// success or warning, the exit code is returned then. If ExpectOutput is set, the task fails when the output of
+// any command doesn't contain or match it, see outputAssertion. Without parameter values the command is executed
+// once without arguments, skipped or fails according to EmptyParams
+func executeShellCommand(ctx context.Context, chainElemExec *pgengine.ChainElementExecution, paramValues []string,
+	namedParams map[string]json.RawMessage) (result pgengine.TaskResult, err error) {
+	var stdout, stderr []byte
+	failed := pgengine.TaskResult{ExitCode: -1, Stdout: []byte{}, Stderr: []byte{}}
+	command := chainElemExec.Script
 	if strings.TrimSpace(command) == "" {
-		return -1, []byte{}, errors.New("Shell command cannot be empty")
+		return failed, errors.New("Shell command cannot be empty")
 	}
-	if len(paramValues) == 0 { //mimic empty param
-		paramValues = []string{""}
+	if len(namedParams) > 0 && placeholderRegexp.MatchString(command) {
+		return failed, errors.New("Parameters cannot be used in the shell command itself, pass them as arguments")
+	}
+	if err := checkWorkDir(chainElemExec.WorkDir); err != nil {
+		return failed, err
+	}
+	var stderrPattern *regexp.Regexp
+	if chainElemExec.StderrAsError && chainElemExec.StderrPattern != "" {
+		if stderrPattern, err = regexp.Compile(chainElemExec.StderrPattern); err != nil {
+			return failed, fmt.Errorf("Invalid stderr_error_pattern %s: %v", chainElemExec.StderrPattern, err)
+		}
+	}
+	expectOutput, err := newOutputAssertion(chainElemExec)
+	if err != nil {
+		return failed, err
+	}
+	exitCodes, err := parseExitCodeMap(chainElemExec.ExitCodeMap.String)
+	if err != nil {
+		return failed, fmt.Errorf("Invalid exit_code_map: %v", err)
+	}
+	limits := ResourceLimits{
+		Nice:      chainElemExec.Nice,
+		CPUTime:   chainElemExec.MaxCPUTime,
+		Memory:    chainElemExec.MaxMemory,
+		OpenFiles: chainElemExec.MaxOpenFiles,
+		User:      chainElemExec.RunAsUser,
+		Group:     chainElemExec.RunAsGroup,
+	}
+	if err := checkRunAs(limits); err != nil {
+		return failed, err
+	}
+	if len(paramValues) == 0 {
+		switch chainElemExec.EmptyParams {
+		case "skip":
+			pgengine.LogToDBContext(ctx, "LOG", "Shell command skipped, the task has no parameters: ", command)
+			return pgengine.TaskResult{Stdout: []byte{}, Stderr: []byte{}}, nil
+		case "fail":
+			return failed, errors.New("Shell command has no parameters and empty_params is fail")
+		}
+		paramValues = []string{""} //mimic empty param, the command is executed once without arguments
 	}
 	for _, val := range paramValues {
 		params := []string{}
 		if val > "" {
 			if err := json.Unmarshal([]byte(val), &params); err != nil {
-				return -1, []byte{}, err
+				return failed, err
 			}
 		}
-		out, err = cmd.CombinedOutput(command, params...) // #nosec
+		if params, err = interpolateArgs(params, namedParams); err != nil {
+			return failed, err
+		}
 		cmdLine := fmt.Sprintf("%s %v: ", command, params)
-		if len(out) > 0 {
-			pgengine.LogToDB("DEBUG", "Output for command ", cmdLine, string(out))
+		// sensitive arguments must be masked in the output as well
+		pgengine.RedactSensitive(cmdLine)
+		if isThrottled(chainElemExec, params, time.Now()) {
+			pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Shell command throttled, it was executed less than %d seconds ago: %s",
+				chainElemExec.MinInterval, cmdLine))
+			continue
+		}
+		if chainElemExec.SeparateOutput {
+			stdout, stderr, err = cmd.SeparateOutput(ctx, chainElemExec.WorkDir, limits, command, params...) // #nosec
+		} else {
+			stdout, err = cmd.CombinedOutput(ctx, chainElemExec.WorkDir, limits, command, params...) // #nosec
+		}
+		if len(stdout) > 0 {
+			pgengine.LogToDBContext(ctx, "DEBUG", "Output for command ", cmdLine, string(stdout))
 		}
+		if len(stderr) > 0 {
+			pgengine.LogToDBContext(ctx, "DEBUG", "Error output for command ", cmdLine, string(stderr))
+			chainElemExec.StderrTail = getTail(stderr, stderrTailSize)
+		}
+		result = pgengine.TaskResult{Stdout: stdout, Stderr: stderr}
 		if err != nil {
 			//check if we're dealing with an ExitError - i.e. return code other than 0
-			if exitError, ok := err.(*exec.ExitError); ok {
-				exitCode := exitError.ProcessState.ExitCode()
-				pgengine.LogToDB("DEBUG", "Return value of the command ", cmdLine, exitCode)
-				return exitCode, out, exitError
+			exitError, ok := err.(exitCoder)
+			if !ok {
+				result.ExitCode = -1
+				return result, err
+			}
+			code := exitError.ExitCode()
+			result.ExitCode = code
+			pgengine.LogToDBContext(ctx, "DEBUG", "Return value of the command ", cmdLine, code)
+			switch exitCodes.outcome(code) {
+			case outcomeFail:
+				return result, exitError
+			case outcomeWarn:
+				pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Command %sexit code %d mapped to warning", cmdLine, code))
+			default:
+				pgengine.LogToDBContext(ctx, "DEBUG", fmt.Sprintf("Command %sexit code %d mapped to success", cmdLine, code))
 			}
-			return -1, out, err
 		}
+		if chainElemExec.StderrAsError {
+			if err = stderrFailure(stderrPattern, stderr); err != nil {
+				return result, err
+			}
+		}
+		if err = expectOutput.failure(cmdLine, stdout); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// throttledUntil holds the time until which shell commands with the minimum interval set are skipped,
+// keyed by the hash of the command, its working directory and parameters
+var throttledUntil = struct {
+	sync.Mutex
+	until map[[sha256.Size]byte]time.Time
+}{until: make(map[[sha256.Size]byte]time.Time)}
+
+// isThrottled returns true if the same command with the same parameters and working directory was started
+// less than MinInterval seconds ago, otherwise the execution is registered. Expired entries are removed
+func isThrottled(chainElemExec *pgengine.ChainElementExecution, params []string, now time.Time) bool {
+	if chainElemExec.MinInterval <= 0 {
+		return false
+	}
+	key, _ := json.Marshal(append([]string{chainElemExec.Script, chainElemExec.WorkDir}, params...))
+	hash := sha256.Sum256(key)
+	throttledUntil.Lock()
+	defer throttledUntil.Unlock()
+	if until, ok := throttledUntil.until[hash]; ok && now.Before(until) {
+		return true
+	}
+	for h, until := range throttledUntil.until {
+		if !now.Before(until) {
+			delete(throttledUntil.until, h)
+		}
+	}
+	throttledUntil.until[hash] = now.Add(time.Duration(chainElemExec.MinInterval) * time.Second)
+	return false
+}
+
+// checkWorkDir returns error if the working directory is set but doesn't exist or isn't a directory
+func checkWorkDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("Working directory %s is not accessible: %v", dir, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("Working directory %s is not a directory", dir)
+	}
+	return nil
+}
+
+// getTail returns at most size last bytes of the output as string
+func getTail(out []byte, size int) string {
+	if len(out) > size {
+		out = out[len(out)-size:]
 	}
-	return 0, out, nil
+	return strings.TrimSpace(string(out))
 }
 
 func init() {
@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// reasons of runs not started when the chain was due, exposed as the reason label of the skipped runs counter
+const (
+	skipExclusive    = "exclusive"    // an exclusive chain was running or the exclusive chain had to wait for others
+	skipPrecondition = "precondition" // precondition query of the chain returned false
+	skipDisabled     = "disabled"     // scheduler was paused or the chain configuration has no chain
+	skipThrottled    = "throttled"    // max_instances of the chain were running
+	skipCapacity     = "capacity"     // no worker got free within the scheduled minute
+	skipWindow       = "window"       // the run was due outside the execution window of the chain
+	skipPaused       = "paused"       // the chain configuration was paused with pgengine.PauseChain
+)
+
+// skipMessages explain skip reasons in the log
+var skipMessages = map[string]string{
+	skipExclusive:    "exclusive execution conflicts with running chains",
+	skipPrecondition: "precondition not met",
+	skipDisabled:     "scheduler is paused",
+	skipThrottled:    "max_instances are running",
+	skipCapacity:     "all workers were busy until the end of the scheduled minute",
+	skipWindow:       "outside of the execution window",
+	skipPaused:       "chain is paused",
+}
+
+// runCounters hold the number of started and skipped runs since the process start
+var runCounters = struct {
+	started int64
+	sync.Mutex
+	skipped map[string]int64
+}{skipped: map[string]int64{
+	skipExclusive: 0, skipPrecondition: 0, skipDisabled: 0, skipThrottled: 0, skipCapacity: 0, skipWindow: 0, skipPaused: 0}}
+
+// countSkipped adds n runs skipped for the reason to the counter
+func countSkipped(reason string, n int) {
+	runCounters.Lock()
+	runCounters.skipped[reason] += int64(n)
+	runCounters.Unlock()
+}
+
+// skipChain logs that the due run of the chain is not started for the reason and counts it
+func skipChain(ctx context.Context, chain Chain, reason string) {
+	pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Chain ID: %d; configuration ID: %d skipped, %s",
+		chain.ChainID, chain.ChainExecutionConfigID, skipMessages[reason]))
+	countSkipped(reason, 1)
+	// runs skipped on purpose are not caught up
+	if reason == skipPaused || reason == skipWindow || reason == skipDisabled {
+		markFired(chain)
+	}
+}
+
+// countStarted counts the run passing all checks
+func countStarted() {
+	atomic.AddInt64(&runCounters.started, 1)
+}
+
+// StartedRuns returns the number of chain runs started since the process start
+func StartedRuns() int64 {
+	return atomic.LoadInt64(&runCounters.started)
+}
+
+// SkippedRuns returns the number of chain runs not started when due since the process start by skip reason,
+// every reason is listed even if nothing was skipped for it
+func SkippedRuns() map[string]int64 {
+	runCounters.Lock()
+	defer runCounters.Unlock()
+	skipped := make(map[string]int64, len(runCounters.skipped))
+	for reason, n := range runCounters.skipped {
+		skipped[reason] = n
+	}
+	return skipped
+}
+
+// exclusiveGate keeps exclusive chains apart from other chains executed by the process: an exclusive chain
+// is started only if no chains are running and no chains are started while it's running
+type exclusiveGate struct {
+	sync.Mutex
+	running   int
+	exclusive bool
+}
+
+// enter registers the starting chain and returns true, or returns false if the chain conflicts with running ones
+func (g *exclusiveGate) enter(exclusive bool) bool {
+	g.Lock()
+	defer g.Unlock()
+	if g.exclusive || (exclusive && g.running > 0) {
+		return false
+	}
+	g.running++
+	g.exclusive = exclusive
+	return true
+}
+
+// leave unregisters the chain registered with enter
+func (g *exclusiveGate) leave() {
+	g.Lock()
+	defer g.Unlock()
+	g.running--
+	g.exclusive = false
+}
+
+// runningChains enforces exclusive_execution of chains
+var runningChains = &exclusiveGate{}
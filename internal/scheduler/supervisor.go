@@ -0,0 +1,69 @@
+package scheduler
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+/* restarts of the failed main loop in a row are delayed for LoopBackoff seconds doubled up to maxLoopBackoff */
+const maxLoopBackoff = 5 * time.Minute
+
+// loopBackoffUnit is the unit of LoopBackoff, tests shorten it
+var loopBackoffUnit = time.Second
+
+// loopRestarts holds the number of main loop restarts since start
+var loopRestarts int64
+
+// LoopRestarts returns the number of times the main loop was restarted after failure since start
+func LoopRestarts() int64 {
+	return atomic.LoadInt64(&loopRestarts)
+}
+
+// loopBackoff returns the delay before the attempt-th restart of the failed main loop in a row
+func loopBackoff(attempt int) time.Duration {
+	d := time.Duration(pgengine.LoopBackoff.Get()) * loopBackoffUnit
+	for i := 1; i < attempt && d < maxLoopBackoff; i++ {
+		d *= 2
+	}
+	if d > maxLoopBackoff {
+		return maxLoopBackoff
+	}
+	return d
+}
+
+// runIteration runs one main loop iteration and returns panic of the iteration as error
+func runIteration(iteration func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return iteration()
+}
+
+// supervise runs iterations of the main loop until the process exits. A failed or panicked iteration is logged and
+// the loop is restarted after backoff, so the scheduler survives failures reconnecting cannot recover from, e.g. the
+// configuration schema being restored. Returns the error if iterations failed more than LoopRestarts times in a row
+func supervise(iteration func() error) error {
+	attempt := 0
+	for {
+		err := runIteration(iteration)
+		if err == nil {
+			attempt = 0
+			continue
+		}
+		if attempt++; attempt > pgengine.LoopRestarts.Get() {
+			pgengine.LogToDB("PANIC", fmt.Sprintf("Scheduler loop failed %d time(s) in a row, giving up: %v", attempt, err))
+			return err
+		}
+		d := loopBackoff(attempt)
+		pgengine.LogToDB("ERROR", fmt.Sprintf("Scheduler loop failed: %v, restarting in %v (attempt %d of %d)",
+			err, d, attempt, pgengine.LoopRestarts.Get()))
+		time.Sleep(d)
+		atomic.AddInt64(&loopRestarts, 1)
+	}
+}
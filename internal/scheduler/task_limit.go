@@ -0,0 +1,72 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// taskLimiter is a semaphore limiting the number of simultaneously executing tasks, the limit is read on
+// every acquire, so it may be changed at runtime
+type taskLimiter struct {
+	sync.Mutex
+	inUse    int
+	released chan struct{} // closed and replaced on every release to wake up waiters
+}
+
+func newTaskLimiter() *taskLimiter {
+	return &taskLimiter{released: make(chan struct{})}
+}
+
+// acquire waits until less than limit tasks are running or the context is done, limit <= 0 means no limit
+func (l *taskLimiter) acquire(ctx context.Context, limit int) error {
+	for {
+		l.Lock()
+		if limit <= 0 || l.inUse < limit {
+			l.inUse++
+			l.Unlock()
+			return nil
+		}
+		released := l.released
+		l.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *taskLimiter) release() {
+	l.Lock()
+	l.inUse--
+	close(l.released)
+	l.released = make(chan struct{})
+	l.Unlock()
+}
+
+func (l *taskLimiter) running() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.inUse
+}
+
+// tasksLimiter limits tasks of all chains executed at once to pgengine.MaxRunningTasks
+var tasksLimiter = newTaskLimiter()
+
+// RunningTasks returns the number of chain elements being executed right now
+func RunningTasks() int {
+	return tasksLimiter.running()
+}
+
+// acquireTaskSlot waits at most TaskWaitTimeout seconds for a free task slot if the limit of running tasks is reached
+func acquireTaskSlot(ctx context.Context) error {
+	if pgengine.TaskWaitTimeout.Get() > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(pgengine.TaskWaitTimeout.Get())*time.Second)
+		defer cancel()
+	}
+	return tasksLimiter.acquire(ctx, pgengine.MaxRunningTasks.Get())
+}
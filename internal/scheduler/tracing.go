@@ -0,0 +1,57 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+	"github.com/cybertec-postgresql/pg_timetable/internal/tracing"
+)
+
+// startChainSpan starts the span of the chain run, spans of its tasks are children of it
+func startChainSpan(ctx context.Context, chain Chain, runStatusID int) (context.Context, *tracing.Span) {
+	return tracing.StartSpan(ctx, "chain "+chain.ChainName,
+		tracing.Int("pg_timetable.chain_execution_config", chain.ChainExecutionConfigID),
+		tracing.Int("pg_timetable.chain_id", chain.ChainID),
+		tracing.Int("pg_timetable.run_status", runStatusID),
+		tracing.String("pg_timetable.client_name", pgengine.ClientName))
+}
+
+// endChainSpan records the final status of the run and ends its span, runs neither done nor skipped are failed
+func endChainSpan(span *tracing.Span, status string) {
+	span.SetAttributes(tracing.String("pg_timetable.status", status))
+	if status != "CHAIN_DONE" && status != "CHAIN_SKIPPED" {
+		span.RecordError(fmt.Errorf("Chain finished with status %s", status))
+	}
+	span.End()
+}
+
+// startTaskSpan starts the span of the chain element executing its task
+func startTaskSpan(ctx context.Context, chainElemExec *pgengine.ChainElementExecution,
+	attrs ...tracing.Attribute) (context.Context, *tracing.Span) {
+	return tracing.StartSpan(ctx, "task "+chainElemExec.TaskName, append([]tracing.Attribute{
+		tracing.Int("pg_timetable.chain_id", chainElemExec.ChainID),
+		tracing.Int("pg_timetable.task_id", chainElemExec.TaskID),
+		tracing.String("pg_timetable.task_kind", chainElemExec.Kind),
+		tracing.Bool("pg_timetable.ignore_error", chainElemExec.IgnoreError)}, attrs...)...)
+}
+
+// endTaskSpan records the exit code of the task and ends its span, the task failed if the code is not zero
+func endTaskSpan(span *tracing.Span, code int) {
+	span.SetAttributes(tracing.Int("pg_timetable.exit_code", code))
+	if code != 0 {
+		span.RecordError(fmt.Errorf("Task failed with exit code %d", code))
+	}
+	span.End()
+}
+
+// commandEnv returns the environment of shell commands, the trace context of the task is passed in TRACEPARENT.
+// Nil is returned without the trace context, so the command inherits the environment of the process
+func commandEnv(ctx context.Context) []string {
+	env := tracing.Environ(ctx)
+	if env == nil {
+		return nil
+	}
+	return append(os.Environ(), env...)
+}
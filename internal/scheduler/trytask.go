@@ -0,0 +1,78 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+	"github.com/cybertec-postgresql/pg_timetable/internal/tasks"
+	"github.com/jmoiron/sqlx"
+)
+
+// TryTask executes the base task with the given name or ID and positional parameter values outside of any chain,
+// the same way a chain element with the task is executed. Parameters are resolved and validated like parameters
+// of chain elements. Output of shell tasks is written to stdout and stderr instead of the execution log, nothing
+// is written to run_status and execution_log. SQL tasks are committed unless DryRun is set.
+// Returns the exit code of the task and the error the task failed with, ready is false if the task cannot be
+// executed at all, e.g. it doesn't exist or its parameters are invalid
+func TryTask(ctx context.Context, task string, params []string, stdout, stderr io.Writer) (code int, ready bool, err error) {
+	elem, err := pgengine.GetBaseTaskElement(task)
+	if err != nil {
+		return -1, false, err
+	}
+	for i, p := range params {
+		if !json.Valid([]byte(p)) {
+			return -1, false, fmt.Errorf("Parameter %d is not valid JSON: %s", i+1, p)
+		}
+		if p, err = pgengine.ResolveFileReferences(p); err != nil {
+			return -1, false, fmt.Errorf("Cannot resolve parameter %d: %w", i+1, err)
+		}
+		if p, err = pgengine.ResolveEnv(p); err != nil {
+			return -1, false, fmt.Errorf("Cannot resolve parameter %d: %w", i+1, err)
+		}
+		if params[i], err = pgengine.ResolveSecrets(p); err != nil {
+			return -1, false, fmt.Errorf("Cannot resolve parameter %d: %w", i+1, err)
+		}
+	}
+	if err = pgengine.ValidateParams(elem, params, nil); err != nil {
+		return -1, false, err
+	}
+	pgengine.LogToDB("LOG", fmt.Sprintf("Trying %s task %s (ID: %d) with %d parameter(s)", elem.Kind, elem.TaskName,
+		elem.TaskID, len(params)))
+	elem.StartedAt = time.Now()
+	var result pgengine.TaskResult
+	switch elem.Kind {
+	case "SQL":
+		var tx *sqlx.Tx
+		if pgengine.DryRun {
+			tx = pgengine.StartTransactionDry()
+		} else {
+			tx = pgengine.StartTransaction()
+		}
+		if result, err = pgengine.ExecuteSQLTask(ctx, tx, elem, params, nil); err != nil {
+			pgengine.MustRollbackTransaction(tx)
+		} else {
+			pgengine.MustCommitTransaction(tx)
+		}
+	case "SHELL":
+		if pgengine.NoShellTasks.Get() {
+			return -1, false, errors.New("Shell tasks are disabled by --no-shell-tasks")
+		}
+		result, err = executeShellCommand(ctx, elem, params, nil)
+	case "BUILTIN":
+		result, err = tasks.ExecuteTask(ctx, elem.TaskName, params, nil)
+	}
+	_, _ = stdout.Write(result.Stdout)
+	_, _ = stderr.Write(result.Stderr)
+	code = result.ExitCode
+	if err != nil && code == 0 {
+		code = -1
+	}
+	pgengine.LogToDB("LOG", fmt.Sprintf("Task %s finished with exit code %d in %v", elem.TaskName, code,
+		time.Since(elem.StartedAt).Round(time.Millisecond)))
+	return code, true, err
+}
@@ -0,0 +1,120 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// runStatusFromContext returns the run status ID of the chain executed with the context, programs started
+// with it are tracked by the watchdog. ok is false if unknown
+func runStatusFromContext(ctx context.Context) (int, bool) {
+	info, ok := pgengine.ExecutionFromContext(ctx)
+	return info.RunStatusID, ok
+}
+
+// runProcesses holds process IDs of programs running at the moment keyed by the run status ID
+var runProcesses = struct {
+	sync.Mutex
+	pids map[int]map[int]struct{}
+}{pids: make(map[int]map[int]struct{})}
+
+// runTracked runs the program registering its process ID under the run status of the context, so the watchdog
+// is able to kill it. If WatchdogKill is set, the program is started in its own process group
+func runTracked(ctx context.Context, cmd *exec.Cmd) error {
+	if pgengine.WatchdogKill.Get() {
+		setProcessGroup(cmd)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	runStatusID, ok := runStatusFromContext(ctx)
+	if !ok {
+		return cmd.Wait()
+	}
+	pid := cmd.Process.Pid
+	runProcesses.Lock()
+	if runProcesses.pids[runStatusID] == nil {
+		runProcesses.pids[runStatusID] = make(map[int]struct{})
+	}
+	runProcesses.pids[runStatusID][pid] = struct{}{}
+	runProcesses.Unlock()
+	defer func() {
+		runProcesses.Lock()
+		delete(runProcesses.pids[runStatusID], pid)
+		if len(runProcesses.pids[runStatusID]) == 0 {
+			delete(runProcesses.pids, runStatusID)
+		}
+		runProcesses.Unlock()
+	}()
+	return cmd.Wait()
+}
+
+// killRunProcesses kills programs started by the run together with their process groups and returns their number
+func killRunProcesses(runStatusID int) int {
+	runProcesses.Lock()
+	pids := make([]int, 0, len(runProcesses.pids[runStatusID]))
+	for pid := range runProcesses.pids[runStatusID] {
+		pids = append(pids, pid)
+	}
+	runProcesses.Unlock()
+	killed := 0
+	for _, pid := range pids {
+		if err := killProcessGroup(pid); err != nil {
+			pgengine.LogToDB("ERROR", fmt.Sprintf("Cannot kill process %d of run %d: ", pid, runStatusID), err)
+			continue
+		}
+		killed++
+	}
+	return killed
+}
+
+// watchStuckRuns checks every WatchdogInterval seconds until shutdown for runs exceeding their timeout by more
+// than WatchdogGrace seconds. Interval is checked on every run, so the watchdog can be enabled at runtime
+func watchStuckRuns() {
+	for {
+		interval := time.Duration(pgengine.WatchdogInterval.Get()) * time.Second
+		if interval > 0 {
+			failStuckRuns()
+		} else {
+			interval = refetchTimeout * time.Second
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-pgengine.ShutdownContext().Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// failStuckRuns logs stuck runs, kills their programs if WatchdogKill is set and marks them as failed, so they
+// don't count towards max_instances of the chain anymore. Stuck runs executed by the process are cancelled
+func failStuckRuns() {
+	runs, err := pgengine.GetStuckRuns(pgengine.WatchdogGrace.Get())
+	if err != nil {
+		pgengine.LogToDB("ERROR", "Cannot check for stuck chain runs: ", err)
+		return
+	}
+	for _, run := range runs {
+		pgengine.LogToDB("ERROR", fmt.Sprintf("Run %d of chain ID: %d; configuration ID: %d is stuck, started at %s with timeout of %d seconds",
+			run.RunStatusID, run.ChainID, run.ChainConfigID, run.Started.Format(time.RFC3339), run.Timeout))
+		if pgengine.WatchdogKill.Get() {
+			if n := killRunProcesses(run.RunStatusID); n > 0 {
+				pgengine.LogToDB("LOG", fmt.Sprintf("Killed %d process group(s) of run %d", n, run.RunStatusID))
+			}
+		}
+		if failActiveRun(run.RunStatusID) {
+			pgengine.LogToDB("LOG", fmt.Sprintf("Cancelled stuck run %d", run.RunStatusID))
+		}
+		pgengine.UpdateChainRunStatus(
+			&pgengine.ChainElementExecution{
+				ChainID:     run.ChainID,
+				ChainConfig: run.ChainConfigID}, run.RunStatusID, "CHAIN_FAILED")
+	}
+}
@@ -0,0 +1,74 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+// deferredChains holds IDs of chain configurations with a run deferred until their execution window opens, so
+// runs due while one is already deferred are folded into it
+var deferredChains = struct {
+	sync.Mutex
+	ids map[int]bool
+}{ids: map[int]bool{}}
+
+// deferChain registers the deferred run of the chain configuration, returns false if one is already deferred
+func deferChain(chainConfigID int) bool {
+	deferredChains.Lock()
+	defer deferredChains.Unlock()
+	if deferredChains.ids[chainConfigID] {
+		return false
+	}
+	deferredChains.ids[chainConfigID] = true
+	return true
+}
+
+// undeferChain removes the deferred run of the chain configuration registered with deferChain
+func undeferChain(chainConfigID int) {
+	deferredChains.Lock()
+	defer deferredChains.Unlock()
+	delete(deferredChains.ids, chainConfigID)
+}
+
+// outsideWindow returns true if the scheduled chain is due outside its execution window, the run is then either
+// skipped or deferred until the window opens depending on window_action. A deferred run is scheduled for the minute
+// the window opens and folds runs due until then
+func outsideWindow(chain Chain) bool {
+	if chain.WindowDelay <= 0 {
+		return false
+	}
+	if chain.WindowAction != "defer" {
+		skipChain(context.Background(), chain, skipWindow)
+		return true
+	}
+	if !deferChain(chain.ChainExecutionConfigID) {
+		pgengine.LogToDB("DEBUG", fmt.Sprintf("Chain ID: %d; configuration ID: %d already deferred until its execution window opens",
+			chain.ChainID, chain.ChainExecutionConfigID))
+		countSkipped(skipWindow, 1)
+		return true
+	}
+	d := time.Duration(chain.WindowDelay) * time.Second
+	pgengine.LogToDB("LOG", fmt.Sprintf("Chain ID: %d; configuration ID: %d deferred for %v until its execution window opens",
+		chain.ChainID, chain.ChainExecutionConfigID, d))
+	time.AfterFunc(d, func() { startDeferredChain(chain) })
+	return true
+}
+
+// startDeferredChain dispatches the deferred chain in the minute its execution window opened
+func startDeferredChain(chain Chain) {
+	undeferChain(chain.ChainExecutionConfigID)
+	switch {
+	case pgengine.ShutdownContext().Err() != nil:
+		pgengine.LogToDB("LOG", fmt.Sprintf("Deferred run of chain %s cancelled by shutdown", chain))
+	case Paused():
+		skipChain(context.Background(), chain, skipDisabled)
+	default:
+		chain.Due = time.Now().Truncate(time.Minute)
+		chain.WindowDelay = 0
+		dispatchChain(chain, chain.Due)
+	}
+}
@@ -0,0 +1,142 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWSSecretsManager resolves secrets from AWS Secrets Manager, the secret name with Prefix prepended is the
+// secret ID, e.g. the prefix prod/pg_timetable/ and the name db_password read prod/pg_timetable/db_password
+type AWSSecretsManager struct {
+	Region          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // set for temporary credentials only
+	Endpoint        string // empty means https://secretsmanager.<Region>.amazonaws.com
+	Client          *http.Client
+	now             func() time.Time
+}
+
+// Resolve returns SecretString of the current version of the secret. Missing secret is unknown
+func (a *AWSSecretsManager) Resolve(name string) (string, bool, error) {
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + a.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/")
+	if err != nil {
+		return "", false, err
+	}
+	body, _ := json.Marshal(map[string]string{"SecretId": a.Prefix + name})
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	signAWSRequest(req, body, "secretsmanager", a.Region, a.AccessKeyID, a.SecretAccessKey, a.SessionToken, now())
+	resp, err := defaultClient(a.Client).Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, err
+	}
+	var result struct {
+		Type         string  `json:"__type"`
+		Message      string  `json:"message"`
+		SecretString *string `json:"SecretString"`
+	}
+	_ = json.Unmarshal(data, &result)
+	switch {
+	case resp.StatusCode == http.StatusBadRequest && strings.HasSuffix(result.Type, "ResourceNotFoundException"):
+		return "", false, nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return "", false, fmt.Errorf("AWS Secrets Manager responded %s reading %s: %s %s", resp.Status, a.Prefix+name,
+			result.Type, result.Message)
+	case result.SecretString == nil:
+		return "", false, fmt.Errorf("AWS secret %s has no SecretString, binary secrets are not supported", a.Prefix+name)
+	}
+	return *result.SecretString, true, nil
+}
+
+// signAWSRequest signs the request with AWS Signature Version 4, the Host, X-Amz-Date and X-Amz-Security-Token
+// headers are set and signed along with the headers already set
+func signAWSRequest(req *http.Request, body []byte, service, region, accessKeyID, secretAccessKey, sessionToken string,
+	t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{req.Method, path, canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(), signedHeaders, hex.EncodeToString(bodyHash[:])}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + secretAccessKey)
+	for _, s := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// canonicalQuery returns query parameters sorted by name and value and escaped as required by Signature Version 4
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for k, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func awsEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
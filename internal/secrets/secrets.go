@@ -0,0 +1,72 @@
+// Package secrets implements resolvers fetching secrets referenced by ${secret:NAME} placeholders of task
+// parameters from external secret managers, see pgengine.RegisterSecretResolver
+package secrets
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Resolver returns the value of the named secret, ok is false if the secret is unknown to resolver.
+// Errors must not contain secret values, since they are logged
+type Resolver interface {
+	Resolve(name string) (value string, ok bool, err error)
+}
+
+// requestTimeout limits requests to secret managers, so a task never waits for an unresponsive one for long
+const requestTimeout = 10 * time.Second
+
+func defaultClient(c *http.Client) *http.Client {
+	if c != nil {
+		return c
+	}
+	return &http.Client{Timeout: requestTimeout}
+}
+
+type cacheEntry struct {
+	value   string
+	expires time.Time
+}
+
+// Cache remembers secrets resolved by the resolver for the TTL, so every task referencing the secret doesn't
+// ask the secret manager again. Unknown secrets and errors are not cached
+type Cache struct {
+	sync.Mutex
+	resolver Resolver
+	ttl      time.Duration
+	entries  map[string]cacheEntry
+	now      func() time.Time
+}
+
+// Cached returns the resolver caching values resolved by r for ttl, r itself is returned if ttl is not positive
+func Cached(r Resolver, ttl time.Duration) Resolver {
+	if ttl <= 0 {
+		return r
+	}
+	return &Cache{resolver: r, ttl: ttl, entries: make(map[string]cacheEntry), now: time.Now}
+}
+
+// Resolve returns the cached value of the secret or asks the resolver if it's expired, expired entries are removed
+func (c *Cache) Resolve(name string) (string, bool, error) {
+	now := c.now()
+	c.Lock()
+	if e, ok := c.entries[name]; ok && now.Before(e.expires) {
+		c.Unlock()
+		return e.value, true, nil
+	}
+	for n, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, n)
+		}
+	}
+	c.Unlock()
+	value, ok, err := c.resolver.Resolve(name)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	c.Lock()
+	c.entries[name] = cacheEntry{value: value, expires: now.Add(c.ttl)}
+	c.Unlock()
+	return value, true, nil
+}
@@ -0,0 +1,152 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingResolver struct {
+	calls int
+	err   error
+}
+
+func (r *countingResolver) Resolve(name string) (string, bool, error) {
+	r.calls++
+	if r.err != nil || name == "missing" {
+		return "", false, r.err
+	}
+	return name + "-value", true, nil
+}
+
+func TestCache(t *testing.T) {
+	r := &countingResolver{}
+	assert.Equal(t, r, Cached(r, 0), "Resolver should not be cached without TTL")
+	now := time.Now()
+	c := Cached(r, time.Minute).(*Cache)
+	c.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		value, ok, err := c.Resolve("token")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "token-value", value)
+	}
+	assert.Equal(t, 1, r.calls, "Cached secret should not be resolved again")
+	_, ok, _ := c.Resolve("missing")
+	assert.False(t, ok)
+	_, _, _ = c.Resolve("missing")
+	assert.Equal(t, 3, r.calls, "Unknown secret should not be cached")
+	now = now.Add(time.Minute)
+	_, _, _ = c.Resolve("token")
+	assert.Equal(t, 4, r.calls, "Expired secret should be resolved again")
+	r.err = errors.New("unavailable")
+	now = now.Add(time.Minute)
+	_, ok, err := c.Resolve("token")
+	assert.EqualError(t, err, "unavailable")
+	assert.False(t, ok)
+}
+
+func TestVault(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/pg_timetable":
+			_, _ = w.Write([]byte(`{"data": {"data": {"db_password": "p@ss", "port": 5432}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/pg_timetable":
+			_, _ = w.Write([]byte(`{"data": {"db_password": "v1-pass"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	v := &Vault{Addr: srv.URL + "/", Token: "s.token", Path: "secret/data/pg_timetable"}
+	value, ok, err := v.Resolve("db_password")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "p@ss", value, "Key of version 2 engine secret should be resolved")
+	value, _, _ = v.Resolve("port")
+	assert.Equal(t, "5432", value, "Non-string value should be returned as JSON")
+	_, ok, err = v.Resolve("missing")
+	assert.NoError(t, err)
+	assert.False(t, ok, "Missing key should be unknown")
+
+	v.Path = "kv/pg_timetable"
+	value, _, _ = v.Resolve("db_password")
+	assert.Equal(t, "v1-pass", value, "Key of version 1 engine secret should be resolved")
+	v.Path = "kv/other"
+	_, ok, err = v.Resolve("db_password")
+	assert.NoError(t, err)
+	assert.False(t, ok, "Missing secret should be unknown")
+	v.Token = "wrong"
+	_, _, err = v.Resolve("db_password")
+	assert.EqualError(t, err, "Vault responded 403 Forbidden reading kv/other")
+}
+
+func TestAWSSecretsManager(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secretsmanager.GetSecretValue", r.Header.Get("X-Amz-Target"))
+		assert.Equal(t, "session", r.Header.Get("X-Amz-Security-Token"))
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"),
+			"AWS4-HMAC-SHA256 Credential=AKID/20240102/eu-central-1/secretsmanager/aws4_request, "+
+				"SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, Signature="))
+		var req struct{ SecretId string }
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		switch req.SecretId {
+		case "prod/db_password":
+			_, _ = w.Write([]byte(`{"Name": "prod/db_password", "SecretString": "s3cret"}`))
+		case "prod/binary":
+			_, _ = w.Write([]byte(`{"Name": "prod/binary", "SecretBinary": "AAE="}`))
+		case "prod/denied":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type": "AccessDeniedException", "message": "not authorized"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type": "ResourceNotFoundException", "message": "not found"}`))
+		}
+	}))
+	defer srv.Close()
+
+	a := &AWSSecretsManager{Region: "eu-central-1", Prefix: "prod/", AccessKeyID: "AKID", SecretAccessKey: "secret",
+		SessionToken: "session", Endpoint: srv.URL,
+		now: func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }}
+	value, ok, err := a.Resolve("db_password")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "s3cret", value)
+	_, ok, err = a.Resolve("missing")
+	assert.NoError(t, err)
+	assert.False(t, ok, "Missing secret should be unknown")
+	_, _, err = a.Resolve("denied")
+	assert.EqualError(t, err, "AWS Secrets Manager responded 400 Bad Request reading prod/denied: AccessDeniedException not authorized")
+	_, _, err = a.Resolve("binary")
+	assert.Error(t, err, "Binary secret should not be resolved")
+}
+
+func TestSignAWSRequest(t *testing.T) {
+	// examples of the Signature Version 4 documentation
+	ts := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	require.NoError(t, err)
+	signAWSRequest(req, nil, "service", "us-east-1", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "", ts)
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+	req, err = http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Version=2010-05-08&Action=ListUsers", nil)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, nil, "iam", "us-east-1", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "", ts)
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+		"SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		req.Header.Get("Authorization"), "Query parameters should be sorted")
+}
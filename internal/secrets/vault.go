@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Vault resolves secrets from one secret of the HashiCorp Vault key/value secrets engine, the secret name is
+// the key within it. Both versions of the engine are supported, e.g. the path secret/data/pg_timetable reads
+// the latest version of the pg_timetable secret of version 2 engine mounted at secret/
+type Vault struct {
+	Addr   string // address of the Vault server, e.g. https://vault:8200
+	Token  string // token sent in X-Vault-Token header
+	Path   string // path of the secret without /v1/ prefix
+	Client *http.Client
+}
+
+// Resolve reads the secret at Path and returns the value of the key, string values are returned as is and other
+// JSON values as JSON text. Missing secret or key is unknown
+func (v *Vault) Resolve(name string) (string, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(v.Addr, "/")+"/v1/"+strings.TrimPrefix(v.Path, "/"), nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	resp, err := defaultClient(v.Client).Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", false, nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return "", false, fmt.Errorf("Vault responded %s reading %s", resp.Status, v.Path)
+	}
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", false, fmt.Errorf("Cannot decode Vault secret %s: %v", v.Path, err)
+	}
+	data := secret.Data
+	if inner, ok := data["data"]; ok && data["metadata"] != nil {
+		// version 2 engine nests keys under data.data
+		data = nil
+		if err = json.Unmarshal(inner, &data); err != nil {
+			return "", false, fmt.Errorf("Cannot decode Vault secret %s: %v", v.Path, err)
+		}
+	}
+	raw, ok := data[name]
+	if !ok {
+		return "", false, nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s, true, nil
+	}
+	return string(raw), true, nil
+}
@@ -0,0 +1,184 @@
+package tasks
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+type archiveDirOpts struct {
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Exclude     []string `json:"exclude"` // glob patterns matched against relative paths and base names
+	Overwrite   bool     `json:"overwrite"`
+}
+
+// contextReader fails reading once the context is done, so copying of large files is interrupted
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// excluded returns true if the relative path or its base name matches any of the patterns
+func excluded(rel string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, filepath.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// taskArchiveDirectory writes the source directory as gzip compressed tar archive into a temporary file next
+// to the destination and renames it then, so the destination never contains a partial archive. Entries are
+// stored relative to the source keeping their modes and modification times, symbolic links are not followed
+func taskArchiveDirectory(ctx context.Context, paramValues string) (err error) {
+	var opts archiveDirOpts
+	if err = json.Unmarshal([]byte(paramValues), &opts); err != nil {
+		return err
+	}
+	if opts.Source == "" {
+		return errors.New("Source directory is not specified")
+	}
+	if opts.Destination == "" {
+		return errors.New("Destination is not specified")
+	}
+	for _, p := range opts.Exclude {
+		if _, err = filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("Invalid exclude pattern %q: %w", p, err)
+		}
+	}
+	src, err := os.Stat(opts.Source)
+	if err != nil {
+		return err
+	}
+	if !src.IsDir() {
+		return fmt.Errorf("Source %s is not a directory", opts.Source)
+	}
+	if _, err = os.Stat(opts.Destination); err == nil && !opts.Overwrite {
+		return fmt.Errorf("Destination %s already exists", opts.Destination)
+	}
+	out, err := ioutil.TempFile(filepath.Dir(opts.Destination), ".pg_timetable-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(out.Name())
+		}
+	}()
+	bw := bufio.NewWriter(out)
+	zw := gzip.NewWriter(bw)
+	tw := tar.NewWriter(zw)
+	files, err := writeTarEntries(ctx, tw, opts, out.Name())
+	if err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	fi, err := out.Stat()
+	if err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(out.Name(), opts.Destination); err != nil {
+		return err
+	}
+	pgengine.SetResultData(ctx, "files", files)
+	pgengine.SetResultData(ctx, "bytes", fi.Size())
+	pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Archived %d files of %s to %s, %d bytes",
+		files, opts.Source, opts.Destination, fi.Size()))
+	return nil
+}
+
+// writeTarEntries walks the source directory and writes its entries not excluded to the archive, the archive
+// being written is skipped if it's inside the source. Returns the number of regular files archived
+func writeTarEntries(ctx context.Context, tw *tar.Writer, opts archiveDirOpts, archive string) (files int, err error) {
+	archive, _ = filepath.Abs(archive)
+	err = filepath.Walk(opts.Source, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(opts.Source, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if abs, _ := filepath.Abs(path); abs == archive {
+			return nil
+		}
+		if excluded(rel, opts.Exclude) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		var link string
+		switch mode := fi.Mode(); {
+		case mode&os.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case !mode.IsDir() && !mode.IsRegular():
+			pgengine.LogToDBContext(ctx, "DEBUG", "Skipping special file ", path)
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err = io.Copy(tw, contextReader{ctx, f}); err != nil {
+			return err
+		}
+		files++
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,230 @@
+package tasks
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type backupTablesOpts struct {
+	DatabaseConnection int64    `json:"database_connection"` // configuration database is used if not set
+	Tables             []string `json:"tables"`
+	Schema             string   `json:"schema"` // all tables of the schema are backed up if tables are not listed
+	FilePath           string   `json:"filepath"`
+	Compress           bool     `json:"compress"`
+	Overwrite          bool     `json:"overwrite"`
+}
+
+// backupTable is the table resolved within the backup snapshot with its quoted name and columns
+type backupTable struct {
+	Name    string         `db:"name"`
+	Only    bool           `db:"only"` // inheritance children are backed up separately, partitioned tables are not
+	Columns pq.StringArray `db:"columns"`
+}
+
+// generated columns are skipped, since they can't be restored with COPY
+const sqlSelectBackupTables = `SELECT format('%I.%I', n.nspname, c.relname) AS name, c.relkind <> 'p' AS only,
+	ARRAY(SELECT quote_ident(column_name) FROM information_schema.columns
+		WHERE table_schema = n.nspname AND table_name = c.relname AND is_generated = 'NEVER'
+		ORDER BY ordinal_position) AS columns
+FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace`
+
+// copyTextEscaper escapes column values for COPY text format
+var copyTextEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// taskBackupTables writes the data of the tables as COPY statements restorable with psql, like a data only
+// pg_dump does, without calling pg_dump. All tables are read within one read-only serializable deferrable
+// transaction, so the backup is consistent and never fails with serialization errors. The file is written under
+// a temporary name next to the destination and renamed only on success, so no partial backup is left
+func taskBackupTables(ctx context.Context, paramValues string) (err error) {
+	var opts backupTablesOpts
+	if err = json.Unmarshal([]byte(paramValues), &opts); err != nil {
+		return err
+	}
+	switch {
+	case len(opts.Tables) == 0 && opts.Schema == "":
+		return errors.New("Tables or schema to back up are not specified")
+	case len(opts.Tables) > 0 && opts.Schema != "":
+		return errors.New("Either tables or schema must be specified, not both")
+	case opts.FilePath == "":
+		return errors.New("File to back up into is not specified")
+	}
+	if _, err = os.Stat(opts.FilePath); err == nil && !opts.Overwrite {
+		return fmt.Errorf("File %s already exists", opts.FilePath)
+	}
+	source, db := "configuration database", pgengine.ConfigDb()
+	if opts.DatabaseConnection != 0 {
+		var release func(error)
+		if db, release, err = pgengine.GetRemoteDB(ctx, opts.DatabaseConnection); err != nil {
+			return err
+		}
+		defer func() { release(err) }()
+		source = fmt.Sprintf("database connection %d", opts.DatabaseConnection)
+	}
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err = tx.ExecContext(ctx, "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE, READ ONLY, DEFERRABLE"); err != nil {
+		return err
+	}
+	tables, err := resolveBackupTables(ctx, tx, opts)
+	if err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(opts.FilePath), ".pg_timetable-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(out.Name())
+		}
+	}()
+	bw := bufio.NewWriter(out)
+	var w io.Writer = bw
+	var zw *gzip.Writer
+	if opts.Compress {
+		zw = gzip.NewWriter(bw)
+		w = zw
+	}
+	rows, err := writeBackup(ctx, tx, w, tables)
+	if err != nil {
+		return err
+	}
+	if zw != nil {
+		if err = zw.Close(); err != nil {
+			return err
+		}
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	fi, err := out.Stat()
+	if err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(out.Name(), opts.FilePath); err != nil {
+		return err
+	}
+	pgengine.SetResultData(ctx, "rows", rows)
+	pgengine.SetResultData(ctx, "bytes", fi.Size())
+	pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Backed up %d rows of %d tables from %s to %s, %d bytes",
+		rows, len(tables), source, opts.FilePath, fi.Size()))
+	return nil
+}
+
+// resolveBackupTables returns the listed tables in the given order or all tables of the schema sorted by name
+func resolveBackupTables(ctx context.Context, tx *sqlx.Tx, opts backupTablesOpts) ([]backupTable, error) {
+	var tables []backupTable
+	if opts.Schema != "" {
+		if err := tx.SelectContext(ctx, &tables, sqlSelectBackupTables+` WHERE n.nspname = $1 AND c.relkind = 'r'
+			ORDER BY c.relname`, opts.Schema); err != nil {
+			return nil, err
+		}
+		if len(tables) == 0 {
+			return nil, fmt.Errorf("Schema %s has no tables", opts.Schema)
+		}
+		return tables, nil
+	}
+	for _, name := range opts.Tables {
+		var t backupTable
+		err := tx.GetContext(ctx, &t, sqlSelectBackupTables+` WHERE c.oid = $1 :: regclass AND c.relkind IN ('r', 'p')`, name)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%s is not a table", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+// writeBackup writes every table as COPY statement followed by its rows in COPY text format, values are selected
+// as text, so they are written exactly as COPY would write them. Returns the number of rows written
+func writeBackup(ctx context.Context, tx *sqlx.Tx, w io.Writer, tables []backupTable) (int64, error) {
+	var total int64
+	if _, err := io.WriteString(w, "-- pg_timetable backup, restore with psql\nSET client_encoding = 'UTF8';\n"); err != nil {
+		return 0, err
+	}
+	for _, t := range tables {
+		columns, values := "", make([]string, len(t.Columns))
+		if len(t.Columns) > 0 {
+			columns = " (" + strings.Join(t.Columns, ", ") + ")"
+		}
+		for i, c := range t.Columns {
+			values[i] = c + " :: text"
+		}
+		only := ""
+		if t.Only {
+			only = "ONLY "
+		}
+		if _, err := fmt.Fprintf(w, "\nCOPY %s%s FROM stdin;\n", t.Name, columns); err != nil {
+			return total, err
+		}
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s%s", strings.Join(values, ", "), only, t.Name))
+		if err != nil {
+			return total, err
+		}
+		n, err := writeCopyRows(w, rows, len(t.Columns))
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if _, err = io.WriteString(w, "\\.\n"); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// writeCopyRows writes rows of text columns in COPY text format and closes them
+func writeCopyRows(w io.Writer, rows *sql.Rows, columns int) (n int64, err error) {
+	defer rows.Close()
+	values := make([]sql.NullString, columns)
+	dest := make([]interface{}, columns)
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	fields := make([]string, columns)
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		for i, v := range values {
+			fields[i] = copyText(v)
+		}
+		if _, err = io.WriteString(w, strings.Join(fields, "\t")+"\n"); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// copyText returns the value in COPY text format, NULL is written as \N
+func copyText(v sql.NullString) string {
+	if !v.Valid {
+		return `\N`
+	}
+	return copyTextEscaper.Replace(v.String)
+}
@@ -0,0 +1,230 @@
+package tasks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+)
+
+type cryptFileOpts struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Key         string `json:"key"` // name of the secret holding the key
+	Overwrite   bool   `json:"overwrite"`
+}
+
+// cryptMagic starts every file encrypted by EncryptFile task
+var cryptMagic = []byte("PGTTAES1")
+
+// cryptChunkSize is the size of plaintext chunks sealed separately, so files of any size are streamed
+const cryptChunkSize = 64 * 1024
+
+// cryptPrefixSize is the size of the random nonce prefix, the rest of the nonce is the chunk counter
+const cryptPrefixSize = 8
+
+// ErrDecryptFailed is returned if the file is not encrypted with the key, is corrupted or truncated
+var ErrDecryptFailed = errors.New("Decryption failed, wrong key or file is corrupted")
+
+// cryptKey returns AES-GCM cipher using the key stored in the named secret as hex or base64 encoded
+// 16, 24 or 32 bytes. Error messages never contain the key
+func cryptKey(secret string) (cipher.AEAD, error) {
+	if secret == "" {
+		return nil, errors.New("Key secret is not specified")
+	}
+	value, err := pgengine.GetSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	value = strings.TrimSpace(value)
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+		return nil, fmt.Errorf("Key of secret %s must be 16, 24 or 32 bytes encoded as hex or base64", secret)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk, the counter makes it unique within the file and the
+// random prefix across files
+func chunkNonce(prefix []byte, counter uint64) ([]byte, error) {
+	if counter > math.MaxUint32 {
+		return nil, errors.New("File is too large to be encrypted")
+	}
+	nonce := make([]byte, cryptPrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[cryptPrefixSize:], uint32(counter))
+	return nonce, nil
+}
+
+// chunkAD returns additional data of the chunk, the last chunk is marked to detect truncated files
+func chunkAD(prefix []byte, last bool) []byte {
+	ad := append(append([]byte{}, cryptMagic...), prefix...)
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// encryptStream writes the header and plaintext from r split into chunks sealed with AES-GCM to w
+func encryptStream(ctx context.Context, aead cipher.AEAD, r io.Reader, w io.Writer) error {
+	prefix := make([]byte, cryptPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	if _, err := w.Write(append(append([]byte{}, cryptMagic...), prefix...)); err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(r, cryptChunkSize+1)
+	buf := make([]byte, cryptChunkSize)
+	for counter := uint64(0); ; counter++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < cryptChunkSize
+		if !last {
+			_, err = br.Peek(1)
+			last = err == io.EOF
+		}
+		nonce, err := chunkNonce(prefix, counter)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(aead.Seal(nil, nonce, buf[:n], chunkAD(prefix, last))); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptStream verifies and opens chunks written by encryptStream from r and writes plaintext to w. Nothing
+// after the last chunk is accepted, so a truncated or extended file fails
+func decryptStream(ctx context.Context, aead cipher.AEAD, r io.Reader, w io.Writer) error {
+	header := make([]byte, len(cryptMagic)+cryptPrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header[:len(cryptMagic)], cryptMagic) {
+		return errors.New("File is not encrypted by EncryptFile task")
+	}
+	prefix := header[len(cryptMagic):]
+	sealedSize := cryptChunkSize + aead.Overhead()
+	br := bufio.NewReaderSize(r, sealedSize+1)
+	buf := make([]byte, sealedSize)
+	for counter := uint64(0); ; counter++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < sealedSize
+		if !last {
+			_, err = br.Peek(1)
+			last = err == io.EOF
+		}
+		nonce, err := chunkNonce(prefix, counter)
+		if err != nil {
+			return err
+		}
+		plain, err := aead.Open(buf[:0], nonce, buf[:n], chunkAD(prefix, last))
+		if err != nil {
+			return ErrDecryptFailed
+		}
+		if _, err = w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// cryptFile streams the source through transform into a temporary file next to the destination and renames it
+// then, so the destination never contains partially written or unverified data
+func cryptFile(ctx context.Context, paramValues string, action string,
+	transform func(context.Context, cipher.AEAD, io.Reader, io.Writer) error) (err error) {
+	var opts cryptFileOpts
+	if err = json.Unmarshal([]byte(paramValues), &opts); err != nil {
+		return err
+	}
+	if opts.Source == "" {
+		return errors.New("Source file is not specified")
+	}
+	if opts.Destination == "" {
+		return errors.New("Destination is not specified")
+	}
+	aead, err := cryptKey(opts.Key)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(opts.Destination); err == nil && !opts.Overwrite {
+		return fmt.Errorf("Destination %s already exists", opts.Destination)
+	}
+	in, err := os.Open(opts.Source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(opts.Destination), ".pg_timetable-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(out.Name())
+		}
+	}()
+	bw := bufio.NewWriter(out)
+	if err = transform(ctx, aead, in, bw); err != nil {
+		return err
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(out.Name(), opts.Destination); err != nil {
+		return err
+	}
+	pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("%s %s to %s", action, opts.Source, opts.Destination))
+	return nil
+}
+
+// taskEncryptFile encrypts the source file with AES-GCM using the key from the secret
+func taskEncryptFile(ctx context.Context, paramValues string) error {
+	return cryptFile(ctx, paramValues, "Encrypted", encryptStream)
+}
+
+// taskDecryptFile decrypts the file encrypted by taskEncryptFile verifying every chunk
+func taskDecryptFile(ctx context.Context, paramValues string) error {
+	return cryptFile(ctx, paramValues, "Decrypted", decryptStream)
+}
@@ -1,8 +1,293 @@
 package tasks
 
-import "github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
 
-func taskLog(val string) error {
-	pgengine.LogToDB("USER", val)
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type copyFromFileOpts struct {
+	DatabaseConnection int64    `json:"database_connection"` // configuration database is used if not set
+	Table              string   `json:"table"`
+	Columns            []string `json:"columns"`
+	Delimiter          string   `json:"delimiter"`
+	FilePath           string   `json:"filepath"`
+}
+
+type remoteSQLOpts struct {
+	DatabaseConnection int64  `json:"database_connection"`
+	SQL                string `json:"sql"`
+	Timeout            int    `json:"timeout"`
+}
+
+type waitForSQLOpts struct {
+	DatabaseConnection int64  `json:"database_connection"` // configuration database is used if not set
+	SQL                string `json:"sql"`
+	Interval           int    `json:"interval"`
+	Timeout            int    `json:"timeout"`
+}
+
+// defaultWaitInterval is the poll interval in seconds of WaitForSQL task if not specified
+const defaultWaitInterval = 10
+
+func taskLog(ctx context.Context, val string) error {
+	pgengine.LogToDBContext(ctx, "USER", val)
+	return nil
+}
+
+func taskCopyFromFile(ctx context.Context, paramValues string) error {
+	var opts copyFromFileOpts
+	if err := json.Unmarshal([]byte(paramValues), &opts); err != nil {
+		return err
+	}
+	if opts.Table == "" {
+		return errors.New("Table to copy into is not specified")
+	}
+	if opts.FilePath == "" {
+		return errors.New("File to copy from is not specified")
+	}
+	delimiter := ','
+	if opts.Delimiter != "" {
+		if utf8.RuneCountInString(opts.Delimiter) != 1 {
+			return errors.New("Delimiter must be a single character")
+		}
+		delimiter, _ = utf8.DecodeRuneInString(opts.Delimiter)
+	}
+	f, err := os.Open(opts.FilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comma = delimiter
+	rows, err := copyFromReader(ctx, r, opts.DatabaseConnection, opts.Table, opts.Columns)
+	if err != nil {
+		return err
+	}
+	pgengine.SetResultData(ctx, "rows", rows)
+	pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Loaded %d rows from %s into %s", rows, opts.FilePath, opts.Table))
 	return nil
 }
+
+func taskRemoteSQL(ctx context.Context, paramValues string) error {
+	var opts remoteSQLOpts
+	if err := json.Unmarshal([]byte(paramValues), &opts); err != nil {
+		return err
+	}
+	if opts.DatabaseConnection == 0 {
+		return errors.New("Database connection is not specified")
+	}
+	if strings.TrimSpace(opts.SQL) == "" {
+		return errors.New("SQL to execute is not specified")
+	}
+	if opts.Timeout < 0 {
+		return errors.New("Timeout must not be negative")
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(opts.Timeout)*time.Second)
+		defer cancel()
+	}
+	var rows int64
+	err := pgengine.RetryTransient(ctx, "remote SQL", func() (err error) {
+		rows, err = execRemoteSQL(ctx, opts.DatabaseConnection, opts.SQL)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	pgengine.SetResultData(ctx, "rows_affected", rows)
+	pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Remote SQL on database connection %d affected %d rows", opts.DatabaseConnection, rows))
+	return nil
+}
+
+func taskWaitForSQL(ctx context.Context, paramValues string) error {
+	var opts waitForSQLOpts
+	if err := json.Unmarshal([]byte(paramValues), &opts); err != nil {
+		return err
+	}
+	if strings.TrimSpace(opts.SQL) == "" {
+		return errors.New("SQL to wait for is not specified")
+	}
+	if opts.Interval < 0 || opts.Timeout < 0 {
+		return errors.New("Interval and timeout must not be negative")
+	}
+	if opts.Interval == 0 {
+		opts.Interval = defaultWaitInterval
+	}
+	check := func(ctx context.Context) (met bool, err error) {
+		err = pgengine.RetryTransient(ctx, "wait for SQL", func() (err error) {
+			met, err = evalSQLCondition(ctx, opts.DatabaseConnection, opts.SQL)
+			return err
+		})
+		return met, err
+	}
+	interval, timeout := time.Duration(opts.Interval)*time.Second, time.Duration(opts.Timeout)*time.Second
+	polls, err := pollCondition(ctx, interval, timeout, check)
+	if err != nil {
+		return err
+	}
+	pgengine.SetResultData(ctx, "polls", polls)
+	pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Condition met after %d poll(s)", polls))
+	return nil
+}
+
+// pollCondition calls check every interval until it returns true, fails or timeout is over, a timeout of 0 means
+// waiting until the context is done. Returns the number of checks made
+func pollCondition(ctx context.Context, interval time.Duration, timeout time.Duration,
+	check func(context.Context) (bool, error)) (int, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for polls := 1; ; polls++ {
+		met, err := check(ctx)
+		switch {
+		case met:
+			return polls, nil
+		case err != nil && ctx.Err() == nil:
+			return polls, err
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded && timeout > 0 {
+				return polls, fmt.Errorf("Condition not met within %v after %d poll(s)", timeout, polls)
+			}
+			return polls, ctx.Err()
+		}
+	}
+}
+
+// evalSQLCondition returns true if the first column of the first row returned by the query is true, the query
+// is executed in a read-only transaction against the remote database or the configuration database if 0
+func evalSQLCondition(ctx context.Context, databaseConnection int64, query string) (met bool, err error) {
+	db := pgengine.ConfigDb()
+	if databaseConnection != 0 {
+		var release func(error)
+		if db, release, err = pgengine.GetRemoteDB(ctx, databaseConnection); err != nil {
+			return false, err
+		}
+		defer func() { release(err) }()
+	}
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var result sql.NullBool
+	if err = tx.GetContext(ctx, &result, query); err == sql.ErrNoRows {
+		return false, nil
+	}
+	return result.Valid && result.Bool, err
+}
+
+// execRemoteSQL executes statements against the remote database in a separate transaction
+func execRemoteSQL(ctx context.Context, databaseConnection int64, script string) (rows int64, err error) {
+	db, release, err := pgengine.GetRemoteDB(ctx, databaseConnection)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { release(err) }()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, script)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if rows, err = res.RowsAffected(); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if pgengine.DryRun {
+		pgengine.LogToDBContext(ctx, "LOG", "Dry run, rolling back remote SQL transaction instead of commit")
+		return rows, tx.Rollback()
+	}
+	return rows, tx.Commit()
+}
+
+// copyFromReader streams records into the table using COPY protocol in a separate transaction
+func copyFromReader(ctx context.Context, r *csv.Reader, databaseConnection int64, table string, columns []string) (rows int64, err error) {
+	var copyStmt string
+	if i := strings.Index(table, "."); i > 0 {
+		copyStmt = pq.CopyInSchema(table[:i], table[i+1:], columns...)
+	} else {
+		copyStmt = pq.CopyIn(table, columns...)
+	}
+	var tx *sqlx.Tx
+	if databaseConnection == 0 {
+		tx = pgengine.StartTransaction()
+	} else {
+		var db *sqlx.DB
+		var release func(error)
+		if db, release, err = pgengine.GetRemoteDB(ctx, databaseConnection); err != nil {
+			return 0, err
+		}
+		defer func() { release(err) }()
+		if tx, err = db.BeginTxx(ctx, nil); err != nil {
+			return 0, err
+		}
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		if pgengine.DryRun {
+			pgengine.LogToDBContext(ctx, "LOG", "Dry run, rolling back copied rows instead of commit")
+			err = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	stmt, err := tx.Prepare(copyStmt)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		if err = ctx.Err(); err != nil {
+			_ = stmt.Close()
+			return 0, err
+		}
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = stmt.Close()
+			return 0, err
+		}
+		values := make([]interface{}, len(record))
+		for i, v := range record {
+			values[i] = v
+		}
+		if _, err = stmt.Exec(values...); err != nil {
+			_ = stmt.Close()
+			return 0, err
+		}
+		rows++
+	}
+	if _, err = stmt.Exec(); err != nil {
+		_ = stmt.Close()
+		return 0, err
+	}
+	return rows, stmt.Close()
+}
@@ -0,0 +1,155 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
+	"github.com/cybertec-postgresql/pg_timetable/internal/tracing"
+)
+
+type downloadFileOpts struct {
+	URL        string            `json:"url"`
+	Path       string            `json:"path"`
+	Username   string            `json:"username"`
+	Password   string            `json:"password"`
+	Headers    map[string]string `json:"headers"`
+	Timeout    int               `json:"timeout"`
+	Checksum   string            `json:"checksum"`
+	CreateDirs bool              `json:"createdirs"`
+}
+
+// checksumHashes maps algorithms allowed in the checksum parameter with hash constructors
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// httpClient is used by DownloadFile task to send requests
+var httpClient = http.DefaultClient
+
+// parseChecksum splits checksum of the form "algorithm:hex digest" into the hash and the expected digest
+func parseChecksum(checksum string) (hash.Hash, []byte, error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("Checksum %s should be in the form algorithm:digest", checksum)
+	}
+	newHash, ok := checksumHashes[strings.ToLower(parts[0])]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unknown checksum algorithm: %s", parts[0])
+	}
+	sum, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("Checksum digest is not hexadecimal: %v", err)
+	}
+	return newHash(), sum, nil
+}
+
+// taskDownloadToFile downloads the url to the local path. The response body is streamed into a temporary file
+// next to the path and renamed when the download is complete and the checksum verified, so the path never
+// contains a partial file
+func taskDownloadToFile(ctx context.Context, paramValues string) (err error) {
+	var opts downloadFileOpts
+	if err = json.Unmarshal([]byte(paramValues), &opts); err != nil {
+		return err
+	}
+	if opts.URL == "" {
+		return errors.New("URL to download is not specified")
+	}
+	if opts.Path == "" {
+		return errors.New("Destination path is not specified")
+	}
+	var h hash.Hash
+	var sum []byte
+	if opts.Checksum != "" {
+		if h, sum, err = parseChecksum(opts.Checksum); err != nil {
+			return err
+		}
+	}
+	if opts.CreateDirs {
+		if err = os.MkdirAll(filepath.Dir(opts.Path), 0755); err != nil {
+			return err
+		}
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(opts.Timeout)*time.Second)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.URL, nil)
+	if err != nil {
+		return err
+	}
+	tracing.Inject(ctx, req.Header)
+	for name, value := range opts.Headers {
+		req.Header.Set(name, value)
+	}
+	if opts.Username != "" || opts.Password != "" {
+		req.SetBasicAuth(opts.Username, opts.Password)
+	}
+	target := *req.URL
+	target.User = nil // credentials of the url are not logged
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Download of %s failed: %s", target.String(), resp.Status)
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(opts.Path), ".pg_timetable-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(out.Name())
+		}
+	}()
+	var w io.Writer = out
+	if h != nil {
+		w = io.MultiWriter(out, h)
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return err
+	}
+	if h != nil {
+		if actual := h.Sum(nil); !bytes.Equal(actual, sum) {
+			return fmt.Errorf("Checksum mismatch of %s: expected %x, got %x", target.String(), sum, actual)
+		}
+	}
+	if err = out.Chmod(0644); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(out.Name(), opts.Path); err != nil {
+		return err
+	}
+	pgengine.SetResultData(ctx, "status_code", resp.StatusCode)
+	pgengine.SetResultData(ctx, "bytes", n)
+	pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Downloaded %s to %s (%d bytes)", target.String(), opts.Path, n))
+	return nil
+}
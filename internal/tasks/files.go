@@ -1,10 +1,15 @@
 package tasks
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/cavaliercoder/grab"
 	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
@@ -16,9 +21,17 @@ type downloadOpts struct {
 	DestPath   string   `json:"destpath"`
 }
 
-var downloadUrls func(urls []string, dest string, workers int) error
+type fileArchiveOpts struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Compress    bool   `json:"compress"`
+	Copy        bool   `json:"copy"`
+	Overwrite   bool   `json:"overwrite"`
+}
+
+var downloadUrls func(ctx context.Context, urls []string, dest string, workers int) error
 
-func taskDownloadFile(paramValues string) error {
+func taskDownloadFile(ctx context.Context, paramValues string) error {
 	var opts downloadOpts
 	if err := json.Unmarshal([]byte(paramValues), &opts); err != nil {
 		return err
@@ -29,11 +42,112 @@ func taskDownloadFile(paramValues string) error {
 	if _, err := os.Stat(opts.DestPath); err != nil {
 		return err
 	}
-	return downloadUrls(opts.FileUrls, opts.DestPath, opts.WorkersNum)
+	return downloadUrls(ctx, opts.FileUrls, opts.DestPath, opts.WorkersNum)
+}
+
+// taskFileArchive moves or copies the file to the destination compressing it with gzip if asked.
+// If the destination is a directory, the file keeps its name with .gz suffix added for compressed one
+func taskFileArchive(ctx context.Context, paramValues string) error {
+	var opts fileArchiveOpts
+	if err := json.Unmarshal([]byte(paramValues), &opts); err != nil {
+		return err
+	}
+	if opts.Source == "" {
+		return errors.New("Source file is not specified")
+	}
+	if opts.Destination == "" {
+		return errors.New("Destination is not specified")
+	}
+	src, err := os.Stat(opts.Source)
+	if err != nil {
+		return err
+	}
+	if !src.Mode().IsRegular() {
+		return fmt.Errorf("Source %s is not a regular file", opts.Source)
+	}
+	dest := opts.Destination
+	if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+		dest = filepath.Join(dest, filepath.Base(opts.Source))
+		if opts.Compress {
+			dest += ".gz"
+		}
+	}
+	if _, err := os.Stat(dest); err == nil && !opts.Overwrite {
+		return fmt.Errorf("Destination %s already exists", dest)
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	action := "Moved"
+	switch {
+	case opts.Compress || opts.Copy:
+		err = copyFile(opts.Source, dest, src, opts.Compress)
+		if err == nil && !opts.Copy {
+			err = os.Remove(opts.Source)
+		}
+		if opts.Compress {
+			action = "Compressed"
+		} else {
+			action = "Copied"
+		}
+	default:
+		// rename fails across devices, fall back to copy and delete then
+		if err = os.Rename(opts.Source, dest); err != nil {
+			pgengine.LogToDBContext(ctx, "DEBUG", "Cannot rename file, copying instead: ", err)
+			if err = copyFile(opts.Source, dest, src, false); err == nil {
+				err = os.Remove(opts.Source)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("%s %s to %s", action, opts.Source, dest))
+	return nil
+}
+
+// copyFile copies the source file into a temporary file next to the destination and renames it then,
+// so the destination never contains partially written file
+func copyFile(source string, dest string, src os.FileInfo, compress bool) (err error) {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(dest), ".pg_timetable-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(out.Name())
+		}
+	}()
+	if compress {
+		zw := gzip.NewWriter(out)
+		zw.Name = src.Name()
+		zw.ModTime = src.ModTime()
+		if _, err = io.Copy(zw, in); err != nil {
+			return err
+		}
+		if err = zw.Close(); err != nil {
+			return err
+		}
+	} else if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	if err = out.Chmod(src.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dest)
 }
 
 // downloadUrls function implemented using grab library
-func grabDownloadUrls(urls []string, dest string, workers int) error {
+func grabDownloadUrls(ctx context.Context, urls []string, dest string, workers int) error {
 	// create multiple download requests
 	reqs := make([]*grab.Request, 0)
 	for _, url := range urls {
@@ -41,7 +155,7 @@ func grabDownloadUrls(urls []string, dest string, workers int) error {
 		if err != nil {
 			return err
 		}
-		reqs = append(reqs, req)
+		reqs = append(reqs, req.WithContext(ctx))
 	}
 	// start downloads with workers, if WorkersNum <= 0, then worker for each file
 	client := grab.NewClient()
@@ -52,7 +166,7 @@ func grabDownloadUrls(urls []string, dest string, workers int) error {
 		if err := resp.Err(); err != nil {
 			errstrings = append(errstrings, err.Error())
 		} else {
-			pgengine.LogToDB("LOG", fmt.Sprintf("Downloaded %s to %s", resp.Request.URL(), resp.Filename))
+			pgengine.LogToDBContext(ctx, "LOG", fmt.Sprintf("Downloaded %s to %s", resp.Request.URL(), resp.Filename))
 		}
 	}
 	if len(errstrings) > 0 {
@@ -1,6 +1,7 @@
 package tasks
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -25,7 +26,7 @@ type emailConn struct {
 
 var sendMail func(m emailConn) error
 
-func taskSendMail(paramValues string) error {
+func taskSendMail(ctx context.Context, paramValues string) error {
 	var conn emailConn
 	if err := json.Unmarshal([]byte(paramValues), &conn); err != nil {
 		return err
@@ -1,47 +1,109 @@
 package tasks
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"strconv"
 	"time"
 
 	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
 )
 
-// Tasks maps builtin task names with event handlers
-var Tasks = map[string](func(string) error){
-	"NoOp":     taskNoOp,
-	"Sleep":    taskSleep,
-	"Log":      taskLog,
-	"SendMail": taskSendMail,
-	"Download": taskDownloadFile}
-
-// ExecuteTask executes built-in task depending on task name and returns err result
-func ExecuteTask(name string, paramValues []string) error {
-	pgengine.LogToDB("DEBUG", fmt.Sprintf("Executing builtin task %s with parameters %v", name, paramValues))
+// Tasks maps builtin task names with event handlers, handlers should stop when the context is done
+var Tasks = map[string](func(context.Context, string) error){
+	"NoOp":             taskNoOp,
+	"Sleep":            taskSleep,
+	"Log":              taskLog,
+	"SendMail":         taskSendMail,
+	"Download":         taskDownloadFile,
+	"DownloadFile":     taskDownloadToFile,
+	"CopyFromFile":     taskCopyFromFile,
+	"RemoteSQL":        taskRemoteSQL,
+	"FileArchive":      taskFileArchive,
+	"ArchiveDirectory": taskArchiveDirectory,
+	"EncryptFile":      taskEncryptFile,
+	"DecryptFile":      taskDecryptFile,
+	"WaitForSQL":       taskWaitForSQL,
+	"BackupTables":     taskBackupTables}
+
+// Names returns names of all registered built-in tasks
+func Names() []string {
+	names := make([]string, 0, len(Tasks))
+	for name := range Tasks {
+		names = append(names, name)
+	}
+	return names
+}
+
+// ExecuteTask executes built-in task depending on task name and returns the result and err. Handlers report
+// structured data with pgengine.SetResultData, a value reported for a later parameter value replaces the earlier
+// one. Named parameters are merged into every JSON object parameter, see mergeNamedParams
+func ExecuteTask(ctx context.Context, name string, paramValues []string,
+	namedParams map[string]json.RawMessage) (result pgengine.TaskResult, err error) {
+	pgengine.LogToDBContext(ctx, "DEBUG", fmt.Sprintf("Executing builtin task %s with parameters %v", name, paramValues))
 	if len(paramValues) == 0 {
 		paramValues = append(paramValues, "")
 	}
+	task, ok := Tasks[name]
+	if !ok {
+		return result, fmt.Errorf("Unknown built-in task: %s", name)
+	}
+	ctx = pgengine.WithTaskResult(ctx, &result)
 	for _, val := range paramValues {
-		err := Tasks[name](val)
-		if err != nil {
-			return err
+		if err = ctx.Err(); err != nil {
+			return result, err
+		}
+		if val, err = mergeNamedParams(val, namedParams); err != nil {
+			return result, err
+		}
+		if err = task(ctx, val); err != nil {
+			return result, err
 		}
 	}
-	return nil
+	return result, nil
 }
 
-func taskNoOp(val string) error {
-	pgengine.LogToDB("DEBUG", "NoOp task called with value: ", val)
+// mergeNamedParams adds named parameters to the JSON object parameter value as its keys. Keys already present
+// in the value take precedence over named parameters. Empty value becomes the object of named parameters,
+// values other than JSON object are returned unchanged
+func mergeNamedParams(val string, namedParams map[string]json.RawMessage) (string, error) {
+	if len(namedParams) == 0 {
+		return val, nil
+	}
+	obj := make(map[string]json.RawMessage, len(namedParams))
+	if strings.TrimSpace(val) != "" {
+		if err := json.Unmarshal([]byte(val), &obj); err != nil || obj == nil {
+			return val, nil
+		}
+	}
+	for name, value := range namedParams {
+		if _, ok := obj[name]; !ok {
+			obj[name] = value
+		}
+	}
+	data, err := json.Marshal(obj)
+	return string(data), err
+}
+
+func taskNoOp(ctx context.Context, val string) error {
+	pgengine.LogToDBContext(ctx, "DEBUG", "NoOp task called with value: ", val)
 	return nil
 }
 
-func taskSleep(val string) (err error) {
+func taskSleep(ctx context.Context, val string) (err error) {
 	var d int
 	if d, err = strconv.Atoi(val); err != nil {
 		return err
 	}
-	pgengine.LogToDB("DEBUG", "Sleep task called for ", d, " seconds")
-	time.Sleep(time.Duration(d) * time.Second)
-	return nil
+	pgengine.LogToDBContext(ctx, "DEBUG", "Sleep task called for ", d, " seconds")
+	timer := time.NewTimer(time.Duration(d) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
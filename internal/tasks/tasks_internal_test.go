@@ -1,42 +1,396 @@
 package tasks
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+var ctx = context.Background()
+
 func TestDownloadFile(t *testing.T) {
-	downloadUrls = func(urls []string, dest string, workers int) error { return nil }
-	assert.EqualError(t, taskDownloadFile(""), `unexpected end of JSON input`,
+	downloadUrls = func(ctx context.Context, urls []string, dest string, workers int) error { return nil }
+	assert.EqualError(t, taskDownloadFile(ctx, ""), `unexpected end of JSON input`,
 		"Download with empty param should fail")
-	assert.EqualError(t, taskDownloadFile(`{"workersnum": 0, "fileurls": [] }`),
+	assert.EqualError(t, taskDownloadFile(ctx, `{"workersnum": 0, "fileurls": [] }`),
 		"Files to download are not specified", "Download with empty files should fail")
-	assert.Error(t, taskDownloadFile(`{"workersnum": 0, "fileurls": ["http://foo.bar"], "destpath": "non-existent" }`),
+	assert.Error(t, taskDownloadFile(ctx, `{"workersnum": 0, "fileurls": ["http://foo.bar"], "destpath": "non-existent" }`),
 		"Downlod with non-existent directory or insufficient rights should fail")
-	assert.NoError(t, taskDownloadFile(`{"workersnum": 0, "fileurls": ["http://foo.bar"], "destpath": "." }`),
+	assert.NoError(t, taskDownloadFile(ctx, `{"workersnum": 0, "fileurls": ["http://foo.bar"], "destpath": "." }`),
 		"Downlod with correct json input should succeed")
 }
 
+func TestDownloadToFile(t *testing.T) {
+	const body = "id;name\n1;Wien\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pwd, ok := r.BasicAuth(); ok && (user != "user" || pwd != "pwd") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-Token") == "bad" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/broken" {
+			w.Header().Set("Content-Length", "100")
+			_, _ = w.Write([]byte(body))
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "download")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "in", "orte.csv")
+	sum := sha256.Sum256([]byte(body))
+	params := func(extra string) string {
+		return fmt.Sprintf(`{"url": "%s/orte.csv", "path": %q %s}`, srv.URL, dest, extra)
+	}
+
+	assert.EqualError(t, taskDownloadToFile(ctx, `{"path": "foo"}`), "URL to download is not specified")
+	assert.EqualError(t, taskDownloadToFile(ctx, `{"url": "http://foo.bar"}`), "Destination path is not specified")
+	assert.EqualError(t, taskDownloadToFile(ctx, params(`, "checksum": "crc:00"`)), "Unknown checksum algorithm: crc")
+	assert.Error(t, taskDownloadToFile(ctx, params("")), "Download should fail without parent directory")
+
+	var result pgengine.TaskResult
+	assert.NoError(t, taskDownloadToFile(pgengine.WithTaskResult(ctx, &result), params(fmt.Sprintf(`, "createdirs": true, "timeout": 5,
+		"username": "user", "password": "pwd", "headers": {"X-Token": "ok"}, "checksum": "sha256:%x"`, sum))))
+	assert.Equal(t, map[string]interface{}{"status_code": 200, "bytes": int64(len(body))}, result.Data,
+		"Status code and size should be reported as result data")
+	data, err := ioutil.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(data), "Downloaded file should contain response body")
+
+	require.NoError(t, os.Remove(dest))
+	assert.EqualError(t, taskDownloadToFile(ctx, params(`, "headers": {"X-Token": "bad"}`)),
+		fmt.Sprintf("Download of %s/orte.csv failed: 403 Forbidden", srv.URL), "HTTP error status should fail")
+	assert.EqualError(t, taskDownloadToFile(ctx, params(`, "username": "user", "password": "wrong"`)),
+		fmt.Sprintf("Download of %s/orte.csv failed: 401 Unauthorized", srv.URL), "Wrong credentials should fail")
+	assert.Error(t, taskDownloadToFile(ctx, params(`, "checksum": "md5:00"`)), "Checksum mismatch should fail")
+	assert.Error(t, taskDownloadToFile(ctx, strings.Replace(params(""), "orte.csv\"", "broken\"", 1)),
+		"Incomplete response should fail")
+	files, err := ioutil.ReadDir(filepath.Dir(dest))
+	require.NoError(t, err)
+	assert.Empty(t, files, "Failed downloads should leave no files")
+}
+
 func TestTaskSendMail(t *testing.T) {
 	sendMail = func(m emailConn) error { return nil }
 	assert := assert.New(t)
-	assert.Error(taskSendMail(""), `unexpected end of JSON input`,
+	assert.Error(taskSendMail(ctx, ""), `unexpected end of JSON input`,
 		"Sending mail with empty param should fail")
-	assert.EqualError(taskSendMail(`{"ServerHost":""}`),
+	assert.EqualError(taskSendMail(ctx, `{"ServerHost":""}`),
 		"The IP address or hostname of the mail server not specified", "Sending mail without host/IP should fail")
-	assert.EqualError(taskSendMail(`{"ServerHost":"smtp.example.com","ServerPort":0}`),
+	assert.EqualError(taskSendMail(ctx, `{"ServerHost":"smtp.example.com","ServerPort":0}`),
 		"The port of the mail server not specified", "Sending mail without port should fail")
-	assert.EqualError(taskSendMail(`{"ServerHost":"smtp.example.com","ServerPort":587,"Username":""}`),
+	assert.EqualError(taskSendMail(ctx, `{"ServerHost":"smtp.example.com","ServerPort":587,"Username":""}`),
 		"The username used for authenticating on the mail server not specified", "Sending mail without valid user id should fail")
-	assert.EqualError(taskSendMail(`{"ServerHost":"smtp.example.com","ServerPort":587,"Username":"user","Password":""}`),
+	assert.EqualError(taskSendMail(ctx, `{"ServerHost":"smtp.example.com","ServerPort":587,"Username":"user","Password":""}`),
 		"The password used for authenticating on the mail server not specified", "Sending mail with invalid authentication should fail")
-	assert.EqualError(taskSendMail(`{"ServerHost":"smtp.example.com","ServerPort":587,"Username":"user","Password":"pwd","SenderAddr":""}`),
+	assert.EqualError(taskSendMail(ctx, `{"ServerHost":"smtp.example.com","ServerPort":587,"Username":"user","Password":"pwd","SenderAddr":""}`),
 		"Sender address not specified", "Sending mail without a valid sender address should fail")
-	assert.EqualError(taskSendMail(`{"ServerHost":"smtp.example.com","ServerPort":587,"Username":"user","Password":"pwd",
+	assert.EqualError(taskSendMail(ctx, `{"ServerHost":"smtp.example.com","ServerPort":587,"Username":"user","Password":"pwd",
 		"SenderAddr":"abc@example.com","ToAddr":[],"CcAddr":[],"BccAddr":[]}`),
 		"Recipient address not specified", "Sending mail without recipient should fail")
-	assert.NoError(taskSendMail(`{"ServerHost":"smtp.example.com","ServerPort":587,"Username":"user","Password":"pwd",
+	assert.NoError(taskSendMail(ctx, `{"ServerHost":"smtp.example.com","ServerPort":587,"Username":"user","Password":"pwd",
 		"SenderAddr":"abc@example.com","ToAddr":["to@example.com"],"CcAddr":["cc@example.com"],"BccAddr":["bcc@example.com"]}`),
 		"Sending email with required json input should succeed")
 }
+
+func TestExecuteTask(t *testing.T) {
+	_, err := ExecuteTask(ctx, "foo", []string{}, nil)
+	assert.EqualError(t, err, "Unknown built-in task: foo", "Executing unregistered built-in task should fail")
+	result, err := ExecuteTask(ctx, "NoOp", []string{}, nil)
+	assert.NoError(t, err, "NoOp task should succeed")
+	assert.Nil(t, result.Data, "NoOp task should report no data")
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = ExecuteTask(cancelled, "NoOp", []string{}, nil)
+	assert.Equal(t, context.Canceled, err, "Task should not start after cancel")
+	deadline, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = ExecuteTask(deadline, "Sleep", []string{"10"}, nil)
+	assert.Equal(t, context.DeadlineExceeded, err, "Sleep should stop at deadline")
+	assert.ElementsMatch(t, []string{"NoOp", "Sleep", "Log", "SendMail", "Download", "DownloadFile", "CopyFromFile", "RemoteSQL", "FileArchive",
+		"ArchiveDirectory", "EncryptFile", "DecryptFile", "WaitForSQL", "BackupTables"}, Names(),
+		"Names should list all registered built-in tasks")
+	Tasks["Report"] = func(ctx context.Context, val string) error {
+		pgengine.SetResultData(ctx, "value", val)
+		return nil
+	}
+	defer delete(Tasks, "Report")
+	result, err = ExecuteTask(ctx, "Report", []string{"1", "2"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"value": "2"}, result.Data, "Data of the last parameter value should be kept")
+}
+
+func TestMergeNamedParams(t *testing.T) {
+	named := map[string]json.RawMessage{"destpath": json.RawMessage(`"/tmp"`), "workersnum": json.RawMessage(`2`)}
+	val, err := mergeNamedParams(`{"fileurls": ["http://foo.bar"], "workersnum": 4}`, named)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"fileurls": ["http://foo.bar"], "workersnum": 4, "destpath": "/tmp"}`, val,
+		"Named parameters should be added, positional keys take precedence")
+	val, err = mergeNamedParams("", named)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"workersnum": 2, "destpath": "/tmp"}`, val, "Empty value should become named parameters object")
+	for _, v := range []string{"10", "null", `["a"]`, "plain text"} {
+		val, err = mergeNamedParams(v, named)
+		assert.NoError(t, err)
+		assert.Equal(t, v, val, "Non object value should be unchanged")
+	}
+	val, err = mergeNamedParams(`{"a": 1}`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a": 1}`, val, "Value should be unchanged without named parameters")
+}
+
+func TestCopyFromFile(t *testing.T) {
+	assert.EqualError(t, taskCopyFromFile(ctx, ""), `unexpected end of JSON input`,
+		"Copy with empty param should fail")
+	assert.EqualError(t, taskCopyFromFile(ctx, `{"filepath": "data.csv"}`),
+		"Table to copy into is not specified", "Copy without table should fail")
+	assert.EqualError(t, taskCopyFromFile(ctx, `{"table": "location"}`),
+		"File to copy from is not specified", "Copy without file should fail")
+	assert.EqualError(t, taskCopyFromFile(ctx, `{"table": "location", "filepath": "data.csv", "delimiter": ";;"}`),
+		"Delimiter must be a single character", "Copy with multi-character delimiter should fail")
+	assert.Error(t, taskCopyFromFile(ctx, `{"table": "location", "filepath": "non-existent.csv"}`),
+		"Copy from non-existent file should fail")
+}
+
+func TestRemoteSQL(t *testing.T) {
+	assert.EqualError(t, taskRemoteSQL(ctx, ""), `unexpected end of JSON input`,
+		"Remote SQL with empty param should fail")
+	assert.EqualError(t, taskRemoteSQL(ctx, `{"sql": "SELECT 1"}`),
+		"Database connection is not specified", "Remote SQL without connection should fail")
+	assert.EqualError(t, taskRemoteSQL(ctx, `{"database_connection": 1, "sql": " "}`),
+		"SQL to execute is not specified", "Remote SQL without statements should fail")
+	assert.EqualError(t, taskRemoteSQL(ctx, `{"database_connection": 1, "sql": "SELECT 1", "timeout": -1}`),
+		"Timeout must not be negative", "Remote SQL with negative timeout should fail")
+}
+
+func TestWaitForSQL(t *testing.T) {
+	assert.EqualError(t, taskWaitForSQL(ctx, ""), `unexpected end of JSON input`,
+		"Wait with empty param should fail")
+	assert.EqualError(t, taskWaitForSQL(ctx, `{"sql": " "}`),
+		"SQL to wait for is not specified", "Wait without query should fail")
+	assert.EqualError(t, taskWaitForSQL(ctx, `{"sql": "SELECT true", "interval": -1}`),
+		"Interval and timeout must not be negative", "Wait with negative interval should fail")
+
+	calls := 0
+	check := func(context.Context) (bool, error) {
+		calls++
+		return calls == 3, nil
+	}
+	polls, err := pollCondition(ctx, time.Millisecond, time.Second, check)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, polls, "Condition should be polled until met")
+
+	never := func(context.Context) (bool, error) { return false, nil }
+	_, err = pollCondition(ctx, time.Millisecond, 20*time.Millisecond, never)
+	assert.Error(t, err, "Condition not met within timeout should fail")
+	assert.True(t, strings.HasPrefix(err.Error(), "Condition not met within 20ms"), err.Error())
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = pollCondition(cancelled, time.Hour, 0, never)
+	assert.Equal(t, context.Canceled, err, "Polling should stop when context is done")
+
+	_, err = pollCondition(ctx, time.Millisecond, time.Second, func(context.Context) (bool, error) {
+		return false, errors.New("syntax error")
+	})
+	assert.EqualError(t, err, "syntax error", "Query error should fail immediately")
+}
+
+func TestFileArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "data.csv")
+	writeSource := func() { require.NoError(t, ioutil.WriteFile(source, []byte("1,foo\n"), 0600)) }
+	archive := func(opts string) error { return taskFileArchive(ctx, fmt.Sprintf(opts, source, dir)) }
+
+	assert.EqualError(t, taskFileArchive(ctx, `{"destination": "foo"}`), "Source file is not specified",
+		"Archive without source should fail")
+	assert.EqualError(t, taskFileArchive(ctx, `{"source": "foo"}`), "Destination is not specified",
+		"Archive without destination should fail")
+	assert.Error(t, taskFileArchive(ctx, `{"source": "non-existent.csv", "destination": "foo"}`),
+		"Archive of non-existent file should fail")
+
+	writeSource()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "done"), 0700))
+	assert.NoError(t, archive(`{"source": %q, "destination": "%s/done"}`), "Move into directory should succeed")
+	assert.FileExists(t, filepath.Join(dir, "done", "data.csv"))
+	_, err = os.Stat(source)
+	assert.True(t, os.IsNotExist(err), "Source should be removed after move")
+
+	writeSource()
+	assert.NoError(t, archive(`{"source": %q, "destination": "%s/done", "compress": true, "copy": true}`),
+		"Compressed copy should succeed")
+	assert.FileExists(t, source, "Source should be kept after copy")
+	f, err := os.Open(filepath.Join(dir, "done", "data.csv.gz"))
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, "1,foo\n", string(data), "Compressed file should contain source data")
+	assert.Equal(t, "data.csv", zr.Name, "Compressed file should keep source name")
+
+	assert.Error(t, archive(`{"source": %q, "destination": "%s/done"}`), "Existing destination should not be overwritten")
+	assert.FileExists(t, source, "Source should be kept if archive failed")
+	assert.NoError(t, archive(`{"source": %q, "destination": "%s/done", "overwrite": true}`),
+		"Existing destination should be overwritten if asked")
+	_, err = os.Stat(source)
+	assert.True(t, os.IsNotExist(err), "Source should be removed after move")
+}
+
+func TestArchiveDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(source, "sub", "cache"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "data.csv"), []byte("1,foo\n"), 0640))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "sub", "run.sh"), []byte("echo"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "sub", "x.tmp"), []byte("tmp"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "sub", "cache", "c"), []byte("c"), 0600))
+	dest := filepath.Join(dir, "src.tar.gz")
+	archive := func(opts string) error { return taskArchiveDirectory(ctx, fmt.Sprintf(opts, source, dest)) }
+
+	assert.EqualError(t, taskArchiveDirectory(ctx, `{"destination": "foo"}`), "Source directory is not specified")
+	assert.EqualError(t, taskArchiveDirectory(ctx, `{"source": "foo"}`), "Destination is not specified")
+	assert.Error(t, archive(`{"source": "%s/missing", "destination": %q}`), "Missing source should fail")
+	assert.Error(t, archive(`{"source": "%s/data.csv", "destination": %q}`), "File source should fail")
+	assert.Error(t, archive(`{"source": %q, "destination": %q, "exclude": ["["]}`), "Invalid pattern should fail")
+
+	assert.NoError(t, archive(`{"source": %q, "destination": %q, "exclude": ["*.tmp", "sub/cache"]}`))
+	f, err := os.Open(dest)
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	tr := tar.NewReader(zr)
+	modes := map[string]os.FileMode{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		modes[hdr.Name] = hdr.FileInfo().Mode().Perm()
+	}
+	assert.Equal(t, map[string]os.FileMode{"data.csv": 0640, "sub/": 0700, "sub/run.sh": 0750}, modes,
+		"Archive should contain not excluded entries with their modes")
+
+	assert.Error(t, archive(`{"source": %q, "destination": %q}`), "Existing destination should not be overwritten")
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(t, context.Canceled, taskArchiveDirectory(cancelled, fmt.Sprintf(`{"source": %q, "destination": %q, "overwrite": true}`,
+		source, dest)), "Cancelled archive should fail")
+	assert.Error(t, archive(`{"source": %q, "destination": "%s/missing/dir.tar.gz"}`), "Write failure should fail")
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "Partial archives should be removed")
+}
+
+func TestBackupTables(t *testing.T) {
+	assert.EqualError(t, taskBackupTables(ctx, ""), `unexpected end of JSON input`,
+		"Backup with empty param should fail")
+	assert.EqualError(t, taskBackupTables(ctx, `{"filepath": "backup.sql"}`),
+		"Tables or schema to back up are not specified", "Backup without tables should fail")
+	assert.EqualError(t, taskBackupTables(ctx, `{"tables": ["t"], "schema": "public", "filepath": "backup.sql"}`),
+		"Either tables or schema must be specified, not both", "Backup with tables and schema should fail")
+	assert.EqualError(t, taskBackupTables(ctx, `{"schema": "public"}`),
+		"File to back up into is not specified", "Backup without file should fail")
+	f, err := ioutil.TempFile("", "backup")
+	require.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	assert.EqualError(t, taskBackupTables(ctx, fmt.Sprintf(`{"schema": "public", "filepath": %q}`, f.Name())),
+		fmt.Sprintf("File %s already exists", f.Name()), "Existing file should not be overwritten")
+
+	assert.Equal(t, `\N`, copyText(sql.NullString{}), "NULL should be written as \\N")
+	assert.Equal(t, `a\\b\tc\nd\re`, copyText(sql.NullString{String: "a\\b\tc\nd\re", Valid: true}),
+		"Special characters should be escaped")
+}
+
+func TestCryptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crypt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("PGTT_SECRET_FILE_KEY", strings.Repeat("0123456789abcdef", 4))
+	os.Setenv("PGTT_SECRET_OTHER_KEY", base64.StdEncoding.EncodeToString([]byte("another 16b key!")))
+	os.Setenv("PGTT_SECRET_BAD_KEY", "short")
+	defer func() {
+		for _, name := range []string{"FILE_KEY", "OTHER_KEY", "BAD_KEY"} {
+			os.Unsetenv("PGTT_SECRET_" + name)
+		}
+	}()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	params := func(src, dest, key string) string {
+		return fmt.Sprintf(`{"source": %q, "destination": %q, "key": %q}`, path(src), path(dest), key)
+	}
+
+	assert.EqualError(t, taskEncryptFile(ctx, `{"destination": "foo", "key": "FILE_KEY"}`), "Source file is not specified")
+	assert.EqualError(t, taskEncryptFile(ctx, `{"source": "foo", "destination": "bar"}`), "Key secret is not specified")
+	assert.EqualError(t, taskEncryptFile(ctx, params("plain", "enc", "BAD_KEY")),
+		"Key of secret BAD_KEY must be 16, 24 or 32 bytes encoded as hex or base64", "Key should not be reported")
+
+	for _, size := range []int{0, 100, cryptChunkSize, 2*cryptChunkSize + 7} {
+		data := make([]byte, size)
+		_, _ = rand.Read(data)
+		require.NoError(t, ioutil.WriteFile(path("plain"), data, 0600))
+		require.NoError(t, taskEncryptFile(ctx, params("plain", "enc", "FILE_KEY")), "Encryption should succeed")
+		encrypted, err := ioutil.ReadFile(path("enc"))
+		require.NoError(t, err)
+		assert.False(t, size > 0 && bytes.Contains(encrypted, data), "Encrypted file should not contain plaintext")
+		require.NoError(t, taskDecryptFile(ctx, params("enc", "dec", "FILE_KEY")), "Decryption should succeed")
+		decrypted, err := ioutil.ReadFile(path("dec"))
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, decrypted), "Decrypted file of %d bytes should match the source", size)
+		assert.EqualError(t, taskDecryptFile(ctx, params("enc", "dec", "FILE_KEY")),
+			fmt.Sprintf("Destination %s already exists", path("dec")))
+		require.NoError(t, os.Remove(path("dec")))
+
+		assert.Equal(t, ErrDecryptFailed, taskDecryptFile(ctx, params("enc", "dec", "OTHER_KEY")), "Wrong key should fail")
+		if size > 0 {
+			require.NoError(t, ioutil.WriteFile(path("trunc"), encrypted[:len(encrypted)-1], 0600))
+			assert.Equal(t, ErrDecryptFailed, taskDecryptFile(ctx, params("trunc", "dec", "FILE_KEY")), "Truncated file should fail")
+		}
+		if size > cryptChunkSize {
+			cut := len(cryptMagic) + cryptPrefixSize + cryptChunkSize + 16
+			require.NoError(t, ioutil.WriteFile(path("trunc"), encrypted[:cut], 0600))
+			assert.Equal(t, ErrDecryptFailed, taskDecryptFile(ctx, params("trunc", "dec", "FILE_KEY")),
+				"File truncated at chunk boundary should fail")
+		}
+		_, err = os.Stat(path("dec"))
+		assert.True(t, os.IsNotExist(err), "Failed decryption should leave no destination")
+		require.NoError(t, os.Remove(path("enc")))
+	}
+	assert.EqualError(t, taskDecryptFile(ctx, params("plain", "dec", "FILE_KEY")), "File is not encrypted by EncryptFile task")
+	files, err := filepath.Glob(path(".pg_timetable-*"))
+	require.NoError(t, err)
+	assert.Empty(t, files, "Temporary files should be removed")
+}
@@ -0,0 +1,225 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exportInterval specifies how often queued spans are exported
+const exportInterval = 5 * time.Second
+
+// maxQueuedSpans limits spans waiting for export, spans ended while the queue is full are dropped
+const maxQueuedSpans = 2048
+
+// maxBatchSpans limits spans posted in one request
+const maxBatchSpans = 512
+
+var exporter = struct {
+	sync.Mutex
+	url     string
+	service string
+	client  *http.Client
+	queue   []*Span
+	dropped int64
+	onError func(error)
+}{client: &http.Client{Timeout: 10 * time.Second}}
+
+// Enable starts recording spans exported to the OTLP/HTTP endpoint, e.g. http://localhost:4318, spans are posted
+// to its /v1/traces path with the resource service.name. Export failures are passed to onError if it's not nil.
+// Empty endpoint disables tracing again
+func Enable(endpoint, service string, onError func(error)) {
+	exporter.Lock()
+	defer exporter.Unlock()
+	exporter.url = ""
+	if endpoint != "" {
+		exporter.url = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	exporter.service = service
+	exporter.onError = onError
+}
+
+// Enabled returns true if spans are recorded
+func Enabled() bool {
+	exporter.Lock()
+	defer exporter.Unlock()
+	return exporter.url != ""
+}
+
+func queueSpan(s *Span) {
+	exporter.Lock()
+	defer exporter.Unlock()
+	if len(exporter.queue) >= maxQueuedSpans {
+		exporter.dropped++
+		return
+	}
+	exporter.queue = append(exporter.queue, s)
+}
+
+// Export posts queued spans every few seconds until ctx is done, then the remaining spans are flushed
+func Export(ctx context.Context) {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			Flush()
+		case <-ctx.Done():
+			Flush()
+			return
+		}
+	}
+}
+
+// Flush posts all queued spans, failed batches are reported and dropped, so the queue never grows unbounded
+func Flush() {
+	exporter.Lock()
+	dropped, onError := exporter.dropped, exporter.onError
+	exporter.dropped = 0
+	exporter.Unlock()
+	if dropped > 0 && onError != nil {
+		onError(fmt.Errorf("%d span(s) dropped, the export queue was full", dropped))
+	}
+	for {
+		exporter.Lock()
+		n := len(exporter.queue)
+		if n > maxBatchSpans {
+			n = maxBatchSpans
+		}
+		batch := exporter.queue[:n]
+		exporter.queue = exporter.queue[n:]
+		url, service, client, onError := exporter.url, exporter.service, exporter.client, exporter.onError
+		exporter.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		if err := post(client, url, service, batch); err != nil && onError != nil {
+			onError(fmt.Errorf("Cannot export %d span(s): %w", len(batch), err))
+		}
+	}
+}
+
+func post(client *http.Client, url, service string, spans []*Span) error {
+	body, err := json.Marshal(encodeSpans(service, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+	return nil
+}
+
+// OTLP JSON encoding of ExportTraceServiceRequest, IDs are hex encoded and 64-bit integers are strings
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1 is OK, 2 is ERROR
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+// otlpSpanKindInternal is the kind of spans of operations within the scheduler
+const otlpSpanKindInternal = 1
+
+func encodeSpans(service string, spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		s.mu.Lock()
+		e := otlpSpan{
+			TraceID:    hex.EncodeToString(s.traceID[:]),
+			SpanID:     hex.EncodeToString(s.spanID[:]),
+			Name:       s.name,
+			Kind:       otlpSpanKindInternal,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: encodeAttributes(s.attrs),
+			Status:     otlpStatus{Code: 1},
+		}
+		if s.parentID != [8]byte{} {
+			e.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.failed {
+			e.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		encoded[i] = e
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: encodeAttributes([]Attribute{String("service.name", service)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "pg_timetable"}, Spans: encoded}},
+	}}}
+}
+
+func encodeAttributes(attrs []Attribute) []otlpAttribute {
+	encoded := make([]otlpAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpValue
+		switch value := a.Value.(type) {
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		encoded = append(encoded, otlpAttribute{Key: a.Key, Value: v})
+	}
+	return encoded
+}
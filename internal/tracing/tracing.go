@@ -0,0 +1,144 @@
+// Package tracing records spans of chain runs and their tasks and exports them with OTLP/HTTP, so runs are seen
+// in OpenTelemetry compatible tracing backends. Tracing is disabled until Enable is called, spans are nil then and
+// all their methods do nothing, so callers never check whether tracing is enabled
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TraceparentEnv is the environment variable carrying the trace context to shell commands, as proposed by
+// OpenTelemetry for environment carriers
+const TraceparentEnv = "TRACEPARENT"
+
+// Attribute is the key and value of span attribute, values are strings, integers or booleans
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns string attribute
+func String(key, value string) Attribute {
+	return Attribute{key, value}
+}
+
+// Int returns integer attribute
+func Int(key string, value int) Attribute {
+	return Attribute{key, int64(value)}
+}
+
+// Bool returns boolean attribute
+func Bool(key string, value bool) Attribute {
+	return Attribute{key, value}
+}
+
+// Span is the traced operation, e.g. chain run or task execution
+type Span struct {
+	mu       sync.Mutex
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    []Attribute
+	err      string // status message of failed span, empty if the span succeeded
+	failed   bool
+	ended    bool
+}
+
+type spanKey struct{}
+
+// StartSpan starts the span as a child of the span carried by ctx, or as a new trace if there is none, and returns
+// the context carrying it. Returns ctx and nil span if tracing is disabled
+func StartSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+	s := &Span{name: name, start: time.Now(), attrs: attrs}
+	if parent := FromContext(ctx); parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext returns the span carried by ctx, nil if there is none
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// RecordError marks the span as failed with the error, the first error recorded is kept
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.failed {
+		s.failed, s.err = true, err.Error()
+	}
+}
+
+// End finishes the span and queues it for export, the span is ended only once
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, time.Now()
+	s.mu.Unlock()
+	queueSpan(s)
+}
+
+// RecordError marks the span carried by ctx as failed with the error
+func RecordError(ctx context.Context, err error) {
+	FromContext(ctx).RecordError(err)
+}
+
+// Traceparent returns the W3C traceparent value of the span carried by ctx, empty if there is none
+func Traceparent(ctx context.Context) string {
+	s := FromContext(ctx)
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+// Inject sets the traceparent header of the HTTP request to the span carried by ctx
+func Inject(ctx context.Context, h http.Header) {
+	if tp := Traceparent(ctx); tp != "" {
+		h.Set("traceparent", tp)
+	}
+}
+
+// Environ returns the environment of shell commands carrying the span of ctx, nil if there is no span
+func Environ(ctx context.Context) []string {
+	if tp := Traceparent(ctx); tp != "" {
+		return []string{TraceparentEnv + "=" + tp}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisabled(t *testing.T) {
+	ctx, span := StartSpan(context.Background(), "chain")
+	assert.Nil(t, span, "No span should be started while tracing is disabled")
+	span.SetAttributes(Int("exit_code", 1))
+	span.RecordError(errors.New("failed"))
+	span.End()
+	assert.Empty(t, Traceparent(ctx))
+	assert.Nil(t, Environ(ctx))
+}
+
+func TestExport(t *testing.T) {
+	var requests []otlpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		var req otlpRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		requests = append(requests, req)
+	}))
+	defer srv.Close()
+	var exportErr error
+	Enable(srv.URL+"/", "scheduler", func(err error) { exportErr = err })
+	defer Enable("", "", nil)
+
+	ctx, chain := StartSpan(context.Background(), "chain nightly", Int("chain_id", 1))
+	taskCtx, task := StartSpan(ctx, "task backup", String("kind", "SHELL"))
+	tp := Traceparent(taskCtx)
+	assert.Regexp(t, regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`), tp)
+	assert.Equal(t, Traceparent(ctx)[:35], tp[:35], "Child span should belong to the trace of its parent")
+	assert.Equal(t, []string{"TRACEPARENT=" + tp}, Environ(taskCtx))
+	h := http.Header{}
+	Inject(taskCtx, h)
+	assert.Equal(t, tp, h.Get("traceparent"))
+
+	task.SetAttributes(Int("exit_code", 2), Bool("ignore_error", false))
+	RecordError(taskCtx, errors.New("exit status 2"))
+	task.RecordError(errors.New("ignored, the first error is kept"))
+	task.End()
+	chain.End()
+	chain.End()
+	Flush()
+	require.NoError(t, exportErr)
+	require.Len(t, requests, 1)
+	rs := requests[0].ResourceSpans[0]
+	assert.Equal(t, "service.name", rs.Resource.Attributes[0].Key)
+	assert.Equal(t, "scheduler", *rs.Resource.Attributes[0].Value.StringValue)
+	spans := rs.ScopeSpans[0].Spans
+	require.Len(t, spans, 2, "Span ended twice should be exported once")
+	assert.Equal(t, "task backup", spans[0].Name)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, otlpStatus{Code: 2, Message: "exit status 2"}, spans[0].Status)
+	assert.Equal(t, "2", *spans[0].Attributes[1].Value.IntValue)
+	assert.False(t, *spans[0].Attributes[2].Value.BoolValue)
+	assert.Empty(t, spans[1].ParentSpanID, "Chain span should be the root")
+	assert.Equal(t, 1, spans[1].Status.Code)
+
+	Flush()
+	assert.Len(t, requests, 1, "Nothing should be posted without spans")
+	srv.Close()
+	_, span := StartSpan(context.Background(), "chain")
+	span.End()
+	Flush()
+	assert.Error(t, exportErr, "Export failure should be reported")
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
+	"time"
 
+	"github.com/cybertec-postgresql/pg_timetable/internal/api"
 	"github.com/cybertec-postgresql/pg_timetable/internal/cmdparser"
 	"github.com/cybertec-postgresql/pg_timetable/internal/pgengine"
 	"github.com/cybertec-postgresql/pg_timetable/internal/scheduler"
+	"github.com/cybertec-postgresql/pg_timetable/internal/secrets"
+	"github.com/cybertec-postgresql/pg_timetable/internal/tasks"
+	"github.com/cybertec-postgresql/pg_timetable/internal/tracing"
 )
 
 /**
@@ -20,13 +28,293 @@ func main() {
 	if cmdparser.Parse() != nil {
 		os.Exit(2)
 	}
-	pgengine.InitAndTestConfigDBConnection()
+	stdout := os.Stdout
+	if pgengine.ListChains || pgengine.RunHistory > 0 || pgengine.CheckConnection || pgengine.TestTask != "" ||
+		len(pgengine.RunChainIDs) > 0 {
+		os.Stdout = os.Stderr // keep stdout for the printed output only
+	}
+	if pgengine.CheckConnection {
+		os.Exit(checkConnection(stdout))
+	}
+	registerSecretBackends()
+	// listing and enabling chains must not create the schema in a database not initialized yet
+	maintenanceMode := !pgengine.InitOnly && (pgengine.ListChains || pgengine.RunHistory > 0 || pgengine.PruneLogs ||
+		pgengine.RunChainID > 0 || len(pgengine.RunChainIDs) > 0 || pgengine.TestTask != "" ||
+		len(pgengine.EnableChains)+len(pgengine.DisableChains) > 0)
+	if maintenanceMode {
+		pgengine.ConnectConfigDB()
+		if err := pgengine.SchemaExists(); err != nil {
+			pgengine.LogToDB("ERROR", "Configuration schema is not initialized, run with --init-only first: ", err)
+			pgengine.FinalizeConfigDBConnection()
+			os.Exit(3)
+		}
+	} else {
+		pgengine.InitAndTestConfigDBConnection()
+	}
+	if pgengine.InitOnly {
+		err := pgengine.InitSchema()
+		pgengine.FinalizeConfigDBConnection()
+		if err != nil {
+			os.Exit(3)
+		}
+		return
+	}
 	if pgengine.Upgrade {
 		pgengine.MigrateDb()
 	} else {
 		pgengine.CheckNeedMigrateDb()
 	}
+	if err := pgengine.CheckConfigDBSchema(); err != nil {
+		pgengine.FinalizeConfigDBConnection()
+		os.Exit(3)
+	}
+	if pgengine.ListChains {
+		err := pgengine.DescribeChains(stdout)
+		pgengine.FinalizeConfigDBConnection()
+		if err != nil {
+			os.Exit(3)
+		}
+		return
+	}
+	if pgengine.RunHistory > 0 {
+		err := pgengine.PrintRunHistory(stdout, pgengine.RunHistory, pgengine.HistorySince, pgengine.HistoryJSON)
+		pgengine.FinalizeConfigDBConnection()
+		if err != nil {
+			os.Exit(3)
+		}
+		return
+	}
+	if pgengine.DryRun {
+		pgengine.LogToDB("LOG", "Dry run mode, SQL tasks are rolled back at the end of every chain, shell and other built-in tasks take effect as usual")
+	}
+	startTracing()
+	if pgengine.RunChainID > 0 {
+		os.Exit(runChainOnce())
+	}
+	if len(pgengine.RunChainIDs) > 0 {
+		os.Exit(runChains(stdout))
+	}
+	if pgengine.TestTask != "" {
+		os.Exit(tryTask(stdout))
+	}
+	if pgengine.PruneLogs {
+		err := pgengine.PruneOldLogs(context.Background())
+		pgengine.FinalizeConfigDBConnection()
+		if err != nil {
+			os.Exit(3)
+		}
+		return
+	}
+	if len(pgengine.EnableChains)+len(pgengine.DisableChains) > 0 {
+		err := setChainsEnabled()
+		pgengine.FinalizeConfigDBConnection()
+		if err != nil {
+			os.Exit(3)
+		}
+		return
+	}
+	if pgengine.VerifyChainTasks(tasks.Names()) != nil {
+		os.Exit(3)
+	}
+	if pgengine.VerifyChainSchedules() != nil {
+		os.Exit(3)
+	}
+	if err := pgengine.AcquireInstanceLock(pgengine.ShutdownContext()); err != nil {
+		pgengine.LogToDB("PANIC", "Refusing to start: ", err)
+		pgengine.FinalizeConfigDBConnection()
+		os.Exit(3)
+	}
+	// the instance lock excludes sessions with the same client name, heartbeats are checked only without it
+	if pgengine.InstanceLock == "off" {
+		if err := pgengine.CheckClientNameUnique(); err != nil {
+			pgengine.LogToDB("PANIC", "Refusing to start: ", err)
+			pgengine.FinalizeConfigDBConnection()
+			os.Exit(3)
+		}
+	}
+	defer pgengine.FinalizeConfigDBConnection()
+	pgengine.StartLogBuffer()
+	pgengine.SetupCloseHandler(scheduler.Drain)
+	pgengine.SetupReloadHandler(cmdparser.Reload)
+	if pgengine.HTTPListen != "" {
+		srv := &api.Server{
+			ClientName:   pgengine.ClientName,
+			OnlyTags:     pgengine.OnlyTags,
+			ExcludeTags:  pgengine.ExcludeTags,
+			StartedAt:    scheduler.StartedAt(),
+			LastTick:     scheduler.LastTick,
+			LastRefresh:  scheduler.LastRefresh,
+			RunningTasks: scheduler.RunningTasks,
+			StartedRuns:  scheduler.StartedRuns,
+			SkippedRuns:  scheduler.SkippedRuns,
+			LoopRestarts: scheduler.LoopRestarts,
+			NextRunTimes: pgengine.NextRunTimes,
+			DroppedLogs:  pgengine.DroppedLogEntries,
+			MaxTickAge:   scheduler.MaxTickAge,
+			SchemaExists: pgengine.SchemaExists,
+			RunChain:     scheduler.RunChain,
+			PauseChain:   scheduler.SetChainPaused,
+			CancelRun:    scheduler.CancelRun,
+			Paused:       scheduler.Paused,
+			SetPaused:    scheduler.SetPaused,
+			ChainStates:  pgengine.GetChainStates,
+			ActiveRuns:   scheduler.RunningChains,
+			RunHistory:   pgengine.GetRunHistory,
+			Token:        pgengine.APIToken,
+			ReadToken:    pgengine.APIReadToken,
+		}
+		done := pgengine.AddShutdownWaiter()
+		go func() {
+			defer done()
+			if err := srv.ListenAndServe(pgengine.ShutdownContext(), pgengine.HTTPListen); err != nil {
+				pgengine.LogToDB("ERROR", "Cannot serve health checks: ", err)
+			}
+		}()
+	}
+	if scheduler.Run() != nil {
+		pgengine.FinalizeConfigDBConnection()
+		os.Exit(1)
+	}
+}
+
+// checkConnection prints diagnostics of the configuration database and returns the exit code: 0 if the setup is
+// healthy, 2 if the database cannot be connected and 3 if the configuration schema is missing, outdated or incomplete
+func checkConnection(w io.Writer) int {
+	d := pgengine.DiagnoseConfigDB()
+	if err := pgengine.WriteDiagnostics(w, d, pgengine.CheckJSON); err != nil {
+		fmt.Printf(pgengine.GetLogPrefixLn("ERROR"), err)
+	}
+	switch {
+	case !d.Connected:
+		return 2
+	case !d.Healthy():
+		return 3
+	}
+	return 0
+}
+
+// setChainsEnabled enables and disables chain configurations specified in command line within one transaction
+func setChainsEnabled() error {
+	var err error
+	tx := pgengine.StartTransaction()
+	for _, id := range pgengine.EnableChains {
+		if err = pgengine.SetChainEnabled(tx, id, true); err != nil {
+			break
+		}
+	}
+	for _, id := range pgengine.DisableChains {
+		if err != nil {
+			break
+		}
+		err = pgengine.SetChainEnabled(tx, id, false)
+	}
+	if err != nil {
+		pgengine.LogToDB("ERROR", err)
+		pgengine.MustRollbackTransaction(tx)
+		return err
+	}
+	pgengine.MustCommitTransaction(tx)
+	return nil
+}
+
+// runChainOnce executes the chain configuration specified in command line and returns the exit code:
+// 0 if the chain succeeded or was skipped as empty, 1 if it failed or timed out and 3 if it cannot be started
+func runChainOnce() int {
+	defer pgengine.FinalizeConfigDBConnection()
+	defer tracing.Flush()
+	status, err := scheduler.RunChainOnce(pgengine.RunChainID)
+	if err != nil {
+		pgengine.LogToDB("ERROR", "Cannot run chain configuration ID: ", pgengine.RunChainID, ": ", err)
+		return 3
+	}
+	pgengine.LogToDB("LOG", fmt.Sprintf("Chain configuration ID: %d finished with status %s", pgengine.RunChainID, status))
+	if status != "CHAIN_DONE" && status != "CHAIN_SKIPPED" {
+		return 1
+	}
+	return 0
+}
+
+// runChains executes the chain configurations specified in command line, prints their outcomes and returns the
+// exit code: 0 if all chains succeeded or were skipped as empty, 1 if any failed, timed out or was cancelled by
+// run-chains-timeout and 3 if any cannot be started
+func runChains(stdout io.Writer) int {
+	defer pgengine.FinalizeConfigDBConnection()
+	defer tracing.Flush()
+	results := scheduler.RunChains(pgengine.RunChainIDs, time.Duration(pgengine.RunChainsTimeout)*time.Second)
+	if err := scheduler.WriteChainResults(stdout, results); err != nil {
+		pgengine.LogToDB("ERROR", "Cannot print outcomes of chains: ", err)
+	}
+	code := 0
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			code = 3
+		case !r.Succeeded() && code == 0:
+			code = 1
+		}
+	}
+	return code
+}
+
+// tryTask executes the base task specified in command line and returns the exit code: 0 if the task succeeded, the
+// exit code of the shell command or 1 if the task failed, and 3 if it cannot be executed
+func tryTask(stdout io.Writer) int {
 	defer pgengine.FinalizeConfigDBConnection()
-	pgengine.SetupCloseHandler()
-	scheduler.Run()
+	code, ready, err := scheduler.TryTask(context.Background(), pgengine.TestTask, pgengine.TestParams, stdout, os.Stderr)
+	if !ready {
+		pgengine.LogToDB("ERROR", "Cannot try task ", pgengine.TestTask, ": ", err)
+		return 3
+	}
+	if err != nil {
+		pgengine.LogToDB("ERROR", "Task ", pgengine.TestTask, " failed: ", err)
+	}
+	fmt.Fprintf(os.Stderr, "Exit code: %d\n", code)
+	switch {
+	case code > 0 && code < 256:
+		return code
+	case err != nil || code != 0:
+		return 1
+	}
+	return 0
+}
+
+// registerSecretBackends adds resolvers of the configured external secret managers after the environment and
+// secret files, resolved values are cached for the secrets cache TTL
+func registerSecretBackends() {
+	ttl := time.Duration(pgengine.SecretsCacheTTL) * time.Second
+	if pgengine.VaultAddr != "" {
+		pgengine.RegisterSecretResolver(secrets.Cached(&secrets.Vault{
+			Addr:  pgengine.VaultAddr,
+			Token: pgengine.VaultToken,
+			Path:  pgengine.VaultPath,
+		}, ttl))
+		pgengine.LogToDB("LOG", "Resolving secrets from Vault ", pgengine.VaultAddr)
+	}
+	if pgengine.AWSSecretsRegion != "" {
+		pgengine.RegisterSecretResolver(secrets.Cached(&secrets.AWSSecretsManager{
+			Region:          pgengine.AWSSecretsRegion,
+			Prefix:          pgengine.AWSSecretsPrefix,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, ttl))
+		pgengine.LogToDB("LOG", "Resolving secrets from AWS Secrets Manager in ", pgengine.AWSSecretsRegion)
+	}
+}
+
+// startTracing enables export of spans of chain runs if the OTLP endpoint is configured, queued spans are flushed
+// on shutdown
+func startTracing() {
+	if pgengine.OTLPEndpoint == "" {
+		return
+	}
+	tracing.Enable(pgengine.OTLPEndpoint, pgengine.OTLPService, func(err error) {
+		pgengine.LogToDB("ERROR", "Tracing: ", err)
+	})
+	done := pgengine.AddShutdownWaiter()
+	go func() {
+		defer done()
+		tracing.Export(pgengine.ShutdownContext())
+	}()
+	pgengine.LogToDB("LOG", "Exporting traces to ", pgengine.OTLPEndpoint)
 }
@@ -0,0 +1,35 @@
+-- An example for CopyFromFile task.
+DO $$
+DECLARE
+	v_head_id bigint;
+	v_chain_config_id bigint;
+BEGIN
+	-- Prepare the destination table 'location_import'
+	CREATE TABLE IF NOT EXISTS location_import(id integer, name text);
+
+	-- Create the chain
+	INSERT INTO timetable.task_chain (task_id)
+	    VALUES (timetable.get_task_id ('CopyFromFile'))
+	RETURNING
+	    chain_id INTO v_head_id;
+
+	-- Create the chain execution configuration with default values executed every minute
+	INSERT INTO timetable.chain_execution_config 
+		(chain_id, chain_name, live)
+	VALUES 
+		(v_head_id, 'Import locations from file', TRUE)
+	RETURNING
+	    chain_execution_config INTO v_chain_config_id;
+
+	-- Create the parameters for the CopyFromFile task
+	INSERT INTO timetable.chain_execution_parameters (chain_execution_config, chain_id, order_id, value)
+		VALUES (v_chain_config_id, v_head_id, 1, '
+				{
+					"table": "location_import", 
+					"columns": ["id", "name"], 
+					"delimiter": ";",
+					"filepath": "orte.csv"
+				}'::jsonb);
+END;
+$$
+LANGUAGE 'plpgsql';